@@ -183,11 +183,62 @@ func main() {
 	s := proxy.New(addr, httpAddr, conf)
 	defer s.Close()
 
+	http.HandleFunc("/setreplicamaxlag", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		n, err := strconv.Atoi(r.Form.Get("seconds"))
+		if err != nil || n < 0 {
+			http.Error(w, "invalid seconds", http.StatusBadRequest)
+			return
+		}
+		s.SetReplicaMaxLag(time.Second * time.Duration(n))
+	})
+
+	http.HandleFunc("/setbackendtimeout", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		read, err1 := strconv.Atoi(r.Form.Get("read"))
+		write, err2 := strconv.Atoi(r.Form.Get("write"))
+		if err1 != nil || err2 != nil || read < 0 || write < 0 {
+			http.Error(w, "invalid read or write seconds", http.StatusBadRequest)
+			return
+		}
+		s.SetBackendTimeout(time.Second*time.Duration(read), time.Second*time.Duration(write))
+	})
+
+	http.HandleFunc("/recyclepool", func(w http.ResponseWriter, r *http.Request) {
+		go s.RecyclePool()
+	})
+
+	http.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		n, err := strconv.Atoi(r.Form.Get("wait_ms"))
+		if err != nil || n < 0 {
+			http.Error(w, "invalid wait_ms", http.StatusBadRequest)
+			return
+		}
+		s.Pause(time.Millisecond * time.Duration(n))
+	})
+
+	http.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		s.Resume()
+	})
+
 	stats.PublishJSONFunc("router", func() string {
 		var m = make(map[string]interface{})
 		m["ops"] = router.OpCounts()
 		m["cmds"] = router.GetAllOpStats()
 		m["info"] = s.Info()
+		m["replica_lags"] = s.ReplicaLags()
+		m["backend_rtts"] = s.BackendRTTs()
+		m["backend_oom_replies"] = s.BackendOOMCounts()
+		m["slot_heatmap"] = s.SlotHeatmap()
+		m["client_waits"] = router.ClientWaits()
+		m["client_throttles"] = router.ClientThrottles()
+		m["client_affinity_conns"] = router.ClientAffinityConns()
+		total, backends := s.InFlight()
+		m["inflight"] = map[string]interface{}{
+			"total":    total,
+			"backends": backends,
+		}
 		m["build"] = map[string]interface{}{
 			"version": utils.Version,
 			"compile": utils.Compile,
@@ -198,8 +249,10 @@ func main() {
 
 	go func() {
 		<-c
-		log.Info("ctrl-c or SIGTERM found, bye bye...")
-		s.Close()
+		log.Info("ctrl-c or SIGTERM found, draining, bye bye...")
+		if err := s.CloseGracefully(); err != nil {
+			log.WarnError(err, "close gracefully failed")
+		}
 	}()
 
 	time.Sleep(time.Second)
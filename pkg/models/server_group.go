@@ -26,6 +26,7 @@ type Server struct {
 	Type    string `json:"type"`
 	GroupId int    `json:"group_id"`
 	Addr    string `json:"addr"`
+	Zone    string `json:"zone,omitempty"`
 }
 
 // redis server group
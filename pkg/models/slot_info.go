@@ -0,0 +1,21 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package models
+
+// SlotInfo describes how a slot is routed by a proxy, it's a runtime view
+// of the proxy and is not stored in zk.
+type SlotInfo struct {
+	Id           int    `json:"id"`
+	BackendAddr  string `json:"backend_addr"`
+	BackendDB    int    `json:"backend_db,omitempty"`
+	BackendLabel string `json:"backend_label,omitempty"`
+	MigrateFrom  string `json:"migrate_from,omitempty"`
+	ReplicaAddr  string `json:"replica_addr,omitempty"`
+	Locked       bool   `json:"locked,omitempty"`
+	ReadOnly     bool   `json:"readonly,omitempty"`
+	Gated        bool   `json:"gated,omitempty"`
+
+	LastError     string `json:"last_error,omitempty"`
+	LastErrorTime int64  `json:"last_error_time,omitempty"` // microseconds
+}
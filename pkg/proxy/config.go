@@ -4,6 +4,7 @@
 package proxy
 
 import (
+	"strconv"
 	"strings"
 
 	"github.com/c4pt0r/cfg"
@@ -15,6 +16,8 @@ type Config struct {
 	productName   string
 	zkAddr        string
 	passwd        string
+	adminPasswd   string
+	adminTokenTTL int // seconds
 	fact          ZkFactory
 	proto         string //tcp or tcp4
 	provider      string
@@ -22,9 +25,92 @@ type Config struct {
 
 	pingPeriod       int // seconds
 	maxTimeout       int // seconds
+	readTimeout      int // seconds
+	writeTimeout     int // seconds
+	backendPoolSize  int
+	backendNoDelay   bool
+	backendLinger    int // seconds
+	backendQueue     string
+	flushDelay       int // microseconds
+	recyclePace      int // milliseconds
+	maxDials         int
+	dialJitter       int // milliseconds
+	reapInterval     int // seconds
+	idleTimeout      int // seconds
+	lagInterval      int // seconds
+	dnsInterval      int // seconds
+	migrateInterval  int // seconds
+	maxLag           int // seconds
+	balanceInterval  int // seconds
+	balanceMax       int // percent
 	maxBufSize       int
+	readBufSize      int
 	maxPipeline      int
+	outputHardLimit  int
+	outputSoftLimit  int
+	outputSoftTime   int // seconds
+	replyBudget      int
+	maxRequestArgs   int
+	maxRequestBulk   int
+	connRateLimit    int
+	connRateWindow   int // milliseconds
+	clientRateLimit  int
+	clientRateBurst  int
+	clientRateWait   int // milliseconds
 	zkSessionTimeout int
+	drainTimeout     int // seconds
+
+	slowlogSlowerThan int // microseconds
+
+	backpressureHighWater int
+	backpressureLowWater  int
+
+	loadingRetryTimes int
+	loadingRetryDelay int // milliseconds
+
+	oomShedWindow int // milliseconds
+
+	durableCheck []string
+	durableOps   []string
+
+	hedgeDelay  int // milliseconds
+	hedgeOps    []string
+	hedgeWindow int // milliseconds
+
+	keyPrefix string
+	zone      string
+	fallback  string
+
+	unavailablePolicy  string
+	unavailableTimeout int // milliseconds
+
+	unknownPolicy  string
+	unknownBackend string
+
+	cmdTimeout  int            // milliseconds
+	cmdTimeouts map[string]int // milliseconds
+
+	routeKeyArgs map[string][]int
+
+	backendTLS           bool
+	backendTLSCA         string
+	backendTLSSkipVerify bool
+	backendTLSStrict     bool
+	backendTLSMinVersion string
+
+	backendCompression    []string
+	backendCompressionMin int
+
+	verboseErrors  bool
+	replyIntegrity bool
+	readCoalescing bool
+	clientAffinity bool
+
+	affinityMaxConns int
+	affinityWait     int // milliseconds
+
+	negCacheSize int
+	negCacheTTL  int // milliseconds
 }
 
 func LoadConf(configFile string) (*Config, error) {
@@ -48,6 +134,12 @@ func LoadConf(configFile string) (*Config, error) {
 	}
 	conf.zkAddr = strings.TrimSpace(conf.zkAddr)
 	conf.passwd, _ = c.ReadString("password", "")
+	conf.adminPasswd, _ = c.ReadString("admin_password", "")
+	conf.adminTokenTTL = loadConfInt("admin_token_ttl", 0)
+
+	conf.keyPrefix, _ = c.ReadString("key_prefix", "")
+	conf.zone, _ = c.ReadString("zone", "")
+	conf.fallback, _ = c.ReadString("fallback_backend", "")
 
 	conf.proxyId, _ = c.ReadString("proxy_id", "")
 	if len(conf.proxyId) == 0 {
@@ -67,8 +159,118 @@ func LoadConf(configFile string) (*Config, error) {
 
 	conf.pingPeriod = loadConfInt("backend_ping_period", 5)
 	conf.maxTimeout = loadConfInt("session_max_timeout", 1800)
+	conf.readTimeout = loadConfInt("backend_read_timeout", 60)
+	conf.writeTimeout = loadConfInt("backend_write_timeout", 60)
+	conf.backendPoolSize = loadConfInt("backend_pool_size", 1)
+	conf.recyclePace = loadConfInt("backend_recycle_pace", 1000)
+	nodelay, _ := c.ReadString("backend_tcp_nodelay", "true")
+	conf.backendNoDelay = nodelay != "false"
+	conf.backendLinger, _ = c.ReadInt("backend_linger", -1)
+	conf.backendQueue, _ = c.ReadString("backend_queue", "fifo")
+	if conf.backendQueue != "fifo" && conf.backendQueue != "fair" {
+		log.Panicf("invalid config: backend_queue = %s", conf.backendQueue)
+	}
+	conf.flushDelay = loadConfInt("backend_flush_delay", 0)
+	conf.maxDials = loadConfInt("backend_max_dials", 0)
+	conf.dialJitter = loadConfInt("backend_dial_jitter", 0)
+	conf.reapInterval = loadConfInt("backend_reap_interval", 0)
+	conf.idleTimeout = loadConfInt("backend_idle_timeout", 300)
+	conf.lagInterval = loadConfInt("replica_lag_check_interval", 0)
+	conf.dnsInterval = loadConfInt("backend_dns_check_interval", 0)
+	conf.migrateInterval = loadConfInt("migration_progress_interval", 0)
+	conf.maxLag = loadConfInt("replica_max_lag", 0)
+	conf.balanceInterval = loadConfInt("slot_balance_check_interval", 0)
+	conf.balanceMax = loadConfInt("slot_balance_max_percent", 50)
 	conf.maxBufSize = loadConfInt("session_max_bufsize", 131072)
+	conf.readBufSize = loadConfInt("session_read_bufsize", 0)
 	conf.maxPipeline = loadConfInt("session_max_pipeline", 1024)
+	conf.outputHardLimit = loadConfInt("session_output_hard_limit", 0)
+	conf.outputSoftLimit = loadConfInt("session_output_soft_limit", 0)
+	conf.outputSoftTime = loadConfInt("session_output_soft_seconds", 60)
+	conf.replyBudget = loadConfInt("proxy_reply_buffer_budget", 1024*1024*1024)
+	conf.maxRequestArgs = loadConfInt("session_max_request_args", 1024*1024)
+	conf.maxRequestBulk = loadConfInt("session_max_request_arg_bytes", 512*1024*1024)
+	conf.connRateLimit = loadConfInt("conn_rate_limit", 0)
+	conf.connRateWindow = loadConfInt("conn_rate_window", 1000)
+	conf.clientRateLimit = loadConfInt("client_rate_limit", 0)
+	conf.clientRateBurst = loadConfInt("client_rate_burst", 100)
+	conf.clientRateWait = loadConfInt("client_rate_wait", 0)
 	conf.zkSessionTimeout = loadConfInt("zk_session_timeout", 30)
+	conf.drainTimeout = loadConfInt("drain_timeout", 10)
+	conf.slowlogSlowerThan = loadConfInt("slowlog_log_slower_than", 0)
+	conf.backpressureHighWater = loadConfInt("backpressure_high_water", 0)
+	conf.backpressureLowWater = loadConfInt("backpressure_low_water", 0)
+	conf.loadingRetryTimes = loadConfInt("loading_retry_times", 0)
+	conf.loadingRetryDelay = loadConfInt("loading_retry_delay", 100)
+	conf.oomShedWindow = loadConfInt("oom_shed_window", 0)
+
+	durableCheck, _ := c.ReadString("durable_check_cmd", "")
+	conf.durableCheck = strings.Fields(durableCheck)
+	durableOps, _ := c.ReadString("durable_check_ops", "")
+	conf.durableOps = strings.Fields(strings.ToUpper(strings.Replace(durableOps, ",", " ", -1)))
+
+	conf.unavailablePolicy, _ = c.ReadString("unavailable_policy", "forward")
+	conf.unavailableTimeout = loadConfInt("unavailable_wait_timeout", 1000)
+	conf.unknownPolicy, _ = c.ReadString("unknown_command_policy", "guess")
+	conf.unknownBackend, _ = c.ReadString("unknown_command_backend", "")
+
+	conf.cmdTimeout = loadConfInt("command_timeout", 0)
+	conf.cmdTimeouts = make(map[string]int)
+	cmdTimeouts, _ := c.ReadString("command_timeouts", "")
+	for _, x := range strings.Fields(strings.Replace(cmdTimeouts, ",", " ", -1)) {
+		kv := strings.SplitN(x, ":", 2)
+		if len(kv) != 2 {
+			log.Panicf("invalid config: command_timeouts = %s", cmdTimeouts)
+		}
+		v, err := strconv.Atoi(kv[1])
+		if err != nil || v < 0 {
+			log.Panicf("invalid config: command_timeouts = %s", cmdTimeouts)
+		}
+		conf.cmdTimeouts[strings.ToUpper(kv[0])] = v
+	}
+
+	conf.routeKeyArgs = make(map[string][]int)
+	routeKeyArgs, _ := c.ReadString("route_key_args", "")
+	for _, x := range strings.Fields(strings.Replace(routeKeyArgs, ",", " ", -1)) {
+		kv := strings.SplitN(x, ":", 2)
+		if len(kv) != 2 {
+			log.Panicf("invalid config: route_key_args = %s", routeKeyArgs)
+		}
+		var indexes []int
+		for _, v := range strings.Split(kv[1], "+") {
+			i, err := strconv.Atoi(v)
+			if err != nil || i <= 0 {
+				log.Panicf("invalid config: route_key_args = %s", routeKeyArgs)
+			}
+			indexes = append(indexes, i)
+		}
+		conf.routeKeyArgs[strings.ToUpper(kv[0])] = indexes
+	}
+
+	conf.hedgeDelay = loadConfInt("hedge_delay", 0)
+	conf.hedgeWindow = loadConfInt("hedge_read_your_writes", 0)
+	hedgeOps, _ := c.ReadString("hedge_ops", "")
+	conf.hedgeOps = strings.Fields(strings.ToUpper(strings.Replace(hedgeOps, ",", " ", -1)))
+
+	loadConfBool := func(key string) bool {
+		v, _ := c.ReadString(key, "false")
+		return v == "true"
+	}
+	conf.backendTLS = loadConfBool("backend_tls")
+	conf.backendTLSCA, _ = c.ReadString("backend_tls_ca", "")
+	conf.backendTLSSkipVerify = loadConfBool("backend_tls_skip_verify")
+	conf.backendTLSStrict = loadConfBool("backend_tls_strict")
+	conf.backendTLSMinVersion, _ = c.ReadString("backend_tls_min_version", "1.2")
+	backendCompression, _ := c.ReadString("backend_compression", "")
+	conf.backendCompression = strings.Fields(strings.Replace(backendCompression, ",", " ", -1))
+	conf.backendCompressionMin = loadConfInt("backend_compression_threshold", 1024)
+	conf.verboseErrors = loadConfBool("verbose_errors")
+	conf.replyIntegrity = loadConfBool("backend_reply_integrity")
+	conf.readCoalescing = loadConfBool("read_coalescing")
+	conf.clientAffinity = loadConfBool("backend_client_affinity")
+	conf.affinityMaxConns = loadConfInt("backend_client_affinity_max_conns", 0)
+	conf.affinityWait = loadConfInt("backend_client_affinity_wait", 0)
+	conf.negCacheSize = loadConfInt("negative_cache_size", 0)
+	conf.negCacheTTL = loadConfInt("negative_cache_ttl", 100)
 	return conf, nil
 }
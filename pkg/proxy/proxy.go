@@ -5,8 +5,11 @@ package proxy
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -75,6 +78,59 @@ func New(addr string, debugVarAddr string, conf *Config) *Server {
 		s.listener = l
 	}
 	s.router = router.NewWithAuth(conf.passwd)
+	s.router.SetAdminAuth(conf.adminPasswd)
+	s.router.SetAdminTokenTTL(time.Second * time.Duration(conf.adminTokenTTL))
+	s.router.SetBackendTimeout(time.Second*time.Duration(conf.readTimeout), time.Second*time.Duration(conf.writeTimeout))
+	s.router.SetBackendPoolSize(conf.backendPoolSize)
+	s.router.SetBackendSockOpts(conf.backendNoDelay, time.Second*time.Duration(conf.backendLinger))
+	router.SetFairQueuing(conf.backendQueue == "fair")
+	s.router.SetBackendFlushDelay(time.Microsecond * time.Duration(conf.flushDelay))
+	s.router.SetBackpressure(int64(conf.backpressureHighWater), int64(conf.backpressureLowWater))
+	s.router.SetDurableCheck(conf.durableCheck, conf.durableOps)
+	s.router.SetKeyPrefix(conf.keyPrefix)
+	s.router.SetZone(conf.zone)
+	s.router.SetFallbackBackend(conf.fallback)
+	s.router.SetReadCoalescing(conf.readCoalescing)
+	s.router.SetClientAffinity(conf.clientAffinity)
+	router.SetClientAffinityLimit(conf.affinityMaxConns, time.Millisecond*time.Duration(conf.affinityWait))
+	if policy, err := router.ParseUnavailablePolicy(conf.unavailablePolicy); err != nil {
+		log.PanicErrorf(err, "invalid config: unavailable_policy = %s", conf.unavailablePolicy)
+	} else {
+		s.router.SetUnavailablePolicy(policy, time.Millisecond*time.Duration(conf.unavailableTimeout))
+	}
+	if policy, err := router.ParseUnknownCommandPolicy(conf.unknownPolicy); err != nil {
+		log.PanicErrorf(err, "invalid config: unknown_command_policy = %s", conf.unknownPolicy)
+	} else if err := s.router.SetUnknownCommandPolicy(policy, conf.unknownBackend); err != nil {
+		log.PanicErrorf(err, "invalid config: unknown_command_backend = %s", conf.unknownBackend)
+	}
+	cmdTimeouts := make(map[string]time.Duration)
+	for opstr, v := range conf.cmdTimeouts {
+		cmdTimeouts[opstr] = time.Millisecond * time.Duration(v)
+	}
+	s.router.SetCommandTimeouts(time.Millisecond*time.Duration(conf.cmdTimeout), cmdTimeouts)
+	for opstr, indexes := range conf.routeKeyArgs {
+		s.router.SetRouteKey(opstr, router.RouteKeyArgs(indexes...))
+	}
+	s.router.SetNegativeCache(conf.negCacheSize, time.Millisecond*time.Duration(conf.negCacheTTL))
+	s.router.SetReplicaMaxLag(time.Second * time.Duration(conf.maxLag))
+	s.router.SetHedging(time.Millisecond*time.Duration(conf.hedgeDelay), conf.hedgeOps)
+	s.router.SetHedgingReadYourWrites(time.Millisecond * time.Duration(conf.hedgeWindow))
+	router.SetSlowLogThreshold(int64(conf.slowlogSlowerThan))
+	router.SetDialLimit(conf.maxDials, time.Millisecond*time.Duration(conf.dialJitter))
+	router.SetClientOutputBufferLimit(int64(conf.outputHardLimit), int64(conf.outputSoftLimit), conf.outputSoftTime)
+	router.SetReplyBufferBudget(int64(conf.replyBudget))
+	router.SetRequestLimits(int64(conf.maxRequestArgs), int64(conf.maxRequestBulk))
+	router.SetSessionReadBuffer(conf.readBufSize)
+	router.SetConnRateLimit(conf.connRateLimit, time.Millisecond*time.Duration(conf.connRateWindow))
+	router.SetClientRateLimit(conf.clientRateLimit, conf.clientRateBurst, time.Millisecond*time.Duration(conf.clientRateWait))
+	if conf.backendTLS {
+		router.SetBackendTLS(loadBackendTLS(conf))
+	}
+	router.SetBackendCompression(conf.backendCompression, conf.backendCompressionMin)
+	router.SetVerboseErrors(conf.verboseErrors)
+	router.SetReplyIntegrity(conf.replyIntegrity)
+	router.SetLoadingRetry(conf.loadingRetryTimes, time.Millisecond*time.Duration(conf.loadingRetryDelay))
+	router.SetOOMShedding(time.Millisecond * time.Duration(conf.oomShedWindow))
 	s.evtbus = make(chan interface{}, 1024)
 
 	s.register()
@@ -141,6 +197,10 @@ func (s *Server) handleConns() {
 		c, err := s.listener.Accept()
 		if err != nil {
 			return
+		} else if s.router.Draining() {
+			c.Close()
+		} else if err := router.AcceptConn(); err != nil {
+			go router.RejectConn(c, err)
 		} else {
 			ch <- c
 		}
@@ -151,6 +211,83 @@ func (s *Server) Info() models.ProxyInfo {
 	return s.info
 }
 
+// InFlight returns the number of requests not answered yet, in total and
+// by backend.
+func (s *Server) InFlight() (int64, map[string]int64) {
+	return s.router.InFlight(), s.router.BackendInFlight()
+}
+
+// SetReplicaMaxLag changes the max lag of replicas at runtime, see
+// replica_max_lag.
+func (s *Server) SetReplicaMaxLag(max time.Duration) {
+	s.router.SetReplicaMaxLag(max)
+}
+
+// SetBackendTimeout changes the read and write deadlines of backend conns
+// at runtime, the conns are recycled at backend_recycle_pace to apply it.
+func (s *Server) SetBackendTimeout(read, write time.Duration) {
+	s.router.SetBackendTimeout(read, write)
+	go s.RecyclePool()
+}
+
+// RecyclePool replaces the backend conns one backend at a time, with
+// backend_recycle_pace in between, see router.RecyclePool.
+func (s *Server) RecyclePool() {
+	if err := s.router.RecyclePool(time.Millisecond * time.Duration(s.conf.recyclePace)); err != nil {
+		log.WarnErrorf(err, "recycle backend conns failed")
+	}
+}
+
+// SetBackendSelector sets the per-request backend selection hook, for
+// embedders of the proxy, see router.SetBackendSelector.
+func (s *Server) SetBackendSelector(fn router.BackendSelector) {
+	s.router.SetBackendSelector(fn)
+}
+
+// Pause holds the requests of the clients for up to wait, until Resume, see
+// router.Pause.
+func (s *Server) Pause(wait time.Duration) {
+	s.router.Pause(wait)
+}
+
+func (s *Server) Resume() {
+	s.router.Resume()
+}
+
+// SetBackendHealth marks the backend unhealthy, or healthy again, for
+// embedders with a health check of their own, see router.SetBackendHealth.
+func (s *Server) SetBackendHealth(addr string, healthy bool) {
+	s.router.SetBackendHealth(addr, healthy)
+}
+
+// BackendRTTs returns the round trip time percentiles of each backend, see
+// router.BackendRTT.
+func (s *Server) BackendRTTs() map[string]*router.BackendRTT {
+	return s.router.BackendRTTs()
+}
+
+// BackendOOMCounts returns the number of OOM replies of each backend.
+func (s *Server) BackendOOMCounts() map[string]int64 {
+	return s.router.BackendOOMCounts()
+}
+
+// SlotHeatmap returns the recent requests per second of each slot, see
+// router.SlotHeatmap.
+func (s *Server) SlotHeatmap() []uint32 {
+	return s.router.SlotHeatmap()
+}
+
+// WatchMigrations returns the stream of the events of the slot migrations,
+// see router.WatchMigrations.
+func (s *Server) WatchMigrations() (<-chan *router.MigrationEvent, func()) {
+	return s.router.WatchMigrations()
+}
+
+// ReplicaLags returns the last known lag of each replica, in seconds.
+func (s *Server) ReplicaLags() map[string]int64 {
+	return s.router.ReplicaLags()
+}
+
 func (s *Server) Join() {
 	s.wait.Wait()
 }
@@ -161,6 +298,14 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// CloseGracefully refuses new client conns and waits up to drain_timeout for
+// the in-flight requests to be answered before closing the server.
+func (s *Server) CloseGracefully() error {
+	err := s.router.CloseGracefully(time.Second * time.Duration(s.conf.drainTimeout))
+	s.Close()
+	return err
+}
+
 func (s *Server) close() {
 	s.stop.Do(func() {
 		s.listener.Close()
@@ -270,6 +415,16 @@ func groupMaster(groupInfo models.ServerGroup) string {
 	return master
 }
 
+func groupSlaves(groupInfo models.ServerGroup) []router.Replica {
+	var replicas []router.Replica
+	for _, server := range groupInfo.Servers {
+		if server.Type == models.SERVER_TYPE_SLAVE {
+			replicas = append(replicas, router.Replica{Addr: server.Addr, Zone: server.Zone})
+		}
+	}
+	return replicas
+}
+
 func (s *Server) resetSlot(i int) {
 	s.router.ResetSlot(i)
 }
@@ -296,6 +451,7 @@ func (s *Server) fillSlot(i int) {
 	s.groups[i] = slotInfo.GroupId
 	s.router.FillSlot(i, addr, from,
 		slotInfo.State.Status == models.SLOT_STATUS_PRE_MIGRATE)
+	s.router.SetSlotReplicas(i, groupSlaves(*slotGroup))
 }
 
 func (s *Server) onSlotRangeChange(param *models.SlotMultiSetParam) {
@@ -436,7 +592,7 @@ func (s *Server) loopEvents() {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
-	var tick int = 0
+	var tick, reap, lag, balance, dns, migration int = 0, 0, 0, 0, 0, 0
 	for s.info.State == models.PROXY_STATE_ONLINE {
 		select {
 		case <-s.kill:
@@ -464,6 +620,58 @@ func (s *Server) loopEvents() {
 					tick = 0
 				}
 			}
+			if maxTick := s.conf.reapInterval; maxTick != 0 {
+				if reap++; reap >= maxTick {
+					s.router.ReapIdle(time.Second * time.Duration(s.conf.idleTimeout))
+					reap = 0
+				}
+			}
+			if maxTick := s.conf.lagInterval; maxTick != 0 {
+				if lag++; lag >= maxTick {
+					go s.router.CheckReplicaLag(router.InfoBackendTimeout)
+					lag = 0
+				}
+			}
+			if maxTick := s.conf.dnsInterval; maxTick != 0 {
+				if dns++; dns >= maxTick {
+					go s.router.CheckBackendDNS()
+					dns = 0
+				}
+			}
+			if maxTick := s.conf.migrateInterval; maxTick != 0 {
+				if migration++; migration >= maxTick {
+					s.router.ReportMigrations()
+					migration = 0
+				}
+			}
+			if maxTick := s.conf.balanceInterval; maxTick != 0 {
+				if balance++; balance >= maxTick {
+					s.router.CheckSlotBalance(float64(s.conf.balanceMax) / 100)
+					balance = 0
+				}
+			}
+		}
+	}
+}
+
+func loadBackendTLS(conf *Config) (*tls.Config, bool, uint16) {
+	minVersion, err := router.ParseTLSVersion(conf.backendTLSMinVersion)
+	if err != nil {
+		log.PanicErrorf(err, "invalid config: backend_tls_min_version = %s", conf.backendTLSMinVersion)
+	}
+	config := &tls.Config{
+		InsecureSkipVerify: conf.backendTLSSkipVerify,
+		MinVersion:         minVersion,
+	}
+	if conf.backendTLSCA != "" {
+		pem, err := ioutil.ReadFile(conf.backendTLSCA)
+		if err != nil {
+			log.PanicErrorf(err, "read backend_tls_ca %s failed", conf.backendTLSCA)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			log.Panicf("invalid config: backend_tls_ca = %s, no certificate found", conf.backendTLSCA)
 		}
 	}
+	return config, conf.backendTLSStrict, minVersion
 }
@@ -33,9 +33,15 @@ func NewConn(sock net.Conn) *Conn {
 }
 
 func NewConnSize(sock net.Conn, bufsize int) *Conn {
+	return NewConnSizes(sock, bufsize, bufsize)
+}
+
+// NewConnSizes is the same as NewConnSize, with different buffer sizes for
+// reading and for writing.
+func NewConnSizes(sock net.Conn, rbufsize, wbufsize int) *Conn {
 	conn := &Conn{Sock: sock}
-	conn.Reader = NewDecoderSize(&connReader{Conn: conn}, bufsize)
-	conn.Writer = NewEncoderSize(&connWriter{Conn: conn}, bufsize)
+	conn.Reader = NewDecoderSize(&connReader{Conn: conn}, rbufsize)
+	conn.Writer = NewEncoderSize(&connWriter{Conn: conn}, wbufsize)
 	return conn
 }
 
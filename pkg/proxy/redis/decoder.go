@@ -6,16 +6,51 @@ package redis
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"strconv"
 
 	"github.com/wandoulabs/codis/pkg/utils/errors"
 )
 
+// ProtocolError is a malformed resp, as opposed to an io error. Its message
+// follows the wording of redis, clients can be replied with "ERR " + Error().
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.Reason
+}
+
+func IsProtocolError(err error) bool {
+	_, ok := errors.Cause(err).(*ProtocolError)
+	return ok
+}
+
 var (
-	ErrBadRespCRLFEnd  = errors.New("bad resp CRLF end")
-	ErrBadRespBytesLen = errors.New("bad resp bytes len")
-	ErrBadRespArrayLen = errors.New("bad resp array len")
+	ErrBadRespCRLFEnd  = &ProtocolError{"bad resp CRLF end"}
+	ErrBadRespBytesLen = &ProtocolError{"invalid bulk length"}
+	ErrBadRespArrayLen = &ProtocolError{"invalid multibulk length"}
+	ErrBadRespLineLen  = &ProtocolError{"too big inline request"}
+)
+
+// Same as proto-max-bulk-len, the max multibulk length and the max inline
+// request size of redis, larger lengths are protocol errors rather than huge
+// allocations, unless the limits of the decoder are changed. The inline one
+// bounds every line, e.g. a length or a simple string, not just inline
+// requests.
+const (
+	MaxBulkBytesLen = 512 * 1024 * 1024
+	MaxArrayLen     = 1024 * 1024
+	MaxInlineLen    = 64 * 1024
+)
+
+// Lengths up to them are allocated at once, larger ones as the data comes,
+// so a claimed length alone can't make the decoder allocate much.
+const (
+	maxPreallocBytesLen = 1024 * 1024
+	maxPreallocArrayLen = 1024
 )
 
 func btoi(b []byte) (int64, error) {
@@ -52,11 +87,18 @@ func btoi(b []byte) (int64, error) {
 type Decoder struct {
 	*bufio.Reader
 
+	// MaxBulkBytesLen, MaxArrayLen and MaxInlineLen are the max lengths of
+	// bulk bytes, arrays and lines, they default to the constants of the
+	// same names.
+	MaxBulkBytesLen int64
+	MaxArrayLen     int64
+	MaxInlineLen    int64
+
 	Err error
 }
 
 func NewDecoder(br *bufio.Reader) *Decoder {
-	return &Decoder{Reader: br}
+	return &Decoder{Reader: br, MaxBulkBytesLen: MaxBulkBytesLen, MaxArrayLen: MaxArrayLen, MaxInlineLen: MaxInlineLen}
 }
 
 func NewDecoderSize(r io.Reader, size int) *Decoder {
@@ -64,7 +106,7 @@ func NewDecoderSize(r io.Reader, size int) *Decoder {
 	if !ok {
 		br = bufio.NewReaderSize(r, size)
 	}
-	return &Decoder{Reader: br}
+	return NewDecoder(br)
 }
 
 func (d *Decoder) Decode() (*Resp, error) {
@@ -106,7 +148,7 @@ func (d *Decoder) decodeResp(depth int) (*Resp, error) {
 		return r, err
 	default:
 		if depth != 0 {
-			return nil, errors.Errorf("bad resp type %s", t)
+			return nil, errors.Trace(&ProtocolError{fmt.Sprintf("expected '$', got '%c'", b)})
 		}
 		if err := d.UnreadByte(); err != nil {
 			return nil, errors.Trace(err)
@@ -118,9 +160,19 @@ func (d *Decoder) decodeResp(depth int) (*Resp, error) {
 }
 
 func (d *Decoder) decodeTextBytes() ([]byte, error) {
-	b, err := d.ReadBytes('\n')
-	if err != nil {
-		return nil, errors.Trace(err)
+	var b []byte
+	for {
+		line, err := d.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, errors.Trace(err)
+		}
+		b = append(b, line...)
+		if int64(len(b))-2 > d.MaxInlineLen {
+			return nil, errors.Trace(ErrBadRespLineLen)
+		}
+		if err == nil {
+			break
+		}
 	}
 	if n := len(b) - 2; n < 0 || b[n] != '\r' {
 		return nil, errors.Trace(ErrBadRespCRLFEnd)
@@ -137,27 +189,38 @@ func (d *Decoder) decodeTextString() (string, error) {
 	return string(b), nil
 }
 
-func (d *Decoder) decodeInt() (int64, error) {
+func (d *Decoder) decodeLen(max int64, bad error) (int64, error) {
 	b, err := d.decodeTextBytes()
 	if err != nil {
 		return 0, err
 	}
-	return btoi(b)
+	n, err := btoi(b)
+	if err != nil || n < -1 || n > max {
+		return 0, errors.Trace(bad)
+	}
+	return n, nil
 }
 
 func (d *Decoder) decodeBulkBytes() ([]byte, error) {
-	n, err := d.decodeInt()
+	n, err := d.decodeLen(d.MaxBulkBytesLen, ErrBadRespBytesLen)
 	if err != nil {
 		return nil, err
 	}
-	if n < -1 {
-		return nil, errors.Trace(ErrBadRespBytesLen)
-	} else if n == -1 {
+	if n == -1 {
 		return nil, nil
 	}
-	b := make([]byte, n+2)
-	if _, err := io.ReadFull(d.Reader, b); err != nil {
-		return nil, errors.Trace(err)
+	var b []byte
+	if n <= maxPreallocBytesLen {
+		b = make([]byte, n+2)
+		if _, err := io.ReadFull(d.Reader, b); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else {
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, d.Reader, n+2); err != nil {
+			return nil, errors.Trace(err)
+		}
+		b = buf.Bytes()
 	}
 	if b[n] != '\r' || b[n+1] != '\n' {
 		return nil, errors.Trace(ErrBadRespCRLFEnd)
@@ -166,40 +229,155 @@ func (d *Decoder) decodeBulkBytes() ([]byte, error) {
 }
 
 func (d *Decoder) decodeArray(depth int) ([]*Resp, error) {
-	n, err := d.decodeInt()
+	n, err := d.decodeLen(d.MaxArrayLen, ErrBadRespArrayLen)
 	if err != nil {
 		return nil, err
 	}
-	if n < -1 {
-		return nil, errors.Trace(ErrBadRespArrayLen)
-	} else if n == -1 {
+	if n == -1 {
 		return nil, nil
 	}
-	a := make([]*Resp, n)
-	for i := 0; i < len(a); i++ {
-		if a[i], err = d.decodeResp(depth + 1); err != nil {
+	a := make([]*Resp, 0, minInt64(n, maxPreallocArrayLen))
+	for i := int64(0); i < n; i++ {
+		x, err := d.decodeResp(depth + 1)
+		if err != nil {
 			return nil, err
 		}
+		a = append(a, x)
 	}
 	return a, nil
 }
 
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func (d *Decoder) decodeSingleLineBulkBytesArray() ([]*Resp, error) {
 	b, err := d.decodeTextBytes()
 	if err != nil {
 		return nil, err
 	}
-	a := make([]*Resp, 0, 4)
-	for l, r := 0, 0; r <= len(b); r++ {
-		if r == len(b) || b[r] == ' ' {
-			if l < r {
-				a = append(a, &Resp{
-					Type:  TypeBulkBytes,
-					Value: b[l:r],
-				})
-			}
-			l = r + 1
+	args, err := splitInlineArgs(b)
+	if err != nil {
+		return nil, err
+	}
+	a := make([]*Resp, len(args))
+	for i, arg := range args {
+		a[i] = &Resp{
+			Type:  TypeBulkBytes,
+			Value: arg,
 		}
 	}
 	return a, nil
 }
+
+var ErrUnbalancedQuotes = &ProtocolError{"unbalanced quotes in request"}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitToInt(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+// splitInlineArgs splits an inline request into arguments following the
+// quoting rules of redis: "..." supports escapes like \n and \x41, '...'
+// only supports \', and a closing quote must be followed by a space.
+func splitInlineArgs(b []byte) ([][]byte, error) {
+	var args [][]byte
+	for i := 0; ; {
+		for i < len(b) && isSpace(b[i]) {
+			i++
+		}
+		if i == len(b) {
+			return args, nil
+		}
+		var arg []byte
+		var inq, insq bool
+		for done := false; !done; {
+			switch {
+			case inq:
+				switch {
+				case i == len(b):
+					return nil, errors.Trace(ErrUnbalancedQuotes)
+				case b[i] == '\\' && i+3 < len(b) && b[i+1] == 'x' && isHexDigit(b[i+2]) && isHexDigit(b[i+3]):
+					arg = append(arg, hexDigitToInt(b[i+2])<<4|hexDigitToInt(b[i+3]))
+					i += 3
+				case b[i] == '\\' && i+1 < len(b):
+					i++
+					switch b[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, b[i])
+					}
+				case b[i] == '"':
+					if i+1 < len(b) && !isSpace(b[i+1]) {
+						return nil, errors.Trace(ErrUnbalancedQuotes)
+					}
+					done = true
+				default:
+					arg = append(arg, b[i])
+				}
+			case insq:
+				switch {
+				case i == len(b):
+					return nil, errors.Trace(ErrUnbalancedQuotes)
+				case b[i] == '\\' && i+1 < len(b) && b[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case b[i] == '\'':
+					if i+1 < len(b) && !isSpace(b[i+1]) {
+						return nil, errors.Trace(ErrUnbalancedQuotes)
+					}
+					done = true
+				default:
+					arg = append(arg, b[i])
+				}
+			default:
+				switch {
+				case i == len(b) || isSpace(b[i]):
+					done = true
+					continue
+				case b[i] == '"':
+					inq = true
+				case b[i] == '\'':
+					insq = true
+				default:
+					arg = append(arg, b[i])
+				}
+			}
+			i++
+		}
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+}
@@ -4,7 +4,10 @@
 package redis
 
 import (
+	"bufio"
 	"bytes"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/wandoulabs/codis/pkg/utils/assert"
@@ -47,6 +50,64 @@ func TestDecodeInvalidRequests(t *testing.T) {
 	}
 }
 
+func TestDecodeProtocolError(t *testing.T) {
+	test := map[string]string{
+		"*hello\r\n":            "invalid multibulk length",
+		"*2097152\r\n":          "invalid multibulk length",
+		"*1\r\n$-2\r\n":         "invalid bulk length",
+		"*1\r\n$1073741824\r\n": "invalid bulk length",
+		"*1\r\n!3\r\nget\r\n":   "expected '$', got '!'",
+		"*1\r\n$3\r\ngetx\r\n":  "bad resp CRLF end",
+		"set foo \"bar\r\n":     "unbalanced quotes in request",
+	}
+	for s, reason := range test {
+		_, err := DecodeFromBytes([]byte(s))
+		assert.Must(IsProtocolError(err))
+		assert.Must(err.Error() == "Protocol error: "+reason)
+	}
+	for _, s := range []string{"*2\r\n$3\r\nget\r\n", "*1\r\n$3\r\nge"} {
+		_, err := DecodeFromBytes([]byte(s))
+		assert.Must(err != nil && !IsProtocolError(err))
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	decode := func(s string, maxArgs, maxBulk int64) (allocated uint64, err error) {
+		d := NewDecoder(bufio.NewReader(bytes.NewReader([]byte(s))))
+		d.MaxArrayLen, d.MaxBulkBytesLen = maxArgs, maxBulk
+		var m1, m2 runtime.MemStats
+		runtime.ReadMemStats(&m1)
+		_, err = d.Decode()
+		runtime.ReadMemStats(&m2)
+		return m2.TotalAlloc - m1.TotalAlloc, err
+	}
+
+	n, err := decode("*2147483647\r\n$3\r\nget\r\n", MaxArrayLen, MaxBulkBytesLen)
+	assert.Must(err.Error() == "Protocol error: invalid multibulk length")
+	assert.Must(n < 1024*1024)
+
+	n, err = decode("*17\r\n", 16, MaxBulkBytesLen)
+	assert.Must(err.Error() == "Protocol error: invalid multibulk length")
+	_, err = decode("*1\r\n$17\r\n", 16, 16)
+	assert.Must(err.Error() == "Protocol error: invalid bulk length")
+	_, err = decode(strings.Repeat("x", MaxInlineLen+1)+"\r\n", MaxArrayLen, MaxBulkBytesLen)
+	assert.Must(err.Error() == "Protocol error: too big inline request")
+	_, err = decode("*1\r\n$"+strings.Repeat("0", MaxInlineLen+1)+"1\r\nx\r\n", MaxArrayLen, MaxBulkBytesLen)
+	assert.Must(err.Error() == "Protocol error: too big inline request")
+
+	_, err = decode(strings.Repeat("x", MaxInlineLen)+"\r\n", MaxArrayLen, MaxBulkBytesLen)
+	assert.MustNoError(err)
+
+	// the inline limit doesn't depend on the bulk one
+	_, err = decode(strings.Repeat("x", 8192)+"\r\n", MaxArrayLen, 16)
+	assert.MustNoError(err)
+
+	// a length within the limits is not allocated before the data comes
+	n, err = decode("*1048576\r\n$536870912\r\nget\r\n", MaxArrayLen, MaxBulkBytesLen)
+	assert.Must(err != nil && !IsProtocolError(err))
+	assert.Must(n < 1024*1024*4)
+}
+
 func TestDecodeSimpleRequest1(t *testing.T) {
 	resp, err := DecodeFromBytes([]byte("\r\n"))
 	assert.MustNoError(err)
@@ -112,3 +173,26 @@ func TestDecoder(t *testing.T) {
 		assert.MustNoError(err)
 	}
 }
+
+func TestDecodeInlineQuotes(t *testing.T) {
+	test := map[string][]string{
+		"set foo \"bar baz\"\r\n":          {"set", "foo", "bar baz"},
+		"set foo 'bar baz'\r\n":            {"set", "foo", "bar baz"},
+		"set foo \"a\\r\\n\\x41\\\"\"\r\n": {"set", "foo", "a\r\nA\""},
+		"set foo 'it\\'s'\r\n":             {"set", "foo", "it's"},
+		"set foo \"\"\r\n":                 {"set", "foo", ""},
+		"get\tfoo\r\n":                     {"get", "foo"},
+	}
+	for s, args := range test {
+		resp, err := DecodeFromBytes([]byte(s))
+		assert.MustNoError(err)
+		assert.Must(resp.IsArray() && len(resp.Array) == len(args))
+		for i, arg := range args {
+			assert.Must(resp.Array[i].IsBulkBytes() && string(resp.Array[i].Value) == arg)
+		}
+	}
+	for _, s := range []string{"set foo \"bar\r\n", "set foo 'bar\r\n", "set foo \"bar\"baz\r\n"} {
+		_, err := DecodeFromBytes([]byte(s))
+		assert.Must(err != nil)
+	}
+}
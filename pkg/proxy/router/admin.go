@@ -0,0 +1,244 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+const AdminBackendTimeout = time.Minute
+
+var (
+	ErrNotBackend        = errors.New("not a backend of any slot")
+	ErrBackendMigrating  = errors.New("backend has slots being migrated")
+	ErrNotAdminCommand   = errors.New("command is not allowed on a single backend")
+	ErrAdminAuthDisabled = errors.New("admin password is not set")
+	ErrAdminAuth         = errors.New("invalid admin password")
+
+	ErrAdminTokenDisabled = errors.New("admin tokens are disabled")
+	ErrAdminTokenRequired = errors.New("admin token is required, see PROXY ADMIN TOKEN")
+	ErrAdminToken         = errors.New("invalid or expired admin token")
+)
+
+// SetAdminAuth sets the password of PROXY ADMIN, which allows the session
+// to run the maintenance commands of RunOnBackend with PROXY BACKEND. An
+// empty password, the default, disables them.
+func (s *Router) SetAdminAuth(password string) {
+	s.rwlck.Lock()
+	s.adminAuth = password
+	s.rwlck.Unlock()
+}
+
+func (s *Router) checkAdminAuth(password string) error {
+	s.rwlck.RLock()
+	defer s.rwlck.RUnlock()
+	switch {
+	case s.adminAuth == "":
+		return ErrAdminAuthDisabled
+	case subtle.ConstantTimeCompare([]byte(s.adminAuth), []byte(password)) != 1:
+		return ErrAdminAuth
+	}
+	return nil
+}
+
+// SetAdminTokenTTL makes PROXY BACKEND require a token of PROXY ADMIN TOKEN,
+// valid for ttl, and consumed by the command, so a command replayed, or run
+// by mistake from the history of a shell, is refused instead of run again.
+// 0 disables the tokens, which is the default.
+func (s *Router) SetAdminTokenTTL(ttl time.Duration) {
+	s.tokens.Lock()
+	defer s.tokens.Unlock()
+	s.tokens.ttl = ttl
+	s.tokens.expire = nil
+}
+
+// newAdminToken returns a new token, see SetAdminTokenTTL.
+func (s *Router) newAdminToken() (string, error) {
+	s.tokens.Lock()
+	defer s.tokens.Unlock()
+	if s.tokens.ttl == 0 {
+		return "", ErrAdminTokenDisabled
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", errors.Trace(err)
+	}
+	now := microseconds()
+	if s.tokens.expire == nil {
+		s.tokens.expire = make(map[string]int64)
+	}
+	for token, expire := range s.tokens.expire {
+		if expire <= now {
+			delete(s.tokens.expire, token)
+		}
+	}
+	token := hex.EncodeToString(b[:])
+	s.tokens.expire[token] = now + int64(s.tokens.ttl/time.Microsecond)
+	return token, nil
+}
+
+// useAdminToken consumes the token, it fails if tokens are required and the
+// token is missing, expired, or already used.
+func (s *Router) useAdminToken(token string) error {
+	s.tokens.Lock()
+	defer s.tokens.Unlock()
+	if s.tokens.ttl == 0 {
+		return nil
+	}
+	if token == "" {
+		return ErrAdminTokenRequired
+	}
+	expire, ok := s.tokens.expire[token]
+	if !ok {
+		return ErrAdminToken
+	}
+	delete(s.tokens.expire, token)
+	if expire <= microseconds() {
+		return ErrAdminToken
+	}
+	return nil
+}
+
+func isAdminCommand(args []string) bool {
+	switch strings.ToUpper(strings.Join(args, " ")) {
+	case "FLUSHDB", "DEBUG RELOAD":
+		return true
+	}
+	return false
+}
+
+// RunOnBackend runs FLUSHDB or DEBUG RELOAD on a single backend, on a conn
+// of its own. FLUSHDB is run on every db of the slots of the backend. Both
+// are destructive: FLUSHDB deletes every key of all the slots on it, and
+// DEBUG RELOAD blocks the backend until its data is saved and loaded again,
+// failing the requests of its slots meanwhile. Backends with slots being
+// migrated, to or from them, are refused.
+func (s *Router) RunOnBackend(addr string, args ...string) (*redis.Resp, error) {
+	if !isAdminCommand(args) {
+		return nil, errors.Trace(ErrNotAdminCommand)
+	}
+	s.mu.Lock()
+	var dbs = make(map[int]bool)
+	for _, slot := range s.slots {
+		if slot.backend.addr != addr && slot.migrate.from != addr {
+			continue
+		}
+		if slot.migrate.from != "" {
+			s.mu.Unlock()
+			return nil, errors.Trace(ErrBackendMigrating)
+		}
+		dbs[slot.backend.db] = true
+	}
+	s.mu.Unlock()
+	if len(dbs) == 0 {
+		return nil, errors.Trace(ErrNotBackend)
+	}
+
+	var list []int
+	for db := range dbs {
+		list = append(list, db)
+	}
+	sort.Ints(list)
+	if strings.ToUpper(args[0]) != "FLUSHDB" {
+		list = list[:1]
+	}
+	var resp *redis.Resp
+	for _, db := range list {
+		log.Warnf("run %s on backend %s db %d", strings.Join(args, " "), addr, db)
+		r, err := s.queryBackend(addr, db, AdminBackendTimeout, args...)
+		if err != nil {
+			return nil, err
+		}
+		if r.IsError() {
+			return r, nil
+		}
+		resp = r
+	}
+	return resp, nil
+}
+
+type adminDispatcher interface {
+	checkAdminAuth(password string) error
+	newAdminToken() (string, error)
+	useAdminToken(token string) error
+	RunOnBackend(addr string, args ...string) (*redis.Resp, error)
+}
+
+// handleProxyAdmin handles the admin subcommands of PROXY:
+//
+//	PROXY ADMIN <password>: makes the session an admin one, see SetAdminAuth.
+//	PROXY ADMIN TOKEN: a one-time token for PROXY BACKEND, for admin sessions
+//	only, see SetAdminTokenTTL.
+//	PROXY BACKEND <addr> FLUSHDB|DEBUG RELOAD CONFIRM [token]: runs the
+//	command on the backend, see RunOnBackend, for admin sessions only.
+//	Without CONFIRM it's refused, so a mistyped line is never run, and so it
+//	is without a fresh token if they are required.
+func (s *Session) handleProxyAdmin(r *Request, d Dispatcher, sub string) (*Request, error) {
+	x, ok := d.(adminDispatcher)
+	if !ok {
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR PROXY %s is not supported", sub)))
+		return r, nil
+	}
+	var args []string
+	for _, a := range r.Resp.Array[2:] {
+		args = append(args, string(a.Value))
+	}
+	switch sub {
+	case "ADMIN":
+		if s.admin && len(args) == 1 && strings.ToUpper(args[0]) == "TOKEN" {
+			token, err := x.newAdminToken()
+			if err != nil {
+				r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR %s", err)))
+				return r, nil
+			}
+			r.Response.Resp = redis.NewBulkBytes([]byte(token))
+			return r, nil
+		}
+		if len(args) != 1 {
+			r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'PROXY ADMIN' command"))
+			return r, nil
+		}
+		if err := x.checkAdminAuth(args[0]); err != nil {
+			s.admin = false
+			r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR %s", err)))
+			return r, nil
+		}
+		s.admin = true
+		r.Response.Resp = redis.NewString([]byte("OK"))
+	case "BACKEND":
+		if !s.admin {
+			r.Response.Resp = redis.NewError([]byte("NOPERM PROXY BACKEND requires PROXY ADMIN first"))
+			return r, nil
+		}
+		var token string
+		if n := len(args); n >= 4 && strings.ToUpper(args[n-2]) == "CONFIRM" {
+			token, args = args[n-1], args[:n-1]
+		}
+		if len(args) < 3 || strings.ToUpper(args[len(args)-1]) != "CONFIRM" {
+			r.Response.Resp = redis.NewError([]byte("ERR usage: PROXY BACKEND <addr> FLUSHDB|DEBUG RELOAD CONFIRM [token]"))
+			return r, nil
+		}
+		if err := x.useAdminToken(token); err != nil {
+			r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("NOPERM %s", err)))
+			return r, nil
+		}
+		resp, err := x.RunOnBackend(args[0], args[1:len(args)-1]...)
+		if err != nil {
+			r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR %s", err)))
+			return r, nil
+		}
+		r.Response.Resp = resp
+	}
+	return r, nil
+}
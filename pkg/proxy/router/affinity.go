@@ -0,0 +1,182 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+var ErrTooManyBackendConns = errors.New("TRYAGAIN too many backend connections, try again")
+
+var affinityConns atomic2.Int64
+
+var affinityLimit struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	max  int64
+	wait time.Duration
+}
+
+func init() {
+	affinityLimit.cond = sync.NewCond(&affinityLimit.Mutex)
+}
+
+// SetClientAffinity makes each client get backend conns of its own, one for
+// each backend it sends requests to, instead of sharing the pool with the
+// other clients. Slots of different dbs on the same backend share its
+// conns, which SELECT again each time the db changes, so clients working on
+// different dbs interleaved on the same conn keep switching it. With their
+// own conns, a client only switches when it does so itself. The cost is in
+// conns: up to the number of clients times the number of backends, instead
+// of the pool size times the number of backends, and each client's are
+// dialed on its first requests and closed with it. Only the requests
+// forwarded to the primary, or to migrate.from, use them, replicas are
+// still shared. It's off by default, and applies to requests forwarded
+// afterwards. See ClientAffinityConns and SetClientAffinityLimit.
+func (s *Router) SetClientAffinity(enabled bool) {
+	s.rwlck.Lock()
+	defer s.rwlck.Unlock()
+	s.affinity = enabled
+}
+
+// ClientAffinityConns returns the number of backend conns of the clients,
+// see SetClientAffinity.
+func ClientAffinityConns() int64 {
+	return affinityConns.Get()
+}
+
+// SetClientAffinityLimit caps the backend conns of the clients, see
+// SetClientAffinity, all clients together. Once at max, a request needing a
+// new one waits up to wait for another client to close its own, and fails
+// with ErrTooManyBackendConns then, for the client to try again. A max of 0
+// means no limit, which is the default.
+func SetClientAffinityLimit(max int, wait time.Duration) {
+	affinityLimit.Lock()
+	affinityLimit.max, affinityLimit.wait = int64(max), wait
+	affinityLimit.cond.Broadcast()
+	affinityLimit.Unlock()
+}
+
+func acquireAffinityConn() error {
+	affinityLimit.Lock()
+	defer affinityLimit.Unlock()
+	var deadline time.Time
+	for affinityLimit.max != 0 && affinityConns.Get() >= affinityLimit.max {
+		if deadline.IsZero() {
+			deadline = time.Now().Add(affinityLimit.wait)
+		}
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return ErrTooManyBackendConns
+		}
+		t := time.AfterFunc(wait, func() {
+			affinityLimit.Lock()
+			affinityLimit.cond.Broadcast()
+			affinityLimit.Unlock()
+		})
+		affinityLimit.cond.Wait()
+		t.Stop()
+	}
+	affinityConns.Incr()
+	return nil
+}
+
+func releaseAffinityConn() {
+	affinityLimit.Lock()
+	affinityConns.Decr()
+	affinityLimit.cond.Broadcast()
+	affinityLimit.Unlock()
+}
+
+// clientConns is the backend conns of a session, by backend addr. A nil
+// conn is reserved, counted in affinityConns but not dialed yet.
+type clientConns struct {
+	sync.Mutex
+	conns  map[string]*BackendConn
+	closed bool
+}
+
+// reserve makes sure the session may have a conn to the backend of addr,
+// waiting for one under the cap if needed, see SetClientAffinityLimit. It's
+// called before the request is prepared, so the wait holds no lock and adds
+// nothing to the slot.
+func (c *clientConns) reserve(addr string) error {
+	if c.has(addr) {
+		return nil
+	}
+	if err := acquireAffinityConn(); err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.conns[addr]; ok || c.closed {
+		releaseAffinityConn()
+		return nil
+	}
+	if c.conns == nil {
+		c.conns = make(map[string]*BackendConn)
+	}
+	c.conns[addr] = nil
+	return nil
+}
+
+func (c *clientConns) has(addr string) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.conns[addr]
+	return ok || c.closed
+}
+
+// push forwards the requests on the conn of the session to the backend,
+// dialing it first if it's only reserved. It returns false if the session
+// is closed, its conns are gone then, or if no conn was reserved for the
+// backend, e.g. the slot moved meanwhile: the requests go to the conns of
+// the pool then.
+func (c *clientConns) push(bc *SharedBackendConn, rs ...*Request) bool {
+	c.Lock()
+	defer c.Unlock()
+	x, ok := c.conns[bc.addr]
+	if !ok || c.closed {
+		return false
+	}
+	if x == nil {
+		x = bc.newConn()
+		c.conns[bc.addr] = x
+	}
+	for _, r := range rs {
+		if r != nil {
+			x.PushBack(r)
+		}
+	}
+	return true
+}
+
+func (c *clientConns) close() {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	for _, x := range c.conns {
+		if x != nil {
+			x.Close()
+		}
+		releaseAffinityConn()
+	}
+	c.conns = nil
+}
+
+// newConn returns a new conn to the backend, the same as the ones of the
+// pool, but of its own.
+func (s *SharedBackendConn) newConn() *BackendConn {
+	c := s.conns[0]
+	x := NewBackendConnTimeout(c.addr, c.auth, c.readTimeout, c.writeTimeout)
+	x.nodelay, x.linger, x.onReadOnly = c.nodelay, c.linger, c.onReadOnly
+	x.flushDelay = c.flushDelay
+	x.pooled = c
+	return x
+}
@@ -0,0 +1,96 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+)
+
+// AuditEntry is the routing decision of a dispatched request.
+type AuditEntry struct {
+	Time    int64 // unix microseconds
+	Id      int64
+	OpStr   string
+	KeyHash uint32 // see hashKey
+	Slot    int    // -1 if rejected before routing
+	Addr    string // the backend forwarded to, "" if not forwarded
+	Client  string
+	Err     string // why it's not forwarded, "" if forwarded
+}
+
+// AuditSink records the entries, it's called in a goroutine of its own.
+type AuditSink interface {
+	Record(e *AuditEntry)
+}
+
+type auditor struct {
+	sink  AuditSink
+	ch    chan *AuditEntry
+	drops atomic2.Int64
+}
+
+// SetAuditSink makes every dispatch, including the retries and the ones
+// rejected, be recorded by the sink. Unlike the slowlog, nothing is left
+// out but the entries dropped when the sink falls behind by more than
+// bufsize, see AuditDrops. Replies are not waited for, so the outcome is
+// whether the request is forwarded, and hedged reads are recorded with the
+// backend of the slot, even if a replica replies first. A nil sink
+// disables it.
+func (s *Router) SetAuditSink(sink AuditSink, bufsize int) {
+	var a *auditor
+	if sink != nil {
+		a = &auditor{sink: sink, ch: make(chan *AuditEntry, bufsize)}
+		go func() {
+			for e := range a.ch {
+				a.sink.Record(e)
+			}
+		}()
+	}
+	s.rwlck.Lock()
+	old := s.auditor
+	s.auditor = a
+	s.rwlck.Unlock()
+	if old != nil {
+		close(old.ch)
+	}
+}
+
+// AuditDrops returns the number of entries dropped since the sink was set.
+func (s *Router) AuditDrops() int64 {
+	s.rwlck.RLock()
+	defer s.rwlck.RUnlock()
+	if s.auditor == nil {
+		return 0
+	}
+	return s.auditor.drops.Get()
+}
+
+func (s *Router) audit(r *Request, hkey []byte, err error) {
+	s.rwlck.RLock()
+	defer s.rwlck.RUnlock()
+	if s.auditor == nil {
+		return
+	}
+	e := &AuditEntry{
+		Time:   microseconds(),
+		Id:     r.Id,
+		OpStr:  r.OpStr,
+		Slot:   -1,
+		Client: r.client,
+	}
+	if hkey != nil {
+		e.KeyHash = hashKey(hkey)
+		e.Slot = int(e.KeyHash % uint32(len(s.slots)))
+	}
+	if err != nil {
+		e.Err = err.Error()
+	} else {
+		e.Addr = r.backend
+	}
+	select {
+	case s.auditor.ch <- e:
+	default:
+		s.auditor.drops.Incr()
+	}
+}
@@ -5,10 +5,14 @@ package router
 
 import (
 	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
 	"github.com/wandoulabs/codis/pkg/utils/errors"
 	"github.com/wandoulabs/codis/pkg/utils/log"
 )
@@ -18,12 +22,54 @@ type BackendConn struct {
 	auth string
 	stop sync.Once
 
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	nodelay bool
+	linger  time.Duration
+
+	flushDelay int64 // microseconds, see Router.SetBackendFlushDelay
+
 	input chan *Request
+	queue requestQueue
+
+	loading  atomic2.Int64
+	inflight atomic2.Int64
+
+	connected atomic2.Bool
+	reaped    atomic2.Bool
+	down      atomic2.Bool
+	lastwrite atomic2.Int64
+
+	remote struct {
+		sync.Mutex
+		addr string
+	}
+
+	readonly   atomic2.Int64
+	onReadOnly func(slot int, addr string)
+
+	oom       atomic2.Int64
+	shedUntil atomic2.Int64 // microseconds
+	pooled    *BackendConn  // of a client, see SharedBackendConn.newConn
+
+	rtt rttHistogram
 }
 
 func NewBackendConn(addr, auth string) *BackendConn {
+	return NewBackendConnTimeout(addr, auth, time.Minute, time.Minute)
+}
+
+// NewBackendConnTimeout creates a backend conn with separate deadlines for
+// reading replies and writing requests. A write timeout tears down the conn
+// and reconnects. A read timeout fails the request waiting for the reply,
+// and since a late reply would mismatch the pipeline, the conn is torn down
+// as well: requests already sent on it fail, the others go to a new conn.
+func NewBackendConnTimeout(addr, auth string, readTimeout, writeTimeout time.Duration) *BackendConn {
 	bc := &BackendConn{
 		addr: addr, auth: auth,
+		readTimeout: readTimeout, writeTimeout: writeTimeout,
+		nodelay: true, linger: -1,
 		input: make(chan *Request, 1024),
 	}
 	go bc.Run()
@@ -36,14 +82,23 @@ func (bc *BackendConn) Run() {
 		err := bc.loopWriter()
 		if err == nil {
 			break
-		} else {
+		} else if err == errIdleConn {
+			log.Infof("backend conn [%p] to %s, close idle conn", bc, bc.addr)
+			continue
+		} else if err == errStaleConn {
+			log.Infof("backend conn [%p] to %s, close conn to stale address", bc, bc.addr)
+			continue
+		} else if err != errBrokenReader {
+			for r := bc.queue.PopRequest(); r != nil; r = bc.queue.PopRequest() {
+				bc.setResponse(r, nil, err)
+			}
 			for i := len(bc.input); i != 0; i-- {
 				r := <-bc.input
 				bc.setResponse(r, nil, err)
 			}
 		}
 		log.WarnErrorf(err, "backend conn [%p] to %s, restart [%d]", bc, bc.addr, k)
-		time.Sleep(time.Millisecond * 50)
+		time.Sleep(time.Millisecond*50 + dialJitter())
 	}
 	log.Infof("backend conn [%p] to %s, stop and exit", bc, bc.addr)
 }
@@ -61,12 +116,13 @@ func (bc *BackendConn) Close() {
 func (bc *BackendConn) PushBack(r *Request) {
 	if r.Wait != nil {
 		r.Wait.Add(1)
+		bc.inflight.Incr()
 	}
 	bc.input <- r
 }
 
 func (bc *BackendConn) KeepAlive() bool {
-	if len(bc.input) != 0 {
+	if len(bc.input) != 0 || bc.reaped.Get() {
 		return false
 	}
 	r := &Request{
@@ -85,27 +141,108 @@ func (bc *BackendConn) KeepAlive() bool {
 
 var ErrFailedRequest = errors.New("discard failed request")
 
+// ErrReplyTruncated fails a request whose reply was being read when its
+// backend conn broke, e.g. reset by the backend. What was read of the reply
+// is dropped, and the conn is torn down, so the requests sent after it fail
+// with the cause and the following ones go to a new conn.
+var ErrReplyTruncated = errors.New("backend conn broken in the middle of the reply")
+
+var errBrokenReader = errors.New("backend conn reader is broken")
+
+var errIdleConn = errors.New("backend conn is idle")
+
+// idleRequest asks the writer to close the conn if nothing else is queued.
+// Requests already sent still get their replies, the reader exits after
+// them, and the next request dials again.
+var idleRequest = &Request{}
+
+// reapIdle closes the conn if no request has been forwarded for idle, the
+// pings of KeepAlive don't count, nor do they dial a reaped conn again.
+func (bc *BackendConn) reapIdle(idle time.Duration) bool {
+	if !bc.connected.Get() || microseconds()-bc.lastwrite.Get() < int64(idle/time.Microsecond) {
+		return false
+	}
+	select {
+	case bc.input <- idleRequest:
+		return true
+	default:
+		return false
+	}
+}
+
 func (bc *BackendConn) loopWriter() error {
-	r, ok := <-bc.input
+	r, ok := bc.nextRequest()
+	for ok && (r == idleRequest || r == staleRequest) {
+		r, ok = bc.nextRequest()
+	}
 	if ok {
-		c, tasks, err := bc.newBackendReader()
+		c, db, tasks, broken, err := bc.newBackendReader(r.db)
 		if err != nil {
+			bc.down.Set(true)
 			return bc.setResponse(r, nil, err)
 		}
 		defer close(tasks)
+		bc.setRemoteAddr(c.Sock.RemoteAddr().String())
+
+		bc.down.Set(false)
+		bc.connected.Set(true)
+		bc.reaped.Set(false)
+		defer bc.connected.Set(false)
 
 		p := &FlushPolicy{
 			Encoder:     c.Writer,
 			MaxBuffered: 64,
 			MaxInterval: 300,
 		}
+		var held int64
 		for ok {
-			var flush = len(bc.input) == 0
-			if bc.canForward(r) {
-				if err := p.Encode(r.Resp, flush); err != nil {
+			select {
+			case <-broken:
+				bc.queue.PushFront(r)
+				return errBrokenReader
+			default:
+			}
+			var flush = len(bc.input) == 0 && bc.queue.Len() == 0
+			var delay = bc.flushDelay
+			if p.MaxInterval = 300; delay > p.MaxInterval {
+				p.MaxInterval = delay
+			}
+			if r == idleRequest {
+				if flush {
+					if err := p.Flush(true); err != nil {
+						return err
+					}
+					bc.reaped.Set(true)
+					return errIdleConn
+				}
+			} else if r == staleRequest {
+				if err := p.Flush(true); err != nil {
+					return err
+				}
+				return errStaleConn
+			} else if bc.canForward(r) {
+				if r.Wait != nil {
+					bc.lastwrite.Set(microseconds())
+				}
+				if r.db != db {
+					if err := bc.selectDB(p, tasks, r.db); err != nil {
+						return bc.setResponse(r, nil, err)
+					}
+					db = r.db
+				}
+				r.sent = microseconds()
+				if p.nbuffered == 0 {
+					held = r.sent
+				}
+				if err := p.Encode(r.Resp, flush && delay == 0); err != nil {
 					return bc.setResponse(r, nil, err)
 				}
 				tasks <- r
+				if delay != 0 && p.nbuffered != 0 {
+					if err := bc.holdFlush(p, held+delay); err != nil {
+						return err
+					}
+				}
 			} else {
 				if err := p.Flush(flush); err != nil {
 					return bc.setResponse(r, nil, err)
@@ -113,64 +250,199 @@ func (bc *BackendConn) loopWriter() error {
 				bc.setResponse(r, nil, ErrFailedRequest)
 			}
 
-			r, ok = <-bc.input
+			r, ok = bc.nextRequest()
 		}
 	}
 	return nil
 }
 
-func (bc *BackendConn) newBackendReader() (*redis.Conn, chan<- *Request, error) {
-	c, err := redis.DialTimeout(bc.addr, 1024*512, time.Second)
-	if err != nil {
-		return nil, nil, err
+func (bc *BackendConn) nextRequest() (*Request, bool) {
+	if bc.queue.Len() == 0 {
+		r, ok := <-bc.input
+		if !ok {
+			return nil, false
+		}
+		bc.queue.PushRequest(r)
 	}
-	c.ReaderTimeout = time.Minute
-	c.WriterTimeout = time.Minute
+	for i := len(bc.input); i != 0; i-- {
+		r, ok := <-bc.input
+		if !ok {
+			break
+		}
+		bc.queue.PushRequest(r)
+	}
+	return bc.queue.PopRequest(), true
+}
+
+// setSockOpts sets TCP_NODELAY and SO_LINGER of a TCP conn, or of the TCP
+// conn under the TLS or compressed ones wrapping it, however deep, see
+// tlsConn, other conns are left as they are. A negative linger keeps the
+// default of the OS, 0 resets the conn on close, discarding the unsent
+// data, and a positive one makes close wait for the unsent data by up to
+// linger, in seconds.
+func setSockOpts(sock net.Conn, nodelay bool, linger time.Duration) error {
+	for {
+		c, ok := sock.(interface {
+			NetConn() net.Conn
+		})
+		if !ok {
+			break
+		}
+		sock = c.NetConn()
+	}
+	tcp, ok := sock.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcp.SetNoDelay(nodelay); err != nil {
+		return errors.Trace(err)
+	}
+	if linger >= 0 {
+		if err := tcp.SetLinger(int(linger / time.Second)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
 
-	if err := bc.verifyAuth(c); err != nil {
+// connect dials the backend and authenticates, see SetDialLimit. It also
+// selects the db during the handshake if it can, see handshakeDB, and
+// returns the db selected.
+func (bc *BackendConn) connect(db int) (*redis.Conn, int, error) {
+	acquireDial()
+	defer releaseDial()
+	c, err := dialBackend(bc.addr, 1024*512, dialTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := setSockOpts(c.Sock, bc.nodelay, bc.linger); err != nil {
 		c.Close()
-		return nil, nil, err
+		return nil, 0, err
+	}
+	db, err = handshakeDB(c, bc.addr, bc.auth, db, dialTimeout)
+	if err != nil {
+		c.Close()
+		return nil, 0, err
+	}
+	c.ReaderTimeout = bc.readTimeout
+	c.WriterTimeout = bc.writeTimeout
+	return c, db, nil
+}
+
+func (bc *BackendConn) newBackendReader(db int) (*redis.Conn, int, chan<- *Request, <-chan struct{}, error) {
+	c, db, err := bc.connect(db)
+	if err != nil {
+		return nil, 0, nil, nil, err
 	}
 
 	tasks := make(chan *Request, 4096)
+	broken := make(chan struct{})
 	go func() {
 		defer c.Close()
 		for r := range tasks {
 			resp, err := c.Reader.Decode()
-			bc.setResponse(r, resp, err)
+			cause := err
+			if err != nil && resp != nil {
+				log.Warnf("backend %s broken in the middle of the reply to %s, error = %s", bc.addr, r.OpStr, err)
+				err = errors.Trace(ErrReplyTruncated)
+			}
+			if err == nil && r.sent != 0 {
+				bc.rtt.add(microseconds() - r.sent)
+			}
+			if err == nil {
+				err = bc.checkReply(r, resp)
+				cause = err
+			}
+			if err != nil {
+				resp = nil
+			}
+			if bc.setResponse(r, resp, err) == nil {
+				continue
+			}
+			c.Close()
+			close(broken)
+			for r := range tasks {
+				bc.setResponse(r, nil, cause)
+			}
 		}
 	}()
-	return c, tasks, nil
+	return c, db, tasks, broken, nil
 }
 
-func (bc *BackendConn) verifyAuth(c *redis.Conn) error {
-	if bc.auth == "" {
-		return nil
+// selectDB switches the db of the conn before forwarding a request of a
+// slot with another db. It waits for the reply, so requests are never sent
+// to a wrong db, at the cost of a round trip on each switch.
+func (bc *BackendConn) selectDB(p *FlushPolicy, tasks chan<- *Request, db int) error {
+	m := &Request{
+		Resp: redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("SELECT")),
+			redis.NewBulkBytes([]byte(strconv.Itoa(db))),
+		}),
+		Wait: &sync.WaitGroup{},
 	}
-	resp := redis.NewArray([]*redis.Resp{
-		redis.NewBulkBytes([]byte("AUTH")),
-		redis.NewBulkBytes([]byte(bc.auth)),
-	})
-
-	if err := c.Writer.Encode(resp, true); err != nil {
+	if err := p.Encode(m.Resp, true); err != nil {
 		return err
 	}
+	m.Wait.Add(1)
+	bc.inflight.Incr()
+	tasks <- m
+	m.Wait.Wait()
 
-	resp, err := c.Reader.Decode()
+	resp, err := m.Response.Resp, m.Response.Err
 	if err != nil {
 		return err
 	}
 	if resp == nil {
-		return errors.New(fmt.Sprintf("error resp: nil response"))
+		return ErrRespIsRequired
 	}
 	if resp.IsError() {
-		return errors.New(fmt.Sprintf("error resp: %s", resp.Value))
+		return errors.New(fmt.Sprintf("select db %d failed, error resp: %s", db, resp.Value))
 	}
-	if resp.IsString() {
-		return nil
-	} else {
-		return errors.New(fmt.Sprintf("error resp: should be string, but got %s", resp.Type))
+	return nil
+}
+
+// AuthHandshake is the default Handshake, it sends AUTH if auth is set.
+func AuthHandshake(c *redis.Conn, addr, auth string) error {
+	return authSelectHandshake(c, auth, 0)
+}
+
+// authSelectHandshake sends AUTH if auth is set, and SELECT if db is not 0,
+// in a single write, so it takes one round trip at most.
+func authSelectHandshake(c *redis.Conn, auth string, db int) error {
+	var cmds []*redis.Resp
+	if auth != "" {
+		cmds = append(cmds, redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("AUTH")),
+			redis.NewBulkBytes([]byte(auth)),
+		}))
+	}
+	if db != 0 {
+		cmds = append(cmds, redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("SELECT")),
+			redis.NewBulkBytes([]byte(strconv.Itoa(db))),
+		}))
+	}
+	for i, cmd := range cmds {
+		if err := c.Writer.Encode(cmd, i == len(cmds)-1); err != nil {
+			return err
+		}
+	}
+	for _, cmd := range cmds {
+		resp, err := c.Reader.Decode()
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			return errors.New(fmt.Sprintf("error resp: nil response"))
+		}
+		if resp.IsError() {
+			return errors.New(fmt.Sprintf("%s failed, error resp: %s", cmd.Array[0].Value, resp.Value))
+		}
+		if !resp.IsString() {
+			return errors.New(fmt.Sprintf("error resp: should be string, but got %s", resp.Type))
+		}
 	}
+	return nil
 }
 
 func (bc *BackendConn) canForward(r *Request) bool {
@@ -181,29 +453,212 @@ func (bc *BackendConn) canForward(r *Request) bool {
 	}
 }
 
+// setResponse hands the reply over to the request. It never waits for the
+// client: the session writes it out on its own, see Session.loopWriter, so
+// a slow client only backs up its own pipeline, bounded by maxPipeline, and
+// is closed by the output buffer limit, never the conn shared with others.
 func (bc *BackendConn) setResponse(r *Request, resp *redis.Resp, err error) error {
+	if err == nil && isLoadingReply(resp) {
+		bc.loading.Incr()
+		resp, r.loading = newLoadingReply(resp), true
+	}
+	if err == nil && isReadOnlyReply(resp) && !isReadOnly(r.OpStr) {
+		bc.readonly.Incr()
+		if r.slot != nil && r.slot.readonly.CompareAndSwap(false, true) && bc.onReadOnly != nil {
+			bc.onReadOnly(r.slot.id, bc.addr)
+		}
+	}
+	if err == nil && isOOMReply(resp) {
+		bc.onOOMReply()
+	}
 	r.Response.Resp, r.Response.Err = resp, err
+	if r.output != nil {
+		r.output.add(resp)
+	}
 	if err != nil && r.Failed != nil {
 		r.Failed.Set(true)
 	}
+	if r.inflight != nil {
+		r.inflight.Decr()
+	}
 	if r.Wait != nil {
+		bc.inflight.Decr()
 		r.Wait.Done()
 	}
 	if r.slot != nil {
-		r.slot.Done()
+		if err != nil {
+			r.slot.setLastError(err)
+		}
+		r.slot.wait.Done()
 	}
 	return err
 }
 
 type SharedBackendConn struct {
-	*BackendConn
-	mu sync.Mutex
+	addr  string
+	conns []*BackendConn
 
+	mu     sync.Mutex
 	refcnt int
+
+	// pins counts the requests being pushed without holding the pool
+	// locked, see Router.forwardPooled, the conns are closed once the last
+	// of them is pushed.
+	pins    atomic2.Int64
+	closing atomic2.Bool
+	closed  sync.Once
+
+	lag     atomic2.Int64 // seconds, -1 if unknown
+	lagging atomic2.Bool
+
+	unhealthy atomic2.Bool
 }
 
 func NewSharedBackendConn(addr, auth string) *SharedBackendConn {
-	return &SharedBackendConn{BackendConn: NewBackendConn(addr, auth), refcnt: 1}
+	return NewSharedBackendConnPool(addr, auth, time.Minute, time.Minute, 1)
+}
+
+func NewSharedBackendConnTimeout(addr, auth string, readTimeout, writeTimeout time.Duration) *SharedBackendConn {
+	return NewSharedBackendConnPool(addr, auth, readTimeout, writeTimeout, 1)
+}
+
+// NewSharedBackendConnPool creates n physical conns to the backend. Each
+// request goes to the conn picked by the hash of its key, so a slow key only
+// blocks the keys sharing its conn. Requests of the same key always use the
+// same conn and keep their order, requests of different keys may not.
+func NewSharedBackendConnPool(addr, auth string, readTimeout, writeTimeout time.Duration, n int) *SharedBackendConn {
+	if n < 1 {
+		n = 1
+	}
+	s := &SharedBackendConn{addr: addr, refcnt: 1}
+	s.lag.Set(-1)
+	for i := 0; i < n; i++ {
+		s.conns = append(s.conns, NewBackendConnTimeout(addr, auth, readTimeout, writeTimeout))
+	}
+	return s
+}
+
+// available tells whether the backend is usable, i.e. it's not marked
+// unhealthy, and the last connect of every conn, if any, has succeeded.
+func (s *SharedBackendConn) available() bool {
+	if s.unhealthy.Get() {
+		return false
+	}
+	for _, c := range s.conns {
+		if c.down.Get() {
+			return false
+		}
+	}
+	return true
+}
+
+// setLag records the lag of the backend as a replica, it's lagging if the
+// lag is over max. It returns true if it has just started lagging.
+func (s *SharedBackendConn) setLag(lag int64, max time.Duration) bool {
+	s.lag.Set(lag)
+	lagging := max > 0 && lag >= 0 && time.Duration(lag)*time.Second > max
+	return s.lagging.CompareAndSwap(!lagging, lagging) && lagging
+}
+
+func (s *SharedBackendConn) Addr() string {
+	return s.addr
+}
+
+// Conn returns the physical conn for the key, requests without a key all
+// go to the first one.
+func (s *SharedBackendConn) Conn(key []byte) *BackendConn {
+	if len(s.conns) == 1 || len(key) == 0 {
+		return s.conns[0]
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return s.conns[h.Sum32()%uint32(len(s.conns))]
+}
+
+func (s *SharedBackendConn) PushBack(r *Request) {
+	s.conns[0].PushBack(r)
+}
+
+func (s *SharedBackendConn) KeepAlive() {
+	for _, bc := range s.conns {
+		bc.KeepAlive()
+	}
+}
+
+func (s *SharedBackendConn) pending() int {
+	var n int
+	for _, bc := range s.conns {
+		n += len(bc.input)
+	}
+	return n
+}
+
+func (s *SharedBackendConn) readonlys() int64 {
+	var n int64
+	for _, bc := range s.conns {
+		n += bc.readonly.Get()
+	}
+	return n
+}
+
+func (s *SharedBackendConn) loadings() int64 {
+	var n int64
+	for _, bc := range s.conns {
+		n += bc.loading.Get()
+	}
+	return n
+}
+
+func (s *SharedBackendConn) inflights() int64 {
+	var n int64
+	for _, bc := range s.conns {
+		n += bc.inflight.Get()
+	}
+	return n
+}
+
+func (s *SharedBackendConn) reapIdle(idle time.Duration) int {
+	var n int
+	for _, bc := range s.conns {
+		if bc.reapIdle(idle) {
+			n++
+		}
+	}
+	return n
+}
+
+// closeConns closes the conns, or makes the last request pinned close them
+// once pushed, see pin.
+func (s *SharedBackendConn) closeConns() {
+	s.closing.Set(true)
+	if s.pins.Get() == 0 {
+		s.close()
+	}
+}
+
+func (s *SharedBackendConn) close() {
+	s.closed.Do(func() {
+		for _, bc := range s.conns {
+			bc.Close()
+		}
+	})
+}
+
+// pin keeps the conns open until unpin, so a request can be pushed without
+// holding the pool locked. It fails if the conns are being closed.
+func (s *SharedBackendConn) pin() bool {
+	s.pins.Incr()
+	if s.closing.Get() {
+		s.unpin()
+		return false
+	}
+	return true
+}
+
+func (s *SharedBackendConn) unpin() {
+	if s.pins.Decr() == 0 && s.closing.Get() {
+		s.close()
+	}
 }
 
 func (s *SharedBackendConn) Close() bool {
@@ -213,7 +668,7 @@ func (s *SharedBackendConn) Close() bool {
 		log.Panicf("shared backend conn has been closed, close too many times")
 	}
 	if s.refcnt == 1 {
-		s.BackendConn.Close()
+		s.closeConns()
 	}
 	s.refcnt--
 	return s.refcnt == 0
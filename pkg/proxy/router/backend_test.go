@@ -4,14 +4,26 @@
 package router
 
 import (
+	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/wandoulabs/codis/pkg/proxy/redis"
 	"github.com/wandoulabs/codis/pkg/utils/assert"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
 )
 
 func TestBackend(t *testing.T) {
@@ -58,3 +70,990 @@ func TestBackend(t *testing.T) {
 	}
 	assert.Must(n == cap(reqc))
 }
+
+func TestBackendPriority(t *testing.T) {
+	SetOpPriority("GET", 1)
+	defer SetOpPriority("GET", 0)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	resume := make(chan bool)
+	opstrs := make(chan string, 16)
+	go func() {
+		defer close(opstrs)
+		c, err := l.Accept()
+		assert.MustNoError(err)
+		defer c.Close()
+		conn := redis.NewConn(c)
+		<-resume
+		for i := 0; i < 4; i++ {
+			resp, err := conn.Reader.Decode()
+			assert.MustNoError(err)
+			opstr := string(resp.Array[0].Value)
+			opstrs <- opstr
+			assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte(opstr)), true))
+		}
+	}()
+
+	bc := NewBackendConn(l.Addr().String(), "foobar")
+	defer bc.Close()
+
+	var reqs []*Request
+	for _, opstr := range []string{"PING", "MSET", "GET"} {
+		r := &Request{
+			OpStr: opstr,
+			Resp:  redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte(opstr))}),
+			Wait:  &sync.WaitGroup{},
+		}
+		bc.PushBack(r)
+		reqs = append(reqs, r)
+	}
+	close(resume)
+
+	for _, r := range reqs {
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		assert.Must(string(r.Response.Resp.Value) == r.OpStr)
+	}
+
+	var order = make(map[string]int)
+	for opstr := range opstrs {
+		order[opstr] = len(order)
+	}
+	assert.Must(order["AUTH"] == 0)
+	assert.Must(order["GET"] < order["MSET"])
+}
+
+func TestBackendPriorityPipeline(t *testing.T) {
+	SetOpPriority("GET", 1)
+	defer SetOpPriority("GET", 0)
+
+	var q requestQueue
+	reqs := []*Request{
+		{OpStr: "SET", client: "c1"},
+		{OpStr: "GET", client: "c1"},
+		{OpStr: "GET", client: "c2"},
+	}
+	for _, r := range reqs {
+		q.PushRequest(r)
+	}
+	assert.Must(q.PopRequest() == reqs[2])
+	assert.Must(q.PopRequest() == reqs[0])
+	assert.Must(q.PopRequest() == reqs[1])
+	assert.Must(q.PopRequest() == nil)
+
+	// the priority is back once the queue ran empty
+	set := &Request{OpStr: "SET", client: "c2"}
+	q.PushRequest(set)
+	q.PushRequest(reqs[1])
+	assert.Must(q.PopRequest() == reqs[1])
+	assert.Must(q.PopRequest() == set)
+}
+
+func TestBackendFairQueuing(t *testing.T) {
+	SetFairQueuing(true)
+	defer SetFairQueuing(false)
+	var waits = make(map[string]*clientWait)
+	for _, client := range []string{"a", "b"} {
+		waits[client] = clientWaits.add(client)
+		defer clientWaits.remove(client)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	const flood, trickle = 200, 5
+	resume := make(chan bool)
+	clients := make(chan string, flood+trickle+1)
+	go func() {
+		defer close(clients)
+		c, err := l.Accept()
+		assert.MustNoError(err)
+		defer c.Close()
+		conn := redis.NewConn(c)
+		<-resume
+		for i := 0; i < flood+trickle+1; i++ {
+			resp, err := conn.Reader.Decode()
+			assert.MustNoError(err)
+			if string(resp.Array[0].Value) == "GET" {
+				clients <- string(resp.Array[1].Value)
+			}
+			assert.MustNoError(conn.Writer.Encode(redis.NewString([]byte("OK")), true))
+		}
+	}()
+
+	bc := NewBackendConn(l.Addr().String(), "foobar")
+	defer bc.Close()
+
+	var reqs []*Request
+	push := func(client string) {
+		r := &Request{
+			OpStr:  "GET",
+			Resp:   redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("GET")), redis.NewBulkBytes([]byte(client))}),
+			Wait:   &sync.WaitGroup{},
+			client: client,
+			wait:   waits[client],
+		}
+		bc.PushBack(r)
+		reqs = append(reqs, r)
+	}
+	for i := 0; i < flood; i++ {
+		push("a")
+	}
+	for i := 0; i < trickle; i++ {
+		push("b")
+	}
+	close(resume)
+	for _, r := range reqs {
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+
+	var last int
+	var i int
+	for client := range clients {
+		if client == "b" {
+			last = i
+		}
+		i++
+	}
+	// the requests of b take turns with the ones of a, instead of waiting behind all of them
+	assert.Must(i == flood+trickle && last <= trickle*2+1)
+	assert.Must(ClientWaits()["b"].Requests == trickle)
+}
+
+func TestBackendWriteTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	bc := NewBackendConnTimeout(l.Addr().String(), "", time.Second, time.Millisecond*100)
+	defer bc.Close()
+
+	r := &Request{
+		Resp: redis.NewBulkBytes(make([]byte, 1024*1024*32)),
+		Wait: &sync.WaitGroup{},
+	}
+	bc.PushBack(r)
+	r.Wait.Wait()
+	assert.Must(redis.IsTimeout(r.Response.Err))
+
+	bc.PushBack(&Request{Resp: redis.NewBulkBytes([]byte("PING"))})
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-accepted:
+			defer c.Close()
+		case <-time.After(time.Second * 5):
+			assert.Must(false)
+		}
+	}
+}
+
+func TestBackendReadTimeout(t *testing.T) {
+	var n atomic2.Int64
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		if n.Incr() == 1 {
+			time.Sleep(time.Millisecond * 300)
+		}
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	bc := NewBackendConnTimeout(b.Addr, "", time.Millisecond*100, time.Second)
+	defer bc.Close()
+
+	r1 := newRequest("GET", "foo")
+	bc.PushBack(r1)
+	r1.Wait.Wait()
+	assert.Must(redis.IsTimeout(r1.Response.Err))
+
+	r2 := newRequest("GET", "foo")
+	bc.PushBack(r2)
+	r2.Wait.Wait()
+	assert.MustNoError(r2.Response.Err)
+	assert.Must(string(r2.Response.Resp.Value) == "OK")
+}
+
+func TestBackendDialLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// never reply to AUTH
+			conns = append(conns, c)
+		}
+	}()
+
+	SetDialLimit(2, time.Millisecond*10)
+	defer SetDialLimit(0, 0)
+
+	var rs []*Request
+	for i := 0; i < 8; i++ {
+		bc := NewBackendConnTimeout(l.Addr().String(), "foobar", time.Millisecond*100, time.Millisecond*100)
+		defer bc.Close()
+		r := &Request{
+			Resp: redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("PING"))}),
+			Wait: &sync.WaitGroup{},
+		}
+		bc.PushBack(r)
+		rs = append(rs, r)
+	}
+
+	var max int
+	done := make(chan struct{})
+	go func() {
+		for _, r := range rs {
+			r.Wait.Wait()
+		}
+		close(done)
+	}()
+	for loop := true; loop; {
+		select {
+		case <-done:
+			loop = false
+		case <-time.After(time.Millisecond):
+			if n := DialsInFlight(); n > max {
+				max = n
+			}
+		}
+	}
+	for _, r := range rs {
+		assert.Must(r.Response.Err != nil)
+	}
+	assert.Must(max == 2)
+}
+
+func TestBackendHandshake(t *testing.T) {
+	var mu sync.Mutex
+	var ops []string
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		mu.Lock()
+		defer mu.Unlock()
+		var args []string
+		for _, x := range resp.Array {
+			args = append(args, string(x.Value))
+		}
+		ops = append(ops, strings.Join(args, " "))
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	SetBackendHandshake(func(c *redis.Conn, addr, auth string) error {
+		if err := AuthHandshake(c, addr, auth); err != nil {
+			return err
+		}
+		setname := redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("CLIENT")),
+			redis.NewBulkBytes([]byte("SETNAME")),
+			redis.NewBulkBytes([]byte("codis-proxy")),
+		})
+		if err := c.Writer.Encode(setname, true); err != nil {
+			return err
+		}
+		resp, err := c.Reader.Decode()
+		if err != nil {
+			return err
+		}
+		if !resp.IsString() {
+			return errors.New("bad setname resp")
+		}
+		return nil
+	})
+	defer SetBackendHandshake(nil)
+
+	bc := NewSharedBackendConn(b.Addr, "foobar")
+	defer bc.Close()
+
+	r := newRequest("GET", "foo")
+	bc.PushBack(r)
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Must(len(ops) == 3)
+	assert.Must(ops[0] == "AUTH foobar" && ops[1] == "CLIENT SETNAME codis-proxy" && ops[2] == "GET foo")
+}
+
+func TestBackendTLSStrict(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("PONG"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+
+	SetBackendTLS(&tls.Config{InsecureSkipVerify: true}, true, tls.VersionTLS12)
+	defer SetBackendTLS(nil, false, 0)
+	m := s.Settings()
+	assert.Must(m["backend_tls_skip_verify"] == "true" && m["backend_tls_min_version"] == "1.2")
+	assert.Must(m["backend_linger"] == "-1")
+
+	n := BackendTLSRefusals()
+	_, err := s.queryBackend(b.Addr, 0, time.Millisecond*100, "PING")
+	assert.Must(errors.Equal(err, ErrBackendNotTLS))
+	assert.Must(BackendTLSRefusals() == n+1)
+
+	SetBackendTLS(&tls.Config{InsecureSkipVerify: true}, false, tls.VersionTLS12)
+	resp, err := s.queryBackend(b.Addr, 0, time.Millisecond*100, "PING")
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "PONG")
+	assert.Must(BackendTLSRefusals() == n+1)
+}
+
+func TestBackendTLSFallback(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	SetBackendTLS(&tls.Config{}, false, 0)
+	defer SetBackendTLS(nil, false, 0)
+
+	// a backend with a certificate that can't be verified is not used in
+	// plaintext
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	_, err := s.queryBackend(ts.Listener.Addr().String(), 0, time.Millisecond*100, "PING")
+	assert.Must(err != nil)
+	err = errors.Cause(err)
+	if x, ok := err.(interface {
+		Unwrap() error
+	}); ok {
+		err = x.Unwrap()
+	}
+	_, ok := err.(x509.UnknownAuthorityError)
+	assert.Must(ok)
+
+	// a backend replying garbage to the handshake doesn't speak TLS
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := redis.NewConn(c)
+				for {
+					if _, err := r.Reader.Decode(); err != nil {
+						return
+					}
+					if err := r.Writer.Encode(redis.NewString([]byte("PONG")), true); err != nil {
+						return
+					}
+				}
+			}(&replyNotTLSConn{Conn: c})
+		}
+	}()
+	resp, err := s.queryBackend(l.Addr().String(), 0, time.Millisecond*100, "PING")
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "PONG")
+}
+
+// replyNotTLSConn replies an error to a TLS handshake, like a backend that
+// reads an inline command.
+type replyNotTLSConn struct {
+	net.Conn
+}
+
+func (c *replyNotTLSConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n != 0 && b[0] == 0x16 {
+		c.Conn.Write([]byte("-ERR unknown command\r\n"))
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func TestBackendSockOpts(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	getSockOpts := func(nodelay bool, linger time.Duration) (int, int) {
+		bc := NewBackendConn(b.Addr, "")
+		defer bc.Close()
+		bc.nodelay, bc.linger = nodelay, linger
+		c, _, err := bc.connect(0)
+		assert.MustNoError(err)
+		defer c.Close()
+		f, err := c.Sock.(*net.TCPConn).File()
+		assert.MustNoError(err)
+		defer f.Close()
+		v, err := syscall.GetsockoptInt(int(f.Fd()), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		assert.MustNoError(err)
+		// l_onoff of struct linger
+		l, err := syscall.GetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_LINGER)
+		assert.MustNoError(err)
+		return v, l
+	}
+
+	v, l := getSockOpts(true, -1)
+	assert.Must(v != 0 && l == 0)
+
+	v, l = getSockOpts(false, time.Second*3)
+	assert.Must(v == 0 && l != 0)
+
+	// the TCP conn is found under the conns wrapping it
+	sock, err := net.Dial("tcp", b.Addr)
+	assert.MustNoError(err)
+	defer sock.Close()
+	tc := &tlsConn{Conn: tls.Client(sock, &tls.Config{}), sock: sock}
+	assert.MustNoError(setSockOpts(NewCompressedConn(tc, 0), false, -1))
+	f, err := sock.(*net.TCPConn).File()
+	assert.MustNoError(err)
+	defer f.Close()
+	v, err = syscall.GetsockoptInt(int(f.Fd()), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	assert.MustNoError(err)
+	assert.Must(v == 0)
+}
+
+func TestBackendReplyIntegrity(t *testing.T) {
+	SetReplyIntegrity(true)
+	defer SetReplyIntegrity(false)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	go func() {
+		accept := func() *redis.Conn {
+			c, err := l.Accept()
+			assert.MustNoError(err)
+			return redis.NewConn(c)
+		}
+		read := func(c *redis.Conn) {
+			_, err := c.Reader.Decode()
+			assert.MustNoError(err)
+		}
+		reply := func(c *redis.Conn, resp *redis.Resp) {
+			assert.MustNoError(c.Writer.Encode(resp, true))
+		}
+
+		// no reply to GET
+		c := accept()
+		defer c.Close()
+		read(c)
+		read(c)
+		reply(c, redis.NewInt([]byte("1")))
+
+		// an extra reply to INCR
+		c = accept()
+		defer c.Close()
+		read(c)
+		reply(c, redis.NewInt([]byte("2")))
+		reply(c, redis.NewBulkBytes([]byte("foo")))
+		read(c)
+		reply(c, redis.NewInt([]byte("3")))
+
+		c = accept()
+		defer c.Close()
+		read(c)
+		reply(c, redis.NewInt([]byte("4")))
+	}()
+
+	bc := NewBackendConn(l.Addr().String(), "")
+	defer bc.Close()
+
+	do := func(rs ...*Request) {
+		for _, r := range rs {
+			bc.PushBack(r)
+		}
+		for _, r := range rs {
+			r.Wait.Wait()
+		}
+	}
+	desyncs := ReplyDesyncs()
+
+	r1, r2 := newRequest("GET", "b"), newRequest("INCR", "a")
+	do(r1, r2)
+	assert.Must(errors.Equal(r1.Response.Err, ErrReplyDesync) && r1.Response.Resp == nil)
+	assert.Must(errors.Equal(r2.Response.Err, ErrReplyDesync))
+
+	r3, r4 := newRequest("INCR", "a"), newRequest("INCR", "a")
+	do(r3)
+	do(r4)
+	assert.Must(r3.Response.Err == nil && string(r3.Response.Resp.Value) == "2")
+	assert.Must(errors.Equal(r4.Response.Err, ErrReplyDesync) && r4.Response.Resp == nil)
+	assert.Must(ReplyDesyncs() == desyncs+2)
+
+	r5 := newRequest("INCR", "a")
+	do(r5)
+	assert.Must(r5.Response.Err == nil && string(r5.Response.Resp.Value) == "4")
+}
+
+func TestReplyTypes(t *testing.T) {
+	rank := redis.NewInt([]byte("1"))
+	withscore := redis.NewArray([]*redis.Resp{redis.NewInt([]byte("1")), redis.NewBulkBytes([]byte("2.5"))})
+	for _, x := range []struct {
+		r    *Request
+		resp *redis.Resp
+		ok   bool
+	}{
+		{newRequest("ZRANK", "z", "a"), rank, true},
+		{newRequest("ZRANK", "z", "a", "WITHSCORE"), withscore, true},
+		{newRequest("ZREVRANK", "z", "a", "WITHSCORE"), withscore, true},
+		{newRequest("ZRANK", "z", "a"), redis.NewBulkBytes(nil), true},
+		{newRequest("ZRANK", "z", "a"), redis.NewString([]byte("OK")), false},
+		{newRequest("GET", "a"), withscore, false},
+	} {
+		assert.Must(isReplyInSync(x.r, x.resp) == x.ok)
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	reads atomic2.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n != 0 {
+		c.reads.Incr()
+	}
+	return n, err
+}
+
+func TestBackendHandshakeSelect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	var ops = make(chan string, 16)
+	var conns = make(chan *countingConn, 1)
+	go func() {
+		c, err := l.Accept()
+		assert.MustNoError(err)
+		cc := &countingConn{Conn: c}
+		conns <- cc
+		conn := redis.NewConn(cc)
+		defer conn.Close()
+		for {
+			resp, err := conn.Reader.Decode()
+			if err != nil {
+				return
+			}
+			var args []string
+			for _, x := range resp.Array {
+				args = append(args, string(x.Value))
+			}
+			ops <- strings.Join(args, " ")
+			if err := conn.Writer.Encode(redis.NewString([]byte("OK")), true); err != nil {
+				return
+			}
+		}
+	}()
+
+	bc := NewBackendConn(l.Addr().String(), "foobar")
+	defer bc.Close()
+
+	r := newRequest("GET", "foo")
+	r.db = 2
+	bc.PushBack(r)
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+
+	assert.Must(<-ops == "AUTH foobar" && <-ops == "SELECT 2" && <-ops == "GET foo")
+	assert.Must((<-conns).reads.Get() == 2)
+}
+
+func TestBackendBrokenReaderOrder(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	var ops = make(chan string, 16)
+	go func() {
+		for k := 0; ; k++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(k int) {
+				conn := redis.NewConn(c)
+				defer conn.Close()
+				for {
+					resp, err := conn.Reader.Decode()
+					if err != nil || k == 0 {
+						// the first conn breaks before replying
+						return
+					}
+					ops <- string(resp.Array[2].Value)
+					if err := conn.Writer.Encode(redis.NewString([]byte("OK")), true); err != nil {
+						return
+					}
+				}
+			}(k)
+		}
+	}()
+
+	bc := NewBackendConn(l.Addr().String(), "")
+	defer bc.Close()
+
+	r := newRequest("SET", "foo", "0")
+	bc.PushBack(r)
+	r.Wait.Wait()
+	assert.Must(r.Response.Err != nil)
+
+	var rs []*Request
+	for i := 1; i <= 8; i++ {
+		r := newRequest("SET", "foo", strconv.Itoa(i))
+		bc.PushBack(r)
+		rs = append(rs, r)
+	}
+	for i, r := range rs {
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		assert.Must(<-ops == strconv.Itoa(i+1))
+	}
+}
+
+func TestBackendReplyTruncated(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		assert.MustNoError(err)
+		conn := redis.NewConn(c)
+		_, err = conn.Reader.Decode()
+		assert.MustNoError(err)
+		_, err = c.Write([]byte("$10\r\nabc"))
+		assert.MustNoError(err)
+		c.(*net.TCPConn).SetLinger(0)
+		c.Close()
+
+		c, err = l.Accept()
+		assert.MustNoError(err)
+		conn = redis.NewConn(c)
+		defer conn.Close()
+		for {
+			if _, err := conn.Reader.Decode(); err != nil {
+				return
+			}
+			assert.MustNoError(conn.Writer.Encode(redis.NewBulkBytes([]byte("bar")), true))
+		}
+	}()
+
+	bc := NewBackendConn(l.Addr().String(), "")
+	defer bc.Close()
+
+	r1, r2 := newRequest("GET", "foo"), newRequest("GET", "foo")
+	bc.PushBack(r1)
+	bc.PushBack(r2)
+	r1.Wait.Wait()
+	r2.Wait.Wait()
+	assert.Must(errors.Equal(r1.Response.Err, ErrReplyTruncated) && r1.Response.Resp == nil)
+	if r2.Response.Err == nil {
+		assert.Must(string(r2.Response.Resp.Value) == "bar")
+	} else {
+		assert.Must(r2.Response.Resp == nil)
+	}
+
+	r3 := newRequest("GET", "foo")
+	bc.PushBack(r3)
+	r3.Wait.Wait()
+	assert.MustNoError(r3.Response.Err)
+	assert.Must(string(r3.Response.Resp.Value) == "bar")
+}
+
+type meteredConn struct {
+	net.Conn
+	n *atomic2.Int64
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestBackendCompression(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	var raw atomic2.Int64
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := redis.NewConn(NewCompressedConn(&meteredConn{Conn: c, n: &raw}, 64))
+				defer conn.Close()
+				for {
+					resp, err := conn.Reader.Decode()
+					if err != nil {
+						return
+					}
+					assert.MustNoError(conn.Writer.Encode(resp.Array[len(resp.Array)-1], true))
+				}
+			}()
+		}
+	}()
+	SetBackendCompression([]string{l.Addr().String()}, 64)
+	defer SetBackendCompression(nil, 0)
+
+	bc := NewBackendConn(l.Addr().String(), "")
+	defer bc.Close()
+
+	big := strings.Repeat("abcdefgh", 4096)
+	var rs []*Request
+	for i := 0; i < 100; i++ {
+		v := strconv.Itoa(i)
+		if i%10 == 0 {
+			v = big + v
+		}
+		r := newRequest("ECHO", v)
+		bc.PushBack(r)
+		rs = append(rs, r)
+	}
+	for i, r := range rs {
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		v := strconv.Itoa(i)
+		if i%10 == 0 {
+			v = big + v
+		}
+		assert.Must(string(r.Response.Resp.Value) == v)
+	}
+	assert.Must(raw.Get() < int64(len(big)))
+}
+
+func TestCompressedConnFrames(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// a write longer than a frame is split
+	big := bytes.Repeat([]byte("abcdefgh"), maxFrameLen/8+16)
+	go func() {
+		n, err := NewCompressedConn(a, 64).Write(big)
+		assert.MustNoError(err)
+		assert.Must(n == len(big))
+	}()
+	c := NewCompressedConn(b, 64)
+	buf := make([]byte, len(big))
+	_, err := io.ReadFull(c, buf)
+	assert.MustNoError(err)
+	assert.Must(bytes.Equal(buf, big))
+
+	// and a frame inflating to more than that is refused
+	var payload bytes.Buffer
+	fw, err := flate.NewWriter(&payload, flate.BestSpeed)
+	assert.MustNoError(err)
+	_, err = fw.Write(make([]byte, maxFrameLen+1))
+	assert.MustNoError(err)
+	assert.MustNoError(fw.Close())
+	go func() {
+		var hdr [5]byte
+		hdr[0] = frameFlate
+		binary.BigEndian.PutUint32(hdr[1:], uint32(payload.Len()))
+		a.Write(append(hdr[:], payload.Bytes()...))
+	}()
+	_, err = c.Read(buf)
+	assert.Must(errors.Equal(err, ErrBadCompressedFrame))
+}
+
+func TestBackendResolver(t *testing.T) {
+	one := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("one"))
+	})
+	defer one.Close()
+	_, port, err := net.SplitHostPort(one.Addr)
+	assert.MustNoError(err)
+	two := newFakeBackendAt(net.JoinHostPort("127.0.0.2", port), func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("two"))
+	})
+	defer two.Close()
+
+	var mu sync.Mutex
+	var ip = "127.0.0.1"
+	SetBackendResolver(func(host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if host != "backend.test" {
+			return nil, errors.New("no such host")
+		}
+		return []string{ip}, nil
+	})
+	defer SetBackendResolver(nil)
+	move := func(to string) {
+		mu.Lock()
+		ip = to
+		mu.Unlock()
+	}
+
+	s := New()
+	defer s.Close()
+	addr := net.JoinHostPort("backend.test", port)
+	i := hashSlot([]byte("foo"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, addr, "", false))
+	get := func() string {
+		r := newRequest("GET", "foo")
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		return string(r.Response.Resp.Value)
+	}
+	assert.Must(get() == "one")
+
+	// a live conn keeps its address until it's checked
+	move("127.0.0.2")
+	assert.Must(get() == "one")
+	assert.Must(s.CheckBackendDNS() == 1)
+	assert.Must(get() == "two")
+	assert.Must(s.CheckBackendDNS() == 0)
+
+	// a reconnect resolves the name again
+	move("127.0.0.1")
+	assert.Must(s.ReapIdle(0) == 1)
+	for s.pool[addr].conns[0].connected.Get() {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(get() == "one")
+}
+
+func newCountingBackend() (net.Listener, *atomic2.Int64) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	var reads atomic2.Int64
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				cc := &countingConn{Conn: c}
+				conn := redis.NewConn(cc)
+				defer func() {
+					reads.Add(cc.reads.Get())
+					conn.Close()
+				}()
+				for {
+					if _, err := conn.Reader.Decode(); err != nil {
+						return
+					}
+					if err := conn.Writer.Encode(redis.NewString([]byte("OK")), true); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l, &reads
+}
+
+func TestBackendFlushDelay(t *testing.T) {
+	l, _ := newCountingBackend()
+	defer l.Close()
+
+	const delay = time.Millisecond * 50
+	s := New()
+	defer s.Close()
+	s.SetBackendFlushDelay(delay)
+
+	sbc := s.newBackendConn(l.Addr().String())
+	defer sbc.Close()
+	bc := sbc.Conn(nil)
+
+	do := func() time.Duration {
+		start := time.Now()
+		r := newRequest("SET", "foo", "bar")
+		bc.PushBack(r)
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		return time.Since(start)
+	}
+	// the first request after a quiet period is written at once
+	time.Sleep(delay * 2)
+	assert.Must(do() < delay/2)
+
+	// the ones following it closely are held, but for no more than delay
+	for i := 0; i < 4; i++ {
+		elapsed := do()
+		assert.Must(elapsed >= delay*8/10 && elapsed < delay*3)
+	}
+}
+
+func benchmarkBackendFlushDelay(b *testing.B, delay time.Duration) {
+	l, reads := newCountingBackend()
+	defer l.Close()
+
+	s := New()
+	defer s.Close()
+	s.SetBackendFlushDelay(delay)
+
+	sbc := s.newBackendConn(l.Addr().String())
+	bc := sbc.Conn(nil)
+	do := func() {
+		r := newRequest("SET", "foo", "bar")
+		bc.PushBack(r)
+		r.Wait.Wait()
+	}
+	do()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// a burst of requests arriving one by one
+		var wg sync.WaitGroup
+		for j := 0; j < 16; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				do()
+			}()
+			time.Sleep(time.Microsecond * 5)
+		}
+		wg.Wait()
+	}
+	b.StopTimer()
+
+	sbc.Close()
+	l.Close()
+	for i := 0; i < 100 && reads.Get() == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	b.Logf("%.1f writes/op", float64(reads.Get())/float64(b.N))
+}
+
+func BenchmarkBackendFlushDelay0(b *testing.B) {
+	benchmarkBackendFlushDelay(b, 0)
+}
+
+func BenchmarkBackendFlushDelay200us(b *testing.B) {
+	benchmarkBackendFlushDelay(b, time.Microsecond*200)
+}
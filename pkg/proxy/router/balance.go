@@ -0,0 +1,64 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+// SlotImbalance tells how the slots are badly distributed, see
+// CheckSlotBalance.
+type SlotImbalance struct {
+	Unassigned int
+	Overloaded map[string]int
+	Total      int
+}
+
+func (e *SlotImbalance) Error() string {
+	var msgs []string
+	if e.Unassigned != 0 {
+		msgs = append(msgs, fmt.Sprintf("%d of %d slots have no backend", e.Unassigned, e.Total))
+	}
+	var addrs []string
+	for addr := range e.Overloaded {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		msgs = append(msgs, fmt.Sprintf("backend %s holds %d of %d slots", addr, e.Overloaded[addr], e.Total))
+	}
+	return "slots are imbalanced: " + strings.Join(msgs, "; ")
+}
+
+// CheckSlotBalance returns a *SlotImbalance, and logs it, if some slots
+// have no backend, or if a backend holds more than max of the slots, e.g.
+// 0.5 for half of them, see BackendDistribution. A max of 0 only checks
+// the coverage, and so does a single backend, which holds all the slots
+// anyway.
+func (s *Router) CheckSlotBalance(max float64) error {
+	dist := s.BackendDistribution()
+	s.rwlck.RLock()
+	total := len(s.slots)
+	s.rwlck.RUnlock()
+
+	e := &SlotImbalance{Total: total, Unassigned: total}
+	for addr, n := range dist {
+		e.Unassigned -= n
+		if max > 0 && len(dist) > 1 && float64(n) > max*float64(total) {
+			if e.Overloaded == nil {
+				e.Overloaded = make(map[string]int)
+			}
+			e.Overloaded[addr] = n
+		}
+	}
+	if e.Unassigned == 0 && len(e.Overloaded) == 0 {
+		return nil
+	}
+	log.Warnf("%s", e)
+	return e
+}
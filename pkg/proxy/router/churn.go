@@ -0,0 +1,103 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+var ErrConnRateLimited = errors.New("max number of new connections per window reached")
+
+var churn struct {
+	opened, closed atomic2.Int64
+	rejected       atomic2.Int64
+
+	sampling sync.Once
+
+	limit struct {
+		sync.Mutex
+		n      int
+		window time.Duration
+		start  time.Time
+		count  int
+	}
+}
+
+// sampleChurn starts sampling the rates of ConnChurn each second, from the
+// first session on, as there is no churn before.
+func sampleChurn() {
+	churn.sampling.Do(func() {
+		go func() {
+			for {
+				start := time.Now()
+				opened, closed := sessions.total.Get(), sessions.closed.Get()
+				time.Sleep(time.Second)
+				scale := float64(time.Second) / float64(time.Since(start))
+				churn.opened.Set(int64(float64(sessions.total.Get()-opened)*scale + 0.5))
+				churn.closed.Set(int64(float64(sessions.closed.Get()-closed)*scale + 0.5))
+			}
+		}()
+	})
+}
+
+// SetConnRateLimit limits the new client conns to n per window, the excess
+// ones should be refused, see AcceptConn. It bounds how fast clients may
+// reconnect, the number of clients is not limited. 0 disables it, and the
+// window defaults to a second.
+func SetConnRateLimit(n int, window time.Duration) {
+	if window <= 0 {
+		window = time.Second
+	}
+	churn.limit.Lock()
+	defer churn.limit.Unlock()
+	churn.limit.n = n
+	churn.limit.window = window
+	churn.limit.start = time.Time{}
+	churn.limit.count = 0
+}
+
+// AcceptConn counts a new client conn against the rate limit, and returns
+// ErrConnRateLimited if it must be refused, see RejectConn.
+func AcceptConn() error {
+	churn.limit.Lock()
+	defer churn.limit.Unlock()
+	if churn.limit.n == 0 {
+		return nil
+	}
+	if now := time.Now(); now.Sub(churn.limit.start) >= churn.limit.window {
+		churn.limit.start, churn.limit.count = now, 0
+	}
+	if churn.limit.count >= churn.limit.n {
+		churn.rejected.Incr()
+		return ErrConnRateLimited
+	}
+	churn.limit.count++
+	return nil
+}
+
+// RejectConn replies the error to the client and closes the conn.
+func RejectConn(c net.Conn, err error) {
+	w := redis.NewConn(c)
+	w.WriterTimeout = time.Second
+	w.Writer.Encode(redis.NewError([]byte("ERR "+err.Error())), true)
+	w.Close()
+}
+
+// ConnChurn returns the number of client conns opened and closed in the
+// last second.
+func ConnChurn() (opened, closed int64) {
+	return churn.opened.Get(), churn.closed.Get()
+}
+
+// RejectedConns returns the number of client conns refused by the rate
+// limit.
+func RejectedConns() int64 {
+	return churn.rejected.Get()
+}
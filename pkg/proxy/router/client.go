@@ -0,0 +1,74 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+)
+
+// handleClient handles CLIENT, which is never forwarded, since the backend
+// conns are shared by all the clients. The subcommands about the session
+// itself are handled by the proxy, the others are rejected:
+//
+//	CLIENT SETNAME <name>, GETNAME: the name of the session.
+//	CLIENT SETINFO <attr> <value>: accepted and ignored.
+//	CLIENT NO-EVICT ON|OFF, NO-TOUCH ON|OFF: the flags are kept by the
+//	session, with no effect though: the proxy doesn't evict clients for
+//	memory, it stops reading them, see SetReplyBufferBudget, and keys are
+//	touched by the backends anyway, on the shared conns.
+//	CLIENT KILL, LIST, PAUSE and so on: rejected, they are about the clients
+//	of a backend, which are proxies and not the clients of the proxy.
+func (s *Session) handleClient(r *Request) (*Request, error) {
+	if len(r.Resp.Array) < 2 {
+		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'CLIENT' command"))
+		return r, nil
+	}
+	args := r.Resp.Array[2:]
+	sub := strings.ToUpper(string(r.Resp.Array[1].Value))
+	switch sub {
+	case "SETNAME", "GETNAME", "SETINFO", "NO-EVICT", "NO-TOUCH":
+	default:
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR CLIENT %s is not supported by the proxy", sub)))
+		return r, nil
+	}
+	if n := map[string]int{"SETNAME": 1, "GETNAME": 0, "SETINFO": 2, "NO-EVICT": 1, "NO-TOUCH": 1}[sub]; len(args) != n {
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR wrong number of arguments for 'CLIENT|%s' command", strings.ToLower(sub))))
+		return r, nil
+	}
+	switch sub {
+	case "SETNAME":
+		if strings.ContainsAny(string(args[0].Value), " \n") {
+			r.Response.Resp = redis.NewError([]byte("ERR Client names cannot contain spaces, newlines or special characters."))
+			return r, nil
+		}
+		s.name = string(args[0].Value)
+	case "GETNAME":
+		if s.name == "" {
+			r.Response.Resp = redis.NewBulkBytes(nil)
+		} else {
+			r.Response.Resp = redis.NewBulkBytes([]byte(s.name))
+		}
+		return r, nil
+	case "NO-EVICT", "NO-TOUCH":
+		var on bool
+		switch strings.ToUpper(string(args[0].Value)) {
+		case "ON":
+			on = true
+		case "OFF":
+		default:
+			r.Response.Resp = redis.NewError([]byte("ERR syntax error"))
+			return r, nil
+		}
+		if sub == "NO-EVICT" {
+			s.noevict.Set(on)
+		} else {
+			s.notouch.Set(on)
+		}
+	}
+	r.Response.Resp = redis.NewString([]byte("OK"))
+	return r, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// readFlight is a read forwarded to a backend, with the requests waiting for
+// its reply, the first one included.
+type readFlight struct {
+	start  time.Time
+	joined []*Request
+}
+
+// SetReadCoalescing makes concurrent identical reads, the same command with
+// the same args, share a single round trip to the backend: a read arriving
+// while the same one is waiting for its reply gets that reply as well,
+// instead of being forwarded. Other requests are forwarded as usual. Reads
+// whose reply may differ from a run to another, SRANDMEMBER and the SCAN
+// family, are never coalesced. A read doesn't join one forwarded before
+// its own session last wrote to the slot, so a session always reads its
+// writes. It's disabled by default.
+func (s *Router) SetReadCoalescing(enabled bool) {
+	s.coalescing.enabled.Set(enabled)
+}
+
+// CoalescedReads returns the number of reads that got the reply of another
+// one instead of being forwarded, see SetReadCoalescing.
+func (s *Router) CoalescedReads() int64 {
+	return s.coalescing.joined.Get()
+}
+
+func isCoalescable(opstr string) bool {
+	switch opstr {
+	case "SRANDMEMBER", "HSCAN", "SSCAN", "ZSCAN":
+		return false
+	}
+	return isReadOnly(opstr)
+}
+
+func coalesceKey(r *Request) string {
+	var b bytes.Buffer
+	b.WriteString(r.OpStr)
+	for _, a := range r.Resp.Array[1:] {
+		b.WriteByte(' ')
+		b.WriteString(strconv.Itoa(len(a.Value)))
+		b.WriteByte(':')
+		b.Write(a.Value)
+	}
+	return b.String()
+}
+
+// dispatchCoalesced makes the request join the flight of an identical read,
+// or forwards it as a new flight, see SetReadCoalescing.
+func (s *Router) dispatchCoalesced(r *Request, hkey []byte) (bool, error) {
+	if !s.coalescing.enabled.Get() || r.Wait == nil {
+		return false, nil
+	}
+	id := s.slotOf(hkey).id
+	if !isCoalescable(r.OpStr) {
+		if r.writes != nil && !isReadOnly(r.OpStr) {
+			r.writes.mark(id)
+		}
+		return false, nil
+	}
+
+	key := coalesceKey(r)
+	s.coalescing.Lock()
+	if f := s.coalescing.flights[key]; f != nil {
+		if r.writes == nil || !r.writes.after(id, f.start) {
+			r.Wait.Add(1)
+			f.joined = append(f.joined, r)
+			s.coalescing.Unlock()
+			s.coalescing.joined.Incr()
+			return true, nil
+		}
+		s.coalescing.Unlock()
+		return false, nil
+	}
+	f := &readFlight{start: time.Now(), joined: []*Request{r}}
+	if s.coalescing.flights == nil {
+		s.coalescing.flights = make(map[string]*readFlight)
+	}
+	s.coalescing.flights[key] = f
+	s.coalescing.Unlock()
+	r.Wait.Add(1)
+
+	x := r.subRequest(r.Resp)
+	x.Wait, x.Failed, x.output = &sync.WaitGroup{}, nil, nil
+	if err := s.dispatch(x, hkey); err != nil {
+		joined := s.landFlight(key, f)
+		for _, j := range joined[1:] {
+			j.Response.Err = err
+			if j.Failed != nil {
+				j.Failed.Set(true)
+			}
+			j.Wait.Done()
+		}
+		r.Wait.Done()
+		return true, err
+	}
+	go func() {
+		x.Wait.Wait()
+		for _, j := range s.landFlight(key, f) {
+			j.Response, j.loading, j.backend = x.Response, x.loading, x.backend
+			if j.Response.Err != nil && j.Failed != nil {
+				j.Failed.Set(true)
+			}
+			if j.output != nil {
+				j.output.add(j.Response.Resp)
+			}
+			j.Wait.Done()
+		}
+	}()
+	return true, nil
+}
+
+// landFlight removes the flight, so no more requests join it, and returns
+// the ones that did.
+func (s *Router) landFlight(key string, f *readFlight) []*Request {
+	s.coalescing.Lock()
+	defer s.coalescing.Unlock()
+	if s.coalescing.flights[key] == f {
+		delete(s.coalescing.flights, key)
+	}
+	return f.joined
+}
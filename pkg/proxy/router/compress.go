@@ -0,0 +1,179 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+var ErrBadCompressedFrame = errors.New("bad compressed frame")
+
+const (
+	frameRaw   = 0
+	frameFlate = 1
+
+	maxFrameLen = 1024 * 1024 * 64
+)
+
+var backendCompression struct {
+	sync.Mutex
+	addrs     map[string]bool
+	threshold int
+}
+
+// SetBackendCompression makes the conns to the backends of addrs, dialed
+// afterwards, see RecyclePool, compress the stream of requests and replies,
+// for backends behind a slow link, e.g. in another region. Redis doesn't
+// speak it, so each of these backends must be behind a relay that sets up
+// the other end with NewCompressedConn, next to it. Writes shorter than
+// threshold bytes are sent as is, as compressing small pipelines costs more
+// CPU than the bytes it saves. It trades the CPU of both ends, and some
+// latency, for bandwidth: it pays off for large values and deep pipelines,
+// much less so for small random keys. Nil addrs disables it.
+func SetBackendCompression(addrs []string, threshold int) {
+	backendCompression.Lock()
+	defer backendCompression.Unlock()
+	backendCompression.addrs = make(map[string]bool)
+	for _, addr := range addrs {
+		backendCompression.addrs[addr] = true
+	}
+	backendCompression.threshold = threshold
+}
+
+func getBackendCompression(addr string) (bool, int) {
+	backendCompression.Lock()
+	defer backendCompression.Unlock()
+	return backendCompression.addrs[addr], backendCompression.threshold
+}
+
+// compressedConn frames each write: a byte telling whether the payload is
+// compressed, its length as 4 bytes big endian, and the payload. Frames are
+// compressed on their own, so a frame never depends on the previous ones,
+// and a write is always sent at once, so pipelining is kept. Writes longer
+// than maxFrameLen are split, no frame is longer than that, compressed or
+// not.
+type compressedConn struct {
+	net.Conn
+	threshold int
+
+	wmu  sync.Mutex
+	wbuf bytes.Buffer
+	fw   *flate.Writer
+
+	rbuf bytes.Buffer
+	fr   io.ReadCloser
+	hdr  [5]byte
+}
+
+// NewCompressedConn wraps the conn with the compression of the backend
+// conns, see SetBackendCompression, for the relay to redis at the other
+// end. Writes shorter than threshold bytes are not compressed.
+func NewCompressedConn(c net.Conn, threshold int) net.Conn {
+	return &compressedConn{Conn: c, threshold: threshold}
+}
+
+// NetConn returns the wrapped conn, see setSockOpts.
+func (c *compressedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *compressedConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var n int
+	for n != len(b) {
+		p := b[n:]
+		if len(p) > maxFrameLen {
+			p = p[:maxFrameLen]
+		}
+		if err := c.writeFrame(p); err != nil {
+			return n, err
+		}
+		n += len(p)
+	}
+	return n, nil
+}
+
+func (c *compressedConn) writeFrame(b []byte) error {
+	c.wbuf.Reset()
+	c.wbuf.Write([]byte{frameRaw, 0, 0, 0, 0})
+	if len(b) >= c.threshold {
+		if c.fw == nil {
+			c.fw, _ = flate.NewWriter(&c.wbuf, flate.BestSpeed)
+		} else {
+			c.fw.Reset(&c.wbuf)
+		}
+		if _, err := c.fw.Write(b); err != nil {
+			return errors.Trace(err)
+		}
+		if err := c.fw.Close(); err != nil {
+			return errors.Trace(err)
+		}
+		if c.wbuf.Len()-5 < len(b) {
+			c.wbuf.Bytes()[0] = frameFlate
+		} else {
+			c.wbuf.Truncate(5)
+		}
+	}
+	if c.wbuf.Bytes()[0] == frameRaw {
+		c.wbuf.Write(b)
+	}
+	frame := c.wbuf.Bytes()
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(frame)-5))
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	for c.rbuf.Len() == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	return c.rbuf.Read(b)
+}
+
+func (c *compressedConn) readFrame() error {
+	if _, err := io.ReadFull(c.Conn, c.hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(c.hdr[1:5])
+	if n > maxFrameLen {
+		return errors.Trace(ErrBadCompressedFrame)
+	}
+	payload := io.LimitReader(c.Conn, int64(n))
+	c.rbuf.Reset()
+	switch c.hdr[0] {
+	case frameRaw:
+		if _, err := io.CopyN(&c.rbuf, payload, int64(n)); err != nil {
+			return err
+		}
+	case frameFlate:
+		if c.fr == nil {
+			c.fr = flate.NewReader(payload)
+		} else if err := c.fr.(flate.Resetter).Reset(payload, nil); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := io.Copy(&c.rbuf, io.LimitReader(c.fr, maxFrameLen+1)); err != nil {
+			return err
+		}
+		if c.rbuf.Len() > maxFrameLen {
+			return errors.Trace(ErrBadCompressedFrame)
+		}
+		if _, err := io.Copy(ioutil.Discard, payload); err != nil {
+			return err
+		}
+	default:
+		return errors.Trace(ErrBadCompressedFrame)
+	}
+	return nil
+}
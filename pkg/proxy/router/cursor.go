@@ -0,0 +1,86 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+)
+
+// cursorPins is the backend endpoint each cursor iteration of a session is
+// pinned to, by the key iterated, whatever it's routed by, since a cursor
+// only means something to the endpoint that issued it.
+type cursorPins struct {
+	sync.Mutex
+	addrs map[string]string
+}
+
+func (c *cursorPins) get(key []byte) string {
+	c.Lock()
+	defer c.Unlock()
+	return c.addrs[string(key)]
+}
+
+func (c *cursorPins) set(key []byte, addr string) {
+	c.Lock()
+	defer c.Unlock()
+	if addr == "" {
+		delete(c.addrs, string(key))
+		return
+	}
+	if c.addrs == nil {
+		c.addrs = make(map[string]string)
+	}
+	c.addrs[string(key)] = addr
+}
+
+func isCursorCommand(opstr string) bool {
+	switch opstr {
+	case "HSCAN", "SSCAN", "ZSCAN":
+		return true
+	}
+	return false
+}
+
+// forwardCursor forwards a cursor command of a session. An iteration starts
+// on the primary of the slot, or on a replica if it's a failover, never
+// hedged, and the rest of it goes to the same endpoint, be it the primary
+// or the replica, until the cursor returns to 0. If the replica is no
+// longer available, or no longer a replica of the slot, the iteration goes
+// on at the primary, and it may miss or repeat elements, like SCAN after a
+// failover in redis.
+func (s *Router) forwardCursor(r *Request, slot *Slot, hkey []byte, f *forwarding) error {
+	var key, cursor []byte
+	if len(r.Resp.Array) > 2 {
+		key, cursor = r.Resp.Array[1].Value, r.Resp.Array[2].Value
+	}
+	var pinned string
+	if string(cursor) != "0" {
+		pinned = r.cursors.get(key)
+	}
+	var err error
+	switch {
+	case pinned != "" && slot.forwardReplicaAddr(r, hkey, pinned):
+	case pinned == "" && f.failover && slot.forwardReplica(r, hkey, f.zone):
+	default:
+		err = slot.forward(r, hkey, nil)
+	}
+	if err != nil {
+		return err
+	}
+	coalesce := r.Coalesce
+	r.Coalesce = func() error {
+		if resp := r.Response.Resp; r.Response.Err == nil && resp != nil && resp.IsArray() && len(resp.Array) == 2 {
+			if string(resp.Array[0].Value) == "0" {
+				r.cursors.set(key, "")
+			} else {
+				r.cursors.set(key, r.backend)
+			}
+		}
+		if coalesce != nil {
+			return coalesce()
+		}
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+)
+
+const dialTimeout = time.Second
+
+var dialer struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	max, inflight int
+	jitter        time.Duration
+
+	handshake Handshake
+}
+
+func init() {
+	dialer.cond = sync.NewCond(&dialer.Mutex)
+}
+
+// SetDialLimit limits the number of backend connects in progress at the
+// same time, across all backend conns, and adds a random delay up to
+// jitter before a broken conn is dialed again. So the backends coming back
+// after a massive failure are not overwhelmed by all the proxies at once.
+// A max of 0 means no limit.
+func SetDialLimit(max int, jitter time.Duration) {
+	dialer.Lock()
+	dialer.max, dialer.jitter = max, jitter
+	dialer.cond.Broadcast()
+	dialer.Unlock()
+}
+
+// DialsInFlight returns the number of backend connects in progress.
+func DialsInFlight() int {
+	dialer.Lock()
+	defer dialer.Unlock()
+	return dialer.inflight
+}
+
+func acquireDial() {
+	dialer.Lock()
+	for dialer.max != 0 && dialer.inflight >= dialer.max {
+		dialer.cond.Wait()
+	}
+	dialer.inflight++
+	dialer.Unlock()
+}
+
+func releaseDial() {
+	dialer.Lock()
+	dialer.inflight--
+	dialer.cond.Signal()
+	dialer.Unlock()
+}
+
+func dialJitter() time.Duration {
+	dialer.Lock()
+	jitter := dialer.jitter
+	dialer.Unlock()
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// Handshake prepares a new backend conn before any request is sent on it,
+// e.g. AUTH, HELLO or CLIENT SETNAME. An error drops the conn and it's
+// dialed again later. It must be done within the dial timeout, the conn
+// has a deadline set meanwhile.
+type Handshake func(c *redis.Conn, addr, auth string) error
+
+// SetBackendHandshake replaces the handshake of the backend conns dialed
+// afterwards, nil restores the default AuthHandshake.
+func SetBackendHandshake(fn Handshake) {
+	dialer.Lock()
+	dialer.handshake = fn
+	dialer.Unlock()
+}
+
+func handshake(c *redis.Conn, addr, auth string, timeout time.Duration) error {
+	_, err := handshakeDB(c, addr, auth, 0, timeout)
+	return err
+}
+
+// handshakeDB is the same as handshake, but the default one also selects
+// the db, in the same write as AUTH, to save a round trip on the first
+// request. It returns the db selected, a custom handshake selects none, so
+// the conn is left on db 0 then.
+func handshakeDB(c *redis.Conn, addr, auth string, db int, timeout time.Duration) (int, error) {
+	dialer.Lock()
+	fn := dialer.handshake
+	dialer.Unlock()
+	c.ReaderTimeout, c.WriterTimeout = 0, 0
+	if err := c.Sock.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+	if fn == nil {
+		if err := authSelectHandshake(c, auth, db); err != nil {
+			return 0, err
+		}
+	} else {
+		if err := fn(c, addr, auth); err != nil {
+			return 0, err
+		}
+		db = 0
+	}
+	return db, c.Sock.SetDeadline(time.Time{})
+}
@@ -0,0 +1,156 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"net"
+	"sync"
+
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+// Resolver returns the IP addresses of the hostname of a backend.
+type Resolver func(host string) ([]string, error)
+
+var resolver struct {
+	sync.Mutex
+	fn Resolver
+}
+
+// SetBackendResolver replaces how the hostnames of the backends are resolved,
+// nil restores the resolver of the system. Either way, a backend conn
+// resolves the hostname again on each connect, so once the conn is broken,
+// e.g. by a failover that moves the name to another IP, it reconnects to the
+// new IP. The conns still alive on the old IP are left to CheckBackendDNS.
+func SetBackendResolver(fn Resolver) {
+	resolver.Lock()
+	resolver.fn = fn
+	resolver.Unlock()
+}
+
+func lookupHost(host string) ([]string, error) {
+	resolver.Lock()
+	fn := resolver.fn
+	resolver.Unlock()
+	if fn == nil {
+		return net.LookupHost(host)
+	}
+	return fn(host)
+}
+
+var errNoAddress = errors.New("no address for the host of the backend")
+
+// resolveAddr returns the addr to dial, with its host resolved by the
+// resolver set, see SetBackendResolver. Without one, the addr is dialed as
+// is, net.Dial resolves it each time as well.
+func resolveAddr(addr string) (string, error) {
+	resolver.Lock()
+	fn := resolver.fn
+	resolver.Unlock()
+	if fn == nil {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := fn(host)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if len(ips) == 0 {
+		return "", errors.Trace(errNoAddress)
+	}
+	return net.JoinHostPort(ips[0], port), nil
+}
+
+// CheckBackendDNS resolves the hostnames of the backends in the pool, and
+// recycles the conns connected to an IP the hostname doesn't resolve to
+// anymore, so they reconnect to the new one without waiting for the old one
+// to break. Requests already sent on them still get their replies, the
+// other ones go to the new conns. It returns the number of conns recycled.
+func (s *Router) CheckBackendDNS() int {
+	s.mu.Lock()
+	var hosts = make(map[string]bool)
+	for addr := range s.pool {
+		if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host) == nil {
+			hosts[host] = true
+		}
+	}
+	s.mu.Unlock()
+
+	var resolved = make(map[string]map[string]bool)
+	for host := range hosts {
+		ips, err := lookupHost(host)
+		if err != nil || len(ips) == 0 {
+			log.WarnErrorf(err, "resolve backend host %s failed", host)
+			continue
+		}
+		resolved[host] = make(map[string]bool)
+		for _, ip := range ips {
+			resolved[host][ip] = true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for addr, bc := range s.pool {
+		host, _, _ := net.SplitHostPort(addr)
+		if ips := resolved[host]; ips != nil {
+			if k := bc.recycleStale(ips); k != 0 {
+				log.Warnf("backend %s has moved, %d conns to the old address recycled", addr, k)
+				n += k
+			}
+		}
+	}
+	return n
+}
+
+// staleRequest asks the writer to close the conn, whatever is queued after
+// it, which goes to a new conn. Requests already sent still get their
+// replies, the reader exits after them.
+var staleRequest = &Request{}
+
+var errStaleConn = errors.New("backend conn is to a stale address")
+
+// recycleStale closes the conn if it's connected to none of the ips.
+func (bc *BackendConn) recycleStale(ips map[string]bool) bool {
+	if !bc.connected.Get() {
+		return false
+	}
+	host, _, err := net.SplitHostPort(bc.getRemoteAddr())
+	if err != nil || ips[host] {
+		return false
+	}
+	select {
+	case bc.input <- staleRequest:
+		return true
+	default:
+		return false
+	}
+}
+
+func (bc *BackendConn) setRemoteAddr(addr string) {
+	bc.remote.Lock()
+	bc.remote.addr = addr
+	bc.remote.Unlock()
+}
+
+func (bc *BackendConn) getRemoteAddr() string {
+	bc.remote.Lock()
+	defer bc.remote.Unlock()
+	return bc.remote.addr
+}
+
+func (s *SharedBackendConn) recycleStale(ips map[string]bool) int {
+	var n int
+	for _, bc := range s.conns {
+		if bc.recycleStale(ips) {
+			n++
+		}
+	}
+	return n
+}
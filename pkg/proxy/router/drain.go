@@ -0,0 +1,60 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+var (
+	ErrRouterDraining = errors.New("proxy is draining, reconnect to another one")
+	ErrDrainTimeout   = errors.New("drain timeout, in-flight requests are aborted")
+)
+
+// Drain makes Dispatch reject new requests with ErrRouterDraining, requests
+// already dispatched are not affected. It can't be undone.
+func (s *Router) Drain() {
+	if s.draining.CompareAndSwap(false, true) {
+		log.Infof("router is draining, inflight = %d", s.inflight.Get())
+	}
+}
+
+func (s *Router) Draining() bool {
+	return s.draining.Get()
+}
+
+// Ready reports whether the router accepts new requests, i.e. it's neither
+// draining nor closed. It's meant for readiness probes.
+func (s *Router) Ready() bool {
+	if s.draining.Get() {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.closed
+}
+
+// CloseGracefully drains the router, waits up to timeout for the in-flight
+// requests to be answered and then closes it. It returns ErrDrainTimeout if
+// some requests were still in flight, they fail once the backends are gone.
+// A proxy shutting down on SIGTERM should stop accepting conns first, see
+// proxy.Server.CloseGracefully.
+func (s *Router) CloseGracefully(timeout time.Duration) error {
+	s.Drain()
+	var err error
+	deadline := time.Now().Add(timeout)
+	for s.inflight.Get() != 0 {
+		if !time.Now().Before(deadline) {
+			log.Warnf("drain timeout, inflight = %d", s.inflight.Get())
+			err = ErrDrainTimeout
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	s.Close()
+	return err
+}
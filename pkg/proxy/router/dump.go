@@ -0,0 +1,63 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"encoding/json"
+
+	"github.com/wandoulabs/codis/pkg/models"
+)
+
+type poolDump struct {
+	Addr     string `json:"addr"`
+	Label    string `json:"label,omitempty"`
+	Refcnt   int    `json:"refcnt"`
+	Pending  int    `json:"pending"`
+	InFlight int64  `json:"inflight"`
+	Loading  int64  `json:"loading"`
+	ReadOnly int64  `json:"readonly"`
+}
+
+type routerDump struct {
+	Slots    []*models.SlotInfo     `json:"slots"`
+	Pool     []*poolDump            `json:"pool"`
+	InFlight int64                  `json:"inflight"`
+	Frozen   bool                   `json:"frozen"`
+	Paused   bool                   `json:"paused"`
+	Closed   bool                   `json:"closed"`
+	Config   map[string]interface{} `json:"config"`
+}
+
+// DebugDump returns a snapshot of the whole router state in json, for
+// diagnostics only. The password is never included.
+func (s *Router) DebugDump() ([]byte, error) {
+	d := &routerDump{Slots: s.GetSlots()}
+
+	s.mu.Lock()
+	for addr, bc := range s.pool {
+		d.Pool = append(d.Pool, &poolDump{
+			Addr: addr, Label: s.labels[addr],
+			Refcnt: bc.refcnt, Pending: bc.pending(),
+			InFlight: bc.inflights(),
+			Loading:  bc.loadings(), ReadOnly: bc.readonlys(),
+		})
+	}
+	d.Frozen = s.frozen
+	d.Paused = s.Paused()
+	d.Closed = s.closed
+	d.Config = map[string]interface{}{
+		"auth":          s.auth != "",
+		"read_timeout":  s.timeout.read.String(),
+		"write_timeout": s.timeout.write.String(),
+		"slot_num":      len(s.slots),
+		"backpressure": map[string]int64{
+			"high": s.backpressure.high.Get(),
+			"low":  s.backpressure.low.Get(),
+		},
+	}
+	s.mu.Unlock()
+
+	d.InFlight = s.inflight.Get()
+	return json.Marshal(d)
+}
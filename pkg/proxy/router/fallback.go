@@ -0,0 +1,53 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+// SetFallbackBackend makes the requests to slots with no backend be
+// forwarded to the backend of addr, e.g. a legacy redis that has all the
+// keys not sharded out yet, instead of failing with ErrSlotIsNotReady. An
+// empty addr disables it, which is the default. A slot being filled from
+// another backend is not unassigned, nor are slots whose backend is down.
+// The requests forwarded to the fallback are counted, see FallbackCount.
+func (s *Router) SetFallbackBackend(addr string) {
+	s.rwlck.Lock()
+	s.fallback.addr = addr
+	s.rwlck.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseSelected()
+	if addr != "" {
+		log.Warnf("requests to unassigned slots fall back to %s", addr)
+	}
+}
+
+// FallbackCount returns the number of requests forwarded to the fallback
+// backend.
+func (s *Router) FallbackCount() int64 {
+	return s.fallback.count.Get()
+}
+
+// dispatchFallback forwards the request to the fallback backend, if there
+// is one and its slot has no backend, see SetFallbackBackend.
+func (s *Router) dispatchFallback(r *Request, hkey []byte) (bool, error) {
+	s.rwlck.RLock()
+	addr := s.fallback.addr
+	s.rwlck.RUnlock()
+	if addr == "" {
+		return false, nil
+	}
+	slot := s.slotOf(hkey)
+	slot.lock.RLock()
+	unassigned := slot.backend.bc == nil && slot.migrate.bc == nil
+	slot.lock.RUnlock()
+	if !unassigned {
+		return false, nil
+	}
+	s.fallback.count.Incr()
+	return true, s.forwardPooled(r, slot, hkey, addr)
+}
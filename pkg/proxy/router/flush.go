@@ -0,0 +1,44 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import "time"
+
+// SetBackendFlushDelay makes the backend conns hold the requests written
+// while their queue runs empty for up to delay, instead of flushing them at
+// once, so the requests of a burst arriving one by one are sent in fewer
+// writes. Like Nagle, the first request after a quiet period is still
+// written at once, only the ones following it closely are held, and never
+// for more than delay, give or take the resolution of the timers, which may
+// be as coarse as a millisecond. It trades a bounded latency for fewer
+// syscalls on both ends. 0 flushes as soon as the queue is empty, which is
+// the default. It only applies to the conns created afterwards, see
+// RecyclePool.
+func (s *Router) SetBackendFlushDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushDelay = delay
+}
+
+// holdFlush waits until the deadline, in microseconds, for more requests to
+// be written along with the buffered ones, and flushes them if none comes,
+// see Router.SetBackendFlushDelay.
+func (bc *BackendConn) holdFlush(p *FlushPolicy, deadline int64) error {
+	if len(bc.input) != 0 || bc.queue.Len() != 0 {
+		return nil
+	}
+	if wait := deadline - microseconds(); wait > 0 {
+		t := time.NewTimer(time.Duration(wait) * time.Microsecond)
+		defer t.Stop()
+		select {
+		case r, ok := <-bc.input:
+			if ok {
+				bc.queue.PushRequest(r)
+				return nil
+			}
+		case <-t.C:
+		}
+	}
+	return p.Flush(true)
+}
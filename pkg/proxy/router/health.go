@@ -0,0 +1,49 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import "github.com/wandoulabs/codis/pkg/utils/log"
+
+// SetBackendHealth marks the backend unhealthy, or healthy again, as told by
+// a health check of its own, e.g. of the dashboard. The slots whose backend
+// is marked unhealthy are gated: their requests fail with ErrSlotUnavailable
+// right away instead of being forwarded and timing out, but the reads that
+// can go to an available replica, whatever the UnavailablePolicy. Otherwise
+// it's the same as the backend being down, see UnavailablePolicy, except it
+// lasts until it's marked healthy again. Gated slots are told by SlotInfo.
+func (s *Router) SetBackendHealth(addr string, healthy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unhealthy[addr] == !healthy {
+		return
+	}
+	if healthy {
+		delete(s.unhealthy, addr)
+		log.Infof("backend %s is marked healthy", addr)
+	} else {
+		s.unhealthy[addr] = true
+		log.Warnf("backend %s is marked unhealthy, its slots are gated", addr)
+	}
+	if bc := s.pool[addr]; bc != nil {
+		bc.unhealthy.Set(!healthy)
+	}
+	for _, slot := range s.slots {
+		if slot.backend.addr == addr {
+			s.notifySlot(slot)
+		}
+	}
+}
+
+// gated tells whether the backend of the slot is marked unhealthy, see
+// SetBackendHealth. Slots being migrated are never gated. It's called with
+// the slot lock, or the router's mu, held.
+func (s *Slot) gated() bool {
+	return s.backend.bc != nil && s.migrate.bc == nil && s.backend.bc.unhealthy.Get()
+}
+
+func (s *Slot) isGated() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.gated()
+}
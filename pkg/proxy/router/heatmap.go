@@ -0,0 +1,57 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"math"
+	"time"
+)
+
+// heatmapDecay is the time constant of the rates of SlotHeatmap, the weight
+// of a past rate is divided by e every heatmapDecay.
+const heatmapDecay = time.Second * 10
+
+// SlotHeatmap returns the recent rate of requests of each slot, in requests
+// per second, for a heatmap of the slots to spot the hot ones. It's a moving
+// average, updated on each call with the requests since the previous one,
+// see heatmapDecay, so it's meant to be polled, e.g. every few seconds. The
+// first call, and the first one after a slot is resharded, only take the
+// count of the slot as a baseline and report 0 for it. The dispatch path
+// only bumps a counter of the slot, all the work is done here.
+func (s *Router) SlotHeatmap() []uint32 {
+	s.mu.Lock()
+	slots := s.slots
+	s.mu.Unlock()
+
+	s.heatmap.Lock()
+	defer s.heatmap.Unlock()
+	now := time.Now()
+	dt := now.Sub(s.heatmap.last)
+	if s.heatmap.last.IsZero() || dt <= 0 {
+		dt = time.Second
+	}
+	s.heatmap.last = now
+	alpha := 1 - math.Exp(-float64(dt)/float64(heatmapDecay))
+
+	h := &s.heatmap
+	if len(h.slots) != len(slots) {
+		h.slots = make([]*Slot, len(slots))
+		h.hits = make([]int64, len(slots))
+		h.rates = make([]float64, len(slots))
+	}
+	var heatmap = make([]uint32, len(slots))
+	for i, slot := range slots {
+		hits := slot.hits.Get()
+		if h.slots[i] != slot {
+			// new or resharded, the slot starts over
+			h.slots[i], h.hits[i], h.rates[i] = slot, hits, 0
+			continue
+		}
+		rate := float64(hits-h.hits[i]) * float64(time.Second) / float64(dt)
+		h.hits[i] = hits
+		h.rates[i] += alpha * (rate - h.rates[i])
+		heatmap[i] = uint32(h.rates[i] + 0.5)
+	}
+	return heatmap
+}
@@ -0,0 +1,149 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// SetHedging makes the given read commands be sent to a replica of the slot
+// as well, if the backend hasn't replied within delay. The reply that comes
+// first is used and the other one is discarded, unless the replica fails.
+// The replica is the one of the proxy's zone if any, see SetZone, but that
+// only picks where the hedged requests go, the others are not sent to the
+// replicas for it. Only read only commands can be hedged. A delay of 0
+// disables it.
+func (s *Router) SetHedging(delay time.Duration, opstrs []string) {
+	s.rwlck.Lock()
+	defer s.rwlck.Unlock()
+	s.hedging.delay = delay
+	s.hedging.ops = make(map[string]bool)
+	for _, opstr := range opstrs {
+		if isReadOnly(opstr) {
+			s.hedging.ops[opstr] = true
+		}
+	}
+}
+
+// HedgeStats returns the number of hedged requests sent to replicas, and
+// how many of them replied first.
+func (s *Router) HedgeStats() (fired, won int64) {
+	return s.hedging.fired.Get(), s.hedging.won.Get()
+}
+
+// SetHedgingReadYourWrites keeps the reads of a session on the primary, if
+// the same session has written to that slot within the window, so a read
+// pipelined right after a write is never served by a lagging replica. The
+// slot is used rather than the key, so multi-key commands are covered too.
+// The wider the window, the fewer reads can be hedged. A window of 0
+// disables it.
+func (s *Router) SetHedgingReadYourWrites(window time.Duration) {
+	s.rwlck.Lock()
+	defer s.rwlck.Unlock()
+	s.hedging.window = window
+}
+
+func (s *Router) isHedged(r *Request) bool {
+	return s.hedging.delay != 0 && s.hedging.ops[r.OpStr]
+}
+
+// isPinned records the writes of the session, and reports whether the read
+// must be served by the primary of the slot.
+func (s *Router) isPinned(r *Request, slot *Slot) bool {
+	if s.hedging.window == 0 || r.writes == nil {
+		return false
+	}
+	if !isReadOnly(r.OpStr) {
+		r.writes.mark(slot.id)
+		return false
+	}
+	return r.writes.since(slot.id) < s.hedging.window
+}
+
+// slotWrites is the last write time of each slot written by a session.
+type slotWrites struct {
+	sync.Mutex
+	last map[int]time.Time
+}
+
+func (w *slotWrites) mark(id int) {
+	w.Lock()
+	defer w.Unlock()
+	if w.last == nil {
+		w.last = make(map[int]time.Time)
+	}
+	w.last[id] = time.Now()
+}
+
+func (w *slotWrites) since(id int) time.Duration {
+	w.Lock()
+	defer w.Unlock()
+	t, ok := w.last[id]
+	if !ok {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Since(t)
+}
+
+// after reports whether the slot has been written since t.
+func (w *slotWrites) after(id int, t time.Time) bool {
+	w.Lock()
+	defer w.Unlock()
+	last, ok := w.last[id]
+	return ok && !last.Before(t)
+}
+
+func (s *Router) hedge(r *Request, slot *Slot, key []byte, f *forwarding) error {
+	newRequest := func() *Request {
+		x := r.subRequest(r.Resp)
+		x.Wait, x.Failed, x.output = &sync.WaitGroup{}, nil, nil
+		return x
+	}
+	p := newRequest()
+	p.inflight = r.inflight
+	if err := slot.forward(p, key, nil); err != nil {
+		return err
+	}
+	r.inflight, r.backend = nil, p.backend
+	r.Wait.Add(1)
+
+	delay, zone := f.delay, f.zone
+	go func() {
+		done := make(chan *Request, 2)
+		go func() {
+			p.Wait.Wait()
+			done <- p
+		}()
+		var x *Request
+		select {
+		case x = <-done:
+		case <-time.After(delay):
+			h := newRequest()
+			if slot.forwardReplica(h, key, zone) {
+				s.hedging.fired.Incr()
+				go func() {
+					h.Wait.Wait()
+					done <- h
+				}()
+			}
+			if x = <-done; x == h {
+				if h.Response.Err != nil {
+					x = <-done
+				} else {
+					s.hedging.won.Incr()
+				}
+			}
+		}
+		r.Response, r.loading = x.Response, x.loading
+		if r.Response.Err != nil && r.Failed != nil {
+			r.Failed.Set(true)
+		}
+		if r.output != nil {
+			r.output.add(r.Response.Resp)
+		}
+		r.Wait.Done()
+	}()
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+const InfoBackendTimeout = time.Second
+
+var startTime = time.Now()
+
+// Info returns the reply to INFO in the layout of redis. The sections are
+// server, clients, stats and slots, plus backends with section "backends"
+// or "all", which asks every backend for its INFO on a conn of its own, so
+// the pipelines of the pool are not blocked, and gives up after timeout.
+func (s *Router) Info(section string, timeout time.Duration) []byte {
+	section = strings.ToLower(section)
+	var b bytes.Buffer
+	if section == "" || section == "default" || section == "all" || section == "server" {
+		fmt.Fprintf(&b, "# Server\r\n")
+		fmt.Fprintf(&b, "process_id:%d\r\n", os.Getpid())
+		fmt.Fprintf(&b, "uptime_in_seconds:%d\r\n", int64(time.Since(startTime).Seconds()))
+		fmt.Fprintf(&b, "\r\n")
+	}
+	if section == "" || section == "default" || section == "all" || section == "clients" {
+		fmt.Fprintf(&b, "# Clients\r\n")
+		fmt.Fprintf(&b, "connected_clients:%d\r\n", sessions.alive.Get())
+		fmt.Fprintf(&b, "total_connections_received:%d\r\n", sessions.total.Get())
+		opened, closed := ConnChurn()
+		fmt.Fprintf(&b, "connections_opened_per_sec:%d\r\n", opened)
+		fmt.Fprintf(&b, "connections_closed_per_sec:%d\r\n", closed)
+		fmt.Fprintf(&b, "rejected_connections:%d\r\n", RejectedConns())
+		fmt.Fprintf(&b, "reply_buffer_bytes:%d\r\n", ReplyBufferUsage())
+		fmt.Fprintf(&b, "total_protocol_errors:%d\r\n", ProtocolErrors())
+		fmt.Fprintf(&b, "backend_tls_refusals:%d\r\n", BackendTLSRefusals())
+		fmt.Fprintf(&b, "\r\n")
+	}
+	if section == "" || section == "default" || section == "all" || section == "stats" {
+		fmt.Fprintf(&b, "# Stats\r\n")
+		fmt.Fprintf(&b, "total_commands_processed:%d\r\n", OpCounts())
+		fmt.Fprintf(&b, "instantaneous_ops_per_sec:%d\r\n", OpQPS())
+		fmt.Fprintf(&b, "inflight_requests:%d\r\n", s.InFlight())
+		hits, misses := s.NegativeCacheStats()
+		fmt.Fprintf(&b, "negative_cache_hits:%d\r\n", hits)
+		fmt.Fprintf(&b, "negative_cache_misses:%d\r\n", misses)
+		fmt.Fprintf(&b, "backend_reply_desyncs:%d\r\n", ReplyDesyncs())
+		fmt.Fprintf(&b, "fallback_requests:%d\r\n", s.FallbackCount())
+		fmt.Fprintf(&b, "coalesced_reads:%d\r\n", s.CoalescedReads())
+		fmt.Fprintf(&b, "\r\n")
+	}
+	if section == "" || section == "default" || section == "all" || section == "slots" {
+		var assigned, migrating, locked int
+		slots := s.GetSlots()
+		for _, slot := range slots {
+			if slot.BackendAddr != "" {
+				assigned++
+			}
+			if slot.MigrateFrom != "" {
+				migrating++
+			}
+			if slot.Locked {
+				locked++
+			}
+		}
+		fmt.Fprintf(&b, "# Slots\r\n")
+		fmt.Fprintf(&b, "slots_total:%d\r\n", len(slots))
+		fmt.Fprintf(&b, "slots_assigned:%d\r\n", assigned)
+		fmt.Fprintf(&b, "slots_migrating:%d\r\n", migrating)
+		fmt.Fprintf(&b, "slots_locked:%d\r\n", locked)
+		fmt.Fprintf(&b, "\r\n")
+	}
+	if section == "all" || section == "backends" {
+		fmt.Fprintf(&b, "# Backends\r\n")
+		for i, x := range s.backendInfos(timeout) {
+			fmt.Fprintf(&b, "backend%d:%s\r\n", i, x)
+		}
+		fmt.Fprintf(&b, "\r\n")
+	}
+	return bytes.TrimRight(b.Bytes(), "\r\n")
+}
+
+var infoBackendFields = []string{"role", "used_memory", "connected_clients", "total_commands_processed"}
+
+func (s *Router) backendInfos(timeout time.Duration) []string {
+	var addrs []string
+	var slots = s.BackendDistribution()
+	var inflight = s.BackendInFlight()
+	var lags = s.ReplicaLags()
+	s.mu.Lock()
+	for addr := range s.pool {
+		addrs = append(addrs, addr)
+	}
+	s.mu.Unlock()
+	sort.Strings(addrs)
+
+	var infos = make([]string, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			info := fmt.Sprintf("addr=%s,slots=%d", addr, slots[addr])
+			if lag, ok := lags[addr]; ok {
+				info += fmt.Sprintf(",lag=%d", lag)
+			}
+			m, err := s.queryBackendInfo(addr, "", timeout)
+			if err != nil {
+				infos[i] = info + fmt.Sprintf(",status=error,inflight=%d", inflight[addr])
+				return
+			}
+			info += fmt.Sprintf(",status=ok,inflight=%d", inflight[addr])
+			for _, field := range infoBackendFields {
+				if v, ok := m[field]; ok {
+					info += fmt.Sprintf(",%s=%s", field, v)
+				}
+			}
+			infos[i] = info
+		}(i, addr)
+	}
+	wg.Wait()
+	return infos
+}
+
+// queryBackend sends the command to the db of the backend on a conn of its
+// own, and returns the reply.
+func (s *Router) queryBackend(addr string, db int, timeout time.Duration, args ...string) (*redis.Resp, error) {
+	resps, err := s.queryBackendPipeline(addr, db, timeout, args)
+	if err != nil {
+		return nil, err
+	}
+	return resps[0], nil
+}
+
+// queryBackendPipeline is the same as queryBackend, but sends the commands
+// in a pipeline and returns their replies in order.
+func (s *Router) queryBackendPipeline(addr string, db int, timeout time.Duration, cmds ...[]string) ([]*redis.Resp, error) {
+	c, err := dialBackend(addr, 1024*64, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if err := handshake(c, addr, s.auth, timeout); err != nil {
+		return nil, err
+	}
+	c.ReaderTimeout = timeout
+	c.WriterTimeout = timeout
+
+	if db != 0 {
+		cmds = append([][]string{{"SELECT", strconv.Itoa(db)}}, cmds...)
+	}
+	for k, cmd := range cmds {
+		var array = make([]*redis.Resp, len(cmd))
+		for i, arg := range cmd {
+			array[i] = redis.NewBulkBytes([]byte(arg))
+		}
+		if err := c.Writer.Encode(redis.NewArray(array), k == len(cmds)-1); err != nil {
+			return nil, err
+		}
+	}
+	var resps = make([]*redis.Resp, len(cmds))
+	for i := range cmds {
+		if resps[i], err = c.Reader.Decode(); err != nil {
+			return nil, err
+		}
+		if resps[i].IsError() {
+			return nil, errors.New(fmt.Sprintf("error resp: %s", resps[i].Value))
+		}
+	}
+	if db != 0 {
+		resps = resps[1:]
+	}
+	return resps, nil
+}
+
+// queryBackendInfo returns the fields of the INFO of the backend, of the
+// given section, or of the default sections if empty.
+func (s *Router) queryBackendInfo(addr, section string, timeout time.Duration) (map[string]string, error) {
+	var args = []string{"INFO"}
+	if section != "" {
+		args = append(args, section)
+	}
+	resp, err := s.queryBackend(addr, 0, timeout, args...)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsBulkBytes() {
+		return nil, errors.New(fmt.Sprintf("bad info resp: %s", resp.Type))
+	}
+	var m = make(map[string]string)
+	for _, line := range strings.Split(string(resp.Value), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			m[line[:i]] = line[i+1:]
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"strings"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+var ErrReplyDesync = errors.New("backend reply doesn't match the request, conn is out of sync")
+
+var replyIntegrity struct {
+	enabled atomic2.Bool
+	desyncs atomic2.Int64
+}
+
+// SetReplyIntegrity makes the backend conns check that every reply has a
+// type its request may get, e.g. an integer for INCR or an array for MGET.
+// A reply that doesn't means the replies of the conn no longer match its
+// requests, e.g. a reply is missing or there's an extra one, so the conn is
+// torn down and the requests waiting for a reply on it fail, instead of
+// getting replies meant for others. Commands not listed in replyTypes are
+// not checked, nor are error and nil replies, so a desync is only caught at
+// the first typed reply after it. It's off by default.
+func SetReplyIntegrity(on bool) {
+	replyIntegrity.enabled.Set(on)
+}
+
+// ReplyDesyncs returns the number of conns torn down by a desync.
+func ReplyDesyncs() int64 {
+	return replyIntegrity.desyncs.Get()
+}
+
+const (
+	replyString = 1 << iota
+	replyInt
+	replyBulk
+	replyArray
+)
+
+var replyTypes = make(map[string]int)
+
+func init() {
+	for types, opstrs := range map[int][]string{
+		replyString: {
+			"MSET", "HMSET", "LSET", "LTRIM", "SETEX", "PSETEX", "SELECT", "PFMERGE", "TYPE",
+		},
+		replyString | replyBulk: {
+			"SET", "PING",
+		},
+		replyInt: {
+			"APPEND", "BITCOUNT", "BITPOS", "DECR", "DECRBY", "DEL", "EXISTS", "EXPIRE", "EXPIREAT",
+			"GETBIT", "HDEL", "HEXISTS", "HINCRBY", "HLEN", "HSET", "HSETNX", "HSTRLEN", "INCR", "INCRBY",
+			"LINSERT", "LLEN", "LPUSH", "LPUSHX", "LREM", "PERSIST", "PEXPIRE", "PEXPIREAT", "PFADD",
+			"PFCOUNT", "PTTL", "RPUSH", "RPUSHX", "SADD", "SCARD", "SETBIT", "SETNX", "SETRANGE",
+			"SISMEMBER", "SREM", "STRLEN", "TTL", "ZCARD", "ZCOUNT", "ZLEXCOUNT", "ZREM",
+			"ZREMRANGEBYLEX", "ZREMRANGEBYRANK", "ZREMRANGEBYSCORE",
+		},
+		replyInt | replyBulk: {
+			"ZADD",
+		},
+		replyInt | replyArray: {
+			"ZRANK", "ZREVRANK",
+		},
+		replyBulk: {
+			"DUMP", "ECHO", "GET", "GETRANGE", "GETSET", "HGET", "HINCRBYFLOAT", "INCRBYFLOAT",
+			"LINDEX", "RPOPLPUSH", "SUBSTR", "ZINCRBY", "ZSCORE",
+		},
+		replyBulk | replyArray: {
+			"LPOP", "RPOP", "SPOP", "SRANDMEMBER",
+		},
+		replyArray: {
+			"HGETALL", "HKEYS", "HMGET", "HSCAN", "HVALS", "LRANGE", "MGET", "SDIFF", "SINTER",
+			"SMEMBERS", "SSCAN", "SUNION", "ZRANGE", "ZRANGEBYLEX", "ZRANGEBYSCORE", "ZREVRANGE",
+			"ZREVRANGEBYLEX", "ZREVRANGEBYSCORE", "ZSCAN",
+		},
+	} {
+		for _, opstr := range opstrs {
+			replyTypes[opstr] = types
+		}
+	}
+}
+
+// isReplyInSync tells whether the reply may be the one of the request, see
+// SetReplyIntegrity. The requests of the proxy itself, e.g. the pings and
+// the SELECTs, have no OpStr, their command is taken from the request.
+func isReplyInSync(r *Request, resp *redis.Resp) bool {
+	if resp == nil || resp.IsError() {
+		return true
+	}
+	opstr := r.OpStr
+	if opstr == "" && r.Resp != nil && r.Resp.IsArray() && len(r.Resp.Array) != 0 {
+		opstr = strings.ToUpper(string(r.Resp.Array[0].Value))
+	}
+	types := replyTypes[opstr]
+	if types == 0 {
+		return true
+	}
+	switch resp.Type {
+	case redis.TypeString:
+		return types&replyString != 0
+	case redis.TypeInt:
+		return types&replyInt != 0
+	case redis.TypeBulkBytes:
+		return types&replyBulk != 0 || resp.Value == nil
+	case redis.TypeArray:
+		return types&replyArray != 0 || resp.Array == nil
+	}
+	return false
+}
+
+// checkReply returns ErrReplyDesync if the integrity check is on, and the
+// reply can't be the one of the request.
+func (bc *BackendConn) checkReply(r *Request, resp *redis.Resp) error {
+	if !replyIntegrity.enabled.Get() || isReplyInSync(r, resp) {
+		return nil
+	}
+	replyIntegrity.desyncs.Incr()
+	log.Errorf("backend conn [%p] to %s, reply type '%c' to %s is out of sync, tear down the conn",
+		bc, bc.addr, resp.Type, r.OpStr)
+	return errors.Trace(ErrReplyDesync)
+}
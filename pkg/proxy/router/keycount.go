@@ -0,0 +1,85 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+var (
+	ErrKeyCountNotInteger = errors.New("value is not an integer or out of range")
+	ErrKeyCountNegative   = errors.New("Number of keys can't be negative")
+	ErrKeyCountZero       = errors.New("numkeys should be greater than 0")
+	ErrKeyCountTooLarge   = errors.New("Number of keys can't be greater than number of args")
+	ErrZAddSyntax         = errors.New("syntax error, ZADD takes score member pairs after its options")
+	ErrZAddIncrPairs      = errors.New("INCR option supports a single increment-element pair")
+)
+
+// checkKeyCount checks the count fields of the request against its number
+// of args, see keySpec.numkeys, and the score member pairs of ZADD. Such a
+// request would be misrouted, the keys read from it are not the ones the
+// backend reads, so it's rejected before it's forwarded, with the errors of
+// redis.
+func checkKeyCount(resp *redis.Resp, opstr string) error {
+	if opstr == "ZADD" {
+		return checkZAdd(resp)
+	}
+	spec, ok := keyspecs[opstr]
+	if !ok || spec.numkeys == 0 || spec.numkeys >= len(resp.Array) {
+		return nil
+	}
+	nkeys, err := strconv.Atoi(string(resp.Array[spec.numkeys].Value))
+	switch {
+	case err != nil:
+		return ErrKeyCountNotInteger
+	case nkeys < 0:
+		return ErrKeyCountNegative
+	case nkeys == 0 && !spec.zerokeys:
+		return ErrKeyCountZero
+	case nkeys > len(resp.Array)-1-spec.numkeys:
+		return ErrKeyCountTooLarge
+	}
+	return nil
+}
+
+var zaddOptions = map[string]bool{
+	"NX": true, "XX": true, "GT": true, "LT": true, "CH": true, "INCR": true,
+}
+
+// checkZAdd checks ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member ...
+func checkZAdd(resp *redis.Resp) error {
+	if len(resp.Array) < 2 {
+		return nil
+	}
+	var incr bool
+	i := 2
+	for ; i < len(resp.Array); i++ {
+		opt := strings.ToUpper(string(resp.Array[i].Value))
+		if !zaddOptions[opt] {
+			break
+		}
+		incr = incr || opt == "INCR"
+	}
+	switch n := len(resp.Array) - i; {
+	case n == 0 || n%2 != 0:
+		return ErrZAddSyntax
+	case incr && n != 2:
+		return ErrZAddIncrPairs
+	}
+	return nil
+}
+
+// rejectBadKeyCount replies the error of checkKeyCount to the request, if
+// any. It returns true if the request is done with then.
+func rejectBadKeyCount(r *Request) bool {
+	if err := checkKeyCount(r.Resp, r.OpStr); err != nil {
+		r.Response.Resp = redis.NewError([]byte("ERR " + err.Error()))
+		return true
+	}
+	return false
+}
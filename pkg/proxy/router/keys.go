@@ -0,0 +1,93 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PartialError tells the backends that failed an aggregate command.
+type PartialError struct {
+	Failed map[string]error
+}
+
+func (e *PartialError) Error() string {
+	var addrs []string
+	for addr := range e.Failed {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	var msgs []string
+	for _, addr := range addrs {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", addr, e.Failed[addr]))
+	}
+	return fmt.Sprintf("partial results, %d backends failed: %s", len(addrs), strings.Join(msgs, "; "))
+}
+
+// SetPartialResults makes aggregate commands over all backends, like Keys,
+// return the results of the healthy backends with a *PartialError, instead
+// of failing as a whole if any backend fails. The results may miss keys
+// then, so it's only for best-effort admin queries.
+func (s *Router) SetPartialResults(enabled bool) {
+	s.partial.Set(enabled)
+}
+
+type backendDB struct {
+	addr string
+	db   int
+}
+
+// Keys returns the keys matching the pattern in every backend, asked on
+// conns of their own with the given timeout. The key prefix applies. If
+// some backends fail, the error is a *PartialError, and the keys of the
+// others are returned as well only if partial results are enabled.
+func (s *Router) Keys(pattern string, timeout time.Duration) ([][]byte, error) {
+	prefix := s.keyPrefix()
+	var backends []backendDB
+	s.mu.Lock()
+	var seen = make(map[backendDB]bool)
+	for _, slot := range s.slots {
+		if x := (backendDB{slot.backend.addr, slot.backend.db}); x.addr != "" && !seen[x] {
+			seen[x] = true
+			backends = append(backends, x)
+		}
+	}
+	s.mu.Unlock()
+
+	var mu sync.Mutex
+	var keys [][]byte
+	var failed = make(map[string]error)
+	var wg sync.WaitGroup
+	for _, x := range backends {
+		wg.Add(1)
+		go func(x backendDB) {
+			defer wg.Done()
+			resp, err := s.queryBackend(x.addr, x.db, timeout, "KEYS", string(prefix)+pattern)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed[fmt.Sprintf("%s/%d", x.addr, x.db)] = err
+				return
+			}
+			for _, k := range resp.Array {
+				keys = append(keys, bytes.TrimPrefix(k.Value, prefix))
+			}
+		}(x)
+	}
+	wg.Wait()
+
+	if len(failed) == 0 {
+		return keys, nil
+	}
+	err := &PartialError{Failed: failed}
+	if !s.partial.Get() {
+		return nil, err
+	}
+	return keys, err
+}
@@ -0,0 +1,124 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+var ErrNotReplica = errors.New("bad replication info, backend is not a replica")
+
+// SetReplicaMaxLag sets the lag a replica may have before it's excluded
+// from reads, 0 disables it. It takes effect at once with the lags known so
+// far, and can be changed at runtime, see CheckReplicaLag.
+func (s *Router) SetReplicaMaxLag(max time.Duration) {
+	s.rwlck.Lock()
+	s.lagging.max = max
+	s.rwlck.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, bc := range s.pool {
+		bc.setLag(bc.lag.Get(), max)
+	}
+}
+
+func (s *Router) getReplicaMaxLag() time.Duration {
+	s.rwlck.RLock()
+	defer s.rwlck.RUnlock()
+	return s.lagging.max
+}
+
+// CheckReplicaLag asks every replica of the slots for its INFO replication,
+// and records its lag, the seconds since its last interaction with the
+// master, or since the link to the master is down. Replicas lagging over
+// the max, see SetReplicaMaxLag, are excluded from reads until a later
+// check finds them caught up. A replica that can't be asked keeps its last
+// known lag, the health check tells whether it's down, and the failed ones
+// are returned with a *PartialError.
+func (s *Router) CheckReplicaLag(timeout time.Duration) error {
+	max := s.getReplicaMaxLag()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errClosedRouter
+	}
+	var replicas = make(map[string]*SharedBackendConn)
+	for _, slot := range s.slots {
+		for _, x := range slot.replicas {
+			replicas[x.addr] = x.bc
+		}
+	}
+	s.mu.Unlock()
+
+	var mu sync.Mutex
+	var failed = make(map[string]error)
+	var wg sync.WaitGroup
+	for addr, bc := range replicas {
+		wg.Add(1)
+		go func(addr string, bc *SharedBackendConn) {
+			defer wg.Done()
+			lag, err := s.queryReplicaLag(addr, timeout)
+			if err != nil {
+				log.WarnErrorf(err, "check lag of replica %s failed", addr)
+				mu.Lock()
+				failed[addr] = err
+				mu.Unlock()
+				return
+			}
+			if bc.setLag(lag, max) {
+				log.Warnf("replica %s lag = %ds, excluded from reads", addr, lag)
+			}
+		}(addr, bc)
+	}
+	wg.Wait()
+	if len(failed) != 0 {
+		return &PartialError{Failed: failed}
+	}
+	return nil
+}
+
+func (s *Router) queryReplicaLag(addr string, timeout time.Duration) (int64, error) {
+	m, err := s.queryBackendInfo(addr, "replication", timeout)
+	if err != nil {
+		return 0, err
+	}
+	if m["role"] != "slave" {
+		return 0, errors.Trace(ErrNotReplica)
+	}
+	field := "master_last_io_seconds_ago"
+	if m["master_link_status"] != "up" {
+		field = "master_link_down_since_seconds"
+	}
+	lag, err := strconv.ParseInt(m[field], 10, 64)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if lag < 0 {
+		// never synced with the master
+		lag = math.MaxInt32
+	}
+	return lag, nil
+}
+
+// ReplicaLags returns the last known lag of each replica, in seconds.
+func (s *Router) ReplicaLags() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lags = make(map[string]int64)
+	for _, slot := range s.slots {
+		for _, x := range slot.replicas {
+			if lag := x.bc.lag.Get(); lag >= 0 {
+				lags[x.addr] = lag
+			}
+		}
+	}
+	return lags
+}
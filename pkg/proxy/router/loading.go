@@ -0,0 +1,77 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+)
+
+var loadingRetry struct {
+	retries atomic2.Int64
+	delay   atomic2.Int64
+}
+
+// SetLoadingRetry makes read commands that get a LOADING or MASTERDOWN reply
+// be retried up to retries times, waiting delay before each retry. Other
+// commands, and reads running out of retries, get the reply as a TRYAGAIN
+// error. The keys of MGET are retried one by one, as they are sent. 0
+// disables retrying.
+//
+// The retries are slept and waited for by the session writer, when it
+// coalesces the reply, so it writes no reply meanwhile: the order is kept,
+// but a pipelined session stalls for about retries*delay, even on replies
+// already received from other backends.
+func SetLoadingRetry(retries int, delay time.Duration) {
+	loadingRetry.retries.Set(int64(retries))
+	loadingRetry.delay.Set(int64(delay))
+}
+
+func isLoadingReply(resp *redis.Resp) bool {
+	if resp == nil || !resp.IsError() {
+		return false
+	}
+	return bytes.HasPrefix(resp.Value, []byte("LOADING")) || bytes.HasPrefix(resp.Value, []byte("MASTERDOWN"))
+}
+
+// isReadOnlyReply tells a write sent to a replica, e.g. the backend has been
+// demoted by a failover that the coordinator hasn't caught up with yet.
+func isReadOnlyReply(resp *redis.Resp) bool {
+	return resp != nil && resp.IsError() && bytes.HasPrefix(resp.Value, []byte("READONLY"))
+}
+
+func newLoadingReply(resp *redis.Resp) *redis.Resp {
+	return redis.NewError(append([]byte("TRYAGAIN "), resp.Value...))
+}
+
+func (s *Router) newLoadingRetry(r *Request, hkey []byte) {
+	retries := int(loadingRetry.retries.Get())
+	if retries == 0 || !isReadOnly(r.OpStr) {
+		return
+	}
+	delay := time.Duration(loadingRetry.delay.Get())
+	coalesce := r.Coalesce
+	r.Coalesce = func() error {
+		for i := 0; i < retries && r.loading && r.Response.Err == nil; i++ {
+			time.Sleep(delay)
+			x := r.subRequest(r.Resp)
+			x.Wait = &sync.WaitGroup{}
+			err := s.dispatch(x, hkey)
+			s.audit(x, hkey, err)
+			if err != nil {
+				return err
+			}
+			x.Wait.Wait()
+			r.Response, r.loading = x.Response, x.loading
+		}
+		if coalesce != nil {
+			return coalesce()
+		}
+		return nil
+	}
+}
@@ -5,10 +5,13 @@ package router
 
 import (
 	"bytes"
+	"fmt"
 	"hash/crc32"
+	"strconv"
 	"strings"
 
 	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
 	"github.com/wandoulabs/codis/pkg/utils/errors"
 )
 
@@ -31,20 +34,60 @@ var (
 func init() {
 	for _, s := range []string{
 		"KEYS", "MOVE", "OBJECT", "RENAME", "RENAMENX", "SCAN", "BITOP", "MSETNX", "MIGRATE", "RESTORE",
-		"BLPOP", "BRPOP", "BRPOPLPUSH", "PSUBSCRIBE", "PUBLISH", "PUNSUBSCRIBE", "SUBSCRIBE", "RANDOMKEY",
-		"UNSUBSCRIBE", "DISCARD", "EXEC", "MULTI", "UNWATCH", "WATCH", "SCRIPT",
-		"BGREWRITEAOF", "BGSAVE", "CLIENT", "CONFIG", "DBSIZE", "DEBUG", "FLUSHALL", "FLUSHDB",
-		"LASTSAVE", "MONITOR", "SAVE", "SHUTDOWN", "SLAVEOF", "SLOWLOG", "SYNC", "TIME",
+		"BLPOP", "BRPOP", "BRPOPLPUSH", "PSUBSCRIBE", "PUNSUBSCRIBE", "RANDOMKEY",
+		"DISCARD", "EXEC", "MULTI", "UNWATCH", "WATCH", "SCRIPT",
+		"BGREWRITEAOF", "BGSAVE", "CONFIG", "DBSIZE", "DEBUG", "FLUSHALL", "FLUSHDB",
+		"LASTSAVE", "SAVE", "SHUTDOWN", "SLAVEOF", "SLOWLOG", "SYNC", "TIME",
 		"SLOTSINFO", "SLOTSDEL", "SLOTSMGRTSLOT", "SLOTSMGRTONE", "SLOTSMGRTTAGSLOT", "SLOTSMGRTTAGONE", "SLOTSCHECK",
 	} {
 		blacklist[s] = true
 	}
 }
 
+var opnames = []string{
+	"DEL", "DUMP", "EXISTS", "EXPIRE", "EXPIREAT", "PERSIST", "PEXPIRE", "PEXPIREAT", "PTTL", "RESTORE", "SORT", "TTL", "TYPE",
+	"APPEND", "BITCOUNT", "DECR", "DECRBY", "GET", "GETBIT", "GETRANGE", "GETSET", "INCR", "INCRBY", "INCRBYFLOAT",
+	"MGET", "MSET", "PSETEX", "SET", "SETBIT", "SETEX", "SETNX", "SETRANGE", "STRLEN",
+	"HDEL", "HEXISTS", "HGET", "HGETALL", "HINCRBY", "HINCRBYFLOAT", "HKEYS", "HLEN", "HMGET", "HMSET", "HSET", "HSETNX", "HVALS", "HSCAN",
+	"LINDEX", "LINSERT", "LLEN", "LPOP", "LPUSH", "LPUSHX", "LRANGE", "LREM", "LSET", "LTRIM", "RPOP", "RPOPLPUSH", "RPUSH", "RPUSHX",
+	"SADD", "SCARD", "SDIFF", "SDIFFSTORE", "SINTER", "SINTERSTORE", "SISMEMBER", "SMEMBERS", "SMOVE", "SPOP", "SRANDMEMBER", "SREM", "SUNION", "SUNIONSTORE", "SSCAN",
+	"ZADD", "ZCARD", "ZCOUNT", "ZINCRBY", "ZINTERSTORE", "ZLEXCOUNT", "ZRANGE", "ZRANGEBYLEX", "ZRANGEBYSCORE", "ZRANK", "ZREM", "ZREMRANGEBYLEX",
+	"ZREMRANGEBYRANK", "ZREMRANGEBYSCORE", "ZREVRANGE", "ZREVRANGEBYSCORE", "ZREVRANK", "ZSCORE", "ZUNIONSTORE", "ZSCAN",
+	"PFADD", "PFCOUNT", "PFMERGE", "EVAL", "EVALSHA",
+	"GETEX", "GETDEL", "COPY", "LMOVE", "LMPOP", "SINTERCARD",
+	"ZDIFF", "ZDIFFSTORE", "ZINTER", "ZINTERCARD", "ZUNION", "ZMPOP",
+	"PUBLISH", "SUBSCRIBE", "UNSUBSCRIBE",
+	"UNLINK", "TOUCH", "BITPOS", "SUBSTR", "HSTRLEN", "HRANDFIELD", "LPOS", "SMISMEMBER", "ZREVRANGEBYLEX",
+	"ECHO",
+}
+
 func isNotAllowed(opstr string) bool {
 	return blacklist[opstr]
 }
 
+var readonly = make(map[string]bool)
+
+func init() {
+	for _, s := range []string{
+		"DUMP", "EXISTS", "PTTL", "TTL", "TYPE",
+		"BITCOUNT", "GET", "GETBIT", "GETRANGE", "MGET", "STRLEN",
+		"HEXISTS", "HGET", "HGETALL", "HKEYS", "HLEN", "HMGET", "HVALS", "HSCAN",
+		"LINDEX", "LLEN", "LRANGE",
+		"SCARD", "SDIFF", "SINTER", "SISMEMBER", "SMEMBERS", "SRANDMEMBER", "SUNION", "SSCAN",
+		"ZCARD", "ZCOUNT", "ZLEXCOUNT", "ZRANGE", "ZRANGEBYLEX", "ZRANGEBYSCORE", "ZRANK",
+		"ZREVRANGE", "ZREVRANGEBYSCORE", "ZREVRANK", "ZSCORE", "ZSCAN",
+		"PFCOUNT",
+		"SINTERCARD", "ZDIFF", "ZINTER", "ZINTERCARD", "ZUNION",
+		"TOUCH", "BITPOS", "SUBSTR", "HSTRLEN", "HRANDFIELD", "LPOS", "SMISMEMBER", "ZREVRANGEBYLEX",
+	} {
+		readonly[s] = true
+	}
+}
+
+func isReadOnly(opstr string) bool {
+	return readonly[opstr]
+}
+
 var (
 	ErrBadRespType = errors.New("bad resp type for command")
 	ErrBadOpStrLen = errors.New("bad command length, too short or too long")
@@ -78,27 +121,165 @@ func getOpStr(resp *redis.Resp) (string, error) {
 	return string(upper[:len(op)]), nil
 }
 
-func hashSlot(key []byte) int {
-	const (
-		TagBeg = '{'
-		TagEnd = '}'
-	)
-	if beg := bytes.IndexByte(key, TagBeg); beg >= 0 {
-		if end := bytes.IndexByte(key[beg+1:], TagEnd); end >= 0 {
+func hashSlot(key []byte, n int) int {
+	return int(hashKey(key) % uint32(n))
+}
+
+const (
+	tagBeg = '{'
+	tagEnd = '}'
+)
+
+// hashKey returns the crc32 of the hash tag of the key, or of the whole key
+// if it has no tag.
+func hashKey(key []byte) uint32 {
+	if beg := bytes.IndexByte(key, tagBeg); beg >= 0 {
+		if end := bytes.IndexByte(key[beg+1:], tagEnd); end >= 0 {
 			key = key[beg+1 : beg+1+end]
 		}
 	}
-	return int(crc32.ChecksumIEEE(key) % MaxSlotNum)
+	return crc32.ChecksumIEEE(key)
 }
 
-func getHashKey(resp *redis.Resp, opstr string) []byte {
-	var index = 1
-	switch opstr {
-	case "ZINTERSTORE", "ZUNIONSTORE", "EVAL", "EVALSHA":
-		index = 3
+// keySpec tells where the keys of a command are. The keys are the args
+// from first to last, stepping by step, a negative last counts from the end.
+// If numkeys is set, the arg at numkeys is the number of keys following it,
+// e.g. EVAL script numkeys key [key ...] arg [arg ...], which must be at
+// least 1, but 0 if zerokeys is set, see checkKeyCount.
+type keySpec struct {
+	first, last, step int
+	numkeys           int
+	zerokeys          bool
+}
+
+// keyspecs lists the commands whose keys are not just the first arg.
+var keyspecs = map[string]keySpec{
+	"DEL":         {first: 1, last: -1, step: 1},
+	"UNLINK":      {first: 1, last: -1, step: 1},
+	"EXISTS":      {first: 1, last: -1, step: 1},
+	"TOUCH":       {first: 1, last: -1, step: 1},
+	"MGET":        {first: 1, last: -1, step: 1},
+	"MSET":        {first: 1, last: -1, step: 2},
+	"SDIFF":       {first: 1, last: -1, step: 1},
+	"SINTER":      {first: 1, last: -1, step: 1},
+	"SUNION":      {first: 1, last: -1, step: 1},
+	"SDIFFSTORE":  {first: 1, last: -1, step: 1},
+	"SINTERSTORE": {first: 1, last: -1, step: 1},
+	"SUNIONSTORE": {first: 1, last: -1, step: 1},
+	"PFCOUNT":     {first: 1, last: -1, step: 1},
+	"PFMERGE":     {first: 1, last: -1, step: 1},
+	"SMOVE":       {first: 1, last: 2, step: 1},
+	"RPOPLPUSH":   {first: 1, last: 2, step: 1},
+	"LMOVE":       {first: 1, last: 2, step: 1},
+	"COPY":        {first: 1, last: 2, step: 1},
+	"ZINTERSTORE": {first: 1, last: 1, step: 1, numkeys: 2},
+	"ZUNIONSTORE": {first: 1, last: 1, step: 1, numkeys: 2},
+	"ZDIFFSTORE":  {first: 1, last: 1, step: 1, numkeys: 2},
+	"EVAL":        {numkeys: 2, zerokeys: true},
+	"EVALSHA":     {numkeys: 2, zerokeys: true},
+	"LMPOP":       {numkeys: 1},
+	"ZMPOP":       {numkeys: 1},
+	"SINTERCARD":  {numkeys: 1},
+	"ZINTERCARD":  {numkeys: 1},
+	"ZDIFF":       {numkeys: 1},
+	"ZINTER":      {numkeys: 1},
+	"ZUNION":      {numkeys: 1},
+	"ECHO":        {},
+}
+
+var defaultKeySpec = keySpec{first: 1, last: 1, step: 1}
+
+// getKeyIndexes returns the indexes of the keys in the request array.
+func getKeyIndexes(resp *redis.Resp, opstr string) []int {
+	spec, ok := keyspecs[opstr]
+	if !ok {
+		spec = defaultKeySpec
 	}
-	if index < len(resp.Array) {
-		return resp.Array[index].Value
+	var n = len(resp.Array)
+	var indexes []int
+	if spec.first > 0 {
+		last := spec.last
+		if last < 0 {
+			last += n
+		}
+		for i := spec.first; i <= last && i < n; i += spec.step {
+			indexes = append(indexes, i)
+		}
+	}
+	if spec.numkeys > 0 && spec.numkeys < n {
+		nkeys, err := strconv.Atoi(string(resp.Array[spec.numkeys].Value))
+		if err != nil {
+			return indexes
+		}
+		for i := spec.numkeys + 1; i <= spec.numkeys+nkeys && i < n; i++ {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func getHashKey(resp *redis.Resp, opstr string) []byte {
+	if indexes := getKeyIndexes(resp, opstr); len(indexes) != 0 {
+		return resp.Array[indexes[0]].Value
 	}
 	return nil
 }
+
+// HashKey returns the key the slot of the request is computed from, its
+// first key, or nil if it has none, as Dispatch does. The opstr must be in
+// upper case, see getOpStr. The key prefix and the route keys of a router,
+// see SetKeyPrefix and SetRouteKey, are not applied. It doesn't modify the
+// request.
+func HashKey(resp *redis.Resp, opstr string) []byte {
+	return getHashKey(resp, opstr)
+}
+
+// HashSlot returns the slot of the key among n slots, as Dispatch does: the
+// crc32 of its hash tag, or of the whole key if it has none, modulo n, see
+// RoutingParams.
+func HashSlot(key []byte, n int) int {
+	return hashSlot(key, n)
+}
+
+var ErrCrossSlot = errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+
+var verboseErrors atomic2.Bool
+
+// SetVerboseErrors makes some errors replied to clients tell more of what
+// went wrong, e.g. the slots of the keys of a cross slot request. It's off
+// by default, the errors are the same as the ones of redis cluster then.
+func SetVerboseErrors(on bool) {
+	verboseErrors.Set(on)
+}
+
+// isCrossSlot tells a request whose keys are in different slots of the n
+// slots, it can't be served by a single backend.
+func isCrossSlot(resp *redis.Resp, opstr string, n int) bool {
+	indexes := getKeyIndexes(resp, opstr)
+	for j := 1; j < len(indexes); j++ {
+		if hashSlot(resp.Array[indexes[j]].Value, n) != hashSlot(resp.Array[indexes[0]].Value, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// crossSlotError returns the error replied to a cross slot request, with
+// the distinct slots of its keys among the n slots, in the order of the
+// keys, if verbose.
+func crossSlotError(resp *redis.Resp, opstr string, n int) string {
+	if !verboseErrors.Get() {
+		return ErrCrossSlot.Error()
+	}
+	var slots []string
+	var seen = make(map[int]bool)
+	for _, i := range getKeyIndexes(resp, opstr) {
+		slot := hashSlot(resp.Array[i].Value, n)
+		if !seen[slot] {
+			seen[slot] = true
+			slots = append(slots, strconv.Itoa(slot))
+		}
+	}
+	return fmt.Sprintf("%s, %s keys are in slots %s, use a hash tag to keep them in the same slot, e.g. {user1000}.following and {user1000}.followers",
+		ErrCrossSlot, opstr, strings.Join(slots, ", "))
+}
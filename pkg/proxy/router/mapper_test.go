@@ -4,6 +4,8 @@
 package router
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/wandoulabs/codis/pkg/proxy/redis"
@@ -158,8 +160,140 @@ func TestHashSlot(t *testing.T) {
 		"123{456}":        "456",
 	}
 	for k, v := range m {
-		i := hashSlot([]byte(k))
-		j := hashSlot([]byte(v))
+		i := hashSlot([]byte(k), MaxSlotNum)
+		j := hashSlot([]byte(v), MaxSlotNum)
 		assert.Must(i == j)
 	}
 }
+
+func TestHashKeySlot(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+	}
+
+	for _, args := range [][]string{
+		{"GET", "foo"},
+		{"SET", "bar", "1"},
+		{"HSET", "{user1000}.following", "f", "1"},
+		{"GET", "{user1000}.followers"},
+		{"GET", "foo{}{bar}"},
+		{"GET", "foo{{bar}}zap"},
+		{"GET", "{bar"},
+		{"EVAL", "return 1", "1", "{user1000}.x", "arg"},
+		{"ZINTERSTORE", "{z}.out", "2", "{z}.a", "{z}.b"},
+	} {
+		r := newRequest(args...)
+		key := HashKey(r.Resp, r.OpStr)
+		assert.Must(string(key) == args[1] || args[0] == "EVAL" && string(key) == args[3])
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		assert.Must(r.slot.id == HashSlot(key, MaxSlotNum))
+	}
+	assert.Must(HashKey(newRequest("PING").Resp, "PING") == nil)
+}
+
+func TestGetKeyIndexes(t *testing.T) {
+	newResp := func(args ...string) *redis.Resp {
+		var array = make([]*redis.Resp, len(args))
+		for i, arg := range args {
+			array[i] = redis.NewBulkBytes([]byte(arg))
+		}
+		return redis.NewArray(array)
+	}
+	var tests = []struct {
+		args    []string
+		indexes []int
+	}{
+		{[]string{"SET", "foo", "bar", "EX", "10"}, []int{1}},
+		{[]string{"GETEX", "foo", "PERSIST"}, []int{1}},
+		{[]string{"COPY", "src", "dst", "DB", "1", "REPLACE"}, []int{1, 2}},
+		{[]string{"LMPOP", "2", "a", "b", "LEFT", "COUNT", "10"}, []int{2, 3}},
+		{[]string{"ZMPOP", "1", "a", "MIN"}, []int{2}},
+		{[]string{"ZUNIONSTORE", "dst", "2", "a", "b", "WEIGHTS", "1", "2"}, []int{1, 3, 4}},
+		{[]string{"EVAL", "return 1", "0", "a"}, nil},
+		{[]string{"MSET", "a", "1", "b", "2"}, []int{1, 3}},
+		{[]string{"LMPOP", "x", "a"}, nil},
+		{[]string{"LMPOP", "5", "a"}, []int{2}},
+	}
+	for _, test := range tests {
+		indexes := getKeyIndexes(newResp(test.args...), test.args[0])
+		assert.Must(len(indexes) == len(test.indexes))
+		for i := range indexes {
+			assert.Must(indexes[i] == test.indexes[i])
+		}
+	}
+
+	assert.Must(string(getHashKey(newResp("LMPOP", "2", "a", "b", "LEFT"), "LMPOP")) == "a")
+	assert.Must(!isCrossSlot(newResp("COPY", "{t}src", "{t}dst"), "COPY", MaxSlotNum))
+	assert.Must(isCrossSlot(newResp("COPY", "src", "dst"), "COPY", MaxSlotNum))
+	assert.Must(isCrossSlot(newResp("LMPOP", "2", "{t}a", "b", "LEFT"), "LMPOP", MaxSlotNum))
+	assert.Must(!isCrossSlot(newResp("GETEX", "foo", "EX", "10"), "GETEX", MaxSlotNum))
+}
+
+func TestCrossSlotError(t *testing.T) {
+	resp := redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes([]byte("SINTER")),
+		redis.NewBulkBytes([]byte("a")),
+		redis.NewBulkBytes([]byte("b")),
+		redis.NewBulkBytes([]byte("{b}c")),
+	})
+	assert.Must(crossSlotError(resp, "SINTER", MaxSlotNum) == ErrCrossSlot.Error())
+
+	SetVerboseErrors(true)
+	defer SetVerboseErrors(false)
+	a, b := hashSlot([]byte("a"), MaxSlotNum), hashSlot([]byte("b"), MaxSlotNum)
+	msg := crossSlotError(resp, "SINTER", MaxSlotNum)
+	assert.Must(strings.HasPrefix(msg, ErrCrossSlot.Error()))
+	assert.Must(strings.Contains(msg, fmt.Sprintf("slots %d, %d,", a, b)))
+	assert.Must(strings.Contains(msg, "hash tag"))
+
+	a, b = hashSlot([]byte("a"), 16), hashSlot([]byte("b"), 16)
+	msg = crossSlotError(resp, "SINTER", 16)
+	assert.Must(a != b && strings.Contains(msg, fmt.Sprintf("slots %d, %d,", a, b)))
+}
+
+func TestCheckKeyCount(t *testing.T) {
+	var tests = []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"EVAL", "return 1", "0"}, nil},
+		{[]string{"EVAL", "return 1", "2", "a", "b", "arg"}, nil},
+		{[]string{"EVAL", "return 1", "3", "a", "b"}, ErrKeyCountTooLarge},
+		{[]string{"EVALSHA", "abc", "-1", "a"}, ErrKeyCountNegative},
+		{[]string{"EVAL", "return 1", "x", "a"}, ErrKeyCountNotInteger},
+		{[]string{"ZUNIONSTORE", "dst", "2", "a", "b", "WEIGHTS", "1", "2"}, nil},
+		{[]string{"ZUNIONSTORE", "dst", "3", "a", "b"}, ErrKeyCountTooLarge},
+		{[]string{"LMPOP", "0", "LEFT"}, ErrKeyCountZero},
+		{[]string{"LMPOP", "2", "a", "b", "LEFT"}, nil},
+		{[]string{"ZADD", "z", "1", "a"}, nil},
+		{[]string{"ZADD", "z", "GT", "CH", "1", "a", "2", "b"}, nil},
+		{[]string{"ZADD", "z", "gt"}, ErrZAddSyntax},
+		{[]string{"ZADD", "z", "XX", "1", "a", "2"}, ErrZAddSyntax},
+		{[]string{"ZADD", "z", "INCR", "1", "a"}, nil},
+		{[]string{"ZADD", "z", "INCR", "1", "a", "2", "b"}, ErrZAddIncrPairs},
+		{[]string{"GET", "foo"}, nil},
+	}
+	for _, test := range tests {
+		r := newRequest(test.args...)
+		assert.Must(checkKeyCount(r.Resp, r.OpStr) == test.err)
+	}
+
+	s := New()
+	defer s.Close()
+	r := newRequest("EVAL", "return 1", "3", "a", "b")
+	assert.MustNoError(s.Dispatch(r))
+	assert.Must(r.Response.Resp.IsError())
+	assert.Must(string(r.Response.Resp.Value) == "ERR "+ErrKeyCountTooLarge.Error())
+	r = newRequest("ZADD", "z", "NX", "1")
+	assert.MustNoError(s.DispatchWithKey(r, []byte("z")))
+	assert.Must(r.Response.Resp.IsError())
+}
@@ -0,0 +1,129 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import "time"
+
+type MigrationEventType string
+
+const (
+	MigrationStarted   MigrationEventType = "started"
+	MigrationProgress  MigrationEventType = "progress"
+	MigrationCompleted MigrationEventType = "completed"
+	MigrationAborted   MigrationEventType = "aborted"
+)
+
+// MigrationEvent is a step of the migration of a slot, from migrate.from to
+// backend.addr. Keys is the number of keys moved by the proxy so far, see
+// Slot.slotsmgrt, not counting the ones moved by the migration tasks
+// themselves. Gap is set if some events before it have been dropped.
+type MigrationEvent struct {
+	Type MigrationEventType
+	Slot int
+	From string
+	To   string
+	Keys int64
+	Time time.Time
+	Gap  bool
+}
+
+const migrationWatchBufferSize = 1024
+
+type migrationWatcher struct {
+	ch  chan *MigrationEvent
+	gap bool
+}
+
+// WatchMigrations returns a channel receiving the events of the slot
+// migrations, and the function to stop watching, which closes the channel.
+// A migration is started once a slot is filled with migrate.from, completed
+// once it's filled again without it on the same backend, and aborted if it's
+// filled otherwise or reset meanwhile. Progress events are sent by
+// ReportMigrations. Unlike WatchSlots, the other fills are not told. Slow
+// watchers never block the migrations, the oldest events are dropped.
+func (s *Router) WatchMigrations() (<-chan *MigrationEvent, func()) {
+	w := &migrationWatcher{ch: make(chan *MigrationEvent, migrationWatchBufferSize)}
+	s.migrations.Lock()
+	defer s.migrations.Unlock()
+	if s.migrations.list == nil {
+		s.migrations.list = make(map[*migrationWatcher]bool)
+	}
+	s.migrations.list[w] = true
+	return w.ch, func() {
+		s.migrations.Lock()
+		defer s.migrations.Unlock()
+		if s.migrations.list[w] {
+			delete(s.migrations.list, w)
+			close(w.ch)
+		}
+	}
+}
+
+// ReportMigrations sends a progress event for each slot being migrated, see
+// WatchMigrations. It's meant to be called periodically.
+func (s *Router) ReportMigrations() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, slot := range s.slots {
+		if slot.migrate.from != "" {
+			s.notifyMigration(MigrationProgress, slot.id, slot.migrate.from, slot.backend.addr, slot.migrated.Get())
+		}
+	}
+}
+
+// noteMigration tells the watchers about the migration of the slot, now
+// filled, given what it was filled with before.
+func (s *Router) noteMigration(slot *Slot, from, to string) {
+	switch {
+	case from == slot.migrate.from && to == slot.backend.addr:
+		return
+	case from != "" && slot.migrate.from == "" && to == slot.backend.addr:
+		s.notifyMigration(MigrationCompleted, slot.id, from, to, slot.migrated.Get())
+		return
+	case from != "":
+		s.notifyMigration(MigrationAborted, slot.id, from, to, slot.migrated.Get())
+	}
+	if slot.migrate.from != "" {
+		slot.migrated.Set(0)
+		s.notifyMigration(MigrationStarted, slot.id, slot.migrate.from, slot.backend.addr, 0)
+	}
+}
+
+func (s *Router) notifyMigration(t MigrationEventType, i int, from, to string, keys int64) {
+	s.migrations.Lock()
+	defer s.migrations.Unlock()
+	if len(s.migrations.list) == 0 {
+		return
+	}
+	e := MigrationEvent{Type: t, Slot: i, From: from, To: to, Keys: keys, Time: time.Now()}
+	for w := range s.migrations.list {
+		w.push(e)
+	}
+}
+
+func (w *migrationWatcher) push(e MigrationEvent) {
+	for {
+		e.Gap = w.gap
+		select {
+		case w.ch <- &e:
+			w.gap = false
+			return
+		default:
+		}
+		select {
+		case <-w.ch:
+			w.gap = true
+		default:
+		}
+	}
+}
+
+func (s *Router) closeMigrationWatchers() {
+	s.migrations.Lock()
+	defer s.migrations.Unlock()
+	for w := range s.migrations.list {
+		close(w.ch)
+	}
+	s.migrations.list = nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+var ErrUnknownBackend = errors.New("not a backend of the proxy")
+
+// Monitor sends MONITOR to the backend on a conn of its own and returns the
+// conn once it's accepted, the commands the backend processes are streamed
+// on it then. Only backends in the pool can be monitored, and only the
+// traffic of that backend is seen, from every client of it, not just this
+// proxy. The caller must close the conn.
+func (s *Router) Monitor(addr string) (*redis.Conn, error) {
+	c, err := s.DialBackend(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.ReaderTimeout, c.WriterTimeout = dialTimeout, dialTimeout
+	resp, err := func() (*redis.Resp, error) {
+		if err := c.Writer.Encode(redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("MONITOR"))}), true); err != nil {
+			return nil, err
+		}
+		return c.Reader.Decode()
+	}()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if !resp.IsString() {
+		c.Close()
+		return nil, errors.New(fmt.Sprintf("bad monitor resp: %s", resp.Value))
+	}
+	c.ReaderTimeout, c.WriterTimeout = 0, 0
+	return c, nil
+}
+
+// DialBackend dials a conn of its own to the backend, which must be in the
+// pool, and returns it once authenticated. The caller must close the conn.
+func (s *Router) DialBackend(addr string) (*redis.Conn, error) {
+	s.mu.Lock()
+	_, ok := s.pool[addr]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownBackend
+	}
+	c, err := dialBackend(addr, 1024*64, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := handshake(c, addr, s.auth, dialTimeout); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+type monitorDispatcher interface {
+	Monitor(addr string) (*redis.Conn, error)
+}
+
+// monitorStream forwards the output of MONITOR from a backend conn, until
+// it's closed.
+type monitorStream struct {
+	*redis.Conn
+	stream chan *redis.Resp
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newMonitorStream(c *redis.Conn) *monitorStream {
+	m := &monitorStream{
+		Conn:   c,
+		stream: make(chan *redis.Resp, 1024),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(m.stream)
+		for {
+			resp, err := c.Reader.Decode()
+			if err != nil {
+				return
+			}
+			select {
+			case m.stream <- resp:
+			case <-m.done:
+				return
+			}
+		}
+	}()
+	return m
+}
+
+func (m *monitorStream) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+		m.Conn.Close()
+	})
+	return nil
+}
+
+// handleMonitor turns the session into a MONITOR of the backend given as the
+// only arg, e.g. MONITOR 127.0.0.1:6379, since the proxy has no traffic of
+// its own to show. It shows the commands of all the clients of the backend,
+// values included, so it requires PROXY ADMIN first, as PROXY BACKEND does.
+// The backend conn is closed with the session.
+func (s *Session) handleMonitor(r *Request, d Dispatcher) (*Request, error) {
+	x, ok := d.(monitorDispatcher)
+	if !ok {
+		r.Response.Resp = redis.NewError([]byte("ERR MONITOR is not supported"))
+		return r, nil
+	}
+	if !s.admin {
+		r.Response.Resp = redis.NewError([]byte("NOPERM MONITOR requires PROXY ADMIN first"))
+		return r, nil
+	}
+	if len(r.Resp.Array) != 2 {
+		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'MONITOR' command, usage: MONITOR <backend addr>"))
+		return r, nil
+	}
+	c, err := x.Monitor(string(r.Resp.Array[1].Value))
+	if err != nil {
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR monitor backend failed: %s", err)))
+		return r, nil
+	}
+	s.monitor = newMonitorStream(c)
+	r.Response.Resp = redis.NewString([]byte("OK"))
+	r.stream = s.monitor.stream
+	return r, nil
+}
+
+func (s *Session) closeMonitor() {
+	if s.monitor != nil {
+		s.monitor.Close()
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+)
+
+// negativeCache remembers the keys recently found absent, up to size keys,
+// the least recently used ones are evicted first.
+type negativeCache struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	size int
+	lru  *list.List
+	keys map[string]*list.Element
+
+	// seq is incremented by every invalidation, a key is only cached if
+	// nothing was invalidated while it was looked up.
+	seq uint64
+
+	hits, misses atomic2.Int64
+}
+
+type negativeEntry struct {
+	key    string
+	expire time.Time
+}
+
+// SetNegativeCache makes GET and EXISTS of a single key be answered by the
+// proxy, if the key was found absent by a GET or EXISTS within ttl, up to
+// size keys are remembered. A write to the key through the proxy forgets
+// it, but that's all the invalidation there is. Writes through other
+// proxies, or to the backends directly, or keys restored by a migration or
+// a failover, are not seen until ttl expires, and while some key is being
+// written, absent keys are not remembered at all, so the ttl should be as
+// short as the clients can take a stale miss. A size or ttl of 0 disables
+// it, which is the default.
+func (s *Router) SetNegativeCache(size int, ttl time.Duration) {
+	var c *negativeCache
+	if size > 0 && ttl > 0 {
+		c = &negativeCache{
+			ttl: ttl, size: size,
+			lru:  list.New(),
+			keys: make(map[string]*list.Element),
+		}
+	}
+	s.rwlck.Lock()
+	s.negcache = c
+	s.rwlck.Unlock()
+}
+
+// NegativeCacheStats returns the number of lookups answered by the proxy,
+// and the number of ones that were forwarded.
+func (s *Router) NegativeCacheStats() (hits, misses int64) {
+	s.rwlck.RLock()
+	c := s.negcache
+	s.rwlck.RUnlock()
+	if c == nil {
+		return 0, 0
+	}
+	return c.hits.Get(), c.misses.Get()
+}
+
+// lookupNegative answers the request if its key is known to be absent. The
+// keys of a write are forgotten, and the reply of a lookup that's forwarded
+// is used to remember its key, if absent, see SetNegativeCache.
+func (s *Router) lookupNegative(r *Request) bool {
+	s.rwlck.RLock()
+	c := s.negcache
+	s.rwlck.RUnlock()
+	if c == nil {
+		return false
+	}
+	if !isReadOnly(r.OpStr) {
+		for _, i := range getKeyIndexes(r.Resp, r.OpStr) {
+			c.invalidate(r.Resp.Array[i].Value)
+		}
+		return false
+	}
+	if (r.OpStr != "GET" && r.OpStr != "EXISTS") || len(r.Resp.Array) != 2 {
+		return false
+	}
+	key := string(r.Resp.Array[1].Value)
+	if c.lookup(key) {
+		c.hits.Incr()
+		if r.OpStr == "GET" {
+			r.Response.Resp = redis.NewBulkBytes(nil)
+		} else {
+			r.Response.Resp = redis.NewInt([]byte("0"))
+		}
+		return true
+	}
+	c.misses.Incr()
+	seq := c.sequence()
+	coalesce := r.Coalesce
+	r.Coalesce = func() error {
+		if r.Response.Err == nil && isAbsentReply(r.Response.Resp) {
+			c.add(key, seq)
+		}
+		if coalesce != nil {
+			return coalesce()
+		}
+		return nil
+	}
+	return false
+}
+
+func isAbsentReply(resp *redis.Resp) bool {
+	if resp == nil {
+		return false
+	}
+	switch {
+	case resp.IsBulkBytes():
+		return resp.Value == nil
+	case resp.IsInt():
+		return string(resp.Value) == "0"
+	}
+	return false
+}
+
+func (c *negativeCache) sequence() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq
+}
+
+func (c *negativeCache) lookup(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.keys[key]
+	if e == nil {
+		return false
+	}
+	if time.Now().After(e.Value.(*negativeEntry).expire) {
+		c.lru.Remove(e)
+		delete(c.keys, key)
+		return false
+	}
+	c.lru.MoveToFront(e)
+	return true
+}
+
+func (c *negativeCache) add(key string, seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seq != seq {
+		return
+	}
+	expire := time.Now().Add(c.ttl)
+	if e := c.keys[key]; e != nil {
+		e.Value.(*negativeEntry).expire = expire
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.keys[key] = c.lru.PushFront(&negativeEntry{key: key, expire: expire})
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.keys, e.Value.(*negativeEntry).key)
+	}
+}
+
+func (c *negativeCache) invalidate(key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	if e := c.keys[string(key)]; e != nil {
+		c.lru.Remove(e)
+		delete(c.keys, string(key))
+	}
+}
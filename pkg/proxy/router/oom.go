@@ -0,0 +1,108 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+var ErrBackendOOM = errors.New("TRYAGAIN backend is out of memory, writes are rejected for a while")
+
+var oomShedding atomic2.Int64
+
+// SetOOMShedding makes the writes to a backend be rejected with
+// ErrBackendOOM for window after it replied an OOM error, i.e. it's above
+// maxmemory, so clients retrying their writes don't make it worse, and get
+// an error telling them to back off. Only the writes that may grow memory,
+// the ones redis itself rejects when out of memory, are shed: reads, and
+// writes that free memory like DEL or EXPIRE, are still forwarded. The OOM
+// replies themselves are always passed through, and counted, see
+// BackendOOMCounts. 0 disables the shedding, which is the default.
+func SetOOMShedding(window time.Duration) {
+	oomShedding.Set(int64(window))
+}
+
+var denyoom = make(map[string]bool)
+
+func init() {
+	for _, s := range []string{
+		"APPEND", "DECR", "DECRBY", "GETSET", "INCR", "INCRBY", "INCRBYFLOAT", "MSET", "PSETEX",
+		"SET", "SETBIT", "SETEX", "SETNX", "SETRANGE", "RESTORE", "COPY", "SORT",
+		"HINCRBY", "HINCRBYFLOAT", "HMSET", "HSET", "HSETNX",
+		"LINSERT", "LMOVE", "LPUSH", "LPUSHX", "LSET", "RPOPLPUSH", "RPUSH", "RPUSHX",
+		"SADD", "SDIFFSTORE", "SINTERSTORE", "SUNIONSTORE",
+		"ZADD", "ZDIFFSTORE", "ZINCRBY", "ZINTERSTORE", "ZUNIONSTORE",
+		"PFADD", "PFMERGE", "EVAL", "EVALSHA",
+	} {
+		denyoom[s] = true
+	}
+}
+
+// isDenyOOM tells whether the command may grow the memory of the backend,
+// see SetOOMShedding.
+func isDenyOOM(opstr string) bool {
+	return denyoom[opstr]
+}
+
+func isOOMReply(resp *redis.Resp) bool {
+	return resp != nil && resp.IsError() && bytes.HasPrefix(resp.Value, []byte("OOM"))
+}
+
+// onOOMReply counts the OOM reply, and starts shedding the writes to the
+// backend if enabled. The replies on the conns of the clients count for the
+// pool, see SetClientAffinity.
+func (bc *BackendConn) onOOMReply() {
+	if bc.pooled != nil {
+		bc.pooled.onOOMReply()
+		return
+	}
+	bc.oom.Incr()
+	if window := oomShedding.Get(); window != 0 {
+		if bc.shedUntil.Get() < microseconds() {
+			log.Warnf("backend %s is out of memory, writes are rejected for %s", bc.addr, time.Duration(window))
+		}
+		bc.shedUntil.Set(microseconds() + window/int64(time.Microsecond))
+	}
+}
+
+func (s *SharedBackendConn) ooms() int64 {
+	var n int64
+	for _, bc := range s.conns {
+		n += bc.oom.Get()
+	}
+	return n
+}
+
+// isShedding tells whether the writes to the backend must be rejected, see
+// SetOOMShedding.
+func (s *SharedBackendConn) isShedding() bool {
+	if oomShedding.Get() == 0 {
+		return false
+	}
+	now := microseconds()
+	for _, bc := range s.conns {
+		if bc.shedUntil.Get() > now {
+			return true
+		}
+	}
+	return false
+}
+
+// BackendOOMCounts returns the number of OOM replies received from each
+// backend in the pool.
+func (s *Router) BackendOOMCounts() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var counts = make(map[string]int64, len(s.pool))
+	for addr, bc := range s.pool {
+		counts[addr] = bc.ooms()
+	}
+	return counts
+}
@@ -0,0 +1,182 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+var outputLimit struct {
+	hard, soft atomic2.Int64
+	seconds    atomic2.Int64
+
+	kills atomic2.Int64
+}
+
+// SetClientOutputBufferLimit limits the bytes of replies received from the
+// backends but not written to a client yet, like client-output-buffer-limit
+// of redis. The client is closed once it's above hard, or above soft for
+// longer than seconds. 0 disables a limit. It only applies to the requests
+// read afterwards.
+func SetClientOutputBufferLimit(hard, soft int64, seconds int) {
+	outputLimit.hard.Set(hard)
+	outputLimit.soft.Set(soft)
+	outputLimit.seconds.Set(int64(seconds))
+}
+
+// ClientOutputBufferKills returns the number of clients closed for going
+// above the output buffer limit.
+func ClientOutputBufferKills() int64 {
+	return outputLimit.kills.Get()
+}
+
+var replyBudget struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	budget  atomic2.Int64
+	used    atomic2.Int64
+	waiters atomic2.Int64
+}
+
+func init() {
+	replyBudget.cond = sync.NewCond(&replyBudget.Mutex)
+}
+
+// SetReplyBufferBudget limits the bytes of replies received from the
+// backends but not written to the clients yet, of all the clients. Once
+// it's used up, no client request is read until enough replies have been
+// written, so new dispatches pause rather than the proxy running out of
+// memory. 0 disables it. It only applies to the requests read afterwards.
+func SetReplyBufferBudget(budget int64) {
+	replyBudget.budget.Set(budget)
+	replyBudget.Lock()
+	replyBudget.cond.Broadcast()
+	replyBudget.Unlock()
+}
+
+// ReplyBufferUsage returns the bytes of replies not written to the clients
+// yet, only counted if an output buffer limit or a reply buffer budget is
+// set.
+func ReplyBufferUsage() int64 {
+	return replyBudget.used.Get()
+}
+
+func waitReplyBudget() {
+	budget := replyBudget.budget.Get()
+	if budget == 0 || replyBudget.used.Get() < budget {
+		return
+	}
+	replyBudget.Lock()
+	replyBudget.waiters.Incr()
+	for {
+		budget := replyBudget.budget.Get()
+		if budget == 0 || replyBudget.used.Get() < budget {
+			break
+		}
+		replyBudget.cond.Wait()
+	}
+	replyBudget.waiters.Decr()
+	replyBudget.Unlock()
+}
+
+func releaseReplyBudget(n int64) {
+	used := replyBudget.used.Sub(n)
+	if replyBudget.waiters.Get() != 0 && used < replyBudget.budget.Get() {
+		replyBudget.Lock()
+		replyBudget.cond.Broadcast()
+		replyBudget.Unlock()
+	}
+}
+
+func isOutputLimited() bool {
+	return outputLimit.hard.Get() != 0 || outputLimit.soft.Get() != 0 || replyBudget.budget.Get() != 0
+}
+
+// outputBytes counts the reply bytes of a request and its sub-requests, so
+// the session can release them once the request is written. Replies coming
+// after the release, e.g. of a closed session, are not counted.
+type outputBytes struct {
+	s *Session
+
+	sync.Mutex
+	n        int64
+	released bool
+}
+
+func (o *outputBytes) add(resp *redis.Resp) {
+	n := respSize(resp)
+	o.Lock()
+	if o.released {
+		o.Unlock()
+		return
+	}
+	o.n += n
+	o.Unlock()
+	replyBudget.used.Add(n)
+	o.s.incrOutput(n)
+}
+
+func (s *Session) newOutputBytes() *outputBytes {
+	if !isOutputLimited() {
+		return nil
+	}
+	return &outputBytes{s: s}
+}
+
+func (s *Session) incrOutput(n int64) {
+	size := s.output.size.Add(n)
+	hard, soft := outputLimit.hard.Get(), outputLimit.soft.Get()
+	switch {
+	case hard != 0 && size > hard:
+		s.killOutput(size)
+	case soft != 0 && size > soft:
+		now := microseconds()
+		if s.output.since.CompareAndSwap(0, now) {
+			return
+		}
+		if now-s.output.since.Get() > outputLimit.seconds.Get()*1e6 {
+			s.killOutput(size)
+		}
+	}
+}
+
+func (s *Session) releaseOutput(o *outputBytes) {
+	if o == nil {
+		return
+	}
+	o.Lock()
+	n := o.n
+	o.released = true
+	o.Unlock()
+	releaseReplyBudget(n)
+	size := s.output.size.Sub(n)
+	if soft := outputLimit.soft.Get(); soft == 0 || size <= soft {
+		s.output.since.Set(0)
+	}
+}
+
+func (s *Session) killOutput(size int64) {
+	if !s.output.killed.CompareAndSwap(false, true) {
+		return
+	}
+	outputLimit.kills.Incr()
+	log.Warnf("session [%p] closed: output buffer overflow, size = %d", s, size)
+	s.Close()
+}
+
+func respSize(resp *redis.Resp) int64 {
+	if resp == nil {
+		return 0
+	}
+	n := int64(len(resp.Value)) + 16
+	for _, x := range resp.Array {
+		n += respSize(x)
+	}
+	return n
+}
@@ -0,0 +1,68 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+var ErrRouterPaused = errors.New("TRYAGAIN proxy is paused, try again later")
+
+// Pause holds the new requests of Dispatch until Resume, for up to wait,
+// after which they fail with ErrRouterPaused, and 0 fails them right away.
+// The conns of the clients are kept, and requests already dispatched are
+// not affected. Unlike FreezeTopology, which only holds the slot changes,
+// it holds the requests themselves, e.g. for a maintenance coordinated
+// across the proxies. Pausing again only changes the wait.
+func (s *Router) Pause(wait time.Duration) {
+	s.paused.Lock()
+	defer s.paused.Unlock()
+	if !s.paused.on.Get() {
+		s.paused.resume = make(chan struct{})
+		s.paused.on.Set(true)
+		log.Infof("router is paused, inflight = %d", s.inflight.Get())
+	}
+	s.paused.wait = wait
+}
+
+// Resume lets the requests held by Pause, and the new ones, flow again.
+func (s *Router) Resume() {
+	s.paused.Lock()
+	defer s.paused.Unlock()
+	if s.paused.on.Get() {
+		s.paused.on.Set(false)
+		close(s.paused.resume)
+		log.Infof("router is resumed")
+	}
+}
+
+func (s *Router) Paused() bool {
+	return s.paused.on.Get()
+}
+
+// waitPaused holds the request while the router is paused, see Pause.
+func (s *Router) waitPaused() error {
+	if !s.paused.on.Get() {
+		return nil
+	}
+	s.paused.Lock()
+	on, wait, resume := s.paused.on.Get(), s.paused.wait, s.paused.resume
+	s.paused.Unlock()
+	if !on {
+		return nil
+	}
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-resume:
+			return nil
+		case <-t.C:
+		}
+	}
+	return ErrRouterPaused
+}
@@ -0,0 +1,127 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+)
+
+var opset = make(map[string]bool)
+
+func init() {
+	for _, opstr := range opnames {
+		opset[opstr] = true
+	}
+}
+
+// SetKeyPrefix makes every key of the requests be prefixed, so clients of
+// different namespaces can share the backends without knowing it. Keys are
+// prefixed before routing, a hash tag still works since the prefix is put
+// outside of it. Keys are found by the keyspecs, and key patterns of KEYS,
+// SCAN and SORT are prefixed as well, the keys replied by KEYS, SCAN and
+// RANDOMKEY have the prefix removed. Commands unknown to the proxy are
+// forwarded as is. An empty prefix disables it.
+func (s *Router) SetKeyPrefix(prefix string) {
+	s.rwlck.Lock()
+	s.prefix = []byte(prefix)
+	s.rwlck.Unlock()
+}
+
+func (s *Router) keyPrefix() []byte {
+	s.rwlck.RLock()
+	defer s.rwlck.RUnlock()
+	return s.prefix
+}
+
+func (s *Router) prefixKeys(r *Request) {
+	prefix := s.keyPrefix()
+	if len(prefix) == 0 {
+		return
+	}
+	array := r.Resp.Array
+	prefixArg := func(i int) {
+		if i > 0 && i < len(array) {
+			array[i] = redis.NewBulkBytes(append(append([]byte{}, prefix...), array[i].Value...))
+		}
+	}
+	switch r.OpStr {
+	case "SORT":
+		prefixArg(1)
+		for i := 2; i+1 < len(array); i++ {
+			switch strings.ToUpper(string(array[i].Value)) {
+			case "STORE":
+				prefixArg(i + 1)
+			case "BY", "GET":
+				if v := string(array[i+1].Value); v != "#" && strings.ToLower(v) != "nosort" {
+					prefixArg(i + 1)
+				}
+			default:
+				continue
+			}
+			i++
+		}
+	case "KEYS":
+		prefixArg(1)
+		s.stripKeys(r, prefix)
+	case "SCAN":
+		var match bool
+		for i := 2; i+1 < len(array); i += 2 {
+			if strings.ToUpper(string(array[i].Value)) == "MATCH" {
+				prefixArg(i + 1)
+				match = true
+			}
+		}
+		if !match {
+			r.Resp.Array = append(array, redis.NewBulkBytes([]byte("MATCH")),
+				redis.NewBulkBytes(append(append([]byte{}, prefix...), '*')))
+		}
+		s.stripKeys(r, prefix)
+	case "RANDOMKEY":
+		s.stripKeys(r, prefix)
+	default:
+		if opset[r.OpStr] {
+			for _, i := range getKeyIndexes(r.Resp, r.OpStr) {
+				prefixArg(i)
+			}
+		}
+	}
+}
+
+func (s *Router) stripKeys(r *Request, prefix []byte) {
+	coalesce := r.Coalesce
+	r.Coalesce = func() error {
+		if resp := r.Response.Resp; resp != nil {
+			stripKeyPrefix(r.OpStr, resp, prefix)
+		}
+		if coalesce != nil {
+			return coalesce()
+		}
+		return nil
+	}
+}
+
+func stripKeyPrefix(opstr string, resp *redis.Resp, prefix []byte) {
+	strip := func(x *redis.Resp) {
+		if x != nil && x.IsBulkBytes() && bytes.HasPrefix(x.Value, prefix) {
+			x.Value = x.Value[len(prefix):]
+		}
+	}
+	switch opstr {
+	case "KEYS":
+		for _, x := range resp.Array {
+			strip(x)
+		}
+	case "SCAN":
+		if resp.IsArray() && len(resp.Array) == 2 {
+			for _, x := range resp.Array[1].Array {
+				strip(x)
+			}
+		}
+	case "RANDOMKEY":
+		strip(resp)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/wandoulabs/codis/pkg/models"
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+)
+
+// KeySlot returns the slot that the key belongs to, as it's routed, i.e.
+// with the key prefix and by its hash tag.
+func (s *Router) KeySlot(key []byte) *models.SlotInfo {
+	hkey := append(append([]byte{}, s.keyPrefix()...), key...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.slotInfo(s.slots[hashSlot(hkey, len(s.slots))])
+}
+
+// RoutingParams is how the proxy maps keys to slots, for clients to compute
+// the slots the same way: the slot of a key is the Hash of its hash tag,
+// i.e. what's between the first TagBeg and the first TagEnd after it, or of
+// the whole key if there's no tag, modulo Slots. The Prefix is prepended to
+// every key before it's hashed.
+type RoutingParams struct {
+	Hash   string `json:"hash"`
+	Slots  int    `json:"slots"`
+	TagBeg string `json:"tag_beg"`
+	TagEnd string `json:"tag_end"`
+	Prefix string `json:"prefix"`
+}
+
+// RoutingParams returns the routing parameters in use, see KeySlot.
+func (s *Router) RoutingParams() *RoutingParams {
+	prefix := s.keyPrefix()
+	s.rwlck.RLock()
+	defer s.rwlck.RUnlock()
+	return &RoutingParams{
+		Hash:   "crc32-ieee",
+		Slots:  len(s.slots),
+		TagBeg: string(tagBeg),
+		TagEnd: string(tagEnd),
+		Prefix: string(prefix),
+	}
+}
+
+type proxyDispatcher interface {
+	KeySlot(key []byte) *models.SlotInfo
+	RoutingParams() *RoutingParams
+}
+
+// handleProxy handles PROXY, the diagnostic commands of the proxy itself.
+// Like any command, it requires AUTH first if the proxy has a password.
+//
+//	PROXY SLOT <key>: the slot of the key, its backend, and the backend it's
+//	being migrated from, if any.
+//	PROXY ROUTING: the hash function, the number of slots, the hash tag
+//	delimiters and the key prefix, see RoutingParams.
+//	PROXY ADMIN, PROXY BACKEND: see handleProxyAdmin.
+//	PROXY CONFIG GET [pattern]: see handleProxyConfig.
+//	PROXY PING: see handleProxyPing.
+func (s *Session) handleProxy(r *Request, d Dispatcher) (*Request, error) {
+	x, ok := d.(proxyDispatcher)
+	if !ok {
+		r.Response.Resp = redis.NewError([]byte("ERR PROXY is not supported"))
+		return r, nil
+	}
+	if len(r.Resp.Array) < 2 {
+		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'PROXY' command"))
+		return r, nil
+	}
+	switch sub := strings.ToUpper(string(r.Resp.Array[1].Value)); sub {
+	case "SLOT":
+		if len(r.Resp.Array) != 3 {
+			r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'PROXY SLOT' command, usage: PROXY SLOT <key>"))
+			return r, nil
+		}
+		info := x.KeySlot(r.Resp.Array[2].Value)
+		var migrating = "0"
+		if info.MigrateFrom != "" {
+			migrating = "1"
+		}
+		r.Response.Resp = redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("slot")),
+			redis.NewInt([]byte(strconv.Itoa(info.Id))),
+			redis.NewBulkBytes([]byte("addr")),
+			redis.NewBulkBytes([]byte(info.BackendAddr)),
+			redis.NewBulkBytes([]byte("db")),
+			redis.NewInt([]byte(strconv.Itoa(info.BackendDB))),
+			redis.NewBulkBytes([]byte("migrating")),
+			redis.NewInt([]byte(migrating)),
+			redis.NewBulkBytes([]byte("from")),
+			redis.NewBulkBytes([]byte(info.MigrateFrom)),
+		})
+	case "ADMIN", "BACKEND":
+		return s.handleProxyAdmin(r, d, sub)
+	case "CONFIG":
+		return s.handleProxyConfig(r, d)
+	case "PING":
+		return s.handleProxyPing(r, d)
+	case "ROUTING":
+		p := x.RoutingParams()
+		r.Response.Resp = redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("hash")),
+			redis.NewBulkBytes([]byte(p.Hash)),
+			redis.NewBulkBytes([]byte("slots")),
+			redis.NewInt([]byte(strconv.Itoa(p.Slots))),
+			redis.NewBulkBytes([]byte("tag_beg")),
+			redis.NewBulkBytes([]byte(p.TagBeg)),
+			redis.NewBulkBytes([]byte("tag_end")),
+			redis.NewBulkBytes([]byte(p.TagEnd)),
+			redis.NewBulkBytes([]byte("prefix")),
+			redis.NewBulkBytes([]byte(p.Prefix)),
+		})
+	default:
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR unknown PROXY subcommand '%s', try PROXY SLOT <key>, PROXY ROUTING, PROXY CONFIG GET or PROXY PING", sub)))
+	}
+	return r, nil
+}
+
+type readyDispatcher interface {
+	Ready() bool
+	Draining() bool
+}
+
+// handleProxyPing handles PROXY PING, the liveness probe of the proxy itself,
+// answered without any backend, so it tells the proxy is alive even if all
+// of them are down. The status tells whether it's ready, see Router.Ready:
+// READY, DRAINING, or CLOSED.
+func (s *Session) handleProxyPing(r *Request, d Dispatcher) (*Request, error) {
+	if len(r.Resp.Array) != 2 {
+		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'PROXY PING' command"))
+		return r, nil
+	}
+	var status = "READY"
+	if x, ok := d.(readyDispatcher); ok {
+		switch {
+		case x.Draining():
+			status = "DRAINING"
+		case !x.Ready():
+			status = "CLOSED"
+		}
+	}
+	r.Response.Resp = redis.NewString([]byte(status))
+	return r, nil
+}
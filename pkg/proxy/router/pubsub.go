@@ -0,0 +1,361 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+var ErrSubscribeTimeout = errors.New("subscribe timeout, backend didn't confirm")
+
+const pubsubTimeout = time.Second * 5
+
+// ChannelBackend returns the backend that the channel belongs to, and the
+// name of the channel there. A channel is mapped like a key: the backend of
+// its slot, with the key prefix, so PUBLISH is forwarded like any command
+// and reaches every subscriber of the proxies. Subscriptions stay on the
+// backend though, messages published after the slot is migrated are lost
+// until the clients subscribe again.
+func (s *Router) ChannelBackend(channel []byte) (string, []byte, error) {
+	name := append(append([]byte{}, s.keyPrefix()...), channel...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := s.slots[hashSlot(name, len(s.slots))].backend.addr
+	if addr == "" {
+		return "", name, ErrSlotIsNotReady
+	}
+	return addr, name, nil
+}
+
+type pubsubDispatcher interface {
+	ChannelBackend(channel []byte) (string, []byte, error)
+	DialBackend(addr string) (*redis.Conn, error)
+}
+
+type pubsubBackend struct {
+	*redis.Conn
+	addr string
+	acks chan struct{}
+}
+
+type pubsubChannel struct {
+	name    string
+	channel []byte
+	backend *pubsubBackend
+}
+
+// pubsubStream is a session in subscribed mode. Each channel is subscribed
+// on a conn of the session to its backend, see ChannelBackend, and the
+// confirmations are made by the proxy, so the counts are the channels of
+// the session over all backends, not of each backend. A subscribe is only
+// confirmed after its backend confirms, messages are never seen before the
+// confirmation. An unsubscribe is confirmed at once, the messages of the
+// channel still coming from the backend are dropped.
+type pubsubStream struct {
+	s *Session
+
+	mu       sync.Mutex
+	stream   chan *redis.Resp
+	done     chan struct{}
+	once     sync.Once
+	backends map[string]*pubsubBackend
+	channels map[string]*pubsubChannel
+	pending  map[string]*pubsubChannel
+	closed   bool
+
+	timeout time.Duration
+}
+
+func newPubSubStream(s *Session) *pubsubStream {
+	return &pubsubStream{
+		s:        s,
+		stream:   make(chan *redis.Resp, 1024),
+		done:     make(chan struct{}),
+		backends: make(map[string]*pubsubBackend),
+		channels: make(map[string]*pubsubChannel),
+		pending:  make(map[string]*pubsubChannel),
+	}
+}
+
+func newPubSubReply(kind string, channel []byte, count int) *redis.Resp {
+	return redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes([]byte(kind)),
+		redis.NewBulkBytes(channel),
+		redis.NewInt([]byte(strconv.Itoa(count))),
+	})
+}
+
+// push must be called with p.mu held.
+func (p *pubsubStream) push(resp *redis.Resp) {
+	if p.closed {
+		return
+	}
+	select {
+	case p.stream <- resp:
+	case <-p.done:
+	}
+}
+
+func (p *pubsubStream) reply(resp *redis.Resp) {
+	p.mu.Lock()
+	p.push(resp)
+	p.mu.Unlock()
+}
+
+func (p *pubsubStream) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.channels)
+}
+
+func (p *pubsubStream) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+	})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.stream)
+	for _, b := range p.backends {
+		b.Close()
+	}
+	return nil
+}
+
+func (p *pubsubStream) getBackend(addr string, d pubsubDispatcher) (*pubsubBackend, error) {
+	p.mu.Lock()
+	b := p.backends[addr]
+	p.mu.Unlock()
+	if b != nil {
+		return b, nil
+	}
+	c, err := d.DialBackend(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.WriterTimeout = pubsubTimeout
+	b = &pubsubBackend{Conn: c, addr: addr, acks: make(chan struct{}, 1)}
+	p.mu.Lock()
+	p.backends[addr] = b
+	p.mu.Unlock()
+	go p.loopBackend(b)
+	return b, nil
+}
+
+func (p *pubsubStream) loopBackend(b *pubsubBackend) {
+	for {
+		resp, err := b.Reader.Decode()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if !closed {
+				// the subscriptions are gone, make the client subscribe again
+				log.Warnf("session [%p] pubsub backend %s closed, error = %s", p.s, b.addr, err)
+				p.s.Close()
+			}
+			return
+		}
+		if !resp.IsArray() || len(resp.Array) != 3 {
+			continue
+		}
+		name := string(resp.Array[1].Value)
+		switch strings.ToLower(string(resp.Array[0].Value)) {
+		case "message":
+			p.mu.Lock()
+			if x := p.channels[name]; x != nil && x.backend == b {
+				p.push(redis.NewArray([]*redis.Resp{
+					resp.Array[0], redis.NewBulkBytes(x.channel), resp.Array[2],
+				}))
+			}
+			p.mu.Unlock()
+		case "subscribe":
+			p.mu.Lock()
+			if x := p.pending[name]; x != nil {
+				delete(p.pending, name)
+				p.channels[name] = x
+				p.push(newPubSubReply("subscribe", x.channel, len(p.channels)))
+			}
+			p.mu.Unlock()
+			select {
+			case b.acks <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func encodeCommand(c *redis.Conn, args ...[]byte) error {
+	var array = make([]*redis.Resp, len(args))
+	for i, arg := range args {
+		array[i] = redis.NewBulkBytes(arg)
+	}
+	return c.Writer.Encode(redis.NewArray(array), true)
+}
+
+func (p *pubsubStream) subscribe(channel []byte, d pubsubDispatcher) error {
+	addr, name, err := d.ChannelBackend(channel)
+	if err != nil {
+		p.reply(redis.NewError([]byte("ERR subscribe failed: " + err.Error())))
+		return nil
+	}
+	p.mu.Lock()
+	if p.channels[string(name)] != nil {
+		p.push(newPubSubReply("subscribe", channel, len(p.channels)))
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	b, err := p.getBackend(addr, d)
+	if err != nil {
+		p.reply(redis.NewError([]byte("ERR subscribe failed: " + err.Error())))
+		return nil
+	}
+	p.mu.Lock()
+	p.pending[string(name)] = &pubsubChannel{name: string(name), channel: channel, backend: b}
+	p.mu.Unlock()
+	if err := encodeCommand(b.Conn, []byte("SUBSCRIBE"), name); err != nil {
+		return err
+	}
+	select {
+	case <-b.acks:
+		return nil
+	case <-time.After(pubsubTimeout):
+		return errors.Trace(ErrSubscribeTimeout)
+	}
+}
+
+// unsubscribe must be called with p.mu held.
+func (p *pubsubStream) unsubscribe(x *pubsubChannel) error {
+	delete(p.channels, x.name)
+	p.push(newPubSubReply("unsubscribe", x.channel, len(p.channels)))
+	return encodeCommand(x.backend.Conn, []byte("UNSUBSCRIBE"), []byte(x.name))
+}
+
+func (p *pubsubStream) unsubscribeChannels(channels [][]byte, d pubsubDispatcher) error {
+	for _, channel := range channels {
+		_, name, _ := d.ChannelBackend(channel)
+		var err error
+		p.mu.Lock()
+		if x := p.channels[string(name)]; x != nil {
+			err = p.unsubscribe(x)
+		} else {
+			p.push(newPubSubReply("unsubscribe", channel, len(p.channels)))
+		}
+		p.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pubsubStream) unsubscribeAll() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.channels) == 0 {
+		p.push(newPubSubReply("unsubscribe", nil, 0))
+		return nil
+	}
+	var names []string
+	for name := range p.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := p.unsubscribe(p.channels[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePubSub handles a SUBSCRIBE or UNSUBSCRIBE, which enters the session
+// into subscribed mode. The replies of the session are all streamed then,
+// until it's subscribed to no channel and leaves the mode. Patterns are not
+// supported, they would have to be subscribed on every backend.
+func (s *Session) handlePubSub(r *Request, d Dispatcher) (*Request, error) {
+	if _, ok := d.(pubsubDispatcher); !ok {
+		r.Response.Resp = redis.NewError([]byte("ERR SUBSCRIBE is not supported"))
+		return r, nil
+	}
+	s.pubsub = newPubSubStream(s)
+	s.pubsub.timeout, s.Conn.ReaderTimeout = s.Conn.ReaderTimeout, 0
+	r.pubsub = s.pubsub.stream
+	if err := s.handlePubSubCommand(r.OpStr, r.Resp, d); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// handlePubSubCommand handles a request of a session in subscribed mode,
+// only SUBSCRIBE, UNSUBSCRIBE, PING and QUIT are allowed, like in redis.
+func (s *Session) handlePubSubCommand(opstr string, resp *redis.Resp, d Dispatcher) error {
+	p := s.pubsub
+	var err error
+	switch opstr {
+	case "SUBSCRIBE":
+		x, _ := d.(pubsubDispatcher)
+		if len(resp.Array) == 1 {
+			p.reply(redis.NewError([]byte("ERR wrong number of arguments for 'subscribe' command")))
+			return nil
+		}
+		for _, arg := range resp.Array[1:] {
+			if err = p.subscribe(arg.Value, x); err != nil {
+				break
+			}
+		}
+	case "UNSUBSCRIBE":
+		x, _ := d.(pubsubDispatcher)
+		if len(resp.Array) == 1 {
+			err = p.unsubscribeAll()
+		} else {
+			var channels [][]byte
+			for _, arg := range resp.Array[1:] {
+				channels = append(channels, arg.Value)
+			}
+			err = p.unsubscribeChannels(channels, x)
+		}
+	case "PING":
+		var arg = []byte{}
+		if len(resp.Array) > 1 {
+			arg = resp.Array[1].Value
+		}
+		p.reply(redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("pong")), redis.NewBulkBytes(arg),
+		}))
+	case "QUIT":
+		p.reply(redis.NewString([]byte("OK")))
+		s.quit = true
+	default:
+		p.reply(redis.NewError([]byte("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context")))
+	}
+	if err != nil {
+		return err
+	}
+	if p.count() == 0 && !s.quit {
+		p.Close()
+		s.pubsub = nil
+		s.Conn.ReaderTimeout = p.timeout
+	}
+	return nil
+}
+
+func (s *Session) closePubSub() {
+	if s.pubsub != nil {
+		s.pubsub.Close()
+	}
+}
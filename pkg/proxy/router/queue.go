@@ -0,0 +1,226 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+)
+
+// oppriority holds the map of priorities, which is never modified but
+// replaced by SetOpPriority, so it's read without locking.
+var oppriority struct {
+	sync.Mutex
+	m atomic.Value
+}
+
+func init() {
+	oppriority.m.Store(map[string]int{})
+}
+
+// SetOpPriority sets the priority of a command when it is queued to a busy
+// backend, requests with higher priority are forwarded first. Commands have
+// priority 0 by default, so the queue is FIFO unless priorities are set,
+// or fair queuing, see SetFairQueuing. A request only overtakes the ones
+// of other clients: it's given the priority of the last one its client has
+// queued, if lower, so the pipelines of a client keep their order.
+func SetOpPriority(opstr string, priority int) {
+	oppriority.Lock()
+	defer oppriority.Unlock()
+	var m = make(map[string]int)
+	for k, v := range oppriority.m.Load().(map[string]int) {
+		m[k] = v
+	}
+	if priority != 0 {
+		m[opstr] = priority
+	} else {
+		delete(m, opstr)
+	}
+	oppriority.m.Store(m)
+}
+
+func GetOpPriority(opstr string) int {
+	return oppriority.m.Load().(map[string]int)[opstr]
+}
+
+var fairQueuing atomic2.Bool
+
+// SetFairQueuing makes the requests queued to a busy backend be forwarded
+// round robin among the clients that sent them, within the same priority,
+// instead of first in first out, so a client flooding a backend can't make
+// the others wait behind all of its requests. The requests of a client
+// keep their order. It's off by default.
+func SetFairQueuing(on bool) {
+	fairQueuing.Set(on)
+}
+
+type queuedRequest struct {
+	r     *Request
+	prio  int
+	round uint64
+	seq   uint64
+	since int64
+}
+
+// requestQueue is the queue of a backend conn. With fair queuing, each
+// request is given the next round of its client, but never a round already
+// passed, and requests are forwarded by round first, so the clients with
+// requests queued take turns.
+type requestQueue struct {
+	items []*queuedRequest
+	seq   uint64
+
+	round  uint64
+	rounds map[string]uint64
+	prios  map[string]int
+
+	last *queuedRequest
+}
+
+func (q *requestQueue) Len() int {
+	return len(q.items)
+}
+
+func (q *requestQueue) Less(i, j int) bool {
+	a, b := q.items[i], q.items[j]
+	if a.prio != b.prio {
+		return a.prio > b.prio
+	}
+	if a.round != b.round {
+		return a.round < b.round
+	}
+	return a.seq < b.seq
+}
+
+func (q *requestQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+}
+
+func (q *requestQueue) Push(x interface{}) {
+	q.items = append(q.items, x.(*queuedRequest))
+}
+
+func (q *requestQueue) Pop() interface{} {
+	n := len(q.items) - 1
+	x := q.items[n]
+	q.items[n] = nil
+	q.items = q.items[:n]
+	return x
+}
+
+func (q *requestQueue) PushRequest(r *Request) {
+	q.seq++
+	x := &queuedRequest{r: r, prio: GetOpPriority(r.OpStr), seq: q.seq, since: microseconds()}
+	if r.client != "" {
+		if q.prios == nil {
+			q.prios = make(map[string]int)
+		}
+		if p, ok := q.prios[r.client]; ok && p < x.prio {
+			x.prio = p
+		}
+		q.prios[r.client] = x.prio
+	}
+	if fairQueuing.Get() {
+		if q.rounds == nil {
+			q.rounds = make(map[string]uint64)
+		}
+		x.round = q.rounds[r.client] + 1
+		if x.round <= q.round {
+			x.round = q.round + 1
+		}
+		q.rounds[r.client] = x.round
+	}
+	heap.Push(q, x)
+}
+
+func (q *requestQueue) PopRequest() *Request {
+	if len(q.items) == 0 {
+		return nil
+	}
+	x := heap.Pop(q).(*queuedRequest)
+	q.last = x
+	if x.round > q.round {
+		q.round = x.round
+	}
+	if len(q.items) == 0 {
+		q.rounds, q.prios = nil, nil
+	}
+	if x.r.wait != nil {
+		x.r.wait.add(microseconds() - x.since)
+	}
+	return x.r
+}
+
+// PushFront puts back the request last popped, with its place in the queue,
+// so it's popped again before the ones queued after it, e.g. when the conn
+// broke before it was written.
+func (q *requestQueue) PushFront(r *Request) {
+	if x := q.last; x != nil && x.r == r {
+		q.last = nil
+		heap.Push(q, x)
+		return
+	}
+	q.PushRequest(r)
+}
+
+// ClientWait is the time the requests of a client waited in the queues of
+// backend conns.
+type ClientWait struct {
+	Requests int64 `json:"requests"`
+	Usecs    int64 `json:"usecs"`
+	MaxUsecs int64 `json:"max_usecs"`
+}
+
+type clientWait struct {
+	requests, usecs, max atomic2.Int64
+}
+
+func (w *clientWait) add(usecs int64) {
+	w.requests.Incr()
+	w.usecs.Add(usecs)
+	for {
+		max := w.max.Get()
+		if usecs <= max || w.max.CompareAndSwap(max, usecs) {
+			return
+		}
+	}
+}
+
+var clientWaits = &clientWaitMap{m: make(map[string]*clientWait)}
+
+type clientWaitMap struct {
+	sync.RWMutex
+	m map[string]*clientWait
+}
+
+func (c *clientWaitMap) add(client string) *clientWait {
+	w := &clientWait{}
+	c.Lock()
+	c.m[client] = w
+	c.Unlock()
+	return w
+}
+
+func (c *clientWaitMap) remove(client string) {
+	c.Lock()
+	delete(c.m, client)
+	c.Unlock()
+}
+
+// ClientWaits returns the queue wait time of the requests of each client,
+// by remote addr, of the clients still connected.
+func ClientWaits() map[string]*ClientWait {
+	clientWaits.RLock()
+	defer clientWaits.RUnlock()
+	var waits = make(map[string]*ClientWait)
+	for client, w := range clientWaits.m {
+		waits[client] = &ClientWait{
+			Requests: w.requests.Get(), Usecs: w.usecs.Get(), MaxUsecs: w.max.Get(),
+		}
+	}
+	return waits
+}
@@ -15,6 +15,7 @@ type Dispatcher interface {
 }
 
 type Request struct {
+	Id    int64
 	OpStr string
 	Start int64
 
@@ -27,7 +28,50 @@ type Request struct {
 	}
 
 	Wait *sync.WaitGroup
-	slot *sync.WaitGroup
+	slot *Slot
+	db   int
+
+	loading bool
+	sent    int64
+
+	backend string
+	client  string
+	wait    *clientWait
+
+	inflight *atomic2.Int64
+	output   *outputBytes
+	writes   *slotWrites
+	cursors  *cursorPins
+	affinity *clientConns
+	stream   <-chan *redis.Resp
+	pubsub   <-chan *redis.Resp
 
 	Failed *atomic2.Bool
 }
+
+var requestId atomic2.Int64
+
+func nextRequestId() int64 {
+	return requestId.Incr()
+}
+
+// subRequest returns a request forwarding resp on behalf of r, of the same
+// client and session. It shares the Wait, Failed and output of r, so r waits
+// for it and its reply is counted as the one of r; a request forwarded on
+// its own, e.g. a hedge, sets them apart.
+func (r *Request) subRequest(resp *redis.Resp) *Request {
+	return &Request{
+		Id:       r.Id,
+		OpStr:    r.OpStr,
+		Start:    r.Start,
+		Resp:     resp,
+		Wait:     r.Wait,
+		Failed:   r.Failed,
+		client:   r.client,
+		wait:     r.wait,
+		output:   r.output,
+		writes:   r.writes,
+		cursors:  r.cursors,
+		affinity: r.affinity,
+	}
+}
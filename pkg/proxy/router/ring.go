@@ -0,0 +1,138 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"sync"
+
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+const ringPointsPerWeight = 64
+
+var (
+	ErrNoBackend     = errors.New("no backend is available")
+	ErrInvalidWeight = errors.New("invalid backend weight")
+)
+
+type ringPoint struct {
+	hash uint32
+	bc   *SharedBackendConn
+}
+
+type ringPoints []ringPoint
+
+func (p ringPoints) Len() int           { return len(p) }
+func (p ringPoints) Less(i, j int) bool { return p[i].hash < p[j].hash }
+func (p ringPoints) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// RingRouter routes keys to backends by a weighted consistent-hash ring
+// instead of the slot table, so adding or removing a backend only moves
+// the keys of its share. There is no migration, moved keys are simply
+// served by the new backend.
+type RingRouter struct {
+	mu sync.Mutex
+
+	auth string
+	pool map[string]*SharedBackendConn
+
+	rwlck sync.RWMutex
+	ring  ringPoints
+
+	closed bool
+}
+
+func NewRingRouter(auth string) *RingRouter {
+	return &RingRouter{auth: auth, pool: make(map[string]*SharedBackendConn)}
+}
+
+// SetBackends replaces the backends with the given addrs and weights, each
+// backend gets a share of the ring in proportion to its weight.
+func (s *RingRouter) SetBackends(weights map[string]int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosedRouter
+	}
+	for _, weight := range weights {
+		if weight <= 0 {
+			return ErrInvalidWeight
+		}
+	}
+
+	var pool = make(map[string]*SharedBackendConn, len(weights))
+	var ring ringPoints
+	for addr, weight := range weights {
+		bc := s.pool[addr]
+		if bc == nil {
+			bc = NewSharedBackendConn(addr, s.auth)
+		}
+		pool[addr] = bc
+		for i := 0; i < weight*ringPointsPerWeight; i++ {
+			hash := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s-%d", addr, i)))
+			ring = append(ring, ringPoint{hash: hash, bc: bc})
+		}
+	}
+	sort.Sort(ring)
+
+	s.rwlck.Lock()
+	s.ring = ring
+	s.rwlck.Unlock()
+
+	for addr, bc := range s.pool {
+		if pool[addr] == nil {
+			bc.Close()
+		}
+	}
+	s.pool = pool
+	log.Infof("ring router, set %d backends", len(pool))
+	return nil
+}
+
+func (s *RingRouter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.rwlck.Lock()
+	s.ring = nil
+	s.rwlck.Unlock()
+	for _, bc := range s.pool {
+		bc.Close()
+	}
+	s.pool = nil
+	s.closed = true
+	return nil
+}
+
+func (s *RingRouter) Dispatch(r *Request) error {
+	hkey := getHashKey(r.Resp, r.OpStr)
+	s.rwlck.RLock()
+	defer s.rwlck.RUnlock()
+	bc := s.lookup(hkey)
+	if bc == nil {
+		return ErrNoBackend
+	}
+	bc.Conn(hkey).PushBack(r)
+	return nil
+}
+
+func (s *RingRouter) lookup(key []byte) *SharedBackendConn {
+	if len(s.ring) == 0 {
+		return nil
+	}
+	hash := crc32.ChecksumIEEE(key)
+	i := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].hash >= hash
+	})
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].bc
+}
@@ -0,0 +1,84 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/assert"
+)
+
+func ringAddrs(s *RingRouter, n int) []string {
+	var addrs = make([]string, n)
+	for i := 0; i < n; i++ {
+		addrs[i] = s.lookup([]byte(fmt.Sprintf("key-%d", i))).Addr()
+	}
+	return addrs
+}
+
+func TestRingRouterAddBackend(t *testing.T) {
+	s := NewRingRouter("")
+	defer s.Close()
+	weights := map[string]int{"127.0.0.1:7000": 1, "127.0.0.1:7001": 1, "127.0.0.1:7002": 1}
+	assert.MustNoError(s.SetBackends(weights))
+
+	const n = 10000
+	before := ringAddrs(s, n)
+
+	weights["127.0.0.1:7003"] = 1
+	assert.MustNoError(s.SetBackends(weights))
+	after := ringAddrs(s, n)
+
+	var moved int
+	for i := 0; i < n; i++ {
+		if before[i] != after[i] {
+			assert.Must(after[i] == "127.0.0.1:7003")
+			moved++
+		}
+	}
+	assert.Must(moved > n/10 && moved < n*35/100)
+
+	delete(weights, "127.0.0.1:7003")
+	assert.MustNoError(s.SetBackends(weights))
+	assert.Must(len(s.pool) == 3)
+	for i, addr := range ringAddrs(s, n) {
+		assert.Must(addr == before[i])
+	}
+}
+
+func TestRingRouterWeight(t *testing.T) {
+	s := NewRingRouter("")
+	defer s.Close()
+	assert.Must(s.SetBackends(map[string]int{"127.0.0.1:7000": 0}) == ErrInvalidWeight)
+	assert.MustNoError(s.SetBackends(map[string]int{"127.0.0.1:7000": 3, "127.0.0.1:7001": 1}))
+
+	const n = 10000
+	var heavy int
+	for _, addr := range ringAddrs(s, n) {
+		if addr == "127.0.0.1:7000" {
+			heavy++
+		}
+	}
+	assert.Must(heavy > n*65/100 && heavy < n*85/100)
+}
+
+func TestRingRouterDispatch(t *testing.T) {
+	s := NewRingRouter("")
+	defer s.Close()
+	assert.Must(s.Dispatch(newRequest("GET", "foo")) == ErrNoBackend)
+
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+	assert.MustNoError(s.SetBackends(map[string]int{b.Addr: 1}))
+
+	r := newRequest("GET", "foo")
+	assert.MustNoError(s.Dispatch(r))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+	assert.Must(string(r.Response.Resp.Value) == "bar")
+}
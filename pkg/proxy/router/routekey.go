@@ -0,0 +1,72 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+)
+
+// RouteKeyFunc returns the hash key of a request given its args, the
+// command included, or nil to route it by its key as usual.
+type RouteKeyFunc func(args []*redis.Resp) []byte
+
+// RouteKeyArgs returns a RouteKeyFunc that routes by the args at the given
+// positions, joined, like a key of them would be, e.g. RouteKeyArgs(3) for
+// ZADD key score member routes by the member.
+func RouteKeyArgs(indexes ...int) RouteKeyFunc {
+	return func(args []*redis.Resp) []byte {
+		var keys [][]byte
+		for _, i := range indexes {
+			if i <= 0 || i >= len(args) {
+				return nil
+			}
+			keys = append(keys, args[i].Value)
+		}
+		return bytes.Join(keys, nil)
+	}
+}
+
+// SetRouteKey makes the requests of the command be routed by the hash key
+// returned by fn instead of their key, nil restores the default. The hash
+// tag still applies to the hash key. fn is given the args once the key
+// prefix is prepended to the keys, so a hash key taken from a key has it,
+// and one taken from another arg doesn't. Nothing else is checked, so it's
+// up to fn to keep all the requests of a key on the slot that has the key:
+// a read routed to another slot than the writes of its key misses them.
+// During a migration the proxy moves the hash key to the destination before
+// forwarding, not the key of the request, so a request whose key doesn't
+// share the hash tag of its hash key may miss it, or write it to both
+// sides. The keys of the requests are unchanged, multi key commands split
+// by the proxy, e.g. MGET, and the CROSSSLOT check use them, not fn.
+func (s *Router) SetRouteKey(opstr string, fn RouteKeyFunc) {
+	opstr = strings.ToUpper(opstr)
+	s.rwlck.Lock()
+	defer s.rwlck.Unlock()
+	if fn == nil {
+		delete(s.routekeys, opstr)
+		return
+	}
+	if s.routekeys == nil {
+		s.routekeys = make(map[string]RouteKeyFunc)
+	}
+	s.routekeys[opstr] = fn
+}
+
+// routeKey returns the hash key of the request, see SetRouteKey, or hkey
+// if the command has no RouteKeyFunc.
+func (s *Router) routeKey(r *Request, hkey []byte) []byte {
+	s.rwlck.RLock()
+	fn := s.routekeys[r.OpStr]
+	s.rwlck.RUnlock()
+	if fn == nil {
+		return hkey
+	}
+	if key := fn(r.Resp.Array); key != nil {
+		return key
+	}
+	return hkey
+}
@@ -4,10 +4,15 @@
 package router
 
 import (
-	"strings"
+	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/wandoulabs/codis/pkg/models"
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
 	"github.com/wandoulabs/codis/pkg/utils/errors"
 	"github.com/wandoulabs/codis/pkg/utils/log"
 )
@@ -17,11 +22,130 @@ const MaxSlotNum = models.DEFAULT_SLOT_NUM
 type Router struct {
 	mu sync.Mutex
 
-	auth string
-	pool map[string]*SharedBackendConn
+	auth   string
+	pool   map[string]*SharedBackendConn
+	labels map[string]string
 
-	slots [MaxSlotNum]*Slot
+	unhealthy map[string]bool
 
+	selected map[string]bool
+	pooled   atomic.Value
+
+	timeout struct {
+		read, write time.Duration
+	}
+	poolsize int
+
+	sockopts struct {
+		nodelay bool
+		linger  time.Duration
+	}
+	flushDelay time.Duration
+
+	rwlck sync.RWMutex
+	slots []*Slot
+	table atomic.Value
+
+	prefix []byte
+	zone   string
+
+	durable struct {
+		check *redis.Resp
+		ops   map[string]bool
+	}
+	hedging struct {
+		delay  time.Duration
+		ops    map[string]bool
+		window time.Duration
+
+		fired, won atomic2.Int64
+	}
+	timeouts struct {
+		def time.Duration
+		ops map[string]time.Duration
+
+		count atomic2.Int64
+	}
+	lagging struct {
+		max time.Duration
+	}
+	unavailable struct {
+		policy  UnavailablePolicy
+		timeout time.Duration
+		ops     map[string]UnavailablePolicy
+	}
+
+	opcounts opCounters
+
+	inflight     atomic2.Int64
+	backpressure struct {
+		high, low atomic2.Int64
+		overload  atomic2.Bool
+	}
+
+	readonly struct {
+		sync.Mutex
+		handler func(slot int, addr string)
+	}
+
+	draining atomic2.Bool
+	partial  atomic2.Bool
+	auditor  *auditor
+	negcache *negativeCache
+	selector BackendSelector
+	fallback struct {
+		addr  string
+		count atomic2.Int64
+	}
+
+	unknown struct {
+		policy UnknownCommandPolicy
+		addr   string
+	}
+
+	routekeys map[string]RouteKeyFunc
+	adminAuth string
+	affinity  bool
+
+	coalescing struct {
+		sync.Mutex
+		flights map[string]*readFlight
+
+		enabled atomic2.Bool
+		joined  atomic2.Int64
+	}
+
+	paused struct {
+		sync.Mutex
+		on     atomic2.Bool
+		wait   time.Duration
+		resume chan struct{}
+	}
+
+	tokens struct {
+		sync.Mutex
+		ttl    time.Duration
+		expire map[string]int64
+	}
+
+	heatmap struct {
+		sync.Mutex
+		last  time.Time
+		slots []*Slot
+		hits  []int64
+		rates []float64
+	}
+
+	watchers struct {
+		sync.Mutex
+		list map[*slotWatcher]bool
+	}
+	migrations struct {
+		sync.Mutex
+		list map[*migrationWatcher]bool
+	}
+
+	frozen bool
 	closed bool
 }
 
@@ -31,15 +155,54 @@ func New() *Router {
 
 func NewWithAuth(auth string) *Router {
 	s := &Router{
-		auth: auth,
-		pool: make(map[string]*SharedBackendConn),
+		auth:   auth,
+		pool:   make(map[string]*SharedBackendConn),
+		labels: make(map[string]string),
+		slots:  make([]*Slot, MaxSlotNum),
+
+		unhealthy: make(map[string]bool),
+
+		opcounts: newOpCounters(),
 	}
 	for i := 0; i < len(s.slots); i++ {
 		s.slots[i] = &Slot{id: i}
 	}
+	s.setSlotTable(s.slots)
+	s.timeout.read = time.Minute
+	s.timeout.write = time.Minute
+	s.poolsize = 1
+	s.sockopts.nodelay = true
+	s.sockopts.linger = -1
 	return s
 }
 
+// SetBackendPoolSize sets the number of physical conns to each backend,
+// requests are spread over them by key, see NewSharedBackendConnPool.
+// It only applies to the conns created afterwards, see RecyclePool.
+func (s *Router) SetBackendPoolSize(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.poolsize = n
+}
+
+// SetBackendTimeout sets the read and write deadlines of backend conns,
+// it only applies to the conns created afterwards, see RecyclePool.
+func (s *Router) SetBackendTimeout(read, write time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeout.read, s.timeout.write = read, write
+}
+
+// SetBackendSockOpts sets TCP_NODELAY and SO_LINGER of backend conns, see
+// setSockOpts, TCP_NODELAY is on by default and a negative linger keeps the
+// default of the OS. It only applies to the conns created afterwards, see
+// RecyclePool.
+func (s *Router) SetBackendSockOpts(nodelay bool, linger time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sockopts.nodelay, s.sockopts.linger = nodelay, linger
+}
+
 func (s *Router) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -49,32 +212,422 @@ func (s *Router) Close() error {
 	for i := 0; i < len(s.slots); i++ {
 		s.resetSlot(i)
 	}
+	s.releaseSelected()
 	s.closed = true
+	s.closeWatchers()
+	s.closeMigrationWatchers()
+	s.SetAuditSink(nil, 0)
 	return nil
 }
 
 var errClosedRouter = errors.New("use of closed router")
 
+var ErrTopologyFrozen = errors.New("topology is frozen")
+
+// FreezeTopology makes all changes of the slot table be rejected with
+// ErrTopologyFrozen until UnfreezeTopology, dispatching is not affected.
+func (s *Router) FreezeTopology() {
+	s.mu.Lock()
+	s.frozen = true
+	s.mu.Unlock()
+}
+
+func (s *Router) UnfreezeTopology() {
+	s.mu.Lock()
+	s.frozen = false
+	s.mu.Unlock()
+}
+
 func (s *Router) ResetSlot(i int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.closed {
 		return errClosedRouter
 	}
+	if s.frozen {
+		return ErrTopologyFrozen
+	}
 	s.resetSlot(i)
 	return nil
 }
 
 func (s *Router) FillSlot(i int, addr, from string, lock bool) error {
+	return s.FillSlotWithDB(i, addr, from, 0, lock)
+}
+
+// FillSlotWithDB fills the slot, and requests of the slot are forwarded to
+// the given db of the backend (and of migrate.from). The backend conn may be
+// shared by slots of different dbs, it issues SELECT whenever it switches.
+func (s *Router) FillSlotWithDB(i int, addr, from string, db int, lock bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosedRouter
+	}
+	if s.frozen {
+		return ErrTopologyFrozen
+	}
+	if err := checkSlotConfig(addr, from); err != nil {
+		log.Warnf("slot-%04d rejected: backend.addr = %s, migrate.from = %s, error = %s", i, addr, from, err)
+		return err
+	}
+	s.fillSlot(i, addr, from, db, lock)
+	return nil
+}
+
+var ErrMigrateToItself = errors.New("slot migrates to itself, migrate.from is the same as backend.addr")
+
+// checkSlotConfig rejects configs that would route requests in a loop,
+// the coordinator is expected to never send them.
+func checkSlotConfig(addr, from string) error {
+	if from != "" && from == addr {
+		return ErrMigrateToItself
+	}
+	return nil
+}
+
+// Replica is a replica of a slot, in the zone of the given name.
+type Replica struct {
+	Addr string
+	Zone string
+}
+
+// SetSlotReplica sets the replica of the slot that hedged reads may go to,
+// an empty addr removes it. It's cleared whenever the slot is filled again.
+func (s *Router) SetSlotReplica(i int, addr string) error {
+	var replicas []Replica
+	if addr != "" {
+		replicas = append(replicas, Replica{Addr: addr})
+	}
+	return s.SetSlotReplicas(i, replicas)
+}
+
+// SetSlotReplicas sets the replicas of the slot, hedged reads go to the
+// first available one in the zone of the proxy, see SetZone, or else to
+// the first available one in other zones.
+func (s *Router) SetSlotReplicas(i int, replicas []Replica) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosedRouter
+	}
+	if s.frozen {
+		return ErrTopologyFrozen
+	}
+	if !s.isValidSlot(i) {
+		return ErrInvalidSlotId
+	}
+	slot := s.slots[i]
+	if isSameReplicas(slot.replicas, replicas) {
+		return nil
+	}
+	held := slot.lock.hold
+	slot.blockAndWait()
+	s.putReplicas(slot)
+	slot.replicas = nil
+	for _, x := range replicas {
+		slot.replicas = append(slot.replicas, &slotReplica{
+			addr: x.Addr, zone: x.Zone, bc: s.getBackendConn(x.Addr),
+		})
+	}
+	if !held {
+		slot.unblock()
+	}
+	log.Infof("slot %04d, replicas = %v", i, replicas)
+	s.notifySlot(slot)
+	return nil
+}
+
+func isSameReplicas(list []*slotReplica, replicas []Replica) bool {
+	if len(list) != len(replicas) {
+		return false
+	}
+	for i, x := range list {
+		if x.addr != replicas[i].Addr || x.zone != replicas[i].Zone {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Router) putReplicas(slot *Slot) {
+	for _, x := range slot.replicas {
+		s.putBackendConn(x.bc)
+	}
+}
+
+// SetZone sets the zone of the proxy, which hedged reads prefer, see
+// SetSlotReplicas.
+func (s *Router) SetZone(zone string) {
+	s.rwlck.Lock()
+	s.zone = zone
+	s.rwlck.Unlock()
+}
+
+func (s *Router) getZone() string {
+	s.rwlck.RLock()
+	defer s.rwlck.RUnlock()
+	return s.zone
+}
+
+// EffectiveReplica returns the addr of the replica that hedged reads of the
+// slot go to at the moment, or "" if there is none available.
+func (s *Router) EffectiveReplica(i int) string {
+	zone := s.getZone()
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if !s.isValidSlot(i) {
+		return ""
+	}
+	return effectiveReplica(s.slots[i], zone)
+}
+
+func effectiveReplica(slot *Slot, zone string) string {
+	if x := slot.pickReplica(zone); x != nil {
+		return x.addr
+	}
+	return ""
+}
+
+// SetBackendLabel sets a human readable label of the backend, which is only
+// for display and has nothing to do with routing. An empty label removes it.
+func (s *Router) SetBackendLabel(addr, label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if label != "" {
+		s.labels[addr] = label
+	} else {
+		delete(s.labels, addr)
+	}
+}
+
+func (s *Router) GetSlots() []*models.SlotInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var slots = make([]*models.SlotInfo, len(s.slots))
+	for i, slot := range s.slots {
+		slots[i] = s.slotInfo(slot)
+	}
+	return slots
+}
+
+func (s *Router) slotInfo(slot *Slot) *models.SlotInfo {
+	info := &models.SlotInfo{
+		Id:           slot.id,
+		BackendAddr:  slot.backend.addr,
+		BackendDB:    slot.backend.db,
+		BackendLabel: s.labels[slot.backend.addr],
+		MigrateFrom:  slot.migrate.from,
+		Locked:       slot.lock.hold,
+		ReadOnly:     slot.readonly.Get(),
+		Gated:        slot.gated(),
+		ReplicaAddr:  effectiveReplica(slot, s.getZone()),
+	}
+	info.LastError, info.LastErrorTime = slot.getLastError()
+	return info
+}
+
+// MigratingSlots returns the ids of the slots being migrated.
+func (s *Router) MigratingSlots() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []int
+	for _, slot := range s.slots {
+		if slot.migrate.from != "" {
+			ids = append(ids, slot.id)
+		}
+	}
+	return ids
+}
+
+// BackendDistribution returns the number of slots served by each backend.
+// Only slot.backend is counted, migrate sources are not, unlike the refcnt
+// of the shared backend conns in the pool.
+func (s *Router) BackendDistribution() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var m = make(map[string]int)
+	for _, slot := range s.slots {
+		if addr := slot.backend.addr; addr != "" {
+			m[addr]++
+		}
+	}
+	return m
+}
+
+var ErrInvalidSlotId = errors.New("invalid slot id")
+
+// ResetBackendConn replaces the backend conn of the slot with a new one,
+// without touching the mapping. The conn is shared, so all slots using it
+// (as backend or as migrate source) switch to the new conn, each after its
+// in-flight requests are done. The old conn is closed once it's drained.
+func (s *Router) ResetBackendConn(i int) error {
+	s.mu.Lock()
 	if s.closed {
+		s.mu.Unlock()
 		return errClosedRouter
 	}
-	s.fillSlot(i, addr, from, lock)
+	if !s.isValidSlot(i) {
+		s.mu.Unlock()
+		return ErrInvalidSlotId
+	}
+	addr := s.slots[i].backend.addr
+	if addr == "" {
+		s.mu.Unlock()
+		return ErrSlotIsNotReady
+	}
+	replaced := s.replaceBackendConns(addr)
+	s.mu.Unlock()
+	closeReplacedConns(replaced)
+	return nil
+}
+
+// RebuildPool replaces every backend conn of the pool with a new one, like
+// ResetBackendConn does for a single backend, so half-open sockets left by
+// a network failure are cleared. The slot mapping is kept, and requests in
+// flight are answered on the old conns before they're closed.
+func (s *Router) RebuildPool() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errClosedRouter
+	}
+	var addrs []string
+	for addr := range s.pool {
+		addrs = append(addrs, addr)
+	}
+	replaced := s.replaceBackendConns(addrs...)
+	s.mu.Unlock()
+	closeReplacedConns(replaced)
+	return nil
+}
+
+// RecyclePool replaces the backend conns of the pool like RebuildPool, but
+// one backend at a time, waiting pace in between, so the settings changed
+// since the conns were created, e.g. SetBackendTimeout, SetBackendPoolSize
+// or SetBackendSockOpts, are applied without reconnecting to all backends
+// at once. Backends added meanwhile already have the new settings, and
+// backends removed meanwhile are skipped. It returns when every backend is
+// done.
+func (s *Router) RecyclePool(pace time.Duration) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errClosedRouter
+	}
+	var addrs []string
+	for addr := range s.pool {
+		addrs = append(addrs, addr)
+	}
+	s.mu.Unlock()
+
+	sort.Strings(addrs)
+	for i, addr := range addrs {
+		if i != 0 {
+			time.Sleep(pace)
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return errClosedRouter
+		}
+		var replaced map[*SharedBackendConn]*SharedBackendConn
+		if s.pool[addr] != nil {
+			replaced = s.replaceBackendConns(addr)
+		}
+		s.mu.Unlock()
+		closeReplacedConns(replaced)
+	}
 	return nil
 }
 
+// replaceBackendConns makes the slots switch to new conns to the backends,
+// one slot at a time after its in-flight requests are done. It returns the
+// new conn of each old one, which are closed by closeReplacedConns, once
+// s.mu is released.
+func (s *Router) replaceBackendConns(addrs ...string) map[*SharedBackendConn]*SharedBackendConn {
+	var m = make(map[*SharedBackendConn]*SharedBackendConn)
+	for _, addr := range addrs {
+		old := s.pool[addr]
+		bc := s.newBackendConn(addr)
+		bc.refcnt = old.refcnt
+		s.pool[addr] = bc
+		m[old] = bc
+	}
+	for _, slot := range s.slots {
+		if m[slot.backend.bc] == nil && m[slot.migrate.bc] == nil && !slot.hasReplicaConnIn(m) {
+			continue
+		}
+		held := slot.lock.hold
+		slot.blockAndWait()
+		if bc := m[slot.backend.bc]; bc != nil {
+			slot.backend.bc = bc
+		}
+		if bc := m[slot.migrate.bc]; bc != nil {
+			slot.migrate.bc = bc
+		}
+		for _, x := range slot.replicas {
+			if bc := m[x.bc]; bc != nil {
+				x.bc = bc
+			}
+		}
+		if !held {
+			slot.unblock()
+		}
+	}
+	for _, bc := range m {
+		log.Infof("reset backend conn to %s, refcnt = %d", bc.addr, bc.refcnt)
+	}
+	s.publishSelected()
+	return m
+}
+
+// closeReplacedConns closes the old conns replaced by replaceBackendConns,
+// once s.mu is released.
+func closeReplacedConns(m map[*SharedBackendConn]*SharedBackendConn) {
+	for old := range m {
+		old.closeConns()
+	}
+}
+
+// BackendLoadingCounts returns the number of LOADING or MASTERDOWN replies
+// received from each backend in the pool.
+func (s *Router) BackendLoadingCounts() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var counts = make(map[string]int64, len(s.pool))
+	for addr, bc := range s.pool {
+		counts[addr] = bc.loadings()
+	}
+	return counts
+}
+
+// BackendInFlight returns the number of requests sent to each backend in
+// the pool and not answered yet, InFlight is the total of the router.
+func (s *Router) BackendInFlight() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var counts = make(map[string]int64, len(s.pool))
+	for addr, bc := range s.pool {
+		counts[addr] = bc.inflights()
+	}
+	return counts
+}
+
+// ReapIdle closes the physical backend conns that have forwarded nothing for
+// idle, they are dialed again on the next request. Conns of backends no
+// longer used by any slot are closed as soon as they are released, so only
+// idle ones are left here. It returns the number of conns closed.
+func (s *Router) ReapIdle(idle time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for _, bc := range s.pool {
+		n += bc.reapIdle(idle)
+	}
+	return n
+}
+
 func (s *Router) KeepAlive() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -87,10 +640,335 @@ func (s *Router) KeepAlive() error {
 	return nil
 }
 
+type SlotConfig struct {
+	Addr string
+	From string
+	DB   int
+	Lock bool
+}
+
+var (
+	ErrInvalidSlotNum = errors.New("invalid slot number")
+	ErrSlotIsLocked   = errors.New("slot is locked, can't be resharded")
+)
+
+// ReshardSlots replaces the slot table with a new one of newCount slots,
+// filled according to mapping. Slots whose config is unchanged are kept as
+// is, only the changed ones get drained and have their backends released.
+// It is rejected if any slot is still locked by a pending migration, since
+// dispatches blocked on that slot can't be interrupted safely.
+func (s *Router) ReshardSlots(newCount int, mapping []SlotConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosedRouter
+	}
+	if s.frozen {
+		return ErrTopologyFrozen
+	}
+	if newCount <= 0 || len(mapping) != newCount {
+		return ErrInvalidSlotNum
+	}
+	for _, slot := range s.slots {
+		if slot.lock.hold {
+			return ErrSlotIsLocked
+		}
+	}
+	for i, c := range mapping {
+		if err := checkSlotConfig(c.Addr, c.From); err != nil {
+			log.Warnf("slot-%04d rejected: backend.addr = %s, migrate.from = %s, error = %s", i, c.Addr, c.From, err)
+			return err
+		}
+	}
+
+	var table = make([]*Slot, newCount)
+	var reused = make(map[*Slot]bool)
+	for i, c := range mapping {
+		if i < len(s.slots) {
+			slot := s.slots[i]
+			if !c.Lock && slot.backend.addr == c.Addr && slot.migrate.from == c.From && slot.backend.db == c.DB {
+				table[i] = slot
+				reused[slot] = true
+				continue
+			}
+		}
+		table[i] = &Slot{id: i}
+		s.setupSlot(table[i], c.Addr, c.From, c.DB, c.Lock)
+	}
+
+	s.rwlck.Lock()
+	slots := s.slots
+	s.slots = table
+	s.setSlotTable(table)
+	s.rwlck.Unlock()
+
+	for _, slot := range slots {
+		if !reused[slot] {
+			s.teardownSlot(slot)
+		}
+	}
+	for _, slot := range table {
+		if !reused[slot] {
+			s.notifySlot(slot)
+		}
+	}
+	log.Infof("reshard slots from %d to %d, %d slots changed",
+		len(slots), len(table), len(table)-len(reused))
+	return nil
+}
+
+// CommandStats returns the number of dispatched requests of each command
+// since the last reset, commands not in the command table are counted as
+// "other" to keep the map bounded.
+func (s *Router) CommandStats() map[string]int64 {
+	return s.opcounts.snapshot()
+}
+
+func (s *Router) ResetCommandStats() {
+	s.opcounts.reset()
+}
+
+var ErrTryAgainLater = errors.New("TRYAGAIN proxy is overloaded, try again later")
+
+// SetBackpressure makes Dispatch return ErrTryAgainLater once the number of
+// in-flight requests reaches high, until it drops back to low. A high-water
+// mark of 0 disables backpressure.
+func (s *Router) SetBackpressure(high, low int64) {
+	if low > high {
+		low = high
+	}
+	s.backpressure.high.Set(high)
+	s.backpressure.low.Set(low)
+	s.backpressure.overload.Set(false)
+}
+
+func (s *Router) InFlight() int64 {
+	return s.inflight.Get()
+}
+
+func (s *Router) isOverloaded() bool {
+	high := s.backpressure.high.Get()
+	if high == 0 {
+		return false
+	}
+	n := s.inflight.Get()
+	if s.backpressure.overload.Get() {
+		if n > s.backpressure.low.Get() {
+			return true
+		}
+		s.backpressure.overload.Set(false)
+		return false
+	}
+	if n >= high {
+		s.backpressure.overload.Set(true)
+		return true
+	}
+	return false
+}
+
+// SetDurableCheck makes the given commands be followed by the check command,
+// e.g. WAITAOF 1 0 100 or WAIT 1 100, sent on the same backend conn right
+// after the request, and the reply is held until the check is answered. A
+// failed check turns the reply into an error, but the write has been done
+// already, it's just not known to be durable. The check covers all writes
+// sent on that conn before it. For commands split into sub-requests, like
+// MSET, the checks delay the reply but their results are not verified.
+// An empty check disables it.
+func (s *Router) SetDurableCheck(check []string, opstrs []string) {
+	s.rwlck.Lock()
+	defer s.rwlck.Unlock()
+	if len(check) == 0 {
+		s.durable.check, s.durable.ops = nil, nil
+		return
+	}
+	var array = make([]*redis.Resp, len(check))
+	for i, arg := range check {
+		array[i] = redis.NewBulkBytes([]byte(arg))
+	}
+	s.durable.check = redis.NewArray(array)
+	s.durable.ops = make(map[string]bool)
+	for _, opstr := range opstrs {
+		s.durable.ops[opstr] = true
+	}
+}
+
+func newDurableCheck(r *Request, check *redis.Resp) *Request {
+	if check == nil {
+		return nil
+	}
+	m := r.subRequest(check)
+	coalesce := r.Coalesce
+	r.Coalesce = func() error {
+		if err := m.Response.Err; err != nil {
+			return err
+		}
+		if resp := m.Response.Resp; resp == nil || resp.IsError() {
+			if resp := r.Response.Resp; resp != nil && !resp.IsError() {
+				r.Response.Resp = redis.NewError([]byte("ERR durable check failed"))
+			}
+			return nil
+		}
+		if coalesce != nil {
+			return coalesce()
+		}
+		return nil
+	}
+	return m
+}
+
 func (s *Router) Dispatch(r *Request) error {
-	hkey := getHashKey(r.Resp, r.OpStr)
-	slot := s.slots[hashSlot(hkey)]
-	return slot.forward(r, hkey)
+	if err := s.admit(r); err != nil {
+		s.audit(r, nil, err)
+		return err
+	}
+	if done, err := s.dispatchUnknown(r); done {
+		s.audit(r, nil, err)
+		return err
+	}
+	if rejectBadKeyCount(r) {
+		s.audit(r, nil, nil)
+		return nil
+	}
+	s.prefixKeys(r)
+	hkey := s.routeKey(r, getHashKey(r.Resp, r.OpStr))
+	if s.lookupNegative(r) {
+		s.audit(r, hkey, nil)
+		return nil
+	}
+	s.newLoadingRetry(r, hkey)
+	if done, err := s.dispatchCoalesced(r, hkey); done {
+		s.audit(r, hkey, err)
+		return err
+	}
+	err := s.dispatch(r, hkey)
+	s.audit(r, hkey, err)
+	return err
+}
+
+// DispatchWithKey is like Dispatch, but the slot is picked by hashing the
+// given key instead of the one taken from the request, for callers that
+// know the key already. The hash tag and the key prefix still apply, and
+// so does the slot locking during migration.
+func (s *Router) DispatchWithKey(r *Request, hkey []byte) error {
+	if err := s.admit(r); err != nil {
+		s.audit(r, nil, err)
+		return err
+	}
+	if rejectBadKeyCount(r) {
+		s.audit(r, nil, nil)
+		return nil
+	}
+	if prefix := s.keyPrefix(); len(prefix) != 0 {
+		s.prefixKeys(r)
+		hkey = append(append([]byte{}, prefix...), hkey...)
+	}
+	if s.lookupNegative(r) {
+		s.audit(r, hkey, nil)
+		return nil
+	}
+	s.newLoadingRetry(r, hkey)
+	if done, err := s.dispatchCoalesced(r, hkey); done {
+		s.audit(r, hkey, err)
+		return err
+	}
+	err := s.dispatch(r, hkey)
+	s.audit(r, hkey, err)
+	return err
+}
+
+func (s *Router) admit(r *Request) error {
+	s.opcounts.incr(r.OpStr)
+	if s.draining.Get() {
+		return ErrRouterDraining
+	}
+	if err := s.waitPaused(); err != nil {
+		return err
+	}
+	if s.isOverloaded() {
+		return ErrTryAgainLater
+	}
+	return nil
+}
+
+func (s *Router) dispatch(r *Request, hkey []byte) error {
+	if done, err := s.dispatchSelected(r, hkey); done {
+		return err
+	}
+	if done, err := s.dispatchFallback(r, hkey); done {
+		return err
+	}
+	if done, err := s.checkUnavailable(r, hkey); done {
+		return err
+	}
+	for {
+		s.rwlck.RLock()
+		slot := s.slotOf(hkey)
+		if !s.affinity {
+			r.affinity = nil
+		}
+		f := s.newForwarding(r, slot)
+		s.rwlck.RUnlock()
+		slot.hits.Incr()
+
+		r.inflight = &s.inflight
+		r.inflight.Incr()
+		var err error
+		if f.timeout != 0 {
+			err = s.forwardTimeout(r, slot, hkey, f)
+		} else {
+			err = s.forward(r, slot, hkey, f)
+		}
+		if err == nil {
+			return nil
+		}
+		r.inflight.Decr()
+		r.inflight = nil
+		// dispatched again if the slot table was resized meanwhile, as the
+		// slot may have been torn down
+		if s.slotOf(hkey) == slot {
+			return err
+		}
+	}
+}
+
+// forwarding is the settings a request is forwarded with, taken by dispatch
+// with rwlck held, so it's released while the request is forwarded.
+type forwarding struct {
+	timeout  time.Duration
+	failover bool
+	hedged   bool
+	delay    time.Duration
+	zone     string
+	check    *redis.Resp
+}
+
+func (s *Router) newForwarding(r *Request, slot *Slot) *forwarding {
+	f := &forwarding{
+		timeout:  s.getCommandTimeout(r.OpStr),
+		failover: s.isFailover(r, slot),
+		delay:    s.hedging.delay,
+		zone:     s.zone,
+	}
+	if !isCursorCommand(r.OpStr) || r.cursors == nil {
+		f.hedged = !s.isPinned(r, slot) && s.isHedged(r)
+	}
+	if s.durable.ops[r.OpStr] {
+		f.check = s.durable.check
+	}
+	return f
+}
+
+func (s *Router) forward(r *Request, slot *Slot, hkey []byte, f *forwarding) error {
+	switch {
+	case r.cursors != nil && isCursorCommand(r.OpStr):
+		return s.forwardCursor(r, slot, hkey, f)
+	case f.failover && slot.forwardReplica(r, hkey, f.zone):
+		return nil
+	case f.hedged:
+		return s.hedge(r, slot, hkey, f)
+	default:
+		return slot.forward(r, hkey, newDurableCheck(r, f.check))
+	}
 }
 
 func (s *Router) getBackendConn(addr string) *SharedBackendConn {
@@ -98,12 +976,55 @@ func (s *Router) getBackendConn(addr string) *SharedBackendConn {
 	if bc != nil {
 		bc.IncrRefcnt()
 	} else {
-		bc = NewSharedBackendConn(addr, s.auth)
+		bc = s.newBackendConn(addr)
 		s.pool[addr] = bc
 	}
 	return bc
 }
 
+func (s *Router) newBackendConn(addr string) *SharedBackendConn {
+	bc := NewSharedBackendConnPool(addr, s.auth, s.timeout.read, s.timeout.write, s.poolsize)
+	for _, c := range bc.conns {
+		c.onReadOnly = s.notifyReadOnly
+		c.nodelay, c.linger = s.sockopts.nodelay, s.sockopts.linger
+		c.flushDelay = int64(s.flushDelay / time.Microsecond)
+	}
+	bc.unhealthy.Set(s.unhealthy[addr])
+	return bc
+}
+
+// SetReadOnlyHandler sets the function called when a write to a slot gets a
+// READONLY reply, which means its backend has become a replica, so the slot
+// may be filled again right away. It's called once until the slot is filled
+// again, in a goroutine of its own.
+func (s *Router) SetReadOnlyHandler(fn func(slot int, addr string)) {
+	s.readonly.Lock()
+	s.readonly.handler = fn
+	s.readonly.Unlock()
+}
+
+func (s *Router) notifyReadOnly(slot int, addr string) {
+	log.Warnf("slot-%04d write to readonly backend %s", slot, addr)
+	s.readonly.Lock()
+	fn := s.readonly.handler
+	s.readonly.Unlock()
+	if fn != nil {
+		go fn(slot, addr)
+	}
+}
+
+// BackendReadOnlyCounts returns the number of READONLY replies to writes
+// received from each backend in the pool.
+func (s *Router) BackendReadOnlyCounts() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var counts = make(map[string]int64, len(s.pool))
+	for addr, bc := range s.pool {
+		counts[addr] = bc.readonlys()
+	}
+	return counts
+}
+
 func (s *Router) putBackendConn(bc *SharedBackendConn) {
 	if bc != nil && bc.Close() {
 		delete(s.pool, bc.Addr())
@@ -115,39 +1036,64 @@ func (s *Router) isValidSlot(i int) bool {
 }
 
 func (s *Router) resetSlot(i int) {
+	if !s.isValidSlot(i) {
+		return
+	}
+	slot := s.slots[i]
+	from, to := slot.migrate.from, slot.backend.addr
+	s.teardownSlot(slot)
+	s.noteMigration(slot, from, to)
+	s.notifySlot(slot)
+}
+
+// fillSlot blocks the slot and drains its in-flight requests, the ones to
+// migrate.from included, before switching it to the new backends. So once a
+// migration is finalized, i.e. the slot is filled again without migrate.from,
+// nothing of the slot is sent to the old source anymore: requests dispatched
+// meanwhile wait for the slot to be unblocked, and go to the new backend.
+func (s *Router) fillSlot(i int, addr, from string, db int, lock bool) {
 	if !s.isValidSlot(i) {
 		return
 	}
 	slot := s.slots[i]
 	slot.blockAndWait()
+	before, to := slot.migrate.from, slot.backend.addr
 
 	s.putBackendConn(slot.backend.bc)
 	s.putBackendConn(slot.migrate.bc)
+	s.putReplicas(slot)
 	slot.reset()
 
-	slot.unblock()
+	s.setupSlot(slot, addr, from, db, lock)
+	s.noteMigration(slot, before, to)
+	s.notifySlot(slot)
 }
 
-func (s *Router) fillSlot(i int, addr, from string, lock bool) {
-	if !s.isValidSlot(i) {
-		return
-	}
-	slot := s.slots[i]
+func (s *Router) teardownSlot(slot *Slot) {
 	slot.blockAndWait()
 
 	s.putBackendConn(slot.backend.bc)
 	s.putBackendConn(slot.migrate.bc)
+	s.putReplicas(slot)
 	slot.reset()
 
+	slot.unblock()
+}
+
+func (s *Router) setupSlot(slot *Slot, addr, from string, db int, lock bool) {
+	if lock {
+		slot.blockAndWait()
+	}
 	if len(addr) != 0 {
-		xx := strings.Split(addr, ":")
-		if len(xx) >= 1 {
-			slot.backend.host = []byte(xx[0])
-		}
-		if len(xx) >= 2 {
-			slot.backend.port = []byte(xx[1])
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			log.WarnErrorf(err, "slot-%04d split backend.addr = %s failed", slot.id, addr)
+			host, port = addr, ""
 		}
+		slot.backend.host = []byte(host)
+		slot.backend.port = []byte(port)
 		slot.backend.addr = addr
+		slot.backend.db = db
 		slot.backend.bc = s.getBackendConn(addr)
 	}
 	if len(from) != 0 {
@@ -160,10 +1106,10 @@ func (s *Router) fillSlot(i int, addr, from string, lock bool) {
 	}
 
 	if slot.migrate.bc != nil {
-		log.Infof("fill slot %04d, backend.addr = %s, migrate.from = %s",
-			i, slot.backend.addr, slot.migrate.from)
+		log.Infof("fill slot %04d, backend.addr = %s, backend.db = %d, migrate.from = %s",
+			slot.id, slot.backend.addr, slot.backend.db, slot.migrate.from)
 	} else {
-		log.Infof("fill slot %04d, backend.addr = %s",
-			i, slot.backend.addr)
+		log.Infof("fill slot %04d, backend.addr = %s, backend.db = %d",
+			slot.id, slot.backend.addr, slot.backend.db)
 	}
 }
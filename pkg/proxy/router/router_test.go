@@ -0,0 +1,2542 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/assert"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+)
+
+func newSlotMapping(n int, naddrs int) []SlotConfig {
+	var mapping = make([]SlotConfig, n)
+	for i := 0; i < n; i++ {
+		mapping[i].Addr = fmt.Sprintf("127.0.0.1:%d", 7000+i%naddrs)
+	}
+	return mapping
+}
+
+func TestReshardSlots(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	assert.MustNoError(s.ReshardSlots(16, newSlotMapping(16, 2)))
+	assert.Must(len(s.slots) == 16)
+
+	var old = make([]*Slot, len(s.slots))
+	copy(old, s.slots)
+
+	mapping := newSlotMapping(64, 4)
+	assert.MustNoError(s.ReshardSlots(64, mapping))
+	assert.Must(len(s.slots) == 64)
+
+	for i, slot := range s.slots {
+		assert.Must(slot.id == i)
+		assert.Must(slot.backend.addr == mapping[i].Addr)
+		assert.Must(slot.backend.bc != nil)
+		if i < len(old) {
+			assert.Must((slot == old[i]) == (i%4 < 2))
+		}
+	}
+	assert.Must(len(s.pool) == 4)
+	for i := 0; i < 4; i++ {
+		assert.Must(s.pool[fmt.Sprintf("127.0.0.1:%d", 7000+i)].refcnt == 16)
+	}
+}
+
+func TestReshardLockedSlot(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	assert.MustNoError(s.FillSlot(0, "127.0.0.1:7000", "127.0.0.1:7001", true))
+	assert.Must(s.ReshardSlots(16, newSlotMapping(16, 2)) == ErrSlotIsLocked)
+	assert.Must(len(s.slots) == MaxSlotNum)
+
+	assert.MustNoError(s.FillSlot(0, "127.0.0.1:7000", "", false))
+	assert.MustNoError(s.ReshardSlots(16, newSlotMapping(16, 2)))
+	assert.Must(s.ReshardSlots(8, newSlotMapping(16, 2)) == ErrInvalidSlotNum)
+}
+
+func TestDispatchError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	from := l.Addr().String()
+	l.Close()
+
+	s := New()
+	defer s.Close()
+
+	r := newRequest("GET", "foo")
+	i := hashSlot([]byte("foo"), MaxSlotNum)
+	assert.MustNoError(s.FillSlot(i, "127.0.0.1:7000", from, false))
+
+	err = s.Dispatch(r)
+	assert.Must(err != nil)
+	e, ok := err.(*DispatchError)
+	assert.Must(ok && e.Cause != nil)
+	assert.Must(strings.Contains(err.Error(), fmt.Sprintf("slot-%04d", i)))
+	assert.Must(strings.Contains(err.Error(), "127.0.0.1:7000"))
+	assert.Must(strings.Contains(err.Error(), from))
+	assert.Must(strings.Contains(err.Error(), "GET"))
+}
+
+type fakeBackend struct {
+	net.Listener
+	Addr string
+}
+
+func newFakeBackend(handler func(resp *redis.Resp) *redis.Resp) *fakeBackend {
+	return newFakeBackendAt("127.0.0.1:0", handler)
+}
+
+func newFakeBackendAt(addr string, handler func(resp *redis.Resp) *redis.Resp) *fakeBackend {
+	l, err := net.Listen("tcp", addr)
+	assert.MustNoError(err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := redis.NewConn(c)
+				defer conn.Close()
+				for {
+					resp, err := conn.Reader.Decode()
+					if err != nil {
+						return
+					}
+					if err := conn.Writer.Encode(handler(resp), true); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return &fakeBackend{Listener: l, Addr: l.Addr().String()}
+}
+
+func newRequest(args ...string) *Request {
+	var array = make([]*redis.Resp, len(args))
+	for i, arg := range args {
+		array[i] = redis.NewBulkBytes([]byte(arg))
+	}
+	return &Request{
+		OpStr: strings.ToUpper(args[0]),
+		Resp:  redis.NewArray(array),
+		Wait:  &sync.WaitGroup{},
+	}
+}
+
+func TestWriteDuringMigration(t *testing.T) {
+	var mu sync.Mutex
+	var srcOps, dstOps []string
+	src := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		mu.Lock()
+		defer mu.Unlock()
+		srcOps = append(srcOps, string(resp.Array[0].Value))
+		return redis.NewInt([]byte("1"))
+	})
+	defer src.Close()
+	dst := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		mu.Lock()
+		defer mu.Unlock()
+		dstOps = append(dstOps, string(resp.Array[0].Value))
+		return redis.NewString([]byte("OK"))
+	})
+	defer dst.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), dst.Addr, src.Addr, false))
+
+	r := newRequest("SET", "foo", "bar")
+	assert.MustNoError(s.Dispatch(r))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+	assert.Must(string(r.Response.Resp.Value) == "OK")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Must(len(srcOps) == 1 && srcOps[0] == "SLOTSMGRTTAGONE")
+	assert.Must(len(dstOps) == 1 && dstOps[0] == "SET")
+}
+
+func TestFinalizeMigration(t *testing.T) {
+	var mu sync.Mutex
+	var cleared bool
+	var late int
+	src := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		mu.Lock()
+		if cleared {
+			late++
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		return redis.NewInt([]byte("1"))
+	})
+	defer src.Close()
+	dst := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("OK"))
+	})
+	defer dst.Close()
+
+	s := New()
+	defer s.Close()
+	i := hashSlot([]byte("foo"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, dst.Addr, src.Addr, false))
+
+	var wg sync.WaitGroup
+	var stop atomic2.Bool
+	var failed atomic2.Int64
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for k := 0; !stop.Get(); k++ {
+				r := newRequest("SET", fmt.Sprintf("{foo}%d-%d", n, k), "bar")
+				if err := s.Dispatch(r); err != nil {
+					failed.Incr()
+					continue
+				}
+				r.Wait.Wait()
+				if r.Response.Err != nil || string(r.Response.Resp.Value) != "OK" {
+					failed.Incr()
+				}
+			}
+		}(n)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	assert.MustNoError(s.FillSlot(i, dst.Addr, "", false))
+	mu.Lock()
+	cleared = true
+	mu.Unlock()
+	time.Sleep(time.Millisecond * 50)
+	stop.Set(true)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Must(late == 0)
+	assert.Must(failed.Get() == 0)
+}
+
+func TestCommandStats(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	var mix = map[string]int{"GET": 3, "SET": 2, "HGETALL": 1, "FOOBAR": 2, "HELLO": 1}
+	for opstr, n := range mix {
+		for i := 0; i < n; i++ {
+			s.Dispatch(newRequest(opstr, "foo"))
+		}
+	}
+	stats := s.CommandStats()
+	assert.Must(len(stats) == 4)
+	assert.Must(stats["GET"] == 3)
+	assert.Must(stats["SET"] == 2)
+	assert.Must(stats["HGETALL"] == 1)
+	assert.Must(stats["other"] == 3)
+
+	s.ResetCommandStats()
+	assert.Must(len(s.CommandStats()) == 0)
+}
+
+func TestBackpressure(t *testing.T) {
+	hold := make(chan bool)
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		<-hold
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+	}
+	s.SetBackpressure(4, 2)
+
+	var reqs []*Request
+	for i := 0; i < 4; i++ {
+		r := newRequest("SET", fmt.Sprintf("key-%d", i), "value")
+		assert.MustNoError(s.Dispatch(r))
+		reqs = append(reqs, r)
+	}
+	assert.Must(s.InFlight() == 4)
+	assert.Must(s.Dispatch(newRequest("GET", "foo")) == ErrTryAgainLater)
+
+	close(hold)
+	for _, r := range reqs {
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+	assert.Must(s.InFlight() == 0)
+
+	r := newRequest("GET", "foo")
+	assert.MustNoError(s.Dispatch(r))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+}
+
+func TestFillSlotAddr(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	var tests = []struct {
+		addr, host, port string
+	}{
+		{"127.0.0.1:6379", "127.0.0.1", "6379"},
+		{"[::1]:6379", "::1", "6379"},
+		{"[fe80::1%eth0]:6380", "fe80::1%eth0", "6380"},
+		{"redis-1.example.com:6381", "redis-1.example.com", "6381"},
+	}
+	for i, x := range tests {
+		assert.MustNoError(s.FillSlot(i, x.addr, "", false))
+		assert.Must(string(s.slots[i].backend.host) == x.host)
+		assert.Must(string(s.slots[i].backend.port) == x.port)
+	}
+	slots := s.GetSlots()
+	assert.Must(len(slots) == MaxSlotNum)
+	for i, x := range tests {
+		assert.Must(slots[i].Id == i && slots[i].BackendAddr == x.addr)
+	}
+}
+
+func TestBackendDistribution(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.MustNoError(s.FillSlot(i, "127.0.0.1:7000", "", false))
+	}
+	for i := 100; i < 130; i++ {
+		assert.MustNoError(s.FillSlot(i, "127.0.0.1:7001", "127.0.0.1:7002", false))
+	}
+	m := s.BackendDistribution()
+	assert.Must(len(m) == 2)
+	assert.Must(m["127.0.0.1:7000"] == 100)
+	assert.Must(m["127.0.0.1:7001"] == 30)
+	assert.Must(s.pool["127.0.0.1:7002"].refcnt == 30)
+}
+
+func TestFillSlotWithDB(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	var mu sync.Mutex
+	var selects int
+	var store = make(map[string]string)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := redis.NewConn(c)
+				defer conn.Close()
+				var db = "0"
+				for {
+					resp, err := conn.Reader.Decode()
+					if err != nil {
+						return
+					}
+					var reply *redis.Resp
+					mu.Lock()
+					switch args := resp.Array; string(args[0].Value) {
+					case "SELECT":
+						db, selects = string(args[1].Value), selects+1
+						reply = redis.NewString([]byte("OK"))
+					case "SET":
+						store[db+"/"+string(args[1].Value)] = string(args[2].Value)
+						reply = redis.NewString([]byte("OK"))
+					case "GET":
+						reply = redis.NewBulkBytes([]byte(store[db+"/"+string(args[1].Value)]))
+					}
+					mu.Unlock()
+					if err := conn.Writer.Encode(reply, true); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	s := New()
+	defer s.Close()
+
+	addr := l.Addr().String()
+	i, j := hashSlot([]byte("foo"), MaxSlotNum), hashSlot([]byte("bar"), MaxSlotNum)
+	assert.Must(i != j)
+	assert.MustNoError(s.FillSlotWithDB(i, addr, "", 1, false))
+	assert.MustNoError(s.FillSlotWithDB(j, addr, "", 2, false))
+	assert.Must(s.GetSlots()[i].BackendDB == 1)
+
+	for _, args := range [][]string{
+		{"SET", "foo", "v1"}, {"SET", "bar", "v2"}, {"GET", "foo"}, {"GET", "bar"},
+	} {
+		r := newRequest(args...)
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		switch args[1] {
+		case "foo":
+			assert.Must(args[0] == "SET" || string(r.Response.Resp.Value) == "v1")
+		case "bar":
+			assert.Must(args[0] == "SET" || string(r.Response.Resp.Value) == "v2")
+		}
+	}
+	s.mu.Lock()
+	assert.Must(s.pool[addr].inflights() == 0)
+	s.mu.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Must(len(store) == 2)
+	assert.Must(store["1/foo"] == "v1" && store["2/bar"] == "v2")
+	assert.Must(selects == 4)
+}
+
+func TestClientAffinity(t *testing.T) {
+	var mu sync.Mutex
+	var selects int
+	backend := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		if string(resp.Array[0].Value) == "SELECT" {
+			mu.Lock()
+			selects++
+			mu.Unlock()
+		}
+		return redis.NewString([]byte("OK"))
+	})
+	defer backend.Close()
+
+	s := New()
+	defer s.Close()
+
+	i, j := hashSlot([]byte("foo"), MaxSlotNum), hashSlot([]byte("bar"), MaxSlotNum)
+	assert.MustNoError(s.FillSlotWithDB(i, backend.Addr, "", 1, false))
+	assert.MustNoError(s.FillSlotWithDB(j, backend.Addr, "", 2, false))
+
+	run := func() int {
+		a, b := &clientConns{}, &clientConns{}
+		defer a.close()
+		defer b.close()
+		mu.Lock()
+		selects = 0
+		mu.Unlock()
+		for n := 0; n < 8; n++ {
+			for _, r := range []*Request{newRequest("SET", "foo", "v1"), newRequest("SET", "bar", "v2")} {
+				r.affinity = a
+				if string(r.Resp.Array[1].Value) == "bar" {
+					r.affinity = b
+				}
+				assert.MustNoError(s.Dispatch(r))
+				r.Wait.Wait()
+				assert.MustNoError(r.Response.Err)
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return selects
+	}
+
+	assert.Must(run() == 16)
+	assert.Must(ClientAffinityConns() == 0)
+
+	s.SetClientAffinity(true)
+	assert.Must(run() == 2)
+	assert.Must(ClientAffinityConns() == 0)
+	assert.Must(s.Settings()["backend_client_affinity"] == "true")
+}
+
+func TestClientAffinityLimit(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), b.Addr, "", false))
+	s.SetClientAffinity(true)
+
+	const wait = time.Millisecond * 100
+	SetClientAffinityLimit(1, wait)
+	defer SetClientAffinityLimit(0, 0)
+
+	dispatch := func(c *clientConns) error {
+		r := newRequest("SET", "foo", "bar")
+		r.affinity = c
+		if err := s.Dispatch(r); err != nil {
+			return err
+		}
+		r.Wait.Wait()
+		return r.Response.Err
+	}
+	a, c := &clientConns{}, &clientConns{}
+	defer c.close()
+	assert.MustNoError(dispatch(a))
+	assert.MustNoError(dispatch(a))
+
+	// the wait for a conn holds neither the settings nor the slot
+	i := hashSlot([]byte("foo"), MaxSlotNum)
+	done := make(chan time.Duration)
+	go func() {
+		time.Sleep(wait / 4)
+		start := time.Now()
+		s.SetZone("z1")
+		assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+		done <- time.Since(start)
+	}()
+	start := time.Now()
+	err := dispatch(c)
+	assert.Must(time.Since(start) >= wait)
+	assert.Must(retryableError(err) == ErrTooManyBackendConns)
+	assert.Must(<-done < wait/2)
+	msg, _ := s.slots[i].getLastError()
+	assert.Must(msg == "")
+
+	go func() {
+		time.Sleep(wait / 4)
+		a.close()
+	}()
+	assert.MustNoError(dispatch(c))
+	assert.Must(ClientAffinityConns() == 1)
+}
+
+func TestDebugDump(t *testing.T) {
+	s := NewWithAuth("password-123")
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(0, "127.0.0.1:7000", "127.0.0.1:7001", false))
+
+	b, err := s.DebugDump()
+	assert.MustNoError(err)
+	assert.Must(!strings.Contains(string(b), "password-123"))
+
+	var m map[string]interface{}
+	assert.MustNoError(json.Unmarshal(b, &m))
+	for _, key := range []string{"slots", "pool", "inflight", "config"} {
+		_, ok := m[key]
+		assert.Must(ok)
+	}
+	assert.Must(len(m["slots"].([]interface{})) == MaxSlotNum)
+	assert.Must(len(m["pool"].([]interface{})) == 2)
+}
+
+func TestBackendLabel(t *testing.T) {
+	s := New()
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		assert.MustNoError(s.FillSlot(i, fmt.Sprintf("127.0.0.1:%d", 7000+i%2), "", false))
+	}
+	bc := s.pool["127.0.0.1:7000"]
+
+	s.SetBackendLabel("127.0.0.1:7000", "cache-shard-0-master")
+	for i, slot := range s.GetSlots()[:10] {
+		if i%2 == 0 {
+			assert.Must(slot.BackendLabel == "cache-shard-0-master")
+		} else {
+			assert.Must(slot.BackendLabel == "")
+		}
+	}
+	assert.Must(s.pool["127.0.0.1:7000"] == bc)
+
+	s.SetBackendLabel("127.0.0.1:7000", "")
+	assert.Must(s.GetSlots()[0].BackendLabel == "")
+}
+
+func TestResetBackendConn(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(0, b.Addr, "", false))
+	assert.MustNoError(s.FillSlot(1, "127.0.0.1:7000", b.Addr, false))
+	assert.MustNoError(s.FillSlot(2, b.Addr, "", false))
+
+	old := s.pool[b.Addr]
+	assert.MustNoError(s.ResetBackendConn(2))
+	bc := s.pool[b.Addr]
+	assert.Must(bc != old && bc.refcnt == 3)
+	assert.Must(s.slots[0].backend.bc == bc && s.slots[2].backend.bc == bc)
+	assert.Must(s.slots[1].migrate.bc == bc)
+	assert.Must(s.slots[0].backend.addr == b.Addr && s.slots[1].migrate.from == b.Addr)
+
+	assert.Must(s.ResetBackendConn(3) == ErrSlotIsNotReady)
+	assert.Must(s.ResetBackendConn(-1) == ErrInvalidSlotId)
+
+	r := newRequest("SET", "foo", "bar")
+	assert.MustNoError(s.slots[0].forward(r, []byte("foo"), nil))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+}
+
+func TestDurableCheck(t *testing.T) {
+	var mu sync.Mutex
+	var ops []string
+	var fail bool
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		mu.Lock()
+		defer mu.Unlock()
+		op := string(resp.Array[0].Value)
+		ops = append(ops, op)
+		if op == "WAITAOF" && fail {
+			return redis.NewError([]byte("ERR WAITAOF cannot be used when appendonly is disabled"))
+		}
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("foo"), len(s.slots)), b.Addr, "", false))
+	s.SetDurableCheck([]string{"WAITAOF", "1", "0", "100"}, []string{"SET"})
+
+	dispatch := func(args ...string) *Request {
+		r := newRequest(args...)
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		if r.Coalesce != nil {
+			assert.MustNoError(r.Coalesce())
+		}
+		assert.MustNoError(r.Response.Err)
+		return r
+	}
+
+	r := dispatch("SET", "foo", "bar")
+	assert.Must(string(r.Response.Resp.Value) == "OK")
+	dispatch("GET", "foo")
+
+	mu.Lock()
+	assert.Must(len(ops) == 3 && ops[0] == "SET" && ops[1] == "WAITAOF" && ops[2] == "GET")
+	fail = true
+	mu.Unlock()
+
+	r = dispatch("SET", "foo", "bar")
+	assert.Must(r.Response.Resp.IsError())
+
+	s.SetDurableCheck(nil, nil)
+	r = dispatch("SET", "foo", "bar")
+	assert.Must(!r.Response.Resp.IsError())
+
+	// the check is sent on the db of the slot, without selecting it again
+	assert.MustNoError(s.FillSlotWithDB(hashSlot([]byte("foo"), len(s.slots)), b.Addr, "", 1, false))
+	s.SetDurableCheck([]string{"WAITAOF", "1", "0", "100"}, []string{"SET"})
+	mu.Lock()
+	ops, fail = nil, false
+	mu.Unlock()
+	dispatch("SET", "foo", "bar")
+	mu.Lock()
+	assert.Must(len(ops) == 3 && ops[0] == "SELECT" && ops[1] == "SET" && ops[2] == "WAITAOF")
+	mu.Unlock()
+}
+
+func TestLoadingRetry(t *testing.T) {
+	var mu sync.Mutex
+	var loading = 2
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		mu.Lock()
+		defer mu.Unlock()
+		if loading > 0 {
+			loading--
+			return redis.NewError([]byte("LOADING Redis is loading the dataset in memory"))
+		}
+		if string(resp.Array[0].Value) == "MGET" {
+			return redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte("bar"))})
+		}
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("foo"), len(s.slots)), b.Addr, "", false))
+
+	SetLoadingRetry(3, time.Millisecond*10)
+	defer SetLoadingRetry(0, 0)
+
+	dispatch := func(args ...string) *Request {
+		r := newRequest(args...)
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		if r.Coalesce != nil {
+			assert.MustNoError(r.Coalesce())
+		}
+		assert.MustNoError(r.Response.Err)
+		return r
+	}
+
+	r := dispatch("GET", "foo")
+	assert.Must(string(r.Response.Resp.Value) == "bar")
+	assert.Must(s.BackendLoadingCounts()[b.Addr] == 2)
+
+	mu.Lock()
+	loading = 1
+	mu.Unlock()
+
+	r = dispatch("SET", "foo", "bar")
+	assert.Must(r.Response.Resp.IsError())
+	assert.Must(strings.HasPrefix(string(r.Response.Resp.Value), "TRYAGAIN LOADING"))
+	assert.Must(s.BackendLoadingCounts()[b.Addr] == 3)
+
+	mu.Lock()
+	loading = 2
+	mu.Unlock()
+
+	session := &Session{}
+	r, err := session.handleRequest(newRequest("MGET", "foo", "{foo}x").Resp, s)
+	assert.MustNoError(err)
+	resp, err := session.handleResponse(r)
+	assert.MustNoError(err)
+	assert.Must(resp.IsArray() && len(resp.Array) == 2)
+	for _, x := range resp.Array {
+		assert.Must(string(x.Value) == "bar")
+	}
+	assert.Must(s.BackendLoadingCounts()[b.Addr] == 5)
+}
+
+func TestBackendPoolSize(t *testing.T) {
+	var mu sync.Mutex
+	var addrs = make(map[string]string)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := redis.NewConn(c)
+				defer conn.Close()
+				for {
+					resp, err := conn.Reader.Decode()
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					addrs[string(resp.Array[1].Value)] = c.RemoteAddr().String()
+					mu.Unlock()
+					if err := conn.Writer.Encode(redis.NewString([]byte("OK")), true); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	s := New()
+	defer s.Close()
+	s.SetBackendPoolSize(4)
+	assert.MustNoError(s.FillSlot(0, l.Addr().String(), "", false))
+
+	bc := s.pool[l.Addr().String()]
+	assert.Must(len(bc.conns) == 4)
+	var keys [][]byte
+	for i := 0; len(keys) < 2; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if hashSlot(key, len(s.slots)) != 0 {
+			continue
+		}
+		if len(keys) == 0 || bc.Conn(key) != bc.Conn(keys[0]) {
+			keys = append(keys, key)
+		}
+	}
+	assert.Must(bc.Conn(keys[0]) == bc.Conn(keys[0]))
+
+	for _, key := range keys {
+		r := newRequest("SET", string(key), "bar")
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Must(addrs[string(keys[0])] != addrs[string(keys[1])])
+}
+
+func TestFreezeTopology(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.FreezeTopology()
+	assert.Must(s.FillSlot(0, "127.0.0.1:7000", "", false) == ErrTopologyFrozen)
+	assert.Must(s.ReshardSlots(4, newSlotMapping(4, 2)) == ErrTopologyFrozen)
+	assert.Must(s.ResetSlot(0) == ErrTopologyFrozen)
+	assert.Must(s.SetSlotReplica(0, "127.0.0.1:7001") == ErrTopologyFrozen)
+	assert.Must(s.SetSlotReplicas(0, []Replica{{Addr: "127.0.0.1:7001"}}) == ErrTopologyFrozen)
+	assert.Must(s.slots[0].backend.addr == "" && len(s.pool) == 0 && len(s.slots) == MaxSlotNum)
+	assert.Must(len(s.slots[0].replicas) == 0)
+
+	b, err := s.DebugDump()
+	assert.MustNoError(err)
+	var m map[string]interface{}
+	assert.MustNoError(json.Unmarshal(b, &m))
+	assert.Must(m["frozen"] == true)
+
+	s.UnfreezeTopology()
+	assert.MustNoError(s.FillSlot(0, "127.0.0.1:7000", "", false))
+	assert.Must(s.slots[0].backend.addr == "127.0.0.1:7000")
+}
+
+func TestPause(t *testing.T) {
+	hold := make(chan bool)
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		if string(resp.Array[1].Value) == "slow" {
+			<-hold
+		}
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	for _, key := range []string{"foo", "slow"} {
+		assert.MustNoError(s.FillSlot(hashSlot([]byte(key), len(s.slots)), b.Addr, "", false))
+	}
+
+	// requests already dispatched are not held
+	slow := newRequest("GET", "slow")
+	assert.MustNoError(s.Dispatch(slow))
+
+	s.Pause(0)
+	assert.Must(s.Paused())
+	assert.Must(s.Dispatch(newRequest("GET", "foo")) == ErrRouterPaused)
+	hold <- true
+	slow.Wait.Wait()
+	assert.MustNoError(slow.Response.Err)
+
+	b1, err := s.DebugDump()
+	assert.MustNoError(err)
+	var m map[string]interface{}
+	assert.MustNoError(json.Unmarshal(b1, &m))
+	assert.Must(m["paused"] == true)
+
+	s.Pause(time.Millisecond * 50)
+	start := time.Now()
+	assert.Must(s.Dispatch(newRequest("GET", "foo")) == ErrRouterPaused)
+	assert.Must(time.Since(start) >= time.Millisecond*50)
+
+	s.Pause(time.Second * 5)
+	r := newRequest("GET", "foo")
+	var done = make(chan error, 1)
+	go func() {
+		done <- s.Dispatch(r)
+	}()
+	select {
+	case <-done:
+		assert.Must(false)
+	case <-time.After(time.Millisecond * 50):
+	}
+	s.Resume()
+	assert.MustNoError(<-done)
+	r.Wait.Wait()
+	assert.Must(string(r.Response.Resp.Value) == "bar")
+	assert.Must(!s.Paused())
+}
+
+func TestSlotLastError(t *testing.T) {
+	var failing atomic2.Bool
+	from := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		if failing.Get() {
+			return redis.NewError([]byte("ERR migration failed"))
+		}
+		return redis.NewInt([]byte("1"))
+	})
+	defer from.Close()
+
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+
+	dispatch := func() {
+		r := newRequest("GET", "foo")
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+
+	i := hashSlot([]byte("foo"), MaxSlotNum)
+	assert.MustNoError(s.FillSlot(i, b.Addr, from.Addr, false))
+	assert.Must(s.GetSlots()[i].LastError == "")
+
+	failing.Set(true)
+	err := s.Dispatch(newRequest("GET", "foo"))
+	assert.Must(err != nil)
+	info := s.GetSlots()[i]
+	assert.Must(info.LastError == err.Error() && info.LastErrorTime != 0)
+
+	// a later success keeps the error
+	failing.Set(false)
+	dispatch()
+	kept := s.GetSlots()[i]
+	assert.Must(kept.LastError == info.LastError && kept.LastErrorTime == info.LastErrorTime)
+
+	// a new error updates the time
+	time.Sleep(time.Millisecond * 10)
+	failing.Set(true)
+	assert.Must(s.Dispatch(newRequest("SET", "foo", "bar")) != nil)
+	next := s.GetSlots()[i]
+	assert.Must(next.LastError != "" && next.LastErrorTime > info.LastErrorTime)
+
+	assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+	dispatch()
+	info = s.GetSlots()[i]
+	assert.Must(info.LastError == "" && info.LastErrorTime == 0)
+}
+
+func TestReapIdle(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("foo"), len(s.slots)), b.Addr, "", false))
+
+	dispatch := func() {
+		r := newRequest("GET", "foo")
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+	dispatch()
+
+	bc := s.pool[b.Addr].conns[0]
+	assert.Must(bc.connected.Get())
+	assert.Must(s.ReapIdle(time.Hour) == 0)
+
+	time.Sleep(time.Millisecond * 50)
+	assert.Must(s.ReapIdle(time.Millisecond*10) == 1)
+	for i := 0; i < 100 && bc.connected.Get(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(!bc.connected.Get())
+	assert.Must(!bc.KeepAlive())
+
+	dispatch()
+	assert.Must(bc.connected.Get())
+}
+
+func TestReadOnlyBackend(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		if string(resp.Array[0].Value) == "SET" {
+			return redis.NewError([]byte("READONLY You can't write against a read only slave."))
+		}
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	type event struct {
+		slot int
+		addr string
+	}
+	events := make(chan event, 4)
+	s.SetReadOnlyHandler(func(slot int, addr string) {
+		events <- event{slot, addr}
+	})
+	i := hashSlot([]byte("foo"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+
+	for _, args := range [][]string{{"GET", "foo"}, {"SET", "foo", "bar"}, {"SET", "foo", "bar"}} {
+		r := newRequest(args...)
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+
+	e := <-events
+	assert.Must(e.slot == i && e.addr == b.Addr)
+	assert.Must(len(events) == 0)
+	assert.Must(s.GetSlots()[i].ReadOnly)
+	assert.Must(s.BackendReadOnlyCounts()[b.Addr] == 2)
+
+	assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+	assert.Must(!s.GetSlots()[i].ReadOnly)
+}
+
+func TestBackendOOM(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		if string(resp.Array[0].Value) == "SET" {
+			return redis.NewError([]byte("OOM command not allowed when used memory > 'maxmemory'."))
+		}
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	i := hashSlot([]byte("foo"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+
+	do := func(args ...string) *Request {
+		r := newRequest(args...)
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		return r
+	}
+
+	r := do("SET", "foo", "bar")
+	assert.MustNoError(r.Response.Err)
+	assert.Must(r.Response.Resp.IsError())
+	assert.Must(s.BackendOOMCounts()[b.Addr] == 1)
+	r = do("SET", "foo", "bar")
+	assert.Must(r.Response.Resp.IsError())
+	assert.Must(s.BackendOOMCounts()[b.Addr] == 2)
+
+	SetOOMShedding(time.Millisecond * 200)
+	defer SetOOMShedding(0)
+	do("SET", "foo", "bar")
+	assert.Must(s.BackendOOMCounts()[b.Addr] == 3)
+
+	assert.Must(retryableError(s.Dispatch(newRequest("SET", "foo", "bar"))) == ErrBackendOOM)
+	r = do("GET", "foo")
+	assert.MustNoError(r.Response.Err)
+	assert.Must(string(r.Response.Resp.Value) == "bar")
+	for _, opstr := range []string{"DEL", "UNLINK", "EXPIRE", "LPOP"} {
+		r = do(opstr, "foo", "1")
+		assert.MustNoError(r.Response.Err)
+		assert.Must(!r.Response.Resp.IsError())
+	}
+	assert.Must(s.BackendOOMCounts()[b.Addr] == 3)
+
+	time.Sleep(time.Millisecond * 300)
+	r = do("SET", "foo", "bar")
+	assert.Must(r.Response.Resp.IsError())
+	assert.Must(s.BackendOOMCounts()[b.Addr] == 4)
+
+	// the OOM replies on the conns of the clients shed the writes too
+	time.Sleep(time.Millisecond * 300)
+	s.SetClientAffinity(true)
+	c := &clientConns{}
+	defer c.close()
+	r = newRequest("SET", "foo", "bar")
+	r.affinity = c
+	assert.MustNoError(s.Dispatch(r))
+	r.Wait.Wait()
+	assert.Must(r.Response.Resp.IsError())
+	assert.Must(ClientAffinityConns() == 1)
+	assert.Must(s.BackendOOMCounts()[b.Addr] == 5)
+	assert.Must(retryableError(s.Dispatch(newRequest("SET", "foo", "bar"))) == ErrBackendOOM)
+}
+
+func TestHedgingToReplica(t *testing.T) {
+	slow := make(chan struct{})
+	primary := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		<-slow
+		return redis.NewBulkBytes([]byte("primary"))
+	})
+	defer primary.Close()
+	replica := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("replica"))
+	})
+	defer replica.Close()
+
+	s := New()
+	defer s.Close()
+	defer close(slow)
+	i := hashSlot([]byte("foo"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, primary.Addr, "", false))
+	assert.MustNoError(s.SetSlotReplica(i, replica.Addr))
+	assert.Must(s.GetSlots()[i].ReplicaAddr == replica.Addr)
+	s.SetHedging(time.Millisecond*20, []string{"GET", "SET"})
+
+	r := newRequest("GET", "foo")
+	assert.MustNoError(s.Dispatch(r))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+	assert.Must(string(r.Response.Resp.Value) == "replica")
+	fired, won := s.HedgeStats()
+	assert.Must(fired == 1 && won == 1)
+
+	assert.Must(!s.isHedged(newRequest("SET", "foo", "bar")))
+}
+
+func TestMigratingSlots(t *testing.T) {
+	s := New()
+	defer s.Close()
+	assert.Must(len(s.MigratingSlots()) == 0)
+	assert.MustNoError(s.FillSlot(0, "127.0.0.1:7000", "", false))
+	assert.MustNoError(s.FillSlot(3, "127.0.0.1:7000", "127.0.0.1:7001", false))
+	assert.MustNoError(s.FillSlot(9, "127.0.0.1:7001", "127.0.0.1:7000", false))
+	ids := s.MigratingSlots()
+	assert.Must(len(ids) == 2 && ids[0] == 3 && ids[1] == 9)
+}
+
+func TestKeyPrefix(t *testing.T) {
+	var mu sync.Mutex
+	var reqs [][]string
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		var args []string
+		for _, x := range resp.Array {
+			args = append(args, string(x.Value))
+		}
+		mu.Lock()
+		reqs = append(reqs, args)
+		mu.Unlock()
+		if args[0] == "SCAN" {
+			return redis.NewArray([]*redis.Resp{
+				redis.NewBulkBytes([]byte("0")),
+				redis.NewArray([]*redis.Resp{
+					redis.NewBulkBytes([]byte("test:a")),
+					redis.NewBulkBytes([]byte("test:{b}c")),
+				}),
+			})
+		}
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	for i := 0; i < len(s.slots); i++ {
+		assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+	}
+	s.SetKeyPrefix("test:")
+
+	dispatch := func(args ...string) *Request {
+		r := newRequest(args...)
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		if r.Coalesce != nil {
+			assert.MustNoError(r.Coalesce())
+		}
+		assert.MustNoError(r.Response.Err)
+		return r
+	}
+	dispatch("SET", "foo", "bar")
+	dispatch("MSET", "a", "1", "b", "2")
+	dispatch("EVAL", "return 1", "2", "a", "b", "c")
+	dispatch("ZUNIONSTORE", "dst", "2", "a", "b", "WEIGHTS", "1", "2")
+	dispatch("SORT", "a", "BY", "w_*", "GET", "#", "STORE", "dst")
+	dispatch("UNLINK", "a", "b")
+	dispatch("ECHO", "hello")
+	r := dispatch("SCAN", "0")
+
+	mu.Lock()
+	defer mu.Unlock()
+	expect := [][]string{
+		{"SET", "test:foo", "bar"},
+		{"MSET", "test:a", "1", "test:b", "2"},
+		{"EVAL", "return 1", "2", "test:a", "test:b", "c"},
+		{"ZUNIONSTORE", "test:dst", "2", "test:a", "test:b", "WEIGHTS", "1", "2"},
+		{"SORT", "test:a", "BY", "test:w_*", "GET", "#", "STORE", "test:dst"},
+		{"UNLINK", "test:a", "test:b"},
+		{"ECHO", "hello"},
+		{"SCAN", "0", "MATCH", "test:*"},
+	}
+	assert.Must(len(reqs) == len(expect))
+	for i, args := range expect {
+		assert.Must(strings.Join(reqs[i], " ") == strings.Join(args, " "))
+	}
+
+	keys := r.Response.Resp.Array[1].Array
+	assert.Must(string(keys[0].Value) == "a" && string(keys[1].Value) == "{b}c")
+	assert.Must(hashSlot([]byte("test:{b}c"), MaxSlotNum) == hashSlot([]byte("{b}c"), MaxSlotNum))
+}
+
+func TestCloseGracefully(t *testing.T) {
+	slow := make(chan struct{})
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		<-slow
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	i := hashSlot([]byte("foo"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+	assert.Must(s.Ready() && !s.Draining())
+
+	r := newRequest("GET", "foo")
+	assert.MustNoError(s.Dispatch(r))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.CloseGracefully(time.Second * 5)
+	}()
+	for i := 0; i < 100 && !s.Draining(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(s.Draining() && !s.Ready())
+	assert.Must(s.Dispatch(newRequest("GET", "foo")) == ErrRouterDraining)
+
+	close(slow)
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+	assert.Must(string(r.Response.Resp.Value) == "bar")
+	assert.MustNoError(<-done)
+	assert.Must(!s.Ready())
+}
+
+func TestDispatchWithKey(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes(resp.Array[1].Value)
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	i := hashSlot([]byte("{foo}"), MaxSlotNum)
+	assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+
+	for _, key := range []string{"foo", "bar:{foo}"} {
+		r, x := newRequest("GET", key), newRequest("GET", key)
+		assert.MustNoError(s.Dispatch(r))
+		assert.MustNoError(s.DispatchWithKey(x, []byte(key)))
+		r.Wait.Wait()
+		x.Wait.Wait()
+		assert.MustNoError(x.Response.Err)
+		assert.Must(string(r.Response.Resp.Value) == string(x.Response.Resp.Value))
+	}
+	x := newRequest("GET", "bar")
+	assert.MustNoError(s.DispatchWithKey(x, []byte("{foo}")))
+	x.Wait.Wait()
+	assert.Must(string(x.Response.Resp.Value) == "bar")
+	assert.Must(s.DispatchWithKey(newRequest("GET", "foo"), []byte("bar")) != nil)
+
+	s.SetKeyPrefix("test:")
+	j := hashSlot([]byte("test:foo"), MaxSlotNum)
+	assert.Must(i != j)
+	assert.MustNoError(s.FillSlot(j, b.Addr, "", false))
+	x = newRequest("GET", "foo")
+	assert.MustNoError(s.DispatchWithKey(x, []byte("foo")))
+	x.Wait.Wait()
+	assert.Must(string(x.Response.Resp.Value) == "test:foo")
+}
+
+func benchmarkDispatch(b *testing.B, dispatch func(s *Router, r *Request) error) {
+	backend := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("OK"))
+	})
+	defer backend.Close()
+
+	s := New()
+	defer s.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(s.FillSlot(i, backend.Addr, "", false))
+	}
+	reqs := make([]*Request, b.N)
+	for i := range reqs {
+		reqs[i] = newRequest("EVAL", "return 1", "1", "foo", "bar")
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, r := range reqs {
+		assert.MustNoError(dispatch(s, r))
+	}
+	b.StopTimer()
+	for _, r := range reqs {
+		r.Wait.Wait()
+	}
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	benchmarkDispatch(b, func(s *Router, r *Request) error {
+		return s.Dispatch(r)
+	})
+}
+
+func BenchmarkDispatchWithKey(b *testing.B) {
+	key := []byte("foo")
+	benchmarkDispatch(b, func(s *Router, r *Request) error {
+		return s.DispatchWithKey(r, key)
+	})
+}
+
+func TestFillSlotMigrateToItself(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	assert.MustNoError(s.FillSlot(0, "127.0.0.1:7000", "", false))
+	assert.Must(s.FillSlot(0, "127.0.0.1:7001", "127.0.0.1:7001", false) == ErrMigrateToItself)
+	assert.Must(s.slots[0].backend.addr == "127.0.0.1:7000" && s.slots[0].migrate.from == "")
+	assert.Must(len(s.pool) == 1)
+
+	mapping := newSlotMapping(16, 2)
+	mapping[3].From = mapping[3].Addr
+	assert.Must(s.ReshardSlots(16, mapping) == ErrMigrateToItself)
+	assert.Must(len(s.slots) == MaxSlotNum)
+}
+
+func TestWatchSlots(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	ch, cancel := s.WatchSlots()
+	assert.MustNoError(s.FillSlot(3, "127.0.0.1:7000", "127.0.0.1:7001", false))
+	d := <-ch
+	assert.Must(d.Slot.Id == 3 && !d.Gap)
+	assert.Must(d.Slot.BackendAddr == "127.0.0.1:7000" && d.Slot.MigrateFrom == "127.0.0.1:7001")
+
+	for i := 0; i <= slotWatchBufferSize; i++ {
+		assert.MustNoError(s.FillSlot(0, "127.0.0.1:7000", "", false))
+	}
+	assert.Must(len(ch) == slotWatchBufferSize)
+	var gap bool
+	for len(ch) != 0 {
+		gap = gap || (<-ch).Gap
+	}
+	assert.Must(gap)
+
+	cancel()
+	cancel()
+	_, ok := <-ch
+	assert.Must(!ok)
+
+	ch, _ = s.WatchSlots()
+	s.Close()
+	for _ = range ch {
+	}
+}
+
+func TestWatchMigrations(t *testing.T) {
+	src := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		if string(resp.Array[0].Value) == "SLOTSMGRTTAGONE" {
+			return redis.NewInt([]byte("1"))
+		}
+		return redis.NewString([]byte("OK"))
+	})
+	defer src.Close()
+	dst := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("OK"))
+	})
+	defer dst.Close()
+
+	s := New()
+	defer s.Close()
+
+	ch, cancel := s.WatchMigrations()
+	defer cancel()
+	i := hashSlot([]byte("foo"), MaxSlotNum)
+	assert.MustNoError(s.FillSlot(i, dst.Addr, src.Addr, false))
+	for _, key := range []string{"foo", "{foo}1", "{foo}2"} {
+		r := newRequest("SET", key, "bar")
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+	s.ReportMigrations()
+	assert.MustNoError(s.FillSlot(i, dst.Addr, "", false))
+
+	for _, t := range []MigrationEventType{MigrationStarted, MigrationProgress, MigrationCompleted} {
+		e := <-ch
+		assert.Must(e.Type == t && e.Slot == i && !e.Gap)
+		assert.Must(e.From == src.Addr && e.To == dst.Addr)
+		assert.Must(t == MigrationStarted || e.Keys == 3)
+	}
+	assert.Must(len(ch) == 0)
+
+	assert.MustNoError(s.FillSlot(i, dst.Addr, src.Addr, false))
+	assert.MustNoError(s.FillSlot(i, src.Addr, "", false))
+	assert.Must((<-ch).Type == MigrationStarted)
+	e := <-ch
+	assert.Must(e.Type == MigrationAborted && e.Keys == 0)
+}
+
+func TestKeysPartialResults(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("foo")),
+			redis.NewBulkBytes([]byte("bar")),
+		})
+	})
+	defer b.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	dead := l.Addr().String()
+	l.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(0, b.Addr, "", false))
+	assert.MustNoError(s.FillSlot(1, dead, "", false))
+
+	keys, err := s.Keys("*", time.Second)
+	assert.Must(keys == nil && err != nil)
+
+	s.SetPartialResults(true)
+	keys, err = s.Keys("*", time.Second)
+	assert.Must(len(keys) == 2 && string(keys[0]) == "foo" && string(keys[1]) == "bar")
+	e, ok := err.(*PartialError)
+	assert.Must(ok && len(e.Failed) == 1 && e.Failed[dead+"/0"] != nil)
+	assert.Must(strings.Contains(err.Error(), dead))
+
+	assert.MustNoError(s.ResetSlot(1))
+	keys, err = s.Keys("*", time.Second)
+	assert.MustNoError(err)
+	assert.Must(len(keys) == 2)
+}
+
+func TestReplicaZoneAffinity(t *testing.T) {
+	slow := make(chan struct{}, 4)
+	primary := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		<-slow
+		return redis.NewBulkBytes([]byte("primary"))
+	})
+	defer primary.Close()
+	newReplica := func(value string) *fakeBackend {
+		return newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+			return redis.NewBulkBytes([]byte(value))
+		})
+	}
+	a, b := newReplica("replica-a"), newReplica("replica-b")
+	defer a.Close()
+	defer b.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	dead := l.Addr().String()
+	l.Close()
+
+	s := New()
+	defer s.Close()
+	defer close(slow)
+	i := hashSlot([]byte("foo"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, primary.Addr, "", false))
+	s.SetHedging(time.Millisecond*20, []string{"GET"})
+	s.SetZone("a")
+
+	get := func() string {
+		r := newRequest("GET", "foo")
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		return string(r.Response.Resp.Value)
+	}
+
+	assert.MustNoError(s.SetSlotReplicas(i, []Replica{{b.Addr, "b"}, {a.Addr, "a"}}))
+	assert.Must(s.EffectiveReplica(i) == a.Addr)
+	assert.Must(get() == "replica-a")
+
+	slow <- struct{}{}
+	assert.MustNoError(s.SetSlotReplicas(i, []Replica{{b.Addr, "b"}, {dead, "a"}}))
+	assert.Must(s.EffectiveReplica(i) == dead)
+	time.AfterFunc(time.Millisecond*100, func() {
+		slow <- struct{}{}
+	})
+	assert.Must(get() == "primary")
+	assert.Must(s.EffectiveReplica(i) == b.Addr)
+	assert.Must(s.GetSlots()[i].ReplicaAddr == b.Addr)
+	assert.Must(get() == "replica-b")
+}
+
+func TestReplicaMaxLag(t *testing.T) {
+	primary := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("primary"))
+	})
+	defer primary.Close()
+	var lag atomic2.Int64
+	a := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		info := fmt.Sprintf("# Replication\r\nrole:slave\r\nmaster_link_status:up\r\nmaster_last_io_seconds_ago:%d\r\n", lag.Get())
+		return redis.NewBulkBytes([]byte(info))
+	})
+	defer a.Close()
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("# Replication\r\nrole:slave\r\nmaster_link_status:up\r\nmaster_last_io_seconds_ago:1\r\n"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	i := hashSlot([]byte("foo"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, primary.Addr, "", false))
+	assert.MustNoError(s.SetSlotReplicas(i, []Replica{{a.Addr, "a"}, {b.Addr, "b"}}))
+	s.SetZone("a")
+	s.SetReplicaMaxLag(time.Second * 10)
+
+	lag.Set(100)
+	assert.MustNoError(s.CheckReplicaLag(time.Second))
+	assert.Must(s.ReplicaLags()[a.Addr] == 100 && s.ReplicaLags()[b.Addr] == 1)
+	assert.Must(s.EffectiveReplica(i) == b.Addr)
+
+	s.SetReplicaMaxLag(time.Second * 200)
+	assert.Must(s.EffectiveReplica(i) == a.Addr)
+	s.SetReplicaMaxLag(time.Second * 10)
+	assert.Must(s.EffectiveReplica(i) == b.Addr)
+
+	lag.Set(2)
+	assert.MustNoError(s.CheckReplicaLag(time.Second))
+	assert.Must(s.ReplicaLags()[a.Addr] == 2)
+	assert.Must(s.EffectiveReplica(i) == a.Addr)
+}
+
+func TestRebuildPool(t *testing.T) {
+	b1 := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("b1"))
+	})
+	defer b1.Close()
+	b2 := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("b2"))
+	})
+	defer b2.Close()
+
+	s := New()
+	defer s.Close()
+	i := hashSlot([]byte("foo"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, b1.Addr, "", false))
+	assert.MustNoError(s.SetSlotReplica(i, b2.Addr))
+	assert.MustNoError(s.FillSlot(i+1, b2.Addr, "", false))
+
+	var old = make(map[string]*SharedBackendConn)
+	for addr, bc := range s.pool {
+		old[addr] = bc
+	}
+
+	var wg sync.WaitGroup
+	for k := 0; k < 4; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				r := newRequest("GET", "foo")
+				assert.MustNoError(s.Dispatch(r))
+				r.Wait.Wait()
+				assert.MustNoError(r.Response.Err)
+				assert.Must(string(r.Response.Resp.Value) == "b1")
+			}
+		}()
+	}
+	assert.MustNoError(s.RebuildPool())
+	wg.Wait()
+
+	assert.Must(len(s.pool) == 2)
+	for addr, bc := range s.pool {
+		assert.Must(bc != old[addr] && bc.refcnt == old[addr].refcnt)
+	}
+	assert.Must(s.slots[i].backend.addr == b1.Addr && s.slots[i].backend.bc == s.pool[b1.Addr])
+	assert.Must(s.slots[i].replicas[0].bc == s.pool[b2.Addr])
+	assert.Must(s.slots[i+1].backend.bc == s.pool[b2.Addr])
+}
+
+func TestBackendInFlight(t *testing.T) {
+	release := make(chan struct{})
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		<-release
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	dead := l.Addr().String()
+	l.Close()
+
+	s := New()
+	defer s.Close()
+	s.SetBackendTimeout(time.Second, time.Second)
+	i, j := hashSlot([]byte("foo"), len(s.slots)), hashSlot([]byte("bar"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+	assert.MustNoError(s.FillSlot(j, dead, "", false))
+
+	var wg sync.WaitGroup
+	for k := 0; k < 20; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := newRequest("GET", "foo")
+			assert.MustNoError(s.Dispatch(r))
+			r.Wait.Wait()
+			assert.MustNoError(r.Response.Err)
+		}()
+	}
+	for k := 0; k < 100 && s.BackendInFlight()[b.Addr] != 20; k++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(s.BackendInFlight()[b.Addr] == 20 && s.InFlight() == 20)
+
+	r := newRequest("GET", "bar")
+	assert.MustNoError(s.Dispatch(r))
+	r.Wait.Wait()
+	assert.Must(r.Response.Err != nil)
+	assert.Must(s.BackendInFlight()[dead] == 0 && s.InFlight() == 20)
+
+	close(release)
+	wg.Wait()
+	assert.Must(s.BackendInFlight()[b.Addr] == 0 && s.InFlight() == 0)
+}
+
+func TestSlotSizes(t *testing.T) {
+	counter := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		op, _ := getOpStr(resp)
+		if op == "CLUSTER" && len(resp.Array) == 3 && strings.ToUpper(string(resp.Array[1].Value)) == "COUNTKEYSINSLOT" {
+			return redis.NewInt(append([]byte("10"), resp.Array[2].Value...))
+		}
+		return redis.NewError([]byte("ERR unknown command"))
+	})
+	defer counter.Close()
+	sized := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		if op, _ := getOpStr(resp); op == "DBSIZE" {
+			return redis.NewInt([]byte("7"))
+		}
+		return redis.NewError([]byte("ERR unknown command 'CLUSTER'"))
+	})
+	defer sized.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	dead := l.Addr().String()
+	l.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(1, counter.Addr, "", false))
+	assert.MustNoError(s.FillSlot(2, counter.Addr, "", false))
+	assert.MustNoError(s.FillSlot(3, sized.Addr, "", false))
+	assert.MustNoError(s.FillSlot(4, sized.Addr, "", false))
+	assert.MustNoError(s.FillSlot(5, dead, "", false))
+
+	sizes, err := s.SlotSizes(time.Second)
+	e, ok := err.(*PartialError)
+	assert.Must(ok && len(e.Failed) == 1 && e.Failed[dead+"/0"] != nil)
+	assert.Must(len(sizes) == 4)
+	assert.Must(sizes[0].Slot == 1 && sizes[0].Keys == 101 && !sizes[0].Estimated)
+	assert.Must(sizes[1].Slot == 2 && sizes[1].Keys == 102 && !sizes[1].Estimated)
+	assert.Must(sizes[2].Slot == 3 && sizes[2].Keys == 4 && sizes[2].Estimated)
+	assert.Must(sizes[3].Slot == 4 && sizes[3].Keys == 3 && sizes[3].Estimated)
+}
+
+func TestUnavailablePolicy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	dead := l.Addr().String()
+	l.Close()
+
+	s := New()
+	defer s.Close()
+	i := hashSlot([]byte("foo"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, dead, "", false))
+
+	dispatch := func(args ...string) (*Request, error) {
+		r := newRequest(args...)
+		if err := s.Dispatch(r); err != nil {
+			return r, err
+		}
+		r.Wait.Wait()
+		return r, r.Response.Err
+	}
+
+	// the failed connect marks the backend down
+	_, err = dispatch("GET", "foo")
+	assert.Must(err != nil && err != ErrSlotUnavailable)
+
+	s.SetUnavailablePolicy(UnavailableFailFast, 0)
+	_, err = dispatch("GET", "foo")
+	assert.Must(err == ErrSlotUnavailable)
+
+	s.SetUnavailablePolicy(UnavailableNilReply, 0)
+	r, err := dispatch("GET", "foo")
+	assert.MustNoError(err)
+	assert.Must(r.Response.Resp.IsBulkBytes() && r.Response.Resp.Value == nil)
+	_, err = dispatch("SET", "foo", "bar")
+	assert.Must(err == ErrSlotUnavailable)
+
+	s.SetCommandUnavailablePolicy([]string{"GET"}, UnavailableFailFast)
+	_, err = dispatch("GET", "foo")
+	assert.Must(err == ErrSlotUnavailable)
+	s.SetCommandUnavailablePolicy([]string{"GET"}, UnavailableWait)
+
+	s.SetUnavailablePolicy(UnavailableWait, time.Millisecond*50)
+	start := time.Now()
+	_, err = dispatch("GET", "foo")
+	assert.Must(err == ErrSlotUnavailable && time.Since(start) >= time.Millisecond*50)
+
+	replica := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("replica"))
+	})
+	defer replica.Close()
+	assert.MustNoError(s.SetSlotReplica(i, replica.Addr))
+	r, err = dispatch("GET", "foo")
+	assert.MustNoError(err)
+	assert.Must(string(r.Response.Resp.Value) == "replica")
+	_, err = dispatch("SET", "foo", "bar")
+	assert.Must(err == ErrSlotUnavailable)
+	assert.MustNoError(s.SetSlotReplicas(i, nil))
+
+	s.SetUnavailablePolicy(UnavailableWait, time.Second*5)
+	b := newFakeBackendAt(dead, func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+	time.AfterFunc(time.Millisecond*50, func() {
+		s.KeepAlive()
+	})
+	r, err = dispatch("GET", "foo")
+	assert.MustNoError(err)
+	assert.Must(string(r.Response.Resp.Value) == "bar")
+
+	p, err := ParseUnavailablePolicy("NIL")
+	assert.Must(err == nil && p == UnavailableNilReply)
+	_, err = ParseUnavailablePolicy("none")
+	assert.Must(err != nil)
+}
+
+func TestSlotHeatmap(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	hot, warm, idle := hashSlot([]byte("hot"), len(s.slots)), hashSlot([]byte("warm"), len(s.slots)), hashSlot([]byte("idle"), len(s.slots))
+	for _, i := range []int{hot, warm, idle} {
+		assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+	}
+	dispatch := func(key string, n int) {
+		for i := 0; i < n; i++ {
+			r := newRequest("GET", key)
+			assert.MustNoError(s.Dispatch(r))
+			r.Wait.Wait()
+		}
+	}
+
+	// the first call only takes the counts so far as a baseline
+	dispatch("hot", 200)
+	heatmap := s.SlotHeatmap()
+	assert.Must(heatmap[hot] == 0)
+
+	for key, n := range map[string]int{"hot": 200, "warm": 20} {
+		dispatch(key, n)
+	}
+	time.Sleep(time.Millisecond * 100)
+	heatmap = s.SlotHeatmap()
+	assert.Must(len(heatmap) == len(s.slots))
+	assert.Must(heatmap[hot] > heatmap[warm] && heatmap[warm] > heatmap[idle])
+	assert.Must(heatmap[idle] == 0)
+
+	// the rates decay once the traffic stops
+	rate := s.heatmap.rates[hot]
+	time.Sleep(time.Millisecond * 100)
+	s.SlotHeatmap()
+	assert.Must(s.heatmap.rates[hot] < rate)
+}
+
+func TestBackendHealthGate(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	i := hashSlot([]byte("foo"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+
+	dispatch := func(args ...string) (*Request, error) {
+		r := newRequest(args...)
+		if err := s.Dispatch(r); err != nil {
+			return r, err
+		}
+		r.Wait.Wait()
+		return r, r.Response.Err
+	}
+	_, err := dispatch("GET", "foo")
+	assert.MustNoError(err)
+
+	s.SetBackendHealth(b.Addr, false)
+	assert.Must(s.GetSlots()[i].Gated)
+	_, err = dispatch("GET", "foo")
+	assert.Must(err == ErrSlotUnavailable)
+	_, err = dispatch("SET", "foo", "bar")
+	assert.Must(err == ErrSlotUnavailable)
+
+	for _, policy := range []UnavailablePolicy{UnavailableWait, UnavailableNilReply} {
+		s.SetUnavailablePolicy(policy, time.Second)
+		start := time.Now()
+		_, err = dispatch("GET", "foo")
+		assert.Must(err == ErrSlotUnavailable && time.Since(start) < time.Second/2)
+	}
+	s.SetUnavailablePolicy(UnavailableForward, 0)
+
+	// the gate outlives a recycle of the pool
+	assert.MustNoError(s.RecyclePool(0))
+	assert.Must(s.GetSlots()[i].Gated)
+
+	replica := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("replica"))
+	})
+	defer replica.Close()
+	assert.MustNoError(s.SetSlotReplica(i, replica.Addr))
+	r, err := dispatch("GET", "foo")
+	assert.MustNoError(err)
+	assert.Must(string(r.Response.Resp.Value) == "replica")
+	_, err = dispatch("SET", "foo", "bar")
+	assert.Must(err == ErrSlotUnavailable)
+	assert.MustNoError(s.SetSlotReplicas(i, nil))
+
+	s.SetBackendHealth(b.Addr, true)
+	assert.Must(!s.GetSlots()[i].Gated)
+	r, err = dispatch("GET", "foo")
+	assert.MustNoError(err)
+	assert.Must(string(r.Response.Resp.Value) == "bar")
+	_, err = dispatch("SET", "foo", "bar")
+	assert.MustNoError(err)
+}
+
+func TestCursorPinning(t *testing.T) {
+	newScanHandler := func(name string) func(resp *redis.Resp) *redis.Resp {
+		return func(resp *redis.Resp) *redis.Resp {
+			if string(resp.Array[0].Value) != "HSCAN" {
+				return redis.NewBulkBytes(nil)
+			}
+			next := map[string]string{"0": "1", "1": "2", "2": "0"}[string(resp.Array[2].Value)]
+			return redis.NewArray([]*redis.Resp{
+				redis.NewBulkBytes([]byte(next)),
+				redis.NewArray([]*redis.Resp{redis.NewBulkBytes([]byte(name))}),
+			})
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	dead := l.Addr().String()
+	l.Close()
+	replica := newFakeBackend(newScanHandler("replica"))
+	defer replica.Close()
+
+	s := New()
+	defer s.Close()
+	i := hashSlot([]byte("foo"), len(s.slots))
+	assert.MustNoError(s.FillSlot(i, dead, "", false))
+	assert.MustNoError(s.SetSlotReplica(i, replica.Addr))
+	s.SetUnavailablePolicy(UnavailableFailFast, 0)
+
+	var pins cursorPins
+	hscanKey := func(key, cursor string) (string, string) {
+		r := newRequest("HSCAN", key, cursor)
+		r.cursors = &pins
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Coalesce())
+		assert.MustNoError(r.Response.Err)
+		resp := r.Response.Resp
+		return string(resp.Array[0].Value), string(resp.Array[1].Array[0].Value)
+	}
+	hscan := func(cursor string) (string, string) {
+		return hscanKey("foo", cursor)
+	}
+
+	// the failed connect marks the primary down, the iteration starts on the replica
+	r := newRequest("GET", "foo")
+	assert.MustNoError(s.Dispatch(r))
+	r.Wait.Wait()
+	cursor, endpoint := hscan("0")
+	assert.Must(cursor == "1" && endpoint == "replica")
+
+	primary := newFakeBackendAt(dead, newScanHandler("primary"))
+	defer primary.Close()
+	for s.slots[i].isBackendDown() {
+		s.KeepAlive()
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	cursor, endpoint = hscan(cursor)
+	assert.Must(cursor == "2" && endpoint == "replica")
+	cursor, endpoint = hscan(cursor)
+	assert.Must(cursor == "0" && endpoint == "replica")
+	assert.Must(pins.get([]byte("foo")) == "")
+
+	cursor, endpoint = hscan(cursor)
+	assert.Must(cursor == "1" && endpoint == "primary")
+	cursor, endpoint = hscan(cursor)
+	assert.Must(cursor == "2" && endpoint == "primary")
+
+	// iterations are pinned by key, not by the hash key they're routed by
+	s.SetRouteKey("HSCAN", func(args []*redis.Resp) []byte {
+		return []byte("foo")
+	})
+	next, endpoint := hscanKey("bar", "0")
+	assert.Must(next == "1" && endpoint == "primary")
+	cursor, _ = hscan(cursor)
+	assert.Must(cursor == "0" && pins.get([]byte("foo")) == "")
+	assert.Must(pins.get([]byte("bar")) == dead)
+}
+
+func TestCommandTimeouts(t *testing.T) {
+	slow := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		if op, _ := getOpStr(resp); op == "SORT" {
+			time.Sleep(time.Millisecond * 300)
+			return redis.NewArray(nil)
+		}
+		return redis.NewBulkBytes([]byte("slow"))
+	})
+	defer slow.Close()
+	fast := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("fast"))
+	})
+	defer fast.Close()
+
+	s := New()
+	defer s.Close()
+	s.SetCommandTimeouts(0, map[string]time.Duration{
+		"GET":  time.Millisecond * 100,
+		"SORT": time.Millisecond * 50,
+	})
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("foo"), len(s.slots)), slow.Addr, "", false))
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("bar"), len(s.slots)), fast.Addr, "", false))
+
+	dispatch := func(args ...string) *Request {
+		r := newRequest(args...)
+		assert.MustNoError(s.Dispatch(r))
+		return r
+	}
+
+	start := time.Now()
+	sort := dispatch("SORT", "foo")
+	get := dispatch("GET", "bar")
+	get.Wait.Wait()
+	assert.MustNoError(get.Response.Err)
+	assert.Must(string(get.Response.Resp.Value) == "fast")
+
+	sort.Wait.Wait()
+	assert.MustNoError(sort.Response.Err)
+	assert.Must(sort.Response.Resp.IsError() && string(sort.Response.Resp.Value) == ErrCommandTimeout.Error())
+	assert.Must(time.Since(start) < time.Millisecond*300)
+	assert.Must(s.CommandTimeouts() == 1)
+
+	// the pipeline is intact once the abandoned reply arrives
+	s.SetCommandTimeouts(0, nil)
+	r := dispatch("GET", "foo")
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+	assert.Must(string(r.Response.Resp.Value) == "slow")
+}
+
+type memAuditSink struct {
+	sync.Mutex
+	entries []*AuditEntry
+}
+
+func (m *memAuditSink) Record(e *AuditEntry) {
+	m.Lock()
+	m.entries = append(m.entries, e)
+	m.Unlock()
+}
+
+func (m *memAuditSink) wait(n int) []*AuditEntry {
+	for i := 0; i < 100; i++ {
+		m.Lock()
+		entries := m.entries
+		m.Unlock()
+		if len(entries) >= n {
+			return entries
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return nil
+}
+
+func TestAuditSink(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+
+	d := New()
+	defer d.Close()
+	i := hashSlot([]byte("foo"), MaxSlotNum)
+	assert.MustNoError(d.FillSlot(i, b.Addr, "", false))
+	sink := &memAuditSink{}
+	d.SetAuditSink(sink, 16)
+
+	x, y := net.Pipe()
+	defer x.Close()
+	s := NewSession(y, "")
+	defer s.Close()
+	for _, key := range []string{"foo", "{foo}bar"} {
+		r, err := s.handleRequest(newRequest("GET", key).Resp, d)
+		assert.MustNoError(err)
+		s.handleResponse(r)
+	}
+	_, err := s.handleRequest(newRequest("GET", "baz").Resp, d)
+	assert.Must(err != nil)
+
+	entries := sink.wait(3)
+	assert.Must(len(entries) == 3)
+	for _, e := range entries[:2] {
+		assert.Must(e.OpStr == "GET" && e.KeyHash == hashKey([]byte("foo")) && e.Slot == i)
+		assert.Must(e.Addr == b.Addr && e.Err == "" && e.Client == s.remote && e.Client != "")
+	}
+	e := entries[2]
+	assert.Must(e.Slot == hashSlot([]byte("baz"), MaxSlotNum) && e.Addr == "")
+	assert.Must(strings.Contains(e.Err, ErrSlotIsNotReady.Error()))
+	assert.Must(d.AuditDrops() == 0)
+}
+
+func TestNegativeCache(t *testing.T) {
+	var mu sync.Mutex
+	var values = make(map[string][]byte)
+	var forwarded int
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		mu.Lock()
+		defer mu.Unlock()
+		forwarded++
+		key := string(resp.Array[1].Value)
+		switch strings.ToUpper(string(resp.Array[0].Value)) {
+		case "SET":
+			values[key] = resp.Array[2].Value
+			return redis.NewString([]byte("OK"))
+		case "EXISTS":
+			if values[key] != nil {
+				return redis.NewInt([]byte("1"))
+			}
+			return redis.NewInt([]byte("0"))
+		default:
+			return redis.NewBulkBytes(values[key])
+		}
+	})
+	defer b.Close()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return forwarded
+	}
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), b.Addr, "", false))
+	s.SetNegativeCache(16, time.Minute)
+
+	do := func(args ...string) *redis.Resp {
+		r := newRequest(args...)
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		if r.Coalesce != nil {
+			assert.MustNoError(r.Coalesce())
+		}
+		assert.MustNoError(r.Response.Err)
+		return r.Response.Resp
+	}
+
+	assert.Must(do("GET", "foo").Value == nil)
+	assert.Must(count() == 1)
+	assert.Must(do("GET", "foo").Value == nil)
+	assert.Must(string(do("EXISTS", "foo").Value) == "0")
+	assert.Must(count() == 1)
+	hits, misses := s.NegativeCacheStats()
+	assert.Must(hits == 2 && misses == 1)
+
+	assert.Must(string(do("SET", "foo", "bar").Value) == "OK")
+	assert.Must(string(do("GET", "foo").Value) == "bar")
+	assert.Must(count() == 3)
+}
+
+func TestBackendSelector(t *testing.T) {
+	reply := func(name string) func(*redis.Resp) *redis.Resp {
+		return func(*redis.Resp) *redis.Resp {
+			return redis.NewBulkBytes([]byte(name))
+		}
+	}
+	b := newFakeBackend(reply("primary"))
+	defer b.Close()
+	canary := newFakeBackend(reply("canary"))
+	defer canary.Close()
+
+	s := New()
+	defer s.Close()
+	i := hashSlot([]byte("foo"), MaxSlotNum)
+	assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+
+	var slots = make(chan int, 1)
+	s.SetBackendSelector(func(opstr string, key []byte, slot int) string {
+		if opstr != "HGET" {
+			return ""
+		}
+		slots <- slot
+		return canary.Addr
+	})
+
+	do := func(args ...string) string {
+		r := newRequest(args...)
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		return string(r.Response.Resp.Value)
+	}
+	assert.Must(do("GET", "foo") == "primary")
+	assert.Must(do("HGET", "foo", "f") == "canary")
+	assert.Must(<-slots == i)
+
+	s.SetBackendSelector(nil)
+	assert.Must(do("HGET", "foo", "f") == "primary")
+	s.mu.Lock()
+	assert.Must(len(s.pool) == 1 && s.pool[canary.Addr] == nil)
+	s.mu.Unlock()
+}
+
+func TestBackendSelectorRelease(t *testing.T) {
+	b := newFakeBackend(func(*redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+	canary := newFakeBackend(func(*redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("OK"))
+	})
+	defer canary.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), b.Addr, "", false))
+	selector := func(opstr string, key []byte, slot int) string {
+		return canary.Addr
+	}
+
+	// the conns picked by the selector are released and replaced while
+	// requests are being pushed to them
+	var wg sync.WaitGroup
+	var stop atomic2.Bool
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Get() {
+				var rs []*Request
+				for j := 0; j < 16; j++ {
+					r := newRequest("GET", "foo")
+					assert.MustNoError(s.Dispatch(r))
+					rs = append(rs, r)
+				}
+				for _, r := range rs {
+					r.Wait.Wait()
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		s.SetBackendSelector(selector)
+		if i%2 == 0 {
+			assert.MustNoError(s.RebuildPool())
+		}
+		s.SetBackendSelector(nil)
+	}
+	stop.Set(true)
+	wg.Wait()
+
+	// a conn closed while pinned is closed once unpinned
+	sbc := NewSharedBackendConn(canary.Addr, "")
+	assert.Must(sbc.pin())
+	assert.Must(sbc.Close())
+	assert.Must(!sbc.pin())
+	r := newRequest("GET", "foo")
+	sbc.Conn(nil).PushBack(r)
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+	sbc.unpin()
+	_, ok := <-sbc.conns[0].input
+	assert.Must(!ok)
+}
+
+func TestRoutingParams(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.SetKeyPrefix("app:")
+
+	p := s.RoutingParams()
+	assert.Must(p.Hash == "crc32-ieee" && p.Slots == MaxSlotNum && p.Prefix == "app:")
+	assert.Must(p.TagBeg == "{" && p.TagEnd == "}")
+
+	slotOf := func(key string) int {
+		key = p.Prefix + key
+		if beg := strings.Index(key, p.TagBeg); beg >= 0 {
+			if end := strings.Index(key[beg+1:], p.TagEnd); end >= 0 {
+				key = key[beg+1 : beg+1+end]
+			}
+		}
+		return int(crc32.ChecksumIEEE([]byte(key)) % uint32(p.Slots))
+	}
+	for _, key := range []string{"foo", "bar", "{user1000}.following", "a{b}{c}", "x{}y", "{open", ""} {
+		assert.Must(s.KeySlot([]byte(key)).Id == slotOf(key))
+	}
+}
+
+func TestRecyclePool(t *testing.T) {
+	echo := func(resp *redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("OK"))
+	}
+	s := New()
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		b := newFakeBackend(echo)
+		defer b.Close()
+		assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+	}
+	recycled := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var n int
+		for _, bc := range s.pool {
+			if len(bc.conns) == 2 && bc.conns[0].readTimeout == time.Second {
+				n++
+			}
+		}
+		return n
+	}
+	s.SetBackendTimeout(time.Second, time.Second)
+	s.SetBackendPoolSize(2)
+	assert.Must(recycled() == 0)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.RecyclePool(time.Millisecond * 100)
+	}()
+	var partial bool
+	for n := recycled(); n != 3; n = recycled() {
+		assert.Must(n <= 3)
+		if n != 0 {
+			partial = true
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	assert.MustNoError(<-done)
+	assert.Must(partial)
+
+	r := newRequest("SET", "foo", "bar")
+	assert.MustNoError(s.DispatchWithKey(r, nil))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+}
+
+func TestRouteKey(t *testing.T) {
+	var mu sync.Mutex
+	var keys = make(map[string][]string)
+	newBackend := func(name string) *fakeBackend {
+		return newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+			mu.Lock()
+			defer mu.Unlock()
+			keys[name] = append(keys[name], string(resp.Array[1].Value))
+			return redis.NewInt([]byte("1"))
+		})
+	}
+	b1, b2 := newBackend("b1"), newBackend("b2")
+	defer b1.Close()
+	defer b2.Close()
+
+	s := New()
+	defer s.Close()
+	s.SetKeyPrefix("app:")
+	i1 := hashSlot([]byte("app:places"), MaxSlotNum)
+	i2 := hashSlot([]byte("paris"), MaxSlotNum)
+	assert.Must(i1 != i2)
+	assert.MustNoError(s.FillSlot(i1, b1.Addr, "", false))
+	assert.MustNoError(s.FillSlot(i2, b2.Addr, "", false))
+
+	s.SetRouteKey("zadd", RouteKeyArgs(3))
+	do := func(args ...string) {
+		r := newRequest(args...)
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+	do("ZADD", "places", "1", "paris")
+	do("ZSCORE", "places", "paris")
+	s.SetRouteKey("ZADD", nil)
+	do("ZADD", "places", "1", "paris")
+	s.SetRouteKey("GET", RouteKeyArgs(1))
+	do("GET", "places")
+
+	r := newRequest("GET", "places")
+	assert.MustNoError(s.DispatchWithKey(r, []byte("places")))
+	r.Wait.Wait()
+	assert.MustNoError(r.Response.Err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Must(len(keys["b2"]) == 1 && keys["b2"][0] == "app:places")
+	assert.Must(len(keys["b1"]) == 4)
+}
+
+func TestBackendRTT(t *testing.T) {
+	for _, usecs := range []int64{0, 3, 4, 7, 8, 1000, 20000, 1 << 30} {
+		i := rttBucket(usecs)
+		assert.Must(usecs <= rttBucketMax(i) && (i == 0 || usecs > rttBucketMax(i-1)))
+	}
+
+	const delay = time.Millisecond * 20
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		time.Sleep(delay)
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), b.Addr, "", false))
+	for i := 0; i < 10; i++ {
+		r := newRequest("SET", "foo", "bar")
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+	rtt := s.BackendRTTs()[b.Addr]
+	assert.Must(rtt.Count == 10)
+	assert.Must(rtt.P50 >= int64(delay/time.Microsecond) && rtt.P50 < int64(delay*2/time.Microsecond))
+	assert.Must(rtt.P50 <= rtt.P95 && rtt.P95 <= rtt.P99)
+
+	s.ResetBackendRTTs()
+	assert.Must(s.BackendRTTs()[b.Addr].Count == 0)
+}
+
+func TestFallbackBackend(t *testing.T) {
+	reply := func(name string) func(*redis.Resp) *redis.Resp {
+		return func(*redis.Resp) *redis.Resp {
+			return redis.NewBulkBytes([]byte(name))
+		}
+	}
+	b := newFakeBackend(reply("sharded"))
+	defer b.Close()
+	legacy := newFakeBackend(reply("legacy"))
+	defer legacy.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), b.Addr, "", false))
+	assert.Must(hashSlot([]byte("bar"), MaxSlotNum) != hashSlot([]byte("foo"), MaxSlotNum))
+
+	do := func(key string) (string, error) {
+		r := newRequest("GET", key)
+		if err := s.Dispatch(r); err != nil {
+			return "", err
+		}
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		return string(r.Response.Resp.Value), nil
+	}
+	_, err := do("bar")
+	assert.Must(err.(*DispatchError).Cause == ErrSlotIsNotReady)
+
+	s.SetFallbackBackend(legacy.Addr)
+	v, err := do("bar")
+	assert.Must(err == nil && v == "legacy")
+	v, err = do("foo")
+	assert.Must(err == nil && v == "sharded")
+	assert.Must(s.FallbackCount() == 1)
+
+	s.SetFallbackBackend("")
+	_, err = do("bar")
+	assert.Must(err != nil)
+}
+
+func TestCheckSlotBalance(t *testing.T) {
+	s := New()
+	defer s.Close()
+	err := s.CheckSlotBalance(0.5)
+	assert.Must(err != nil && err.(*SlotImbalance).Unassigned == MaxSlotNum)
+
+	for i := 0; i < MaxSlotNum; i++ {
+		addr := "127.0.0.1:6379"
+		if i%2 == 0 {
+			addr = "127.0.0.1:6380"
+		}
+		assert.MustNoError(s.FillSlot(i, addr, "", false))
+	}
+	assert.MustNoError(s.CheckSlotBalance(0.5))
+
+	for i := 0; i < MaxSlotNum/4; i++ {
+		assert.MustNoError(s.FillSlot(i*2+1, "127.0.0.1:6380", "", false))
+	}
+	err = s.CheckSlotBalance(0.5)
+	assert.Must(err != nil && err.(*SlotImbalance).Unassigned == 0)
+	assert.Must(err.(*SlotImbalance).Overloaded["127.0.0.1:6380"] == MaxSlotNum*3/4)
+	assert.MustNoError(s.CheckSlotBalance(0))
+}
+
+func TestReadCoalescing(t *testing.T) {
+	var gets atomic2.Int64
+	var release = make(chan bool)
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		if strings.ToUpper(string(resp.Array[0].Value)) != "GET" {
+			return redis.NewString([]byte("OK"))
+		}
+		gets.Incr()
+		<-release
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), b.Addr, "", false))
+	s.SetReadCoalescing(true)
+
+	const n = 10
+	var reqs []*Request
+	for i := 0; i < n; i++ {
+		r := newRequest("GET", "foo")
+		assert.MustNoError(s.Dispatch(r))
+		reqs = append(reqs, r)
+	}
+	close(release)
+	for _, r := range reqs {
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		assert.Must(string(r.Response.Resp.Value) == "bar")
+	}
+	assert.Must(gets.Get() == 1)
+	assert.Must(s.CoalescedReads() == n-1)
+
+	w := &slotWrites{}
+	r := newRequest("GET", "foo")
+	r.writes = w
+	assert.MustNoError(s.Dispatch(r))
+	x := newRequest("SET", "foo", "baz")
+	x.writes = w
+	assert.MustNoError(s.Dispatch(x))
+	y := newRequest("GET", "foo")
+	y.writes = w
+	assert.MustNoError(s.Dispatch(y))
+	for _, r := range []*Request{r, x, y} {
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+	}
+	assert.Must(gets.Get() == 3)
+
+	s.SetReadCoalescing(false)
+	for i := 0; i < 2; i++ {
+		r := newRequest("GET", "foo")
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+	}
+	assert.Must(gets.Get() == 5)
+}
+
+func TestUnknownCommandPolicy(t *testing.T) {
+	reply := func(name string) func(resp *redis.Resp) *redis.Resp {
+		return func(resp *redis.Resp) *redis.Resp {
+			return redis.NewBulkBytes([]byte(name))
+		}
+	}
+	b := newFakeBackend(reply("sharded"))
+	defer b.Close()
+	module := newFakeBackend(reply("module"))
+	defer module.Close()
+
+	s := New()
+	defer s.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(s.FillSlot(i, b.Addr, "", false))
+	}
+
+	do := func(args ...string) *redis.Resp {
+		r := newRequest(args...)
+		assert.MustNoError(s.Dispatch(r))
+		r.Wait.Wait()
+		assert.MustNoError(r.Response.Err)
+		return r.Response.Resp
+	}
+	assert.Must(string(do("MY.CMD", "foo").Value) == "sharded")
+
+	assert.Must(s.SetUnknownCommandPolicy(UnknownDefaultBackend, "") != nil)
+	assert.MustNoError(s.SetUnknownCommandPolicy(UnknownDefaultBackend, module.Addr))
+	assert.Must(string(do("MY.CMD", "foo").Value) == "module")
+	assert.Must(string(do("GET", "foo").Value) == "sharded")
+
+	assert.MustNoError(s.SetUnknownCommandPolicy(UnknownReject, ""))
+	resp := do("MY.CMD", "foo")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR unknown command 'MY.CMD'")
+	assert.Must(string(do("GET", "foo").Value) == "sharded")
+	for _, opstr := range []string{"UNLINK", "TOUCH", "LPOS", "SMISMEMBER", "ZREVRANGEBYLEX", "ECHO"} {
+		assert.Must(string(do(opstr, "foo", "bar").Value) == "sharded")
+	}
+
+	policy, err := ParseUnknownCommandPolicy("Reject")
+	assert.Must(err == nil && policy == UnknownReject)
+	_, err = ParseUnknownCommandPolicy("drop")
+	assert.Must(err != nil)
+}
+
+func TestSlotTable(t *testing.T) {
+	for _, n := range []int{1, 16, 24, MaxSlotNum} {
+		table := newSlotTable(make([]*Slot, n))
+		for _, key := range []string{"", "foo", "{foo}.bar", "a very long key to hash"} {
+			assert.Must(table.index([]byte(key)) == hashSlot([]byte(key), n))
+		}
+	}
+
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	s := New()
+	defer s.Close()
+	var wg sync.WaitGroup
+	var done = make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			n := 16 << uint(i%3)
+			var mapping = make([]SlotConfig, n)
+			for j := range mapping {
+				mapping[j].Addr = b.Addr
+			}
+			assert.MustNoError(s.ReshardSlots(n, mapping))
+			assert.MustNoError(s.FillSlot(i%n, b.Addr, "", false))
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				r := newRequest("SET", fmt.Sprintf("key%d-%d", i, j), "v")
+				if s.Dispatch(r) == nil {
+					r.Wait.Wait()
+				}
+			}
+		}(i)
+	}
+	time.Sleep(time.Millisecond * 100)
+	close(done)
+	wg.Wait()
+}
+
+func BenchmarkSlotLookupLocked(b *testing.B) {
+	s := New()
+	defer s.Close()
+	key := []byte("foo")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.rwlck.RLock()
+			_ = s.slots[hashSlot(key, len(s.slots))]
+			s.rwlck.RUnlock()
+		}
+	})
+}
+
+func BenchmarkSlotLookup(b *testing.B) {
+	s := New()
+	defer s.Close()
+	key := []byte("foo")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = s.slotOf(key)
+		}
+	})
+}
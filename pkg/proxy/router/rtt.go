@@ -0,0 +1,115 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import "github.com/wandoulabs/codis/pkg/utils/atomic2"
+
+// rttHistogram counts round trips by their microseconds, in buckets of 4
+// per power of 2, so a percentile is off by 25% at most, see rttBucket.
+type rttHistogram struct {
+	buckets [rttBuckets]atomic2.Int64
+}
+
+const rttBuckets = 160
+
+func rttBucket(usecs int64) int {
+	if usecs < 4 {
+		if usecs < 0 {
+			return 0
+		}
+		return int(usecs)
+	}
+	var n int
+	for x := usecs; x != 0; x >>= 1 {
+		n++
+	}
+	i := (n-2)*4 + int(usecs>>uint(n-3))&3
+	if i >= rttBuckets {
+		return rttBuckets - 1
+	}
+	return i
+}
+
+// rttBucketMax returns the largest microseconds of the bucket.
+func rttBucketMax(i int) int64 {
+	if i < 4 {
+		return int64(i)
+	}
+	shift := uint(i/4 - 1)
+	return (int64(4+i%4)+1)<<shift - 1
+}
+
+func (h *rttHistogram) add(usecs int64) {
+	h.buckets[rttBucket(usecs)].Incr()
+}
+
+func (h *rttHistogram) reset() {
+	for i := range h.buckets {
+		h.buckets[i].Set(0)
+	}
+}
+
+// BackendRTT is the round trip time of the requests to a backend, from
+// writing a request to reading its reply on the backend conn, so it's the
+// latency of the backend and the network, without the proxy's own.
+type BackendRTT struct {
+	Count int64 `json:"count"`
+	P50   int64 `json:"p50_usecs"`
+	P95   int64 `json:"p95_usecs"`
+	P99   int64 `json:"p99_usecs"`
+}
+
+// rtt returns the percentiles of the round trips over all the conns of the
+// backend.
+func (s *SharedBackendConn) rtt() *BackendRTT {
+	var counts [rttBuckets]int64
+	var total int64
+	for _, bc := range s.conns {
+		for i := range counts {
+			n := bc.rtt.buckets[i].Get()
+			counts[i] += n
+			total += n
+		}
+	}
+	x := &BackendRTT{Count: total}
+	if total == 0 {
+		return x
+	}
+	var percentiles = []struct {
+		p int64
+		v *int64
+	}{{50, &x.P50}, {95, &x.P95}, {99, &x.P99}}
+	var sum int64
+	for i, n := range counts {
+		sum += n
+		for len(percentiles) != 0 && sum*100 >= total*percentiles[0].p {
+			*percentiles[0].v = rttBucketMax(i)
+			percentiles = percentiles[1:]
+		}
+	}
+	return x
+}
+
+// BackendRTTs returns the round trip time percentiles of each backend in
+// the pool, since its conns were created or ResetBackendRTTs.
+func (s *Router) BackendRTTs() map[string]*BackendRTT {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var m = make(map[string]*BackendRTT, len(s.pool))
+	for addr, bc := range s.pool {
+		m[addr] = bc.rtt()
+	}
+	return m
+}
+
+// ResetBackendRTTs clears the round trips recorded so far.
+func (s *Router) ResetBackendRTTs() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, bc := range s.pool {
+		for _, c := range bc.conns {
+			c.rtt.reset()
+		}
+	}
+}
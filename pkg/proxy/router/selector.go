@@ -0,0 +1,109 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+// BackendSelector returns the backend addr a request is forwarded to, given
+// its command, its hash key, with the key prefix, and its slot, or "" for
+// the backend of the slot.
+type BackendSelector func(opstr string, key []byte, slot int) string
+
+// SetBackendSelector sets the function called for every request with a
+// key, to forward it to another backend than the one of its slot, e.g. a
+// canary or a shadow environment, nil disables it, which is the default.
+//
+// It bypasses the sharding: a redirected request ignores the migration of
+// its slot, the replicas, hedging, timeouts and the unavailable policy, so
+// whatever it reads or writes on the other backend is up to the selector.
+// It's called on the dispatching path, so it must be fast and never block.
+func (s *Router) SetBackendSelector(fn BackendSelector) {
+	s.rwlck.Lock()
+	s.selector = fn
+	s.rwlck.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseSelected()
+}
+
+// releaseSelected puts back the conns to the backends picked by the
+// selector, to the fallback or to the default backend of unknown commands,
+// so far.
+func (s *Router) releaseSelected() {
+	for addr := range s.selected {
+		s.putBackendConn(s.pool[addr])
+	}
+	s.selected = nil
+	s.publishSelected()
+}
+
+// publishSelected makes the conns of s.selected, as in the pool, be found by
+// forwardPooled without locking. It's called with s.mu held, whenever they
+// change.
+func (s *Router) publishSelected() {
+	var m = make(map[string]*SharedBackendConn, len(s.selected))
+	for addr := range s.selected {
+		m[addr] = s.pool[addr]
+	}
+	s.pooled.Store(m)
+}
+
+// dispatchSelected forwards the request to the backend returned by the
+// selector, if any, see SetBackendSelector.
+func (s *Router) dispatchSelected(r *Request, hkey []byte) (bool, error) {
+	s.rwlck.RLock()
+	fn := s.selector
+	s.rwlck.RUnlock()
+	if fn == nil {
+		return false, nil
+	}
+	slot := s.slotOf(hkey)
+	addr := fn(r.OpStr, hkey, slot.id)
+	if addr == "" {
+		return false, nil
+	}
+
+	return true, s.forwardPooled(r, slot, hkey, addr)
+}
+
+// forwardPooled forwards the request to the backend of addr instead of the
+// backend of its slot, on a conn of the pool that's kept until the selector,
+// the fallback or the unknown command policy changes. The db of the slot
+// still applies. Once kept, the conn is found without locking, and pinned
+// while the request is pushed, so it's not closed meanwhile, see pin.
+func (s *Router) forwardPooled(r *Request, slot *Slot, hkey []byte, addr string) error {
+	m, _ := s.pooled.Load().(map[string]*SharedBackendConn)
+	sbc := m[addr]
+	if sbc == nil || !sbc.pin() {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return errClosedRouter
+		}
+		if !s.selected[addr] {
+			if s.selected == nil {
+				s.selected = make(map[string]bool)
+			}
+			s.getBackendConn(addr)
+			s.selected[addr] = true
+			s.publishSelected()
+		}
+		sbc = s.pool[addr]
+		pinned := sbc.pin()
+		s.mu.Unlock()
+		if !pinned {
+			return errClosedRouter
+		}
+	}
+
+	slot.lock.RLock()
+	r.db = slot.backend.db
+	slot.lock.RUnlock()
+
+	r.backend = addr
+	r.inflight = &s.inflight
+	r.inflight.Incr()
+	sbc.Conn(hkey).PushBack(r)
+	sbc.unpin()
+	return nil
+}
@@ -27,10 +27,29 @@ type Session struct {
 
 	auth       string
 	authorized bool
+	remote     string
+	name       string
+	admin      bool
+
+	noevict atomic2.Bool
+	notouch atomic2.Bool
 
 	quit   bool
 	failed atomic2.Bool
 	closed atomic2.Bool
+
+	output struct {
+		size   atomic2.Int64
+		since  atomic2.Int64
+		killed atomic2.Bool
+	}
+	writes   slotWrites
+	cursors  cursorPins
+	affinity clientConns
+	wait     *clientWait
+	throttle *clientThrottle
+	monitor  *monitorStream
+	pubsub   *pubsubStream
 }
 
 func (s *Session) String() string {
@@ -47,22 +66,84 @@ func (s *Session) String() string {
 	return string(b)
 }
 
+var sessions struct {
+	alive  atomic2.Int64
+	total  atomic2.Int64
+	closed atomic2.Int64
+
+	protoerrs atomic2.Int64
+}
+
+// ProtocolErrors returns the number of clients closed for sending malformed
+// requests.
+func ProtocolErrors() int64 {
+	return sessions.protoerrs.Get()
+}
+
+var requestLimits struct {
+	args, bulk atomic2.Int64
+}
+
+// SetRequestLimits sets the max number of args of a request and the max
+// length of an arg, the sessions created afterwards close with a protocol
+// error on a request over them, before it's read, let alone allocated.
+// A limit of 0 is the default of redis, see redis.MaxArrayLen and
+// redis.MaxBulkBytesLen.
+func SetRequestLimits(maxArgs, maxBulkBytes int64) {
+	requestLimits.args.Set(maxArgs)
+	requestLimits.bulk.Set(maxBulkBytes)
+}
+
+var sessionReadBuffer atomic2.Int64
+
+// SetSessionReadBuffer sets the size of the buffer the requests of a client
+// are read into, for the sessions created afterwards, instead of the bufsize
+// of NewSessionSize, which still sizes the replies buffer. Clients sending
+// deep pipelines fill a small buffer at once, and each refill is a read, a
+// deadline reset too, so a larger one takes fewer syscalls for the same
+// pipeline. But it's allocated for each client, idle ones included, so it
+// costs size bytes times the number of clients. 0 means bufsize.
+func SetSessionReadBuffer(size int) {
+	sessionReadBuffer.Set(int64(size))
+}
+
 func NewSession(c net.Conn, auth string) *Session {
 	return NewSessionSize(c, auth, 1024*32, 1800)
 }
 
 func NewSessionSize(c net.Conn, auth string, bufsize int, timeout int) *Session {
-	s := &Session{CreateUnix: time.Now().Unix(), auth: auth}
-	s.Conn = redis.NewConnSize(c, bufsize)
+	s := &Session{CreateUnix: time.Now().Unix(), auth: auth, remote: c.RemoteAddr().String()}
+	rbufsize := bufsize
+	if n := sessionReadBuffer.Get(); n != 0 {
+		rbufsize = int(n)
+	}
+	s.Conn = redis.NewConnSizes(c, rbufsize, bufsize)
+	if n := requestLimits.args.Get(); n != 0 {
+		s.Conn.Reader.MaxArrayLen = n
+	}
+	if n := requestLimits.bulk.Get(); n != 0 {
+		s.Conn.Reader.MaxBulkBytesLen = n
+	}
 	s.Conn.ReaderTimeout = time.Second * time.Duration(timeout)
 	s.Conn.WriterTimeout = time.Second * 30
 	log.Infof("session [%p] create: %s", s, s)
+	sampleChurn()
+	sessions.alive.Incr()
+	sessions.total.Incr()
+	s.wait = clientWaits.add(s.remote)
+	s.throttle = clientThrottles.add(s.remote)
 	return s
 }
 
 func (s *Session) Close() error {
 	s.failed.Set(true)
-	s.closed.Set(true)
+	if s.closed.CompareAndSwap(false, true) {
+		sessions.alive.Decr()
+		sessions.closed.Incr()
+		clientWaits.remove(s.remote)
+		clientThrottles.remove(s.remote)
+		s.affinity.close()
+	}
 	return s.Conn.Close()
 }
 
@@ -84,7 +165,8 @@ func (s *Session) Serve(d Dispatcher, maxPipeline int) {
 	go func() {
 		defer func() {
 			s.Close()
-			for _ = range tasks {
+			for r := range tasks {
+				s.releaseOutput(r.output)
 			}
 		}()
 		if err := s.loopWriter(tasks); err != nil {
@@ -96,6 +178,8 @@ func (s *Session) Serve(d Dispatcher, maxPipeline int) {
 	if err := s.loopReader(tasks, d); err != nil {
 		errlist.PushBack(err)
 	}
+	s.closeMonitor()
+	s.closePubSub()
 }
 
 func (s *Session) loopReader(tasks chan<- *Request, d Dispatcher) error {
@@ -105,10 +189,36 @@ func (s *Session) loopReader(tasks chan<- *Request, d Dispatcher) error {
 	for !s.quit {
 		resp, err := s.Reader.Decode()
 		if err != nil {
+			if redis.IsProtocolError(err) {
+				s.handleProtocolError(tasks, err)
+			}
 			return err
 		}
+		if resp.IsArray() && len(resp.Array) == 0 {
+			continue
+		}
+		if s.monitor != nil {
+			if opstr, _ := getOpStr(resp); opstr == "QUIT" {
+				return nil
+			}
+			continue
+		}
+		if s.pubsub != nil {
+			opstr, err := getOpStr(resp)
+			if err != nil {
+				return err
+			}
+			if err := s.handlePubSubCommand(opstr, resp, d); err != nil {
+				return err
+			}
+			continue
+		}
+		waitReplyBudget()
 		r, err := s.handleRequest(resp, d)
 		if err != nil {
+			if r != nil {
+				log.Warnf("session [%p] request-%d dispatch failed: cmd = %s, error = %s", s, r.Id, r.OpStr, err)
+			}
 			return err
 		} else {
 			tasks <- r
@@ -124,13 +234,33 @@ func (s *Session) loopWriter(tasks <-chan *Request) error {
 		MaxInterval: 300,
 	}
 	for r := range tasks {
+		if r.pubsub != nil {
+			for resp := range r.pubsub {
+				if err := p.Encode(resp, len(r.pubsub) == 0); err != nil {
+					return err
+				}
+			}
+			s.releaseOutput(r.output)
+			continue
+		}
 		resp, err := s.handleResponse(r)
 		if err != nil {
+			s.releaseOutput(r.output)
 			return err
 		}
-		if err := p.Encode(resp, len(tasks) == 0); err != nil {
+		err = p.Encode(resp, len(tasks) == 0)
+		s.releaseOutput(r.output)
+		if err != nil {
 			return err
 		}
+		if r.stream != nil {
+			for resp := range r.stream {
+				if err := p.Encode(resp, true); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
 	}
 	return nil
 }
@@ -138,6 +268,24 @@ func (s *Session) loopWriter(tasks <-chan *Request) error {
 var ErrRespIsRequired = errors.New("resp is required")
 
 func (s *Session) handleResponse(r *Request) (*redis.Resp, error) {
+	resp, err := s.waitResponse(r)
+	if err != nil {
+		log.Warnf("session [%p] request-%d failed: cmd = %s, error = %s", s, r.Id, r.OpStr, err)
+		return nil, err
+	}
+	if r.Resp == nil {
+		// a reply without request, see handleProtocolError
+		return resp, nil
+	}
+	usecs := microseconds() - r.Start
+	if isSlowRequest(usecs) {
+		pushSlowLog(r, usecs)
+	}
+	incrOpStats(r.OpStr, usecs)
+	return resp, nil
+}
+
+func (s *Session) waitResponse(r *Request) (*redis.Resp, error) {
 	r.Wait.Wait()
 	if r.Coalesce != nil {
 		if err := r.Coalesce(); err != nil {
@@ -151,7 +299,6 @@ func (s *Session) handleResponse(r *Request) (*redis.Resp, error) {
 	if resp == nil {
 		return nil, ErrRespIsRequired
 	}
-	incrOpStats(r.OpStr, microseconds()-r.Start)
 	return resp, nil
 }
 
@@ -169,11 +316,18 @@ func (s *Session) handleRequest(resp *redis.Resp, d Dispatcher) (*Request, error
 	s.Ops++
 
 	r := &Request{
-		OpStr:  opstr,
-		Start:  usnow,
-		Resp:   resp,
-		Wait:   &sync.WaitGroup{},
-		Failed: &s.failed,
+		Id:       nextRequestId(),
+		OpStr:    opstr,
+		Start:    usnow,
+		Resp:     resp,
+		Wait:     &sync.WaitGroup{},
+		Failed:   &s.failed,
+		output:   s.newOutputBytes(),
+		writes:   &s.writes,
+		cursors:  &s.cursors,
+		affinity: &s.affinity,
+		client:   s.remote,
+		wait:     s.wait,
 	}
 
 	if opstr == "QUIT" {
@@ -191,11 +345,32 @@ func (s *Session) handleRequest(resp *redis.Resp, d Dispatcher) (*Request, error
 		s.authorized = true
 	}
 
+	if s.throttle != nil {
+		if err := s.throttle.take(); err != nil {
+			r.Response.Resp = redis.NewError([]byte("ERR " + err.Error()))
+			return r, nil
+		}
+	}
+
+	if opstr == "ASKING" {
+		return s.handleAsking(r)
+	}
+
 	switch opstr {
 	case "SELECT":
 		return s.handleSelect(r)
 	case "PING":
 		return s.handlePing(r)
+	case "INFO":
+		return s.handleInfo(r, d)
+	case "MONITOR":
+		return s.handleMonitor(r, d)
+	case "PROXY":
+		return s.handleProxy(r, d)
+	case "CLIENT":
+		return s.handleClient(r)
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		return s.handlePubSub(r, d)
 	case "MGET":
 		return s.handleRequestMGet(r, d)
 	case "MSET":
@@ -203,9 +378,61 @@ func (s *Session) handleRequest(resp *redis.Resp, d Dispatcher) (*Request, error
 	case "DEL":
 		return s.handleRequestMDel(r, d)
 	}
-	return r, d.Dispatch(r)
+	n := MaxSlotNum
+	if x, ok := d.(slotsDispatcher); ok {
+		n = x.slotNum()
+	}
+	if isCrossSlot(r.Resp, opstr, n) {
+		r.Response.Resp = redis.NewError([]byte(crossSlotError(r.Resp, opstr, n)))
+		return r, nil
+	}
+	return replyRetryable(r, d.Dispatch(r))
 }
 
+// replyRetryable replies the dispatch error to the client if it's retryable,
+// see retryableError. The sub-requests dispatched before it are still waited
+// for.
+func replyRetryable(r *Request, err error) (*Request, error) {
+	if err := retryableError(err); err != nil {
+		r.Response.Resp = redis.NewError([]byte(err.Error()))
+		return r, nil
+	}
+	return r, err
+}
+
+// retryableError returns the cause of the dispatch error if it should be
+// replied to the client as is, instead of closing the session.
+func retryableError(err error) error {
+	if e, ok := err.(*DispatchError); ok {
+		err = e.Cause
+	}
+	switch err {
+	case ErrTryAgainLater, ErrSlotNoDestination, ErrSlotUnavailable, ErrBackendOOM, ErrRouterPaused, ErrTooManyBackendConns:
+		return err
+	}
+	return nil
+}
+
+// handleProtocolError replies the error like redis does, the session is
+// closed once it's written as the rest of the input can't be parsed.
+func (s *Session) handleProtocolError(tasks chan<- *Request, err error) {
+	sessions.protoerrs.Incr()
+	log.Warnf("session [%p] protocol error: %s", s, err)
+	r := &Request{
+		Id:     nextRequestId(),
+		Start:  microseconds(),
+		Wait:   &sync.WaitGroup{},
+		Failed: &s.failed,
+	}
+	r.Response.Resp = redis.NewError([]byte("ERR " + err.Error()))
+	tasks <- r
+}
+
+// handleQuit replies OK and stops reading, the session is closed once the
+// replies of the requests before QUIT are written. Nothing of a session is
+// left behind then: its subscriptions, monitor, and backend conns of its own,
+// see SetClientAffinity, are released as it's closed. There is never a
+// transaction to discard, MULTI is not allowed and closes the session.
 func (s *Session) handleQuit(r *Request) (*Request, error) {
 	s.quit = true
 	r.Response.Resp = redis.NewString([]byte("OK"))
@@ -232,6 +459,19 @@ func (s *Session) handleAuth(r *Request) (*Request, error) {
 	}
 }
 
+// ASKING is sent by cluster clients before retrying a command on the
+// migration destination. The proxy always forwards keyed commands to the
+// destination slot.backend, after migrating the key from migrate.from, so
+// there is nothing to remember, it's only acknowledged.
+func (s *Session) handleAsking(r *Request) (*Request, error) {
+	if len(r.Resp.Array) != 1 {
+		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'ASKING' command"))
+		return r, nil
+	}
+	r.Response.Resp = redis.NewString([]byte("OK"))
+	return r, nil
+}
+
 func (s *Session) handleSelect(r *Request) (*Request, error) {
 	if len(r.Resp.Array) != 2 {
 		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'SELECT' command"))
@@ -249,6 +489,32 @@ func (s *Session) handleSelect(r *Request) (*Request, error) {
 	}
 }
 
+type slotsDispatcher interface {
+	slotNum() int
+}
+
+type infoDispatcher interface {
+	Info(section string, timeout time.Duration) []byte
+}
+
+func (s *Session) handleInfo(r *Request, d Dispatcher) (*Request, error) {
+	x, ok := d.(infoDispatcher)
+	if !ok {
+		return r, d.Dispatch(r)
+	}
+	var section string
+	switch len(r.Resp.Array) {
+	case 1:
+	case 2:
+		section = string(r.Resp.Array[1].Value)
+	default:
+		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'INFO' command"))
+		return r, nil
+	}
+	r.Response.Resp = redis.NewBulkBytes(x.Info(section, InfoBackendTimeout))
+	return r, nil
+}
+
 func (s *Session) handlePing(r *Request) (*Request, error) {
 	if len(r.Resp.Array) != 1 {
 		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'PING' command"))
@@ -261,27 +527,24 @@ func (s *Session) handlePing(r *Request) (*Request, error) {
 func (s *Session) handleRequestMGet(r *Request, d Dispatcher) (*Request, error) {
 	nkeys := len(r.Resp.Array) - 1
 	if nkeys <= 1 {
-		return r, d.Dispatch(r)
+		return replyRetryable(r, d.Dispatch(r))
 	}
 	var sub = make([]*Request, nkeys)
 	for i := 0; i < len(sub); i++ {
-		sub[i] = &Request{
-			OpStr: r.OpStr,
-			Start: r.Start,
-			Resp: redis.NewArray([]*redis.Resp{
-				r.Resp.Array[0],
-				r.Resp.Array[i+1],
-			}),
-			Wait:   r.Wait,
-			Failed: r.Failed,
-		}
+		sub[i] = r.subRequest(redis.NewArray([]*redis.Resp{
+			r.Resp.Array[0],
+			r.Resp.Array[i+1],
+		}))
 		if err := d.Dispatch(sub[i]); err != nil {
-			return nil, err
+			return replyRetryable(r, err)
 		}
 	}
 	r.Coalesce = func() error {
 		var array = make([]*redis.Resp, len(sub))
 		for i, x := range sub {
+			if err := coalesceSub(x); err != nil {
+				return err
+			}
 			if err := x.Response.Err; err != nil {
 				return err
 			}
@@ -303,7 +566,7 @@ func (s *Session) handleRequestMGet(r *Request, d Dispatcher) (*Request, error)
 func (s *Session) handleRequestMSet(r *Request, d Dispatcher) (*Request, error) {
 	nblks := len(r.Resp.Array) - 1
 	if nblks <= 2 {
-		return r, d.Dispatch(r)
+		return replyRetryable(r, d.Dispatch(r))
 	}
 	if nblks%2 != 0 {
 		r.Response.Resp = redis.NewError([]byte("ERR wrong number of arguments for 'MSET' command"))
@@ -311,23 +574,20 @@ func (s *Session) handleRequestMSet(r *Request, d Dispatcher) (*Request, error)
 	}
 	var sub = make([]*Request, nblks/2)
 	for i := 0; i < len(sub); i++ {
-		sub[i] = &Request{
-			OpStr: r.OpStr,
-			Start: r.Start,
-			Resp: redis.NewArray([]*redis.Resp{
-				r.Resp.Array[0],
-				r.Resp.Array[i*2+1],
-				r.Resp.Array[i*2+2],
-			}),
-			Wait:   r.Wait,
-			Failed: r.Failed,
-		}
+		sub[i] = r.subRequest(redis.NewArray([]*redis.Resp{
+			r.Resp.Array[0],
+			r.Resp.Array[i*2+1],
+			r.Resp.Array[i*2+2],
+		}))
 		if err := d.Dispatch(sub[i]); err != nil {
-			return nil, err
+			return replyRetryable(r, err)
 		}
 	}
 	r.Coalesce = func() error {
 		for _, x := range sub {
+			if err := coalesceSub(x); err != nil {
+				return err
+			}
 			if err := x.Response.Err; err != nil {
 				return err
 			}
@@ -348,27 +608,24 @@ func (s *Session) handleRequestMSet(r *Request, d Dispatcher) (*Request, error)
 func (s *Session) handleRequestMDel(r *Request, d Dispatcher) (*Request, error) {
 	nkeys := len(r.Resp.Array) - 1
 	if nkeys <= 1 {
-		return r, d.Dispatch(r)
+		return replyRetryable(r, d.Dispatch(r))
 	}
 	var sub = make([]*Request, nkeys)
 	for i := 0; i < len(sub); i++ {
-		sub[i] = &Request{
-			OpStr: r.OpStr,
-			Start: r.Start,
-			Resp: redis.NewArray([]*redis.Resp{
-				r.Resp.Array[0],
-				r.Resp.Array[i+1],
-			}),
-			Wait:   r.Wait,
-			Failed: r.Failed,
-		}
+		sub[i] = r.subRequest(redis.NewArray([]*redis.Resp{
+			r.Resp.Array[0],
+			r.Resp.Array[i+1],
+		}))
 		if err := d.Dispatch(sub[i]); err != nil {
-			return nil, err
+			return replyRetryable(r, err)
 		}
 	}
 	r.Coalesce = func() error {
 		var n int
 		for _, x := range sub {
+			if err := coalesceSub(x); err != nil {
+				return err
+			}
 			if err := x.Response.Err; err != nil {
 				return err
 			}
@@ -389,6 +646,15 @@ func (s *Session) handleRequestMDel(r *Request, d Dispatcher) (*Request, error)
 	return r, nil
 }
 
+// coalesceSub completes a sub-request of MGET, MSET or DEL once it's done,
+// as waitResponse does for a request, e.g. retries it on LOADING.
+func coalesceSub(x *Request) error {
+	if x.Coalesce != nil {
+		return x.Coalesce()
+	}
+	return nil
+}
+
 func microseconds() int64 {
 	return time.Now().UnixNano() / int64(time.Microsecond)
 }
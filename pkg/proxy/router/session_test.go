@@ -0,0 +1,1067 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/assert"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+func TestSlowLogRequestId(t *testing.T) {
+	SetSlowLogThreshold(1000 * 10)
+	defer SetSlowLogThreshold(0)
+	defer ResetSlowLogs()
+
+	s := &Session{}
+
+	fast := newRequest("GET", "foo")
+	fast.Id = nextRequestId()
+	fast.Start = microseconds()
+	fast.Response.Resp = redis.NewString([]byte("OK"))
+	_, err := s.handleResponse(fast)
+	assert.MustNoError(err)
+
+	slow := newRequest("GET", "foo")
+	slow.Id = nextRequestId()
+	slow.Start = microseconds() - 1000*50
+	slow.Response.Resp = redis.NewString([]byte("OK"))
+	_, err = s.handleResponse(slow)
+	assert.MustNoError(err)
+
+	logs := GetSlowLogs()
+	assert.Must(len(logs) == 1)
+	assert.Must(logs[0].Id == slow.Id && logs[0].OpStr == "GET")
+	assert.Must(logs[0].USecs >= 1000*50)
+}
+
+func TestAskingDuringMigration(t *testing.T) {
+	src := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		if string(resp.Array[0].Value) == "SLOTSMGRTTAGONE" {
+			return redis.NewInt([]byte("1"))
+		}
+		return redis.NewError([]byte("ERR served by migrate.from"))
+	})
+	defer src.Close()
+	dst := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("dst"))
+	})
+	defer dst.Close()
+
+	d := New()
+	defer d.Close()
+	assert.MustNoError(d.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), dst.Addr, src.Addr, false))
+
+	s := &Session{}
+	r, err := s.handleRequest(newRequest("ASKING").Resp, d)
+	assert.MustNoError(err)
+	assert.Must(r.Response.Resp.IsString())
+
+	r, err = s.handleRequest(newRequest("GET", "foo").Resp, d)
+	assert.MustNoError(err)
+	resp, err := s.handleResponse(r)
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "dst")
+}
+
+func TestClientOutputBufferLimit(t *testing.T) {
+	value := make([]byte, 1024*64)
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes(value)
+	})
+	defer b.Close()
+
+	d := New()
+	defer d.Close()
+	assert.MustNoError(d.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), b.Addr, "", false))
+
+	SetClientOutputBufferLimit(1024*1024, 0, 0)
+	defer SetClientOutputBufferLimit(0, 0, 0)
+	kills := ClientOutputBufferKills()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.MustNoError(err)
+	defer c.Close()
+	x, err := l.Accept()
+	assert.MustNoError(err)
+
+	s := NewSession(x, "")
+	done := make(chan struct{})
+	go func() {
+		s.Serve(d, 1024)
+		close(done)
+	}()
+
+	// never read the replies
+	go func() {
+		w := redis.NewConn(c).Writer
+		for i := 0; i < 1024; i++ {
+			if err := w.Encode(newRequest("GET", "foo").Resp, true); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("session is not closed")
+	}
+	assert.Must(s.IsClosed())
+	assert.Must(ClientOutputBufferKills() == kills+1)
+}
+
+func TestQuit(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	d := New()
+	defer d.Close()
+	assert.MustNoError(d.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), b.Addr, "", false))
+	d.SetClientAffinity(true)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.MustNoError(err)
+	defer c.Close()
+	x, err := l.Accept()
+	assert.MustNoError(err)
+
+	s := NewSession(x, "")
+	done := make(chan struct{})
+	go func() {
+		s.Serve(d, 1024)
+		close(done)
+	}()
+
+	conn := redis.NewConn(c)
+	for _, args := range [][]string{{"SET", "foo", "bar"}, {"QUIT"}, {"GET", "foo"}} {
+		assert.MustNoError(conn.Writer.Encode(newRequest(args...).Resp, true))
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := conn.Reader.Decode()
+		assert.MustNoError(err)
+		assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	}
+	_, err = conn.Reader.Decode()
+	assert.Must(err != nil)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("session is not closed")
+	}
+	for i := 0; ClientAffinityConns() != 0; i++ {
+		assert.Must(i < 100)
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(s.IsClosed())
+}
+
+func TestSlowClient(t *testing.T) {
+	value := make([]byte, 1024*64)
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes(value)
+	})
+	defer b.Close()
+
+	d := New()
+	defer d.Close()
+	assert.MustNoError(d.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), b.Addr, "", false))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	connect := func() net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		assert.MustNoError(err)
+		x, err := l.Accept()
+		assert.MustNoError(err)
+		go NewSession(x, "").Serve(d, 16)
+		return c
+	}
+
+	// never read the replies
+	slow := connect()
+	defer slow.Close()
+	go func() {
+		w := redis.NewConn(slow).Writer
+		for i := 0; i < 1024; i++ {
+			if err := w.Encode(newRequest("GET", "foo").Resp, true); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	fast := connect()
+	defer fast.Close()
+	c := redis.NewConn(fast)
+	start := time.Now()
+	for i := 0; i < 64; i++ {
+		assert.MustNoError(c.Writer.Encode(newRequest("GET", "foo").Resp, true))
+		resp, err := c.Reader.Decode()
+		assert.MustNoError(err)
+		assert.Must(len(resp.Value) == len(value))
+	}
+	assert.Must(time.Since(start) < time.Second*2)
+}
+
+func TestReplyBufferBudget(t *testing.T) {
+	value := make([]byte, 1024*64)
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes(value)
+	})
+	defer b.Close()
+
+	d := New()
+	defer d.Close()
+	assert.MustNoError(d.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), b.Addr, "", false))
+
+	SetReplyBufferBudget(1024 * 100)
+	defer SetReplyBufferBudget(0)
+
+	s := &Session{}
+	var rs []*Request
+	for i := 0; i < 2; i++ {
+		r, err := s.handleRequest(newRequest("GET", "foo").Resp, d)
+		assert.MustNoError(err)
+		_, err = s.handleResponse(r)
+		assert.MustNoError(err)
+		rs = append(rs, r)
+	}
+	assert.Must(ReplyBufferUsage() > 1024*100)
+
+	resumed := make(chan struct{})
+	go func() {
+		waitReplyBudget()
+		close(resumed)
+	}()
+	select {
+	case <-resumed:
+		t.Fatal("reply buffer budget is used up")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	s.releaseOutput(rs[0].output)
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("not resumed")
+	}
+	s.releaseOutput(rs[1].output)
+	assert.Must(ReplyBufferUsage() == 0)
+}
+
+func TestInfo(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("# Server\r\nredis_version:2.8.13\r\n\r\n# Memory\r\nused_memory:1024\r\n"))
+	})
+	defer b.Close()
+
+	d := New()
+	defer d.Close()
+	assert.MustNoError(d.FillSlot(0, b.Addr, "", false))
+	assert.MustNoError(d.FillSlot(1, "127.0.0.1:0", "", false))
+
+	parse := func(args ...string) map[string]map[string]string {
+		s := &Session{}
+		r, err := s.handleRequest(newRequest(args...).Resp, d)
+		assert.MustNoError(err)
+		resp, err := s.handleResponse(r)
+		assert.MustNoError(err)
+		assert.Must(resp.IsBulkBytes())
+
+		var sections = make(map[string]map[string]string)
+		var section map[string]string
+		for _, line := range strings.Split(string(resp.Value), "\r\n") {
+			switch {
+			case line == "":
+			case strings.HasPrefix(line, "# "):
+				section = make(map[string]string)
+				sections[line[2:]] = section
+			default:
+				kv := strings.SplitN(line, ":", 2)
+				assert.Must(len(kv) == 2 && section != nil)
+				section[kv[0]] = kv[1]
+			}
+		}
+		return sections
+	}
+
+	m := parse("INFO")
+	for _, name := range []string{"Server", "Clients", "Stats", "Slots"} {
+		_, ok := m[name]
+		assert.Must(ok)
+	}
+	_, ok := m["Backends"]
+	assert.Must(!ok)
+	assert.Must(m["Slots"]["slots_total"] == strconv.Itoa(MaxSlotNum))
+	assert.Must(m["Slots"]["slots_assigned"] == "2")
+
+	m = parse("INFO", "backends")
+	assert.Must(len(m) == 1 && len(m["Backends"]) == 2)
+	var ok1, ok2 bool
+	for _, v := range m["Backends"] {
+		if strings.HasPrefix(v, "addr="+b.Addr+",slots=1,status=ok") && strings.Contains(v, "used_memory=1024") {
+			ok1 = true
+		}
+		if strings.HasPrefix(v, "addr=127.0.0.1:0,slots=1,status=error") {
+			ok2 = true
+		}
+	}
+	assert.Must(ok1 && ok2)
+}
+
+func TestMigrateWithoutDestination(t *testing.T) {
+	src := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("src"))
+	})
+	defer src.Close()
+
+	d := New()
+	defer d.Close()
+	assert.MustNoError(d.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), "", src.Addr, false))
+
+	s := &Session{}
+	r, err := s.handleRequest(newRequest("GET", "foo").Resp, d)
+	assert.MustNoError(err)
+	resp, err := s.handleResponse(r)
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "src")
+
+	r, err = s.handleRequest(newRequest("SET", "foo", "bar").Resp, d)
+	assert.MustNoError(err)
+	resp, err = s.handleResponse(r)
+	assert.MustNoError(err)
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "TRYAGAIN"))
+
+	// so do the commands split into sub-requests, the session is kept
+	for _, args := range [][]string{{"MSET", "foo", "1", "bar", "2"}, {"DEL", "foo", "bar"}} {
+		r, err = s.handleRequest(newRequest(args...).Resp, d)
+		assert.MustNoError(err)
+		resp, err = s.handleResponse(r)
+		assert.MustNoError(err)
+		assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "TRYAGAIN"))
+	}
+}
+
+func TestInlineRequest(t *testing.T) {
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		if len(resp.Array) != 2 || string(resp.Array[0].Value) != "GET" || string(resp.Array[1].Value) != "foo" {
+			return redis.NewError([]byte("ERR bad request"))
+		}
+		return redis.NewBulkBytes([]byte("bar"))
+	})
+	defer b.Close()
+
+	d := New()
+	defer d.Close()
+	assert.MustNoError(d.FillSlot(hashSlot([]byte("foo"), MaxSlotNum), b.Addr, "", false))
+
+	resp, err := redis.DecodeFromBytes([]byte("GET foo\r\n"))
+	assert.MustNoError(err)
+
+	s := &Session{}
+	r, err := s.handleRequest(resp, d)
+	assert.MustNoError(err)
+	resp, err = s.handleResponse(r)
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "bar")
+}
+
+func TestHedgingReadYourWrites(t *testing.T) {
+	slow := make(chan struct{})
+	primary := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		<-slow
+		return redis.NewBulkBytes([]byte("primary"))
+	})
+	defer primary.Close()
+	replica := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewBulkBytes([]byte("replica"))
+	})
+	defer replica.Close()
+
+	d := New()
+	defer d.Close()
+	defer close(slow)
+	i := hashSlot([]byte("foo"), MaxSlotNum)
+	assert.MustNoError(d.FillSlot(i, primary.Addr, "", false))
+	assert.MustNoError(d.SetSlotReplica(i, replica.Addr))
+	d.SetHedging(time.Millisecond*20, []string{"GET"})
+	d.SetHedgingReadYourWrites(time.Second)
+
+	s := &Session{}
+	w, err := s.handleRequest(newRequest("SET", "foo", "bar").Resp, d)
+	assert.MustNoError(err)
+	r, err := s.handleRequest(newRequest("GET", "foo").Resp, d)
+	assert.MustNoError(err)
+
+	time.Sleep(time.Millisecond * 50)
+	slow <- struct{}{}
+	slow <- struct{}{}
+	for _, x := range []*Request{w, r} {
+		resp, err := s.handleResponse(x)
+		assert.MustNoError(err)
+		assert.Must(string(resp.Value) == "primary")
+	}
+	fired, _ := d.HedgeStats()
+	assert.Must(fired == 0)
+}
+
+func TestCrossSlotRequest(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	s := &Session{}
+	r, err := s.handleRequest(newRequest("COPY", "src", "dst").Resp, d)
+	assert.MustNoError(err)
+	resp, err := s.handleResponse(r)
+	assert.MustNoError(err)
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "CROSSSLOT"))
+
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		return redis.NewInt([]byte("1"))
+	})
+	defer b.Close()
+	assert.MustNoError(d.ReshardSlots(1, []SlotConfig{{Addr: b.Addr}}))
+	r, err = s.handleRequest(newRequest("COPY", "src", "dst").Resp, d)
+	assert.MustNoError(err)
+	resp, err = s.handleResponse(r)
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "1")
+}
+
+func TestMonitor(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	closed := make(chan struct{})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := redis.NewConn(c)
+				defer conn.Close()
+				resp, err := conn.Reader.Decode()
+				if err != nil || string(resp.Array[0].Value) != "MONITOR" {
+					return
+				}
+				conn.Writer.Encode(redis.NewString([]byte("OK")), true)
+				for i := 0; i < 2; i++ {
+					line := `1339518083.107412 [0 127.0.0.1:60866] "GET" "key` + strconv.Itoa(i) + `"`
+					conn.Writer.Encode(redis.NewString([]byte(line)), true)
+				}
+				conn.Reader.Decode()
+				close(closed)
+			}()
+		}
+	}()
+
+	d := New()
+	defer d.Close()
+	assert.MustNoError(d.FillSlot(0, l.Addr().String(), "", false))
+	d.SetAdminAuth("secret")
+
+	x, y := net.Pipe()
+	go NewSession(y, "").Serve(d, 16)
+	c := redis.NewConn(x)
+
+	send := func(args ...string) {
+		assert.MustNoError(c.Writer.Encode(newRequest(args...).Resp, true))
+	}
+	send("MONITOR", l.Addr().String())
+	resp, err := c.Reader.Decode()
+	assert.MustNoError(err)
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "NOPERM"))
+
+	send("PROXY", "ADMIN", "secret")
+	resp, err = c.Reader.Decode()
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "OK")
+
+	send("MONITOR")
+	resp, err = c.Reader.Decode()
+	assert.MustNoError(err)
+	assert.Must(resp.IsError())
+
+	send("MONITOR", "127.0.0.1:1")
+	resp, err = c.Reader.Decode()
+	assert.MustNoError(err)
+	assert.Must(resp.IsError() && strings.Contains(string(resp.Value), ErrUnknownBackend.Error()))
+
+	send("MONITOR", l.Addr().String())
+	resp, err = c.Reader.Decode()
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "OK")
+	for i := 0; i < 2; i++ {
+		resp, err = c.Reader.Decode()
+		assert.MustNoError(err)
+		assert.Must(resp.IsString() && strings.HasSuffix(string(resp.Value), `"GET" "key`+strconv.Itoa(i)+`"`))
+	}
+
+	c.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		assert.Must(false)
+	}
+}
+
+func TestProxySlot(t *testing.T) {
+	d := New()
+	defer d.Close()
+	i := hashSlot([]byte("somekey"), MaxSlotNum)
+	assert.MustNoError(d.FillSlot(i, "127.0.0.1:6379", "", false))
+
+	x, y := net.Pipe()
+	go NewSession(y, "foobar").Serve(d, 16)
+	c := redis.NewConn(x)
+	defer c.Close()
+
+	send := func(args ...string) *redis.Resp {
+		assert.MustNoError(c.Writer.Encode(newRequest(args...).Resp, true))
+		resp, err := c.Reader.Decode()
+		assert.MustNoError(err)
+		return resp
+	}
+	resp := send("PROXY", "SLOT", "somekey")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "NOAUTH"))
+	assert.Must(string(send("AUTH", "foobar").Value) == "OK")
+
+	resp = send("PROXY", "SLOT", "somekey")
+	assert.Must(resp.IsArray() && len(resp.Array) == 10)
+	assert.Must(string(resp.Array[1].Value) == strconv.Itoa(i))
+	assert.Must(string(resp.Array[3].Value) == "127.0.0.1:6379")
+	assert.Must(string(resp.Array[7].Value) == "0" && len(resp.Array[9].Value) == 0)
+
+	resp = send("PROXY", "ROUTING")
+	assert.Must(resp.IsArray() && len(resp.Array) == 10)
+	assert.Must(string(resp.Array[1].Value) == "crc32-ieee")
+	assert.Must(string(resp.Array[3].Value) == strconv.Itoa(MaxSlotNum))
+
+	assert.Must(send("PROXY", "FOO").IsError())
+}
+
+func TestProxyPing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	dead := l.Addr().String()
+	l.Close()
+
+	d := New()
+	defer d.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(d.FillSlot(i, dead, "", false))
+	}
+	r := newRequest("GET", "foo")
+	assert.MustNoError(d.Dispatch(r))
+	r.Wait.Wait()
+	assert.Must(r.Response.Err != nil)
+
+	x, y := net.Pipe()
+	go NewSession(y, "").Serve(d, 16)
+	c := redis.NewConn(x)
+	defer c.Close()
+
+	send := func(args ...string) *redis.Resp {
+		assert.MustNoError(c.Writer.Encode(newRequest(args...).Resp, true))
+		resp, err := c.Reader.Decode()
+		assert.MustNoError(err)
+		return resp
+	}
+	resp := send("PROXY", "PING")
+	assert.Must(resp.IsString() && string(resp.Value) == "READY")
+	assert.Must(send("PROXY", "PING", "foo").IsError())
+
+	d.Drain()
+	resp = send("PROXY", "PING")
+	assert.Must(resp.IsString() && string(resp.Value) == "DRAINING")
+}
+
+func TestClientNoEvict(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	x, y := net.Pipe()
+	s := NewSession(y, "")
+	go s.Serve(d, 16)
+	c := redis.NewConn(x)
+	defer c.Close()
+
+	send := func(args ...string) *redis.Resp {
+		assert.MustNoError(c.Writer.Encode(newRequest(args...).Resp, true))
+		resp, err := c.Reader.Decode()
+		assert.MustNoError(err)
+		return resp
+	}
+	assert.Must(string(send("CLIENT", "NO-EVICT", "ON").Value) == "OK")
+	assert.Must(s.noevict.Get() && !s.notouch.Get())
+	assert.Must(string(send("CLIENT", "NO-TOUCH", "on").Value) == "OK")
+	assert.Must(s.notouch.Get())
+	assert.Must(string(send("CLIENT", "NO-EVICT", "OFF").Value) == "OK")
+	assert.Must(!s.noevict.Get())
+	assert.Must(send("CLIENT", "NO-EVICT", "MAYBE").IsError())
+
+	assert.Must(string(send("CLIENT", "SETNAME", "app").Value) == "OK")
+	assert.Must(string(send("CLIENT", "GETNAME").Value) == "app")
+	assert.Must(send("CLIENT", "KILL", "127.0.0.1:1").IsError())
+}
+
+func TestProxyBackendFlushDB(t *testing.T) {
+	var mu sync.Mutex
+	var ops = make(map[string][]string)
+	newBackend := func(name string) *fakeBackend {
+		return newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+			mu.Lock()
+			defer mu.Unlock()
+			ops[name] = append(ops[name], string(resp.Array[0].Value))
+			return redis.NewString([]byte("OK"))
+		})
+	}
+	b1, b2 := newBackend("b1"), newBackend("b2")
+	defer b1.Close()
+	defer b2.Close()
+
+	d := New()
+	defer d.Close()
+	d.SetAdminAuth("secret")
+	assert.MustNoError(d.FillSlot(0, b1.Addr, "", false))
+	assert.MustNoError(d.FillSlot(1, b2.Addr, "", false))
+
+	x, y := net.Pipe()
+	go NewSession(y, "").Serve(d, 16)
+	c := redis.NewConn(x)
+	defer c.Close()
+
+	send := func(args ...string) *redis.Resp {
+		assert.MustNoError(c.Writer.Encode(newRequest(args...).Resp, true))
+		resp, err := c.Reader.Decode()
+		assert.MustNoError(err)
+		return resp
+	}
+	resp := send("PROXY", "BACKEND", b1.Addr, "FLUSHDB", "CONFIRM")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "NOPERM"))
+	assert.Must(send("PROXY", "ADMIN", "foobar").IsError())
+	assert.Must(send("PROXY", "BACKEND", b1.Addr, "FLUSHDB", "CONFIRM").IsError())
+
+	assert.Must(string(send("PROXY", "ADMIN", "secret").Value) == "OK")
+	assert.Must(send("PROXY", "BACKEND", b1.Addr, "FLUSHDB").IsError())
+	assert.Must(send("PROXY", "BACKEND", b1.Addr, "FLUSHALL", "CONFIRM").IsError())
+	assert.Must(send("PROXY", "BACKEND", "127.0.0.1:1", "FLUSHDB", "CONFIRM").IsError())
+	assert.Must(string(send("PROXY", "BACKEND", b1.Addr, "FLUSHDB", "CONFIRM").Value) == "OK")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Must(len(ops["b1"]) == 1 && ops["b1"][0] == "FLUSHDB")
+	assert.Must(len(ops["b2"]) == 0)
+}
+
+func TestProxyAdminToken(t *testing.T) {
+	var flushes atomic2.Int64
+	b := newFakeBackend(func(resp *redis.Resp) *redis.Resp {
+		flushes.Incr()
+		return redis.NewString([]byte("OK"))
+	})
+	defer b.Close()
+
+	d := New()
+	defer d.Close()
+	d.SetAdminAuth("secret")
+	assert.MustNoError(d.FillSlot(0, b.Addr, "", false))
+
+	x, y := net.Pipe()
+	go NewSession(y, "").Serve(d, 16)
+	c := redis.NewConn(x)
+	defer c.Close()
+
+	send := func(args ...string) *redis.Resp {
+		assert.MustNoError(c.Writer.Encode(newRequest(args...).Resp, true))
+		resp, err := c.Reader.Decode()
+		assert.MustNoError(err)
+		return resp
+	}
+	assert.Must(string(send("PROXY", "ADMIN", "secret").Value) == "OK")
+	assert.Must(send("PROXY", "ADMIN", "TOKEN").IsError())
+
+	d.SetAdminTokenTTL(time.Millisecond * 50)
+	refused := func(resp *redis.Resp) bool {
+		return resp.IsError() && strings.HasPrefix(string(resp.Value), "NOPERM")
+	}
+	assert.Must(refused(send("PROXY", "BACKEND", b.Addr, "FLUSHDB", "CONFIRM")))
+	assert.Must(refused(send("PROXY", "BACKEND", b.Addr, "FLUSHDB", "CONFIRM", "foobar")))
+
+	expired := send("PROXY", "ADMIN", "TOKEN")
+	assert.Must(expired.IsBulkBytes() && len(expired.Value) != 0)
+	time.Sleep(time.Millisecond * 100)
+	assert.Must(refused(send("PROXY", "BACKEND", b.Addr, "FLUSHDB", "CONFIRM", string(expired.Value))))
+	assert.Must(flushes.Get() == 0)
+
+	token := string(send("PROXY", "ADMIN", "TOKEN").Value)
+	assert.Must(token != string(expired.Value))
+	assert.Must(string(send("PROXY", "BACKEND", b.Addr, "FLUSHDB", "CONFIRM", token).Value) == "OK")
+	assert.Must(refused(send("PROXY", "BACKEND", b.Addr, "FLUSHDB", "CONFIRM", token)))
+	assert.Must(flushes.Get() == 1)
+}
+
+func TestProtocolError(t *testing.T) {
+	d := New()
+	defer d.Close()
+
+	errs := ProtocolErrors()
+
+	x, y := net.Pipe()
+	s := NewSession(y, "")
+	done := make(chan struct{})
+	go func() {
+		s.Serve(d, 16)
+		close(done)
+	}()
+	c := redis.NewConn(x)
+	defer c.Close()
+
+	go x.Write([]byte("PING\r\n*1\r\n$-5\r\nPING\r\n"))
+	resp, err := c.Reader.Decode()
+	assert.MustNoError(err)
+	assert.Must(string(resp.Value) == "PONG")
+	resp, err = c.Reader.Decode()
+	assert.MustNoError(err)
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR Protocol error: invalid bulk length")
+	_, err = c.Reader.Decode()
+	assert.Must(err != nil)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("session is not closed")
+	}
+	assert.Must(s.IsClosed())
+	assert.Must(ProtocolErrors() == errs+1)
+}
+
+func TestConnRateLimit(t *testing.T) {
+	SetConnRateLimit(5, time.Millisecond*200)
+	defer SetConnRateLimit(0, 0)
+	rejected := RejectedConns()
+
+	d := New()
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if err := AcceptConn(); err != nil {
+				go RejectConn(c, err)
+			} else {
+				go NewSession(c, "").Serve(d, 16)
+			}
+		}
+	}()
+
+	ping := func() error {
+		c, err := net.Dial("tcp", l.Addr().String())
+		assert.MustNoError(err)
+		conn := redis.NewConn(c)
+		defer conn.Close()
+		assert.MustNoError(conn.Writer.Encode(newRequest("PING").Resp, true))
+		resp, err := conn.Reader.Decode()
+		assert.MustNoError(err)
+		if resp.IsError() {
+			return errors.New(string(resp.Value))
+		}
+		return nil
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.MustNoError(ping())
+	}
+	for i := 0; i < 3; i++ {
+		err := ping()
+		assert.Must(err != nil && err.Error() == "ERR "+ErrConnRateLimited.Error())
+	}
+	assert.Must(RejectedConns() == rejected+3)
+
+	time.Sleep(time.Millisecond * 200)
+	assert.MustNoError(ping())
+}
+
+func newFakePubSubBackend() *fakeBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := redis.NewConn(c)
+				defer conn.Close()
+				var channels = make(map[string]bool)
+				reply := func(args ...string) {
+					var array []*redis.Resp
+					for _, arg := range args[:2] {
+						array = append(array, redis.NewBulkBytes([]byte(arg)))
+					}
+					if args[0] == "message" {
+						array = append(array, redis.NewBulkBytes([]byte(args[2])))
+					} else {
+						array = append(array, redis.NewInt([]byte(args[2])))
+					}
+					conn.Writer.Encode(redis.NewArray(array), true)
+				}
+				for {
+					resp, err := conn.Reader.Decode()
+					if err != nil {
+						return
+					}
+					op, _ := getOpStr(resp)
+					channel := string(resp.Array[1].Value)
+					switch op {
+					case "SUBSCRIBE":
+						channels[channel] = true
+						reply("subscribe", channel, strconv.Itoa(len(channels)))
+						reply("message", channel, "hello "+channel)
+					case "UNSUBSCRIBE":
+						delete(channels, channel)
+						reply("unsubscribe", channel, strconv.Itoa(len(channels)))
+					}
+				}
+			}()
+		}
+	}()
+	return &fakeBackend{Listener: l, Addr: l.Addr().String()}
+}
+
+func TestSubscribeCounts(t *testing.T) {
+	b1, b2 := newFakePubSubBackend(), newFakePubSubBackend()
+	defer b1.Close()
+	defer b2.Close()
+
+	d := New()
+	defer d.Close()
+	for channel, b := range map[string]*fakeBackend{"a": b1, "b": b2, "c": b1} {
+		assert.MustNoError(d.FillSlot(hashSlot([]byte(channel), MaxSlotNum), b.Addr, "", false))
+	}
+
+	x, y := net.Pipe()
+	go NewSession(y, "").Serve(d, 16)
+	c := redis.NewConn(x)
+	defer c.Close()
+
+	send := func(args ...string) {
+		assert.MustNoError(c.Writer.Encode(newRequest(args...).Resp, true))
+	}
+	recv := func() *redis.Resp {
+		resp, err := c.Reader.Decode()
+		assert.MustNoError(err)
+		return resp
+	}
+	isReply := func(resp *redis.Resp, kind, channel string, count int) bool {
+		return resp.IsArray() && len(resp.Array) == 3 &&
+			string(resp.Array[0].Value) == kind && string(resp.Array[1].Value) == channel &&
+			resp.Array[2].IsInt() && string(resp.Array[2].Value) == strconv.Itoa(count)
+	}
+
+	send("SUBSCRIBE", "a", "b", "c")
+	var confirmed = make(map[string]bool)
+	var count int
+	for i := 0; i < 6; i++ {
+		resp := recv()
+		assert.Must(resp.IsArray() && len(resp.Array) == 3)
+		channel := string(resp.Array[1].Value)
+		switch string(resp.Array[0].Value) {
+		case "subscribe":
+			count++
+			assert.Must(isReply(resp, "subscribe", channel, count))
+			confirmed[channel] = true
+		case "message":
+			assert.Must(confirmed[channel] && string(resp.Array[2].Value) == "hello "+channel)
+		default:
+			assert.Must(false)
+		}
+	}
+	assert.Must(count == 3)
+
+	send("GET", "a")
+	assert.Must(recv().IsError())
+	send("PING")
+	resp := recv()
+	assert.Must(resp.IsArray() && string(resp.Array[0].Value) == "pong")
+
+	send("SUBSCRIBE", "a")
+	assert.Must(isReply(recv(), "subscribe", "a", 3))
+	send("UNSUBSCRIBE", "b", "x")
+	assert.Must(isReply(recv(), "unsubscribe", "b", 2))
+	assert.Must(isReply(recv(), "unsubscribe", "x", 2))
+	send("UNSUBSCRIBE")
+	assert.Must(isReply(recv(), "unsubscribe", "a", 1))
+	assert.Must(isReply(recv(), "unsubscribe", "c", 0))
+
+	// back to normal mode
+	send("PING")
+	assert.Must(string(recv().Value) == "PONG")
+}
+
+func TestClientRateLimit(t *testing.T) {
+	SetClientRateLimit(1, 3, 0)
+	defer SetClientRateLimit(0, 0, 0)
+
+	d := New()
+	defer d.Close()
+
+	connect := func() (*Session, func(args ...string) *redis.Resp) {
+		x, y := net.Pipe()
+		s := NewSession(y, "")
+		go s.Serve(d, 16)
+		c := redis.NewConn(x)
+		return s, func(args ...string) *redis.Resp {
+			assert.MustNoError(c.Writer.Encode(newRequest(args...).Resp, true))
+			resp, err := c.Reader.Decode()
+			assert.MustNoError(err)
+			return resp
+		}
+	}
+	abusive, send := connect()
+	defer abusive.Close()
+	for i := 0; i < 3; i++ {
+		assert.Must(string(send("PING").Value) == "PONG")
+	}
+	resp := send("PING")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR "+ErrClientThrottled.Error())
+	assert.Must(abusive.throttle.rejected.Get() == 1)
+
+	polite, send := connect()
+	defer polite.Close()
+	for i := 0; i < 3; i++ {
+		assert.Must(string(send("PING").Value) == "PONG")
+	}
+	assert.Must(polite.throttle.rejected.Get() == 0)
+
+	SetClientRateLimit(100, 1, time.Second)
+	for i := 0; i < 3; i++ {
+		assert.Must(string(send("PING").Value) == "PONG")
+	}
+	assert.Must(polite.throttle.delayed.Get() != 0 && polite.throttle.rejected.Get() == 0)
+}
+
+func TestProxyConfigGet(t *testing.T) {
+	d := NewWithAuth("backendpw")
+	defer d.Close()
+	d.SetAdminAuth("secret")
+	d.SetZone("zone1")
+	d.SetBackendTimeout(time.Second*5, time.Second*6)
+
+	x, y := net.Pipe()
+	go NewSession(y, "").Serve(d, 16)
+	c := redis.NewConn(x)
+	defer c.Close()
+
+	send := func(args ...string) map[string]string {
+		assert.MustNoError(c.Writer.Encode(newRequest(args...).Resp, true))
+		resp, err := c.Reader.Decode()
+		assert.MustNoError(err)
+		assert.Must(resp.IsArray() && len(resp.Array)%2 == 0)
+		var m = make(map[string]string)
+		for i := 0; i < len(resp.Array); i += 2 {
+			m[string(resp.Array[i].Value)] = string(resp.Array[i+1].Value)
+		}
+		return m
+	}
+	m := send("PROXY", "CONFIG", "GET")
+	assert.Must(m["password"] == "(redacted)" && m["admin_password"] == "(redacted)")
+	assert.Must(m["requirepass"] == "false")
+	assert.Must(m["zone"] == "zone1" && m["backend_read_timeout"] == "5")
+	assert.Must(m["unavailable_policy"] == "forward" && m["read_coalescing"] == "false")
+	for _, v := range m {
+		assert.Must(!strings.Contains(v, "backendpw") && !strings.Contains(v, "secret"))
+	}
+
+	d.SetReadCoalescing(true)
+	m = send("PROXY", "CONFIG", "GET", "read_*")
+	assert.Must(len(m) == 1 && m["read_coalescing"] == "true")
+}
+
+// pipelineConn is a client conn that has sent the whole pipeline already,
+// each read returns as much of it as fits.
+type pipelineConn struct {
+	net.Conn
+	r     *bytes.Reader
+	reads int
+}
+
+func (c *pipelineConn) Read(b []byte) (int, error) {
+	c.reads++
+	return c.r.Read(b)
+}
+
+func (c *pipelineConn) RemoteAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *pipelineConn) SetReadDeadline(t time.Time) error { return nil }
+func (c *pipelineConn) Close() error                      { return nil }
+
+func benchmarkSessionReadBuffer(b *testing.B, size int) {
+	var buf bytes.Buffer
+	w := redis.NewEncoderSize(&buf, 1024*64)
+	for i := 0; i < 10000; i++ {
+		assert.MustNoError(w.Encode(newRequest("SET", "foo"+strconv.Itoa(i), "bar").Resp, false))
+	}
+	assert.MustNoError(w.Flush())
+	pipeline := buf.Bytes()
+
+	SetSessionReadBuffer(size)
+	defer SetSessionReadBuffer(0)
+	b.ResetTimer()
+	var reads int
+	for i := 0; i < b.N; i++ {
+		c := &pipelineConn{r: bytes.NewReader(pipeline)}
+		s := NewSessionSize(c, "", 1024*32, 1800)
+		for n := 0; n < 10000; n++ {
+			if _, err := s.Conn.Reader.Decode(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		s.Close()
+		reads += c.reads
+	}
+	b.Logf("%.1f reads/op", float64(reads)/float64(b.N))
+}
+
+func BenchmarkSessionReadBuffer4K(b *testing.B) {
+	benchmarkSessionReadBuffer(b, 1024*4)
+}
+
+func BenchmarkSessionReadBuffer32K(b *testing.B) {
+	benchmarkSessionReadBuffer(b, 1024*32)
+}
+
+func BenchmarkSessionReadBuffer256K(b *testing.B) {
+	benchmarkSessionReadBuffer(b, 1024*256)
+}
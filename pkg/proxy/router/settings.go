@@ -0,0 +1,188 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+)
+
+const redacted = "(redacted)"
+
+// Settings returns the settings in effect, named as in the config file and
+// in its units, so the ones changed at runtime are the current ones, not
+// the ones the proxy started with. Passwords are redacted, only whether
+// they are set is told.
+func (s *Router) Settings() map[string]string {
+	var m = make(map[string]string)
+	secret := func(v string) string {
+		if v != "" {
+			return redacted
+		}
+		return ""
+	}
+	ms := func(d time.Duration) string {
+		return strconv.FormatInt(int64(d/time.Millisecond), 10)
+	}
+	secs := func(d time.Duration) string {
+		return strconv.FormatInt(int64(d/time.Second), 10)
+	}
+	itoa := func(n int64) string {
+		return strconv.FormatInt(n, 10)
+	}
+
+	s.mu.Lock()
+	m["password"] = secret(s.auth)
+	m["backend_read_timeout"] = secs(s.timeout.read)
+	m["backend_write_timeout"] = secs(s.timeout.write)
+	m["backend_pool_size"] = strconv.Itoa(s.poolsize)
+	m["backend_tcp_nodelay"] = strconv.FormatBool(s.sockopts.nodelay)
+	m["backend_linger"] = "-1"
+	if s.sockopts.linger >= 0 {
+		m["backend_linger"] = secs(s.sockopts.linger)
+	}
+	m["backend_flush_delay"] = itoa(int64(s.flushDelay / time.Microsecond))
+	s.mu.Unlock()
+
+	s.rwlck.RLock()
+	m["admin_password"] = secret(s.adminAuth)
+	m["key_prefix"] = string(s.prefix)
+	m["zone"] = s.zone
+	m["hedge_delay"] = ms(s.hedging.delay)
+	m["hedge_read_your_writes"] = ms(s.hedging.window)
+	m["command_timeout"] = ms(s.timeouts.def)
+	m["replica_max_lag"] = secs(s.lagging.max)
+	m["unavailable_policy"] = s.unavailable.policy.String()
+	m["unavailable_wait_timeout"] = ms(s.unavailable.timeout)
+	m["unknown_command_policy"] = s.unknown.policy.String()
+	m["unknown_command_backend"] = s.unknown.addr
+	m["fallback_backend"] = s.fallback.addr
+	m["durable_check_cmd"] = ""
+	if s.durable.check != nil {
+		var args []string
+		for _, a := range s.durable.check.Array {
+			args = append(args, string(a.Value))
+		}
+		m["durable_check_cmd"] = strings.Join(args, " ")
+	}
+	m["backend_client_affinity"] = strconv.FormatBool(s.affinity)
+	m["negative_cache_size"], m["negative_cache_ttl"] = "0", "0"
+	if c := s.negcache; c != nil {
+		m["negative_cache_size"], m["negative_cache_ttl"] = strconv.Itoa(c.size), ms(c.ttl)
+	}
+	s.rwlck.RUnlock()
+
+	s.tokens.Lock()
+	m["admin_token_ttl"] = secs(s.tokens.ttl)
+	s.tokens.Unlock()
+
+	m["read_coalescing"] = strconv.FormatBool(s.coalescing.enabled.Get())
+
+	m["backpressure_high_water"] = itoa(s.backpressure.high.Get())
+	m["backpressure_low_water"] = itoa(s.backpressure.low.Get())
+
+	dialer.Lock()
+	m["backend_max_dials"] = strconv.Itoa(dialer.max)
+	m["backend_dial_jitter"] = ms(dialer.jitter)
+	dialer.Unlock()
+
+	churn.limit.Lock()
+	m["conn_rate_limit"] = strconv.Itoa(churn.limit.n)
+	m["conn_rate_window"] = ms(churn.limit.window)
+	churn.limit.Unlock()
+
+	backendTLS.Lock()
+	m["backend_tls"] = strconv.FormatBool(backendTLS.config != nil)
+	m["backend_tls_skip_verify"] = strconv.FormatBool(backendTLS.config != nil && backendTLS.config.InsecureSkipVerify)
+	m["backend_tls_strict"] = strconv.FormatBool(backendTLS.strict)
+	m["backend_tls_min_version"] = formatTLSVersion(backendTLS.minVersion)
+	backendTLS.Unlock()
+
+	backendCompression.Lock()
+	var addrs []string
+	for addr := range backendCompression.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	m["backend_compression"] = strings.Join(addrs, ",")
+	m["backend_compression_threshold"] = strconv.Itoa(backendCompression.threshold)
+	backendCompression.Unlock()
+
+	affinityLimit.Lock()
+	m["backend_client_affinity_max_conns"] = itoa(affinityLimit.max)
+	m["backend_client_affinity_wait"] = ms(affinityLimit.wait)
+	affinityLimit.Unlock()
+
+	m["backend_queue"] = "fifo"
+	if fairQueuing.Get() {
+		m["backend_queue"] = "fair"
+	}
+	m["client_rate_limit"] = itoa(clientRate.rate.Get())
+	m["client_rate_burst"] = itoa(clientRate.burst.Get())
+	m["client_rate_wait"] = ms(time.Duration(clientRate.wait.Get()))
+	m["session_output_hard_limit"] = itoa(outputLimit.hard.Get())
+	m["session_output_soft_limit"] = itoa(outputLimit.soft.Get())
+	m["session_output_soft_seconds"] = itoa(outputLimit.seconds.Get())
+	m["proxy_reply_buffer_budget"] = itoa(replyBudget.budget.Get())
+	m["session_read_bufsize"] = itoa(sessionReadBuffer.Get())
+	m["session_max_request_args"] = itoa(requestLimits.args.Get())
+	m["session_max_request_arg_bytes"] = itoa(requestLimits.bulk.Get())
+	m["slowlog_log_slower_than"] = itoa(slowlog.threshold.Get())
+	m["loading_retry_times"] = itoa(loadingRetry.retries.Get())
+	m["loading_retry_delay"] = ms(time.Duration(loadingRetry.delay.Get()))
+	m["oom_shed_window"] = ms(time.Duration(oomShedding.Get()))
+	m["verbose_errors"] = strconv.FormatBool(verboseErrors.Get())
+	m["backend_reply_integrity"] = strconv.FormatBool(replyIntegrity.enabled.Get())
+	return m
+}
+
+type settingsDispatcher interface {
+	Settings() map[string]string
+}
+
+// handleProxyConfig handles PROXY CONFIG GET [pattern], which replies the
+// settings matching the glob pattern, all of them by default, as pairs of
+// name and value sorted by name, see Settings. The requirepass entry tells
+// whether the session has to AUTH, given by the session itself.
+func (s *Session) handleProxyConfig(r *Request, d Dispatcher) (*Request, error) {
+	x, ok := d.(settingsDispatcher)
+	if !ok {
+		r.Response.Resp = redis.NewError([]byte("ERR PROXY CONFIG is not supported"))
+		return r, nil
+	}
+	args := r.Resp.Array[2:]
+	if len(args) == 0 || len(args) > 2 || strings.ToUpper(string(args[0].Value)) != "GET" {
+		r.Response.Resp = redis.NewError([]byte("ERR usage: PROXY CONFIG GET [pattern]"))
+		return r, nil
+	}
+	var pattern = "*"
+	if len(args) == 2 {
+		pattern = string(args[1].Value)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		r.Response.Resp = redis.NewError([]byte("ERR invalid pattern: " + pattern))
+		return r, nil
+	}
+
+	m := x.Settings()
+	m["requirepass"] = strconv.FormatBool(s.auth != "")
+	var names []string
+	for name := range m {
+		if ok, _ := path.Match(pattern, name); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var array []*redis.Resp
+	for _, name := range names {
+		array = append(array, redis.NewBulkBytes([]byte(name)), redis.NewBulkBytes([]byte(m[name])))
+	}
+	r.Response.Resp = redis.NewArray(array)
+	return r, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+// SlotSize is the number of keys of a slot.
+type SlotSize struct {
+	Slot int   `json:"slot"`
+	Keys int64 `json:"keys"`
+
+	// Estimated is true if Keys is a share of DBSIZE rather than counted.
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+// SlotSizes returns the number of keys of every filled slot, asking each
+// backend on a conn of its own with the given timeout. A backend is asked
+// CLUSTER COUNTKEYSINSLOT for each of its slots first, which is exact only
+// if it hashes keys the way codis does. Otherwise, e.g. if it rejects the
+// command, the DBSIZE of its db is split evenly across the slots on it, a
+// rough estimate that can't tell a big slot from a small one, and that
+// also counts the keys left behind by migrations. It's best-effort: the
+// slots of the failed backends are left out, with a *PartialError.
+func (s *Router) SlotSizes(timeout time.Duration) ([]*SlotSize, error) {
+	var backends = make(map[backendDB][]int)
+	s.mu.Lock()
+	for i, slot := range s.slots {
+		if x := (backendDB{slot.backend.addr, slot.backend.db}); x.addr != "" {
+			backends[x] = append(backends[x], i)
+		}
+	}
+	s.mu.Unlock()
+
+	var mu sync.Mutex
+	var sizes []*SlotSize
+	var failed = make(map[string]error)
+	var wg sync.WaitGroup
+	for x, slots := range backends {
+		wg.Add(1)
+		go func(x backendDB, slots []int) {
+			defer wg.Done()
+			v, err := s.querySlotSizes(x, slots, timeout)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed[fmt.Sprintf("%s/%d", x.addr, x.db)] = err
+				return
+			}
+			sizes = append(sizes, v...)
+		}(x, slots)
+	}
+	wg.Wait()
+
+	sort.Sort(slotSizes(sizes))
+	if len(failed) != 0 {
+		return sizes, &PartialError{Failed: failed}
+	}
+	return sizes, nil
+}
+
+type slotSizes []*SlotSize
+
+func (p slotSizes) Len() int           { return len(p) }
+func (p slotSizes) Less(i, j int) bool { return p[i].Slot < p[j].Slot }
+func (p slotSizes) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+var ErrBadCountResp = errors.New("bad count resp")
+
+func parseCount(resp *redis.Resp) (int64, error) {
+	if !resp.IsInt() {
+		return 0, errors.Trace(ErrBadCountResp)
+	}
+	n, err := strconv.ParseInt(string(resp.Value), 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Trace(ErrBadCountResp)
+	}
+	return n, nil
+}
+
+func (s *Router) querySlotSizes(x backendDB, slots []int, timeout time.Duration) ([]*SlotSize, error) {
+	var cmds [][]string
+	for _, i := range slots {
+		cmds = append(cmds, []string{"CLUSTER", "COUNTKEYSINSLOT", strconv.Itoa(i)})
+	}
+	if resps, err := s.queryBackendPipeline(x.addr, x.db, timeout, cmds...); err == nil {
+		var sizes []*SlotSize
+		for k, resp := range resps {
+			n, err := parseCount(resp)
+			if err != nil {
+				sizes = nil
+				break
+			}
+			sizes = append(sizes, &SlotSize{Slot: slots[k], Keys: n})
+		}
+		if sizes != nil {
+			return sizes, nil
+		}
+	}
+
+	resp, err := s.queryBackend(x.addr, x.db, timeout, "DBSIZE")
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseCount(resp)
+	if err != nil {
+		return nil, err
+	}
+	var sizes []*SlotSize
+	for k, i := range slots {
+		keys := n / int64(len(slots))
+		if int64(k) < n%int64(len(slots)) {
+			keys++
+		}
+		sizes = append(sizes, &SlotSize{Slot: i, Keys: keys, Estimated: true})
+	}
+	return sizes, nil
+}
@@ -5,9 +5,11 @@ package router
 
 import (
 	"fmt"
+	"strconv"
 	"sync"
 
 	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
 	"github.com/wandoulabs/codis/pkg/utils/errors"
 	"github.com/wandoulabs/codis/pkg/utils/log"
 )
@@ -19,18 +21,44 @@ type Slot struct {
 		addr string
 		host []byte
 		port []byte
+		db   int
 		bc   *SharedBackendConn
 	}
 	migrate struct {
 		from string
 		bc   *SharedBackendConn
 	}
+	replicas []*slotReplica
 
 	wait sync.WaitGroup
 	lock struct {
 		hold bool
 		sync.RWMutex
 	}
+
+	lasterr struct {
+		sync.Mutex
+		msg  string
+		time int64
+	}
+	readonly atomic2.Bool
+
+	hits     atomic2.Int64
+	migrated atomic2.Int64
+}
+
+// setLastError records the latest forwarding error of the slot, it's kept
+// until the next error or until the slot is filled again.
+func (s *Slot) setLastError(err error) {
+	s.lasterr.Lock()
+	s.lasterr.msg, s.lasterr.time = err.Error(), microseconds()
+	s.lasterr.Unlock()
+}
+
+func (s *Slot) getLastError() (string, int64) {
+	s.lasterr.Lock()
+	defer s.lasterr.Unlock()
+	return s.lasterr.msg, s.lasterr.time
 }
 
 func (s *Slot) blockAndWait() {
@@ -53,41 +81,226 @@ func (s *Slot) reset() {
 	s.backend.addr = ""
 	s.backend.host = nil
 	s.backend.port = nil
+	s.backend.db = 0
 	s.backend.bc = nil
 	s.migrate.from = ""
 	s.migrate.bc = nil
+	s.replicas = nil
+	s.lasterr.Lock()
+	s.lasterr.msg, s.lasterr.time = "", 0
+	s.lasterr.Unlock()
+	s.readonly.Set(false)
 }
 
-func (s *Slot) forward(r *Request, key []byte) error {
+type DispatchError struct {
+	Slot  int
+	Addr  string
+	From  string
+	OpStr string
+	Cause error
+}
+
+func (e *DispatchError) Error() string {
+	if e.From != "" {
+		return fmt.Sprintf("slot-%04d forward %s to %s (migrate from %s) failed, error = %s",
+			e.Slot, e.OpStr, e.Addr, e.From, e.Cause)
+	}
+	return fmt.Sprintf("slot-%04d forward %s to %s failed, error = %s",
+		e.Slot, e.OpStr, e.Addr, e.Cause)
+}
+
+func (s *Slot) forward(r *Request, key []byte, check *Request) error {
+	if r.affinity != nil {
+		if addr := s.primaryAddr(); addr != "" {
+			if err := r.affinity.reserve(addr); err != nil {
+				return err
+			}
+		}
+	}
 	s.lock.RLock()
 	bc, err := s.prepare(r, key)
+	if err != nil {
+		err = &DispatchError{
+			Slot: s.id, Addr: s.backend.addr, From: s.migrate.from,
+			OpStr: r.OpStr, Cause: err,
+		}
+	}
 	s.lock.RUnlock()
 	if err != nil {
+		s.setLastError(err)
 		return err
 	} else {
-		bc.PushBack(r)
+		r.backend = bc.addr
+		if check != nil {
+			check.db = r.db
+		}
+		if r.affinity != nil {
+			if r.affinity.push(bc, r, check) {
+				return nil
+			}
+		}
+		c := bc.Conn(key)
+		c.PushBack(r)
+		if check != nil {
+			c.PushBack(check)
+		}
 		return nil
 	}
 }
 
 var ErrSlotIsNotReady = errors.New("slot is not ready, may be offline")
 
+var ErrSlotNoDestination = errors.New("TRYAGAIN slot is migrating, destination is not ready")
+
+// During migration every request with a key, no matter read or write, asks
+// migrate.from to move the key to the destination first, and then the
+// request itself is always forwarded to the destination slot.backend.
+// Writes must never be served by migrate.from, they would be lost as soon
+// as the migration is done. Reads could be served by either side, but going
+// to the destination keeps them consistent with the preceding writes.
+//
+// A slot may have migrate.from but no backend yet, while the destination is
+// being set up. Then reads are served by migrate.from, which still has all
+// the keys, and writes get ErrSlotNoDestination, to be retried once the
+// destination is filled.
 func (s *Slot) prepare(r *Request, key []byte) (*SharedBackendConn, error) {
 	if s.backend.bc == nil {
-		log.Infof("slot-%04d is not ready: key = %s", s.id, key)
-		return nil, ErrSlotIsNotReady
+		if s.migrate.bc == nil {
+			log.Infof("slot-%04d is not ready: key = %s", s.id, key)
+			return nil, ErrSlotIsNotReady
+		}
+		if !isReadOnly(r.OpStr) {
+			return nil, ErrSlotNoDestination
+		}
+		r.slot = s
+		r.slot.wait.Add(1)
+		r.db = s.backend.db
+		return s.migrate.bc, nil
+	}
+	if isDenyOOM(r.OpStr) && s.backend.bc.isShedding() {
+		return nil, ErrBackendOOM
 	}
 	if err := s.slotsmgrt(r, key); err != nil {
 		log.Warnf("slot-%04d migrate from = %s to %s failed: key = %s, error = %s",
 			s.id, s.migrate.from, s.backend.addr, key, err)
 		return nil, err
 	} else {
-		r.slot = &s.wait
-		r.slot.Add(1)
+		r.slot = s
+		r.slot.wait.Add(1)
+		r.db = s.backend.db
 		return s.backend.bc, nil
 	}
 }
 
+// primaryAddr returns the addr of the backend the requests with a key are
+// forwarded to, but the reads of a slot being set up, see prepare.
+func (s *Slot) primaryAddr() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.backend.bc == nil {
+		return s.migrate.from
+	}
+	return s.backend.addr
+}
+
+// isBackendDown tells whether the backend of the slot is down, see
+// SharedBackendConn.available. Slots being migrated are never down.
+func (s *Slot) isBackendDown() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.backend.bc != nil && s.migrate.bc == nil && !s.backend.bc.available()
+}
+
+// isDown tells whether the request can't be served by the slot, see
+// UnavailablePolicy.
+func (s *Slot) isDown(r *Request, zone string) bool {
+	if !s.isBackendDown() {
+		return false
+	}
+	if !isReadOnly(r.OpStr) {
+		return true
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.pickReplica(zone) == nil
+}
+
+type slotReplica struct {
+	addr string
+	zone string
+	bc   *SharedBackendConn
+}
+
+func (s *Slot) hasReplicaConnIn(m map[*SharedBackendConn]*SharedBackendConn) bool {
+	for _, x := range s.replicas {
+		if m[x.bc] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// pickReplica returns the replica that reads go to, the first available one
+// in the given zone, or else the first available one in other zones.
+// Replicas lagging behind, see SetReplicaMaxLag, are not available.
+func (s *Slot) pickReplica(zone string) *slotReplica {
+	var other *slotReplica
+	for _, x := range s.replicas {
+		if !x.bc.available() || x.bc.lagging.Get() {
+			continue
+		}
+		if x.zone == zone {
+			return x
+		}
+		if other == nil {
+			other = x
+		}
+	}
+	return other
+}
+
+// forwardReplica forwards a read to a replica of the slot, see pickReplica.
+// Slots being migrated are never read from replicas, the keys may not be
+// there yet.
+func (s *Slot) forwardReplica(r *Request, key []byte, zone string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.migrate.bc != nil {
+		return false
+	}
+	x := s.pickReplica(zone)
+	if x == nil {
+		return false
+	}
+	s.pushReplica(r, key, x)
+	return true
+}
+
+// forwardReplicaAddr is the same as forwardReplica, but to the replica of
+// the given addr, if it's available.
+func (s *Slot) forwardReplicaAddr(r *Request, key []byte, addr string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.migrate.bc != nil {
+		return false
+	}
+	for _, x := range s.replicas {
+		if x.addr == addr && x.bc.available() {
+			s.pushReplica(r, key, x)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Slot) pushReplica(r *Request, key []byte, x *slotReplica) {
+	r.slot = s
+	r.slot.wait.Add(1)
+	r.db = s.backend.db
+	r.backend = x.addr
+	x.bc.Conn(key).PushBack(r)
+}
+
 func (s *Slot) slotsmgrt(r *Request, key []byte) error {
 	if len(key) == 0 || s.migrate.bc == nil {
 		return nil
@@ -101,6 +314,7 @@ func (s *Slot) slotsmgrt(r *Request, key []byte) error {
 			redis.NewBulkBytes(key),
 		}),
 		Wait: &sync.WaitGroup{},
+		db:   s.backend.db,
 	}
 	s.migrate.bc.PushBack(m)
 
@@ -117,6 +331,9 @@ func (s *Slot) slotsmgrt(r *Request, key []byte) error {
 		return errors.New(fmt.Sprintf("error resp: %s", resp.Value))
 	}
 	if resp.IsInt() {
+		if n, err := strconv.ParseInt(string(resp.Value), 10, 64); err == nil {
+			s.migrated.Add(n)
+		}
 		log.Debugf("slot-%04d migrate from %s to %s: key = %s, resp = %s",
 			s.id, s.migrate.from, s.backend.addr, key, resp.Value)
 		return nil
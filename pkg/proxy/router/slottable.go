@@ -0,0 +1,48 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+// slotTable is the slots array as routed by the dispatching path. It's never
+// modified, ReshardSlots swaps it as a whole, so it's read without locking,
+// see Router.slotOf.
+type slotTable struct {
+	slots []*Slot
+	// mask is the number of slots minus 1 if it's a power of 2, so the slot
+	// of a hash is a mask instead of a modulo, and always in range.
+	mask uint32
+	pow2 bool
+}
+
+func newSlotTable(slots []*Slot) *slotTable {
+	n := uint32(len(slots))
+	return &slotTable{slots: slots, mask: n - 1, pow2: n&(n-1) == 0}
+}
+
+// index returns the slot of the key, the same as hashSlot.
+func (t *slotTable) index(key []byte) int {
+	if t.pow2 {
+		return int(hashKey(key) & t.mask)
+	}
+	return int(hashKey(key) % uint32(len(t.slots)))
+}
+
+// setSlotTable publishes the slots, with s.mu and the rwlck held, so it's
+// always the same as s.slots for the ones holding either.
+func (s *Router) setSlotTable(slots []*Slot) {
+	s.table.Store(newSlotTable(slots))
+}
+
+// slotNum returns the number of slots, as routed by slotOf.
+func (s *Router) slotNum() int {
+	return len(s.table.Load().(*slotTable).slots)
+}
+
+// slotOf returns the slot of the hash key without locking. With the rwlck
+// held it's the one of s.slots, which a reshard can't tear down meanwhile,
+// otherwise it may be one just replaced, and forwarding to it then fails as
+// for a slot with no backend.
+func (s *Router) slotOf(hkey []byte) *Slot {
+	t := s.table.Load().(*slotTable)
+	return t.slots[t.index(hkey)]
+}
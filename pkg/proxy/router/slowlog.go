@@ -0,0 +1,72 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+const MaxSlowLogLen = 128
+
+type SlowLogEntry struct {
+	Id    int64  `json:"id"`
+	OpStr string `json:"cmd"`
+	Start int64  `json:"start"`
+	USecs int64  `json:"usecs"`
+}
+
+func (e *SlowLogEntry) String() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+
+var slowlog struct {
+	threshold atomic2.Int64
+
+	entries []*SlowLogEntry
+	mu      sync.Mutex
+}
+
+// SetSlowLogThreshold sets the latency in microseconds above which a request
+// is recorded in the slow log, 0 disables the slow log.
+func SetSlowLogThreshold(usecs int64) {
+	slowlog.threshold.Set(usecs)
+}
+
+func GetSlowLogs() []*SlowLogEntry {
+	slowlog.mu.Lock()
+	defer slowlog.mu.Unlock()
+	var all = make([]*SlowLogEntry, len(slowlog.entries))
+	copy(all, slowlog.entries)
+	return all
+}
+
+func ResetSlowLogs() {
+	slowlog.mu.Lock()
+	slowlog.entries = nil
+	slowlog.mu.Unlock()
+}
+
+func isSlowRequest(usecs int64) bool {
+	threshold := slowlog.threshold.Get()
+	return threshold != 0 && usecs >= threshold
+}
+
+func pushSlowLog(r *Request, usecs int64) {
+	e := &SlowLogEntry{Id: r.Id, OpStr: r.OpStr, Start: r.Start, USecs: usecs}
+	log.Warnf("slow request: %s", e)
+
+	slowlog.mu.Lock()
+	if len(slowlog.entries) >= MaxSlowLogLen {
+		copy(slowlog.entries, slowlog.entries[1:])
+		slowlog.entries[len(slowlog.entries)-1] = e
+	} else {
+		slowlog.entries = append(slowlog.entries, e)
+	}
+	slowlog.mu.Unlock()
+}
@@ -6,6 +6,7 @@ package router
 import (
 	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/wandoulabs/codis/pkg/utils/atomic2"
 )
@@ -47,6 +48,7 @@ func (s *OpStats) MarshalJSON() ([]byte, error) {
 
 var cmdstats struct {
 	requests atomic2.Int64
+	qps      atomic2.Int64
 
 	opmap map[string]*OpStats
 	rwlck sync.RWMutex
@@ -54,12 +56,24 @@ var cmdstats struct {
 
 func init() {
 	cmdstats.opmap = make(map[string]*OpStats)
+	go func() {
+		for {
+			start, total := time.Now(), cmdstats.requests.Get()
+			time.Sleep(time.Second)
+			delta := float64(cmdstats.requests.Get() - total)
+			cmdstats.qps.Set(int64(delta*float64(time.Second)/float64(time.Since(start)) + 0.5))
+		}
+	}()
 }
 
 func OpCounts() int64 {
 	return cmdstats.requests.Get()
 }
 
+func OpQPS() int64 {
+	return cmdstats.qps.Get()
+}
+
 func GetOpStats(opstr string, create bool) *OpStats {
 	cmdstats.rwlck.RLock()
 	s := cmdstats.opmap[opstr]
@@ -95,3 +109,40 @@ func incrOpStats(opstr string, usecs int64) {
 	s.usecs.Add(usecs)
 	cmdstats.requests.Incr()
 }
+
+const otherOpStr = "other"
+
+type opCounters map[string]*atomic2.Int64
+
+func newOpCounters() opCounters {
+	var m = make(opCounters, len(opnames)+1)
+	for _, opstr := range opnames {
+		m[opstr] = &atomic2.Int64{}
+	}
+	m[otherOpStr] = &atomic2.Int64{}
+	return m
+}
+
+func (m opCounters) incr(opstr string) {
+	c := m[opstr]
+	if c == nil {
+		c = m[otherOpStr]
+	}
+	c.Incr()
+}
+
+func (m opCounters) snapshot() map[string]int64 {
+	var all = make(map[string]int64)
+	for opstr, c := range m {
+		if n := c.Get(); n != 0 {
+			all[opstr] = n
+		}
+	}
+	return all
+}
+
+func (m opCounters) reset() {
+	for _, c := range m {
+		c.Set(0)
+	}
+}
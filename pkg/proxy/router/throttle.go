@@ -0,0 +1,116 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+var ErrClientThrottled = errors.New("max rate of commands of the client reached")
+
+var clientRate struct {
+	rate  atomic2.Int64
+	burst atomic2.Int64
+	wait  atomic2.Int64
+}
+
+// SetClientRateLimit limits the commands of each client conn to rate per
+// second, with bursts of up to burst commands, by a token bucket. A command
+// over the limit is held until it's within the limit again, if that's no
+// longer than wait, so the session isn't read meanwhile, otherwise it's
+// replied ErrClientThrottled. It applies to the clients connected already
+// as well. A rate of 0 disables it, and the burst is at least 1.
+func SetClientRateLimit(rate, burst int, wait time.Duration) {
+	if burst < 1 {
+		burst = 1
+	}
+	clientRate.rate.Set(int64(rate))
+	clientRate.burst.Set(int64(burst))
+	clientRate.wait.Set(int64(wait))
+}
+
+// ClientThrottle is the number of commands of a client that were over the
+// rate limit, see SetClientRateLimit.
+type ClientThrottle struct {
+	Delayed  int64 `json:"delayed"`
+	Rejected int64 `json:"rejected"`
+}
+
+// clientThrottle is the token bucket of a session, only used by the reader
+// of the session, but the counters.
+type clientThrottle struct {
+	tokens float64
+	last   time.Time
+
+	delayed, rejected atomic2.Int64
+}
+
+// take takes a token for a command, waiting for it if allowed.
+func (t *clientThrottle) take() error {
+	rate := float64(clientRate.rate.Get())
+	if rate == 0 {
+		return nil
+	}
+	burst := float64(clientRate.burst.Get())
+	now := time.Now()
+	if t.last.IsZero() {
+		t.tokens = burst
+	} else if t.tokens += now.Sub(t.last).Seconds() * rate; t.tokens > burst {
+		t.tokens = burst
+	}
+	t.last = now
+	if t.tokens >= 1 {
+		t.tokens--
+		return nil
+	}
+	delay := time.Duration((1 - t.tokens) / rate * float64(time.Second))
+	if delay > time.Duration(clientRate.wait.Get()) {
+		t.rejected.Incr()
+		return ErrClientThrottled
+	}
+	t.delayed.Incr()
+	time.Sleep(delay)
+	t.tokens, t.last = 0, now.Add(delay)
+	return nil
+}
+
+var clientThrottles = &clientThrottleMap{m: make(map[string]*clientThrottle)}
+
+type clientThrottleMap struct {
+	sync.RWMutex
+	m map[string]*clientThrottle
+}
+
+func (c *clientThrottleMap) add(client string) *clientThrottle {
+	t := &clientThrottle{}
+	c.Lock()
+	c.m[client] = t
+	c.Unlock()
+	return t
+}
+
+func (c *clientThrottleMap) remove(client string) {
+	c.Lock()
+	delete(c.m, client)
+	c.Unlock()
+}
+
+// ClientThrottles returns the throttled commands of each client, by remote
+// addr, of the clients still connected that were throttled at least once.
+func ClientThrottles() map[string]*ClientThrottle {
+	clientThrottles.RLock()
+	defer clientThrottles.RUnlock()
+	var m = make(map[string]*ClientThrottle)
+	for client, t := range clientThrottles.m {
+		delayed, rejected := t.delayed.Get(), t.rejected.Get()
+		if delayed != 0 || rejected != 0 {
+			m[client] = &ClientThrottle{Delayed: delayed, Rejected: rejected}
+		}
+	}
+	return m
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+var ErrCommandTimeout = errors.New("ERR command timeout, the backend didn't reply in time")
+
+// SetCommandTimeouts sets how long the commands may wait for the backend,
+// by command, or def for the ones not listed. A command that times out is
+// replied with ErrCommandTimeout, and its backend request is abandoned
+// rather than cancelled: it stays in the pipeline of the backend conn, so
+// the replies still match, and the late reply is discarded. Requests behind
+// it on the same backend conn keep waiting for it, within their own
+// timeouts. A timeout of 0 means no timeout but the backend read timeout.
+func (s *Router) SetCommandTimeouts(def time.Duration, timeouts map[string]time.Duration) {
+	s.rwlck.Lock()
+	defer s.rwlck.Unlock()
+	s.timeouts.def = def
+	s.timeouts.ops = make(map[string]time.Duration)
+	for opstr, timeout := range timeouts {
+		s.timeouts.ops[opstr] = timeout
+	}
+}
+
+// CommandTimeouts returns the number of commands that timed out.
+func (s *Router) CommandTimeouts() int64 {
+	return s.timeouts.count.Get()
+}
+
+func (s *Router) getCommandTimeout(opstr string) time.Duration {
+	if timeout, ok := s.timeouts.ops[opstr]; ok {
+		return timeout
+	}
+	return s.timeouts.def
+}
+
+func (s *Router) forwardTimeout(r *Request, slot *Slot, key []byte, f *forwarding) error {
+	p := r.subRequest(r.Resp)
+	p.Wait, p.Failed, p.output = &sync.WaitGroup{}, nil, nil
+	p.inflight = r.inflight
+	if err := s.forward(p, slot, key, f); err != nil {
+		return err
+	}
+	r.inflight, r.backend = nil, p.backend
+	r.Wait.Add(1)
+
+	go func() {
+		done := make(chan struct{})
+		go func() {
+			p.Wait.Wait()
+			if p.Coalesce != nil {
+				if err := p.Coalesce(); err != nil {
+					p.Response.Err = err
+				}
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+			r.Response, r.loading = p.Response, p.loading
+		case <-time.After(f.timeout):
+			s.timeouts.count.Incr()
+			r.Response.Resp = redis.NewError([]byte(ErrCommandTimeout.Error()))
+		}
+		if r.Response.Err != nil && r.Failed != nil {
+			r.Failed.Set(true)
+		}
+		if r.output != nil {
+			r.output.add(r.Response.Resp)
+		}
+		r.Wait.Done()
+	}()
+	return nil
+}
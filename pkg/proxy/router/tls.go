@@ -0,0 +1,226 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/atomic2"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+var (
+	ErrBackendNotTLS = errors.New("backend conn is not TLS, refused in strict mode")
+	ErrBadTLSVersion = errors.New("bad TLS version, should be 1.0, 1.1, 1.2 or 1.3")
+)
+
+// versionTLS13 is tls.VersionTLS13, which is only there from go1.12.
+const versionTLS13 = 0x0304
+
+var backendTLS struct {
+	sync.Mutex
+	config     *tls.Config
+	strict     bool
+	minVersion uint16
+
+	refusals atomic2.Int64
+}
+
+// SetBackendTLS makes the backend conns dialed afterwards use TLS with the
+// given config, nil disables it. If the backend doesn't speak TLS, i.e. it
+// replies to the handshake with something that is not a TLS record, hangs
+// up or doesn't reply in time, like redis waiting for the end of an inline
+// command, the conn falls back to plaintext with a warning. Any other
+// handshake error, e.g. a bad certificate, fails the dial. If strict is
+// set, such a backend is refused instead and logged as a security error,
+// and so is a conn that negotiated a version below minVersion, e.g.
+// tls.VersionTLS12. Strict mode is meant to make sure a misconfigured
+// backend is never used in plaintext, see BackendTLSRefusals.
+func SetBackendTLS(config *tls.Config, strict bool, minVersion uint16) {
+	backendTLS.Lock()
+	defer backendTLS.Unlock()
+	backendTLS.config = config
+	backendTLS.strict = strict
+	backendTLS.minVersion = minVersion
+}
+
+// BackendTLSRefusals returns the number of backend conns refused in strict
+// mode.
+func BackendTLSRefusals() int64 {
+	return backendTLS.refusals.Get()
+}
+
+// ParseTLSVersion parses a TLS version like 1.2, as used in the config.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return versionTLS13, nil
+	}
+	return 0, errors.Trace(ErrBadTLSVersion)
+}
+
+// formatTLSVersion is the reverse of ParseTLSVersion, 0 is "".
+func formatTLSVersion(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case versionTLS13:
+		return "1.3"
+	case 0:
+		return ""
+	}
+	return fmt.Sprintf("%#x", v)
+}
+
+// dialBackend dials a conn to the backend, with TLS and compression if
+// configured, see SetBackendCompression. The replies of backends are
+// trusted, they are not limited like requests, e.g. an array reply may be
+// much longer than redis.MaxArrayLen.
+func dialBackend(addr string, bufsize int, timeout time.Duration) (*redis.Conn, error) {
+	c, err := dialBackendConn(addr, bufsize, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if ok, threshold := getBackendCompression(addr); ok {
+		c = redis.NewConnSize(NewCompressedConn(c.Sock, threshold), bufsize)
+	}
+	c.Reader.MaxBulkBytesLen, c.Reader.MaxArrayLen, c.Reader.MaxInlineLen = math.MaxInt64, math.MaxInt64, math.MaxInt64
+	return c, nil
+}
+
+func dialBackendConn(addr string, bufsize int, timeout time.Duration) (*redis.Conn, error) {
+	raddr, err := resolveAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	backendTLS.Lock()
+	config, strict, minVersion := backendTLS.config, backendTLS.strict, backendTLS.minVersion
+	backendTLS.Unlock()
+	if config == nil {
+		return redis.DialTimeout(raddr, bufsize, timeout)
+	}
+
+	sock, err := net.DialTimeout("tcp", raddr, timeout)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c, err := handshakeTLS(sock, addr, config, timeout)
+	if err == nil {
+		if v := c.ConnectionState().Version; strict && v < minVersion {
+			err = errors.Errorf("TLS version %#x is below the minimum %#x", v, minVersion)
+		}
+	}
+	if err == nil {
+		return redis.NewConnSize(&tlsConn{Conn: c, sock: sock}, bufsize), nil
+	}
+	sock.Close()
+	if strict {
+		backendTLS.refusals.Incr()
+		log.ErrorErrorf(err, "security error: backend %s refused, TLS is required", addr)
+		return nil, errors.Trace(ErrBackendNotTLS)
+	}
+	if !isNotTLS(err) {
+		return nil, err
+	}
+	log.WarnErrorf(err, "backend %s TLS handshake failed, fall back to plaintext", addr)
+	return redis.DialTimeout(raddr, bufsize, timeout)
+}
+
+// notTLSErrors are the messages of the handshake errors of a peer that
+// doesn't send TLS records, which are only typed as tls.RecordHeaderError
+// from go1.6.
+var notTLSErrors = []string{
+	"tls: first record does not look like a TLS handshake",
+	"tls: oversized record received",
+	"tls: unsupported SSLv2 handshake received",
+}
+
+// isNotTLS tells whether the handshake failed because the peer doesn't speak
+// TLS at all, rather than because of the certificate or the negotiation.
+func isNotTLS(err error) bool {
+	err = errors.Cause(err)
+	if err == io.EOF {
+		return true
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return true
+	}
+	for _, msg := range notTLSErrors {
+		if strings.HasPrefix(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func handshakeTLS(sock net.Conn, addr string, config *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		config = withServerName(config, host)
+	}
+	c := tls.Client(sock, config)
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := c.Handshake(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := c.SetDeadline(time.Time{}); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return c, nil
+}
+
+// tlsConn is a TLS conn that tells the conn under it, as tls.Conn only does
+// from go1.18, see setSockOpts.
+type tlsConn struct {
+	*tls.Conn
+	sock net.Conn
+}
+
+func (c *tlsConn) NetConn() net.Conn {
+	return c.sock
+}
+
+// withServerName returns a copy of the client settings of the config, with
+// the given server name. The config can't be copied as a whole, it has
+// locks, and Config.Clone is only there from go1.8.
+func withServerName(config *tls.Config, name string) *tls.Config {
+	return &tls.Config{
+		Time:                   config.Time,
+		Certificates:           config.Certificates,
+		RootCAs:                config.RootCAs,
+		NextProtos:             config.NextProtos,
+		ServerName:             name,
+		InsecureSkipVerify:     config.InsecureSkipVerify,
+		CipherSuites:           config.CipherSuites,
+		SessionTicketsDisabled: config.SessionTicketsDisabled,
+		ClientSessionCache:     config.ClientSessionCache,
+		MinVersion:             config.MinVersion,
+		MaxVersion:             config.MaxVersion,
+		CurvePreferences:       config.CurvePreferences,
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+var ErrSlotUnavailable = errors.New("slot is unavailable, backend and replicas are down")
+
+// UnavailablePolicy tells what happens to a request of a slot that is down,
+// i.e. its backend is down and, for reads, so are all of its replicas. A
+// backend is down if the last connect to it failed, until a later connect,
+// e.g. of the keepalive pings, succeeds. Slots being migrated are never
+// considered down.
+type UnavailablePolicy int
+
+const (
+	// UnavailableForward forwards the request anyway, so it fails once the
+	// connect to the backend fails, as if there were no policy.
+	UnavailableForward UnavailablePolicy = iota
+
+	// UnavailableFailFast fails the request with ErrSlotUnavailable right
+	// away, without trying the backend.
+	UnavailableFailFast
+
+	// UnavailableWait holds the request until the slot is up again, or
+	// fails it with ErrSlotUnavailable after the timeout. The session isn't
+	// read meanwhile, so the requests pipelined after it wait as well.
+	UnavailableWait
+
+	// UnavailableNilReply replies a nil bulk to reads, whatever their reply
+	// type should be, and fails writes with ErrSlotUnavailable.
+	UnavailableNilReply
+)
+
+var unavailablePolicyNames = []string{"forward", "failfast", "wait", "nil"}
+
+func (p UnavailablePolicy) String() string {
+	if p >= 0 && int(p) < len(unavailablePolicyNames) {
+		return unavailablePolicyNames[p]
+	}
+	return fmt.Sprintf("UnavailablePolicy(%d)", int(p))
+}
+
+var ErrBadUnavailablePolicy = errors.New("bad unavailable policy, should be forward, failfast, wait or nil")
+
+// ParseUnavailablePolicy parses the name of a policy, as used in the config.
+func ParseUnavailablePolicy(name string) (UnavailablePolicy, error) {
+	for i, x := range unavailablePolicyNames {
+		if strings.EqualFold(x, name) {
+			return UnavailablePolicy(i), nil
+		}
+	}
+	return UnavailableForward, errors.Trace(ErrBadUnavailablePolicy)
+}
+
+// SetUnavailablePolicy sets the policy of the requests of slots that are
+// down, unless set per command, see SetCommandUnavailablePolicy. The timeout
+// is for UnavailableWait. With any policy other than UnavailableForward,
+// reads of a slot whose backend is down go to an available replica, see
+// SetSlotReplicas.
+func (s *Router) SetUnavailablePolicy(policy UnavailablePolicy, timeout time.Duration) {
+	s.rwlck.Lock()
+	defer s.rwlck.Unlock()
+	s.unavailable.policy = policy
+	s.unavailable.timeout = timeout
+}
+
+// SetCommandUnavailablePolicy overrides the policy of the given commands.
+func (s *Router) SetCommandUnavailablePolicy(opstrs []string, policy UnavailablePolicy) {
+	s.rwlck.Lock()
+	defer s.rwlck.Unlock()
+	if s.unavailable.ops == nil {
+		s.unavailable.ops = make(map[string]UnavailablePolicy)
+	}
+	for _, opstr := range opstrs {
+		s.unavailable.ops[opstr] = policy
+	}
+}
+
+func (s *Router) getUnavailablePolicy(opstr string) UnavailablePolicy {
+	if policy, ok := s.unavailable.ops[opstr]; ok {
+		return policy
+	}
+	return s.unavailable.policy
+}
+
+// isFailover reports whether the read should go to a replica, as the backend
+// of the slot is down, or the slot is gated, see SetBackendHealth.
+func (s *Router) isFailover(r *Request, slot *Slot) bool {
+	if !isReadOnly(r.OpStr) {
+		return false
+	}
+	if s.getUnavailablePolicy(r.OpStr) == UnavailableForward {
+		return slot.isGated()
+	}
+	return slot.isBackendDown()
+}
+
+// checkUnavailable applies the policy if the slot is down, gated slots fail
+// fast whatever the policy. It returns true if the request is done with,
+// replied or failed, and must not be forwarded.
+func (s *Router) checkUnavailable(r *Request, hkey []byte) (bool, error) {
+	var deadline time.Time
+	for {
+		s.rwlck.RLock()
+		policy, timeout := s.getUnavailablePolicy(r.OpStr), s.unavailable.timeout
+		slot := s.slotOf(hkey)
+		gated := slot.isGated()
+		down := (policy != UnavailableForward || gated) && slot.isDown(r, s.zone)
+		s.rwlck.RUnlock()
+		if !down {
+			return false, nil
+		}
+		if gated {
+			return true, ErrSlotUnavailable
+		}
+		switch policy {
+		case UnavailableNilReply:
+			if isReadOnly(r.OpStr) {
+				r.Response.Resp = redis.NewBulkBytes(nil)
+				return true, nil
+			}
+		case UnavailableWait:
+			if deadline.IsZero() {
+				deadline = time.Now().Add(timeout)
+			}
+			if time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond * 10)
+				continue
+			}
+		}
+		return true, ErrSlotUnavailable
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wandoulabs/codis/pkg/proxy/redis"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+// UnknownCommandPolicy tells what happens to a command the proxy doesn't
+// know the keys of, e.g. a command of a redis module or of a newer redis.
+type UnknownCommandPolicy int
+
+const (
+	// UnknownGuessKey forwards the command as if its key were its first
+	// arg, so commands with no key, or whose key is elsewhere, may go to the
+	// wrong backend.
+	UnknownGuessKey UnknownCommandPolicy = iota
+
+	// UnknownDefaultBackend forwards the command to a given backend,
+	// whatever its args, e.g. one holding the data of a module.
+	UnknownDefaultBackend
+
+	// UnknownReject replies an unknown command error, as redis does.
+	UnknownReject
+)
+
+var unknownCommandPolicyNames = []string{"guess", "default", "reject"}
+
+func (p UnknownCommandPolicy) String() string {
+	if p >= 0 && int(p) < len(unknownCommandPolicyNames) {
+		return unknownCommandPolicyNames[p]
+	}
+	return fmt.Sprintf("UnknownCommandPolicy(%d)", int(p))
+}
+
+var (
+	ErrBadUnknownCommandPolicy = errors.New("bad unknown command policy, should be guess, default or reject")
+	ErrNoDefaultBackend        = errors.New("default backend is required")
+)
+
+// ParseUnknownCommandPolicy parses the name of a policy, as used in the
+// config.
+func ParseUnknownCommandPolicy(name string) (UnknownCommandPolicy, error) {
+	for i, x := range unknownCommandPolicyNames {
+		if strings.EqualFold(x, name) {
+			return UnknownCommandPolicy(i), nil
+		}
+	}
+	return UnknownGuessKey, errors.Trace(ErrBadUnknownCommandPolicy)
+}
+
+// SetUnknownCommandPolicy sets the policy of the commands dispatched that
+// aren't known to the proxy. The addr is the backend of
+// UnknownDefaultBackend, the db of the slot of the first arg applies. It's
+// UnknownGuessKey by default. Commands handled by the proxy itself, e.g.
+// PING or INFO, are never unknown, nor are the ones given a RouteKeyFunc,
+// see SetRouteKey.
+func (s *Router) SetUnknownCommandPolicy(policy UnknownCommandPolicy, addr string) error {
+	if policy == UnknownDefaultBackend && addr == "" {
+		return errors.Trace(ErrNoDefaultBackend)
+	}
+	s.rwlck.Lock()
+	s.unknown.policy = policy
+	s.unknown.addr = addr
+	s.rwlck.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseSelected()
+	return nil
+}
+
+// dispatchUnknown applies the policy if the command is unknown. It returns
+// true if the request is done with, replied or forwarded.
+func (s *Router) dispatchUnknown(r *Request) (bool, error) {
+	if opset[r.OpStr] {
+		return false, nil
+	}
+	s.rwlck.RLock()
+	policy, addr := s.unknown.policy, s.unknown.addr
+	known := s.routekeys[r.OpStr] != nil
+	s.rwlck.RUnlock()
+	if known {
+		return false, nil
+	}
+	switch policy {
+	case UnknownReject:
+		r.Response.Resp = redis.NewError([]byte(fmt.Sprintf("ERR unknown command '%s'", r.OpStr)))
+		return true, nil
+	case UnknownDefaultBackend:
+		hkey := getHashKey(r.Resp, r.OpStr)
+		return true, s.forwardPooled(r, s.slotOf(hkey), hkey, addr)
+	}
+	return false, nil
+}
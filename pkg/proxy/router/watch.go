@@ -0,0 +1,80 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import "github.com/wandoulabs/codis/pkg/models"
+
+// SlotDelta is the new state of a slot that has been changed. Gap is set if
+// some deltas before it have been dropped, the watcher should call GetSlots
+// to catch up then.
+type SlotDelta struct {
+	Slot *models.SlotInfo
+	Gap  bool
+}
+
+const slotWatchBufferSize = MaxSlotNum
+
+type slotWatcher struct {
+	ch  chan *SlotDelta
+	gap bool
+}
+
+// WatchSlots returns a channel receiving a delta for each change of the
+// slot table, and the function to stop watching, which closes the channel.
+// The channel is closed as well once the router is closed. Slow watchers
+// never block the changes, the oldest deltas are dropped instead.
+func (s *Router) WatchSlots() (<-chan *SlotDelta, func()) {
+	w := &slotWatcher{ch: make(chan *SlotDelta, slotWatchBufferSize)}
+	s.watchers.Lock()
+	defer s.watchers.Unlock()
+	if s.watchers.list == nil {
+		s.watchers.list = make(map[*slotWatcher]bool)
+	}
+	s.watchers.list[w] = true
+	return w.ch, func() {
+		s.watchers.Lock()
+		defer s.watchers.Unlock()
+		if s.watchers.list[w] {
+			delete(s.watchers.list, w)
+			close(w.ch)
+		}
+	}
+}
+
+func (s *Router) notifySlot(slot *Slot) {
+	s.watchers.Lock()
+	defer s.watchers.Unlock()
+	if len(s.watchers.list) == 0 {
+		return
+	}
+	info := s.slotInfo(slot)
+	for w := range s.watchers.list {
+		w.push(info)
+	}
+}
+
+func (w *slotWatcher) push(info *models.SlotInfo) {
+	for {
+		select {
+		case w.ch <- &SlotDelta{Slot: info, Gap: w.gap}:
+			w.gap = false
+			return
+		default:
+		}
+		select {
+		case <-w.ch:
+			w.gap = true
+		default:
+		}
+	}
+}
+
+func (s *Router) closeWatchers() {
+	s.watchers.Lock()
+	defer s.watchers.Unlock()
+	for w := range s.watchers.list {
+		close(w.ch)
+	}
+	s.watchers.list = nil
+}